@@ -0,0 +1,5 @@
+UPDATE db_file_data SET data = (SELECT b.data FROM db_file_blob b WHERE b.datahash = db_file_data.datahash) WHERE datahash <> '';
+
+ALTER TABLE db_file_data DROP COLUMN datahash;
+
+DROP TABLE db_file_blob;
@@ -0,0 +1,7 @@
+ALTER TABLE db_file_data ADD COLUMN datahash varchar(64) NOT NULL DEFAULT '';
+
+CREATE TABLE db_file_blob (
+    datahash varchar(64) PRIMARY KEY,
+    data blob NOT NULL,
+    refcount int NOT NULL
+);
@@ -0,0 +1,5 @@
+DELETE FROM db_file_data WHERE (zoneid, name) IN (SELECT zoneid, name FROM db_wave_file WHERE deletedts <> 0);
+
+DELETE FROM db_wave_file WHERE deletedts <> 0;
+
+ALTER TABLE db_wave_file DROP COLUMN deletedts;
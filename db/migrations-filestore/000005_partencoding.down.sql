@@ -0,0 +1,8 @@
+-- compressed parts can't be decoded in sql, and dropping them would silently zero-fill their files, so this
+-- migration fails (CHECK constraint failed: compressed_parts = 0) while any are left.  to downgrade, turn off
+-- FileStore.Compress and rewrite the files that still have compressed parts first (parts are flushed plain).
+CREATE TEMP TABLE partencoding_down_guard (compressed_parts int CHECK (compressed_parts = 0));
+INSERT INTO partencoding_down_guard SELECT count(*) FROM db_file_data WHERE encoding <> 0;
+DROP TABLE partencoding_down_guard;
+
+ALTER TABLE db_file_data DROP COLUMN encoding;
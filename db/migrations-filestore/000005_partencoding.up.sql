@@ -0,0 +1 @@
+ALTER TABLE db_file_data ADD COLUMN encoding int NOT NULL DEFAULT 0;
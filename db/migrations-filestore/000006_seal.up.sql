@@ -0,0 +1 @@
+ALTER TABLE db_wave_file ADD COLUMN sealed boolean NOT NULL DEFAULT 0;
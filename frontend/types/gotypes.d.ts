@@ -372,6 +372,7 @@ declare global {
         circular?: boolean;
         ijson?: boolean;
         ijsonbudget?: number;
+        overflowpolicy?: string;
     };
 
     // wconfig.FullConfigType
@@ -1008,6 +1009,8 @@ declare global {
         createdts: number;
         size: number;
         modts: number;
+        version: number;
+        sealed?: boolean;
         meta: {[key: string]: any};
     };
 
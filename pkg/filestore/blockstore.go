@@ -9,9 +9,16 @@ package filestore
 
 import (
 	"context"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"hash/fnv"
+	"io"
 	"io/fs"
 	"log"
+	"math"
+	mathrand "math/rand"
+	"sort"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -33,6 +40,72 @@ const (
 	IJsonLowCommands  = 10
 )
 
+// returned by cache-only reads (see ReadOpts) when the file or a requested part is not resident
+var ErrNotCached = errors.New("data not resident in cache")
+
+// returned when a DB load on a cache miss takes longer than FileStore.LoadTimeout
+var ErrBackendTimeout = errors.New("backend load timed out")
+
+// returned when a write would take a non-circular file past its MaxSize (see OverflowPolicy)
+var ErrFileFull = errors.New("file is full")
+
+// returned by data writes to a sealed file (see Seal)
+var ErrSealed = errors.New("file is sealed")
+
+// returned when the store's Authorizer denies an operation
+var ErrForbidden = errors.New("operation not permitted")
+
+// returned by conditional operations (DeleteIfVersion) when the file has changed
+var ErrVersionMismatch = errors.New("version mismatch")
+
+// returned when a new file's zoneid or name is rejected by the store's validators
+var ErrInvalidName = errors.New("invalid name")
+
+// returned by reads with ReadOpts.FailEvicted that start before the oldest byte a circular file retains
+var ErrEvicted = errors.New("data evicted from circular file")
+
+// optional per-file access control (see FileStore.Authorizer).  reads (Stat, ReadAt, Head, Tail, MarshalFile, ...)
+// consult CanRead, everything that creates, changes, or deletes a file consults CanWrite (SwapFiles checks both
+// files).  zone and store-level operations (ListFiles, DiskUsage, FlushCache, Evict, SnapshotAll, Fsck, ...) are
+// not checked.  DeleteZone deletes file by file, so denied files are skipped (and logged).
+// the checks run before any lock is taken, so implementations must not call back into the store.
+type Authorizer interface {
+	CanRead(zoneId string, name string) bool
+	CanWrite(zoneId string, name string) bool
+}
+
+func (s *FileStore) checkRead(zoneId string, name string) error {
+	if s.Authorizer != nil && !s.Authorizer.CanRead(zoneId, name) {
+		return fmt.Errorf("%w: read %s:%s", ErrForbidden, zoneId, name)
+	}
+	return nil
+}
+
+func (s *FileStore) checkWrite(zoneId string, name string) error {
+	if s.Authorizer != nil && !s.Authorizer.CanWrite(zoneId, name) {
+		return fmt.Errorf("%w: write %s:%s", ErrForbidden, zoneId, name)
+	}
+	return nil
+}
+
+// validates the names of new files (see FileStore.NameValidator and ZoneIdValidator).  only the APIs that
+// can create a file check (MakeFile, MakeFileWithData, UnmarshalFile and so RestoreAll, ConcatFiles'
+// destination, and WriteAtEx and IncrementCounter only when they create the file), so files created
+// before a validator was set stay usable.
+func (s *FileStore) checkNewName(zoneId string, name string) error {
+	if s.ZoneIdValidator != nil {
+		if err := s.ZoneIdValidator(zoneId); err != nil {
+			return fmt.Errorf("%w: zoneid %q: %v", ErrInvalidName, zoneId, err)
+		}
+	}
+	if s.NameValidator != nil {
+		if err := s.NameValidator(name); err != nil {
+			return fmt.Errorf("%w: name %q: %v", ErrInvalidName, name, err)
+		}
+	}
+	return nil
+}
+
 const DefaultPartDataSize = 64 * 1024
 const DefaultFlushTime = 5 * time.Second
 const NoPartIdx = -1
@@ -49,26 +122,57 @@ var WFS *FileStore = &FileStore{
 	Cache: make(map[cacheKey]*CacheEntry),
 }
 
+// circular files are append-only until their size reaches MaxSize, the first write that takes the size
+// past MaxSize wraps: part indexes are taken modulo MaxSize/partDataSize and only the last MaxSize bytes
+// are retained (readers see that window, starting at DataStartIdx).  until then a circular file is laid
+// out exactly like a regular one.
 type FileOptsType struct {
-	MaxSize     int64 `json:"maxsize,omitempty"`
-	Circular    bool  `json:"circular,omitempty"`
-	IJson       bool  `json:"ijson,omitempty"`
-	IJsonBudget int   `json:"ijsonbudget,omitempty"`
+	MaxSize        int64  `json:"maxsize,omitempty"`
+	Circular       bool   `json:"circular,omitempty"`
+	IJson          bool   `json:"ijson,omitempty"`
+	IJsonBudget    int    `json:"ijsonbudget,omitempty"`
+	OverflowPolicy string `json:"overflowpolicy,omitempty"`
+}
+
+// what a write does when it would take a non-circular file past MaxSize.  OverflowNone keeps the
+// behavior of files created before policies existed (MaxSize only limits Preallocate).
+//   - OverflowError fails the write with ErrFileFull, nothing is written
+//   - OverflowBlock waits until the file shrinks (WriteFile, delete, swap, ijson compaction) and retries,
+//     the wait is bounded by the write's context.  a WriteFile that is larger than MaxSize fails immediately.
+//
+// there is no drop-oldest policy, a Circular file is that: it only starts dropping once it is full.
+const (
+	OverflowNone  = ""
+	OverflowError = "error"
+	OverflowBlock = "block"
+)
+
+// true if writes past MaxSize fail (or block) instead of growing the file
+func (opts FileOptsType) enforcesMaxSize() bool {
+	return opts.OverflowPolicy == OverflowError || opts.OverflowPolicy == OverflowBlock
 }
 
 type FileMeta = map[string]any
 
+// identifies a file, for the APIs that take or return files from several zones
+type FileKey struct {
+	ZoneId string
+	Name   string
+}
+
 type WaveFile struct {
-	// these fields are static (not updated)
+	// these fields are static (not updated, except Opts by UpdateOpts)
 	ZoneId    string       `json:"zoneid"`
 	Name      string       `json:"name"`
 	Opts      FileOptsType `json:"opts"`
 	CreatedTs int64        `json:"createdts"`
 
 	//  these fields are mutable
-	Size  int64    `json:"size"`
-	ModTs int64    `json:"modts"`
-	Meta  FileMeta `json:"meta"` // only top-level keys can be updated (lower levels are immutable)
+	Size    int64    `json:"size"`
+	ModTs   int64    `json:"modts"`
+	Version int64    `json:"version"`          // bumped on every data or meta change (not on flush)
+	Meta    FileMeta `json:"meta"`             // only top-level keys can be updated (lower levels are immutable)
+	Sealed  bool     `json:"sealed,omitempty"` // set by Seal/Unseal only (not by flushes)
 }
 
 // for regular files this is just Size
@@ -98,6 +202,8 @@ func copyMeta(meta FileMeta) FileMeta {
 	return newMeta
 }
 
+// Opts is a small struct of scalars, so it is copied by value along with the file (no allocation).
+// only Meta needs an explicit copy.  Opts are only replaced wholesale (see UpdateOpts).
 func (f *WaveFile) DeepCopy() *WaveFile {
 	if f == nil {
 		return nil
@@ -109,6 +215,14 @@ func (f *WaveFile) DeepCopy() *WaveFile {
 
 func (WaveFile) UseDBMap() {}
 
+// files handed out by the store are copies, unless the caller opted out (see UnsafeSharedFiles)
+func (s *FileStore) fileForCaller(f *WaveFile) *WaveFile {
+	if s.UnsafeSharedFiles {
+		return f
+	}
+	return f.DeepCopy()
+}
+
 type FileData struct {
 	ZoneId  string `json:"zoneid"`
 	Name    string `json:"name"`
@@ -118,16 +232,28 @@ type FileData struct {
 
 func (FileData) UseDBMap() {}
 
-// synchronous (does not interact with the cache)
-func (s *FileStore) MakeFile(ctx context.Context, zoneId string, name string, meta FileMeta, opts FileOptsType) error {
+// returns the normalized opts (circular files have MaxSize rounded up to a multiple of the part size)
+func validateFileOpts(opts FileOptsType) (FileOptsType, error) {
 	if opts.MaxSize < 0 {
-		return fmt.Errorf("max size must be non-negative")
+		return opts, fmt.Errorf("max size must be non-negative")
 	}
 	if opts.Circular && opts.MaxSize <= 0 {
-		return fmt.Errorf("circular file must have a max size")
+		return opts, fmt.Errorf("circular file must have a max size")
 	}
 	if opts.Circular && opts.IJson {
-		return fmt.Errorf("circular file cannot be ijson")
+		return opts, fmt.Errorf("circular file cannot be ijson")
+	}
+	switch opts.OverflowPolicy {
+	case OverflowNone:
+	case OverflowError, OverflowBlock:
+		if opts.Circular {
+			return opts, fmt.Errorf("circular files cannot have an overflow policy")
+		}
+		if opts.MaxSize <= 0 {
+			return opts, fmt.Errorf("overflow policy %q requires a max size", opts.OverflowPolicy)
+		}
+	default:
+		return opts, fmt.Errorf("invalid overflow policy %q", opts.OverflowPolicy)
 	}
 	if opts.Circular {
 		if opts.MaxSize%partDataSize != 0 {
@@ -135,10 +261,25 @@ func (s *FileStore) MakeFile(ctx context.Context, zoneId string, name string, me
 		}
 	}
 	if opts.IJsonBudget > 0 && !opts.IJson {
-		return fmt.Errorf("ijson budget requires ijson")
+		return opts, fmt.Errorf("ijson budget requires ijson")
 	}
 	if opts.IJsonBudget < 0 {
-		return fmt.Errorf("ijson budget must be non-negative")
+		return opts, fmt.Errorf("ijson budget must be non-negative")
+	}
+	return opts, nil
+}
+
+// synchronous (does not interact with the cache)
+func (s *FileStore) MakeFile(ctx context.Context, zoneId string, name string, meta FileMeta, opts FileOptsType) error {
+	if err := s.checkWrite(zoneId, name); err != nil {
+		return err
+	}
+	if err := s.checkNewName(zoneId, name); err != nil {
+		return err
+	}
+	opts, err := validateFileOpts(opts)
+	if err != nil {
+		return err
 	}
 	return withLock(s, zoneId, name, func(entry *CacheEntry) error {
 		if entry.File != nil {
@@ -158,30 +299,333 @@ func (s *FileStore) MakeFile(ctx context.Context, zoneId string, name string, me
 	})
 }
 
+// create-only write: creates the file with its initial data in a single DB transaction, so other readers
+// never see it empty.  fails with fs.ErrExist if the file already exists.  (the other write methods are
+// update-only, they fail with fs.ErrNotExist rather than creating a missing file.)
+func (s *FileStore) MakeFileWithData(ctx context.Context, zoneId string, name string, meta FileMeta, opts FileOptsType, data []byte) error {
+	if err := s.checkWrite(zoneId, name); err != nil {
+		return err
+	}
+	if err := s.checkNewName(zoneId, name); err != nil {
+		return err
+	}
+	opts, err := validateFileOpts(opts)
+	if err != nil {
+		return err
+	}
+	if opts.enforcesMaxSize() && int64(len(data)) > opts.MaxSize {
+		return fmt.Errorf("%w: %d bytes of data exceeds max size %d", ErrFileFull, len(data), opts.MaxSize)
+	}
+	return withLock(s, zoneId, name, func(entry *CacheEntry) error {
+		if entry.File != nil {
+			return fs.ErrExist
+		}
+		_, err := entry.createWithData(ctx, meta, opts, data)
+		return err
+	})
+}
+
+// must hold the entry lock, and entry.File must be nil.  opts must already be validated.
+// returns the version of the new file
+func (entry *CacheEntry) createWithData(ctx context.Context, meta FileMeta, opts FileOptsType, data []byte) (int64, error) {
+	now := time.Now().UnixMilli()
+	file := &WaveFile{
+		ZoneId:    entry.ZoneId,
+		Name:      entry.Name,
+		Size:      0,
+		CreatedTs: now,
+		ModTs:     now,
+		Opts:      opts,
+		Meta:      meta,
+	}
+	return entry.createFileWithData(ctx, file, 0, data)
+}
+
+// same as createWithData, but for a file restored from an export: file (with an empty Size) keeps its
+// timestamps, and data starts at dataStart (non-zero for wrapped circular files)
+func (entry *CacheEntry) createFileWithData(ctx context.Context, file *WaveFile, dataStart int64, data []byte) (int64, error) {
+	modTs := file.ModTs
+	entry.File = file
+	entry.writeAt(dataStart, data, true)
+	entry.File.ModTs = modTs
+	version := entry.File.Version
+	err := WithTx(ctx, func(tx *TxWrap) error {
+		err := dbInsertFile(tx.Context(), entry.File)
+		if err != nil {
+			return err
+		}
+		return dbWriteCacheEntry(tx.Context(), entry.File, entry.DataEntries, true, entry.Store.partWriteOpts())
+	})
+	if err == nil {
+		entry.Store.recordPartsFlushed(len(entry.DataEntries))
+	}
+	// either the file was fully persisted or the create failed as a whole
+	entry.clear()
+	return version, err
+}
+
+// size of a counter file (see IncrementCounter)
+const CounterSize = 8
+
+// treats the file as a counter (an 8-byte big-endian int64), adds delta under the entry lock, and
+// returns the new value, so concurrent increments never lose an update.  a missing file is created
+// (holding delta) with default opts.  fails if the file exists but isn't exactly CounterSize bytes.
+// like other writes the new value is cached and flushed later.
+func (s *FileStore) IncrementCounter(ctx context.Context, zoneId string, name string, delta int64) (int64, error) {
+	if err := s.checkWrite(zoneId, name); err != nil {
+		return 0, err
+	}
+	s.flushPrerequisitesForWrite(ctx, zoneId, name)
+	return withLockRtn(s, zoneId, name, func(entry *CacheEntry) (int64, error) {
+		buf := make([]byte, CounterSize)
+		err := entry.loadFileForWrite(ctx)
+		if err == fs.ErrNotExist {
+			if err := s.checkNewName(zoneId, name); err != nil {
+				return 0, err
+			}
+			binary.BigEndian.PutUint64(buf, uint64(delta))
+			_, err := entry.createWithData(ctx, nil, FileOptsType{}, buf)
+			return delta, err
+		}
+		if err != nil {
+			return 0, err
+		}
+		if entry.File.Size != CounterSize {
+			return 0, fmt.Errorf("file %s:%s is not a counter (size %d, expected %d)", zoneId, name, entry.File.Size, CounterSize)
+		}
+		_, data, err := entry.readAt(ctx, 0, CounterSize, false)
+		if err != nil {
+			return 0, err
+		}
+		newVal := int64(binary.BigEndian.Uint64(data)) + delta
+		binary.BigEndian.PutUint64(buf, uint64(newVal))
+		err = entry.loadAndWriteAt(ctx, 0, buf)
+		if err != nil {
+			return 0, err
+		}
+		entry.writeThrough(ctx)
+		return newVal, nil
+	})
+}
+
+// deletion is synchronous (under the entry lock), once DeleteFile returns every operation on the file
+// (including ones already waiting on the lock) fails with fs.ErrNotExist, and nothing can resurrect it
+// (other than an explicit Undelete).  with DeleteRetention set the file is soft-deleted: it is hidden
+// immediately but its data is kept until the retention window expires.  with BatchDeletes only the file's
+// removal from the DB is deferred to the next flush, it is marked deleted right away.
+// a read holds the same lock for its whole duration, so there is no half-deleted state for a read to see:
+// a ReadAt either completes with the data from before the delete, or starts after it and fails.  a reader
+// that streams a file across several calls (ReadInto, ConcatFiles, ...) gets fs.ErrNotExist on its next
+// call after the delete, unless a new file with the same name was created in between (check CreatedTs).
 func (s *FileStore) DeleteFile(ctx context.Context, zoneId string, name string) error {
+	if err := s.checkWrite(zoneId, name); err != nil {
+		return err
+	}
+	return withLock(s, zoneId, name, func(entry *CacheEntry) error {
+		return entry.deleteFile(ctx)
+	})
+}
+
+// same as DeleteFile, but only deletes if the file's current version (cached or flushed) is
+// expectedVersion, otherwise fails with ErrVersionMismatch.  the check and the delete happen under the
+// same entry lock, so no write can land in between.  like DeleteFile, the cache entry itself is only
+// dropped once nothing has it pinned.
+func (s *FileStore) DeleteIfVersion(ctx context.Context, zoneId string, name string, expectedVersion int64) error {
+	if err := s.checkWrite(zoneId, name); err != nil {
+		return err
+	}
 	return withLock(s, zoneId, name, func(entry *CacheEntry) error {
-		err := dbDeleteFile(ctx, zoneId, name)
+		file, err := entry.loadFileForRead(ctx)
+		if err != nil {
+			return err
+		}
+		if file.Version != expectedVersion {
+			return fmt.Errorf("%w: %s:%s is at version %d, expected %d", ErrVersionMismatch, zoneId, name, file.Version, expectedVersion)
+		}
+		return entry.deleteFile(ctx)
+	})
+}
+
+// must hold the entry lock
+func (entry *CacheEntry) deleteFile(ctx context.Context) error {
+	s := entry.Store
+	var err error
+	if s.DeleteRetention > 0 {
+		err = dbSoftDeleteFile(ctx, entry.ZoneId, entry.Name, time.Now().UnixMilli())
+	} else if s.BatchDeletes {
+		// only the mark, the row and its parts are removed by the next flush
+		err = dbSoftDeleteFile(ctx, entry.ZoneId, entry.Name, deletePendingTs)
+	} else {
+		err = dbDeleteFile(ctx, entry.ZoneId, entry.Name)
+	}
+	if err != nil {
+		return fmt.Errorf("error deleting file: %v", err)
+	}
+	entry.resolveFlushWaiters(fs.ErrNotExist)
+	entry.clear()
+	s.dropContentHash(entry.ZoneId, entry.Name)
+	// wakes OverflowBlock writers waiting on this file (they'll fail with fs.ErrNotExist)
+	s.notifySpaceFreed()
+	return nil
+}
+
+// atomically swaps the contents of two files in the same zone (data, size, opts, and meta, each file
+// keeps its name and createdts), e.g. to publish a double-buffered "next" file as "current".
+// both entry locks are held for the whole swap (taken in name order), so concurrent operations on
+// either file see the pre-swap or post-swap state for both.  dirty state is flushed before the swap.
+// both files must exist, and both versions are bumped.
+func (s *FileStore) SwapFiles(ctx context.Context, zoneId string, nameA string, nameB string) error {
+	if nameA == nameB {
+		return fmt.Errorf("cannot swap file %s:%s with itself", zoneId, nameA)
+	}
+	if err := s.checkWrite(zoneId, nameA); err != nil {
+		return err
+	}
+	if err := s.checkWrite(zoneId, nameB); err != nil {
+		return err
+	}
+	firstName, secondName := nameA, nameB
+	if secondName < firstName {
+		firstName, secondName = secondName, firstName
+	}
+	keys := []cacheKey{{ZoneId: zoneId, Name: firstName}, {ZoneId: zoneId, Name: secondName}}
+	// both entries are locked at once (in name order) under a single quiesce read lock, so a pending
+	// SnapshotAll can't deadlock us between the two entry locks
+	_, err := withPrerequisitesLocked(ctx, s, keys, func(entries []*CacheEntry) (struct{}, error) {
+		for _, entry := range entries {
+			err := entry.flushToDB(ctx, false)
+			if err != nil {
+				return struct{}{}, fmt.Errorf("error flushing %s:%s before swap: %w", zoneId, entry.Name, err)
+			}
+		}
+		err := dbSwapFiles(ctx, zoneId, nameA, nameB, time.Now().UnixMilli())
+		if err != nil {
+			return struct{}{}, err
+		}
+		s.notifySpaceFreed()
+		return struct{}{}, nil
+	})
+	return err
+}
+
+// replaces the opts of an existing file (e.g. to change its OverflowPolicy or IJsonBudget) without
+// recreating it.  dirty data is flushed first and the new opts are persisted
+// directly, so the cache never holds a file whose opts changed underneath it.  changes that would
+// re-lay out existing data (see checkOptsChange) are rejected rather than migrated: copy the data
+// into a new file instead.  returns the new version.
+func (s *FileStore) UpdateOpts(ctx context.Context, zoneId string, name string, opts FileOptsType) (int64, error) {
+	if err := s.checkWrite(zoneId, name); err != nil {
+		return 0, err
+	}
+	opts, err := validateFileOpts(opts)
+	if err != nil {
+		return 0, err
+	}
+	return withPrerequisitesLocked(ctx, s, []cacheKey{{ZoneId: zoneId, Name: name}}, func(entries []*CacheEntry) (int64, error) {
+		err := entries[0].flushToDB(ctx, false)
 		if err != nil {
-			return fmt.Errorf("error deleting file: %v", err)
+			return 0, fmt.Errorf("error flushing file before opts update: %w", err)
 		}
-		entry.clear()
+		return dbUpdateFileOpts(ctx, zoneId, name, opts, time.Now().UnixMilli())
+	})
+}
+
+// a file with data can't change whether it is circular, or the MaxSize of its ring, since that
+// changes which part holds which offset.  empty files can change anything.
+func checkOptsChange(file *WaveFile, opts FileOptsType) error {
+	if file.Size == 0 {
 		return nil
+	}
+	oldOpts := file.Opts
+	if oldOpts.Circular != opts.Circular {
+		return fmt.Errorf("cannot change circular mode of non-empty file %s:%s", file.ZoneId, file.Name)
+	}
+	if opts.Circular && oldOpts.MaxSize != opts.MaxSize {
+		return fmt.Errorf("cannot change max size of non-empty circular file %s:%s", file.ZoneId, file.Name)
+	}
+	if opts.IJson && !oldOpts.IJson {
+		return fmt.Errorf("cannot turn on ijson for non-empty file %s:%s", file.ZoneId, file.Name)
+	}
+	return nil
+}
+
+// makes the file's data immutable: once Seal returns, every data write (WriteFile, WriteAt, appends,
+// truncates, ijson compaction, Preallocate, SwapFiles) fails with ErrSealed.  reads, meta updates, and
+// DeleteFile still work.  dirty data is flushed before the file is sealed, and the flag is persisted.
+// sealing a sealed file is a no-op.  the flag is not part of MarshalFile/SnapshotAll exports.
+func (s *FileStore) Seal(ctx context.Context, zoneId string, name string) error {
+	if err := s.checkWrite(zoneId, name); err != nil {
+		return err
+	}
+	return s.setSealed(ctx, zoneId, name, true)
+}
+
+// reverses Seal.  this exists for administrative repair only: consumers may rely on a sealed file
+// never changing again, so unsealing one that has already been handed off breaks that promise.
+func (s *FileStore) Unseal(ctx context.Context, zoneId string, name string) error {
+	if err := s.checkWrite(zoneId, name); err != nil {
+		return err
+	}
+	return s.setSealed(ctx, zoneId, name, false)
+}
+
+func (s *FileStore) setSealed(ctx context.Context, zoneId string, name string, sealed bool) error {
+	_, err := withPrerequisitesLocked(ctx, s, []cacheKey{{ZoneId: zoneId, Name: name}}, func(entries []*CacheEntry) (struct{}, error) {
+		err := entries[0].flushToDB(ctx, false)
+		if err != nil {
+			return struct{}{}, fmt.Errorf("error flushing file before seal: %w", err)
+		}
+		return struct{}{}, dbSetFileSealed(ctx, zoneId, name, sealed)
+	})
+	return err
+}
+
+// restores a soft-deleted file (see DeleteRetention) that is still within the retention window.
+// returns fs.ErrNotExist if there is no such file, and fs.ErrExist if a live file has taken its name.
+func (s *FileStore) Undelete(ctx context.Context, zoneId string, name string) error {
+	if err := s.checkWrite(zoneId, name); err != nil {
+		return err
+	}
+	if s.DeleteRetention <= 0 {
+		return fs.ErrNotExist
+	}
+	return withLock(s, zoneId, name, func(entry *CacheEntry) error {
+		if entry.File != nil {
+			return fs.ErrExist
+		}
+		minDeletedTs := time.Now().Add(-s.DeleteRetention).UnixMilli()
+		return dbUndeleteFile(ctx, zoneId, name, minDeletedTs)
 	})
 }
 
+// hard-deletes soft-deleted files whose retention window has expired (run by the flusher)
+func (s *FileStore) reapDeletedFiles(ctx context.Context) (int, error) {
+	if s.DeleteRetention <= 0 {
+		return 0, nil
+	}
+	cutoffTs := time.Now().Add(-s.DeleteRetention).UnixMilli()
+	return dbReapDeletedFiles(ctx, cutoffTs)
+}
+
 func (s *FileStore) DeleteZone(ctx context.Context, zoneId string) error {
 	fileNames, err := dbGetZoneFileNames(ctx, zoneId)
 	if err != nil {
 		return fmt.Errorf("error getting zone files: %v", err)
 	}
 	for _, name := range fileNames {
-		s.DeleteFile(ctx, zoneId, name)
+		err = s.DeleteFile(ctx, zoneId, name)
+		if err != nil {
+			s.logf("filestore: error deleting file %s:%s (in DeleteZone): %v\n", zoneId, name, err)
+		}
 	}
 	return nil
 }
 
 // if file doesn't exsit, returns fs.ErrNotExist
 func (s *FileStore) Stat(ctx context.Context, zoneId string, name string) (*WaveFile, error) {
+	if err := s.checkRead(zoneId, name); err != nil {
+		return nil, err
+	}
 	return withLockRtn(s, zoneId, name, func(entry *CacheEntry) (*WaveFile, error) {
 		file, err := entry.loadFileForRead(ctx)
 		if err != nil {
@@ -190,8 +634,43 @@ func (s *FileStore) Stat(ctx context.Context, zoneId string, name string) (*Wave
 			}
 			return nil, fmt.Errorf("error getting file: %v", err)
 		}
-		return file.DeepCopy(), nil
+		return s.fileForCaller(file), nil
+	})
+}
+
+// cheap check for client-side caching, returns the current version of the file
+// the version increases monotonically across data writes, truncates, and meta changes (flushing does not change it)
+func (s *FileStore) StatVersion(ctx context.Context, zoneId string, name string) (int64, error) {
+	if err := s.checkRead(zoneId, name); err != nil {
+		return 0, err
+	}
+	return withLockRtn(s, zoneId, name, func(entry *CacheEntry) (int64, error) {
+		file, err := entry.loadFileForRead(ctx)
+		if err != nil {
+			return 0, err
+		}
+		return file.Version, nil
+	})
+}
+
+// returns the logical range [startOffset, endOffset) of data the file currently retains.  for circular
+// files the start advances as appends wrap over the oldest data, for regular files it is always 0.
+// readers that must not skip data can read with ReadOpts.FailEvicted to get ErrEvicted instead.
+func (s *FileStore) RetainedRange(ctx context.Context, zoneId string, name string) (startOffset int64, endOffset int64, err error) {
+	if err := s.checkRead(zoneId, name); err != nil {
+		return 0, 0, err
+	}
+	file, err := withLockRtn(s, zoneId, name, func(entry *CacheEntry) (WaveFile, error) {
+		file, err := entry.loadFileForRead(ctx)
+		if err != nil {
+			return WaveFile{}, err
+		}
+		return *file, nil
 	})
+	if err != nil {
+		return 0, 0, err
+	}
+	return file.DataStartIdx(), file.Size, nil
 }
 
 func (s *FileStore) ListFiles(ctx context.Context, zoneId string) ([]*WaveFile, error) {
@@ -202,7 +681,7 @@ func (s *FileStore) ListFiles(ctx context.Context, zoneId string) ([]*WaveFile,
 	for idx, file := range files {
 		withLock(s, file.ZoneId, file.Name, func(entry *CacheEntry) error {
 			if entry.File != nil {
-				files[idx] = entry.File.DeepCopy()
+				files[idx] = s.fileForCaller(entry.File)
 			}
 			return nil
 		})
@@ -210,11 +689,183 @@ func (s *FileStore) ListFiles(ctx context.Context, zoneId string) ([]*WaveFile,
 	return files, nil
 }
 
-func (s *FileStore) WriteMeta(ctx context.Context, zoneId string, name string, meta FileMeta, merge bool) error {
-	return withLock(s, zoneId, name, func(entry *CacheEntry) error {
+// lightweight file metadata, used for listing large numbers of files (no Meta, no DeepCopy)
+type FileInfo struct {
+	ZoneId   string `json:"zoneid"`
+	Name     string `json:"name"`
+	Size     int64  `json:"size"`
+	ModTs    int64  `json:"modts"`
+	Version  int64  `json:"version"`
+	Circular bool   `json:"circular,omitempty"`
+	Dirty    bool   `json:"dirty,omitempty"` // has changes in the cache that have not been flushed to the DB
+}
+
+func makeFileInfo(file *WaveFile, dirty bool) FileInfo {
+	return FileInfo{
+		ZoneId:   file.ZoneId,
+		Name:     file.Name,
+		Size:     file.Size,
+		ModTs:    file.ModTs,
+		Version:  file.Version,
+		Circular: file.Opts.Circular,
+		Dirty:    dirty,
+	}
+}
+
+// like ListFiles, but returns FileInfo structs.  only files resident in the cache are locked (to pick
+// up their unflushed state), so this stays cheap for zones with many files.
+func (s *FileStore) ListFileInfos(ctx context.Context, zoneId string) ([]FileInfo, error) {
+	files, err := dbGetZoneFileInfos(ctx, zoneId)
+	if err != nil {
+		return nil, fmt.Errorf("error getting zone files: %v", err)
+	}
+	rtn := make([]FileInfo, len(files))
+	fileIdx := make(map[string]int)
+	for idx, file := range files {
+		rtn[idx] = makeFileInfo(file, false)
+		fileIdx[file.Name] = idx
+	}
+	for _, key := range s.getResidentZoneKeys(zoneId) {
+		idx, found := fileIdx[key.Name]
+		if !found {
+			continue
+		}
+		withLock(s, key.ZoneId, key.Name, func(entry *CacheEntry) error {
+			if entry.File != nil {
+				rtn[idx] = makeFileInfo(entry.File, true)
+			}
+			return nil
+		})
+	}
+	return rtn, nil
+}
+
+// sort order for ListFilesSorted.  size and modts sort largest/newest first, name sorts ascending.
+// ties are broken by name so the order is stable.
+type SortKey string
+
+const (
+	SortByName  SortKey = "name"
+	SortBySize  SortKey = "size"
+	SortByModTs SortKey = "modts"
+)
+
+// returns the zone's files (as in ListFileInfos, dirty cache state included) sorted by the given
+// key (see the SortBy consts).  if limit > 0 at most limit files are returned (top-N).  ModTs is set
+// by every data write, so SortByModTs orders by the latest write.
+func (s *FileStore) ListFilesSorted(ctx context.Context, zoneId string, by SortKey, limit int) ([]FileInfo, error) {
+	var less func(a, b FileInfo) bool
+	switch by {
+	case SortByName:
+		less = func(a, b FileInfo) bool { return false }
+	case SortBySize:
+		less = func(a, b FileInfo) bool { return a.Size > b.Size }
+	case SortByModTs:
+		less = func(a, b FileInfo) bool { return a.ModTs > b.ModTs }
+	default:
+		return nil, fmt.Errorf("invalid sort key %q", by)
+	}
+	infos, err := s.ListFileInfos(ctx, zoneId)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		if less(infos[i], infos[j]) {
+			return true
+		}
+		if less(infos[j], infos[i]) {
+			return false
+		}
+		return infos[i].Name < infos[j].Name
+	})
+	if limit > 0 && len(infos) > limit {
+		infos = infos[:limit]
+	}
+	return infos, nil
+}
+
+// returns the keys (sorted by zoneid, name) of every file, in all zones, modified at or after t, e.g. for an
+// incremental backup.  ModTs is set by every data write, meta change, and Touch, and is persisted with the
+// file, so it survives a restart.  dirty (unflushed) changes count, they are picked up from the cache.
+// ModTs has millisecond precision and the comparison includes t's millisecond, so passing the time of the
+// last backup may return a file again, but never misses one.  soft-deleted files are not included.
+func (s *FileStore) ModifiedSince(ctx context.Context, t time.Time) ([]FileKey, error) {
+	modTs := t.UnixMilli()
+	files, err := dbGetFilesModifiedSince(ctx, modTs)
+	if err != nil {
+		return nil, fmt.Errorf("error getting modified files: %v", err)
+	}
+	found := make(map[cacheKey]bool)
+	for _, file := range files {
+		found[cacheKey{ZoneId: file.ZoneId, Name: file.Name}] = true
+	}
+	for _, key := range s.getCacheKeys() {
+		if found[key] {
+			continue
+		}
+		withLock(s, key.ZoneId, key.Name, func(entry *CacheEntry) error {
+			if entry.File != nil && entry.File.ModTs >= modTs {
+				found[key] = true
+			}
+			return nil
+		})
+	}
+	rtn := make([]FileKey, 0, len(found))
+	for key := range found {
+		rtn = append(rtn, FileKey(key))
+	}
+	sort.Slice(rtn, func(i, j int) bool {
+		if rtn[i].ZoneId != rtn[j].ZoneId {
+			return rtn[i].ZoneId < rtn[j].ZoneId
+		}
+		return rtn[i].Name < rtn[j].Name
+	})
+	return rtn, nil
+}
+
+// returns the number of files in the zone without loading them.  files are created and deleted in the DB
+// synchronously (the cache only ever holds unflushed changes to existing files), so a count query is exact:
+// resident entries add nothing, and deleted or soft-deleted files (including ones whose BatchDeletes removal
+// is still pending) are never counted.
+func (s *FileStore) FileCount(ctx context.Context, zoneId string) (int, error) {
+	return dbGetZoneFileCount(ctx, zoneId)
+}
+
+// same as FileCount, for every zone at once (zones without files are not included)
+func (s *FileStore) FileCounts(ctx context.Context) (map[string]int, error) {
+	return dbGetFileCounts(ctx)
+}
+
+// returns the bytes of part data physically stored in the DB for the zone (not the logical file sizes,
+// which differ for sparse and circular files).  deduplicated parts count each shared blob once per zone.
+// this reflects persisted state only, dirty (unflushed) data is not included, call FlushCache first if needed.
+// soft-deleted files (see DeleteRetention) are included until they are reaped, pending BatchDeletes removals
+// are applied first.
+func (s *FileStore) DiskUsage(ctx context.Context, zoneId string) (int64, error) {
+	if _, err := s.flushQueuedDeletes(ctx); err != nil {
+		return 0, err
+	}
+	return dbGetZoneDiskUsage(ctx, zoneId)
+}
+
+// returns the (sorted) indexes of the parts persisted in the DB for the file, a diagnostic for comparing
+// durable state against the logical size (sparse gaps, missing or orphaned parts).  reads the DB directly:
+// dirty parts that have not been flushed yet are not included, call FlushCache first if needed.
+func (s *FileStore) DBPartIndexes(ctx context.Context, zoneId string, name string) ([]int, error) {
+	if err := s.checkRead(zoneId, name); err != nil {
+		return nil, err
+	}
+	return dbGetFilePartIdxs(ctx, zoneId, name)
+}
+
+func (s *FileStore) WriteMeta(ctx context.Context, zoneId string, name string, meta FileMeta, merge bool) (int64, error) {
+	if err := s.checkWrite(zoneId, name); err != nil {
+		return 0, err
+	}
+	return withLockRtn(s, zoneId, name, func(entry *CacheEntry) (int64, error) {
 		err := entry.loadFileIntoCache(ctx)
 		if err != nil {
-			return err
+			return 0, err
 		}
 		if merge {
 			for k, v := range meta {
@@ -228,62 +879,551 @@ func (s *FileStore) WriteMeta(ctx context.Context, zoneId string, name string, m
 			entry.File.Meta = meta
 		}
 		entry.File.ModTs = time.Now().UnixMilli()
-		return nil
+		entry.File.Version++
+		return entry.File.Version, nil
 	})
 }
 
-func (s *FileStore) WriteFile(ctx context.Context, zoneId string, name string, data []byte) error {
+// updates the file's ModTs to now without changing its contents (like unix touch).  the file is loaded
+// into the cache and persisted by the next flush.  the version is not bumped since nothing changed.
+// returns fs.ErrNotExist if the file does not exist (Touch never creates files).
+func (s *FileStore) Touch(ctx context.Context, zoneId string, name string) error {
+	if err := s.checkWrite(zoneId, name); err != nil {
+		return err
+	}
 	return withLock(s, zoneId, name, func(entry *CacheEntry) error {
 		err := entry.loadFileIntoCache(ctx)
 		if err != nil {
 			return err
 		}
-		entry.writeAt(0, data, true)
-		// since WriteFile can *truncate* the file, we need to flush the file to the DB immediately
-		return entry.flushToDB(ctx, true)
+		entry.File.ModTs = time.Now().UnixMilli()
+		return nil
 	})
 }
 
-func (s *FileStore) WriteAt(ctx context.Context, zoneId string, name string, offset int64, data []byte) error {
-	if offset < 0 {
-		return fmt.Errorf("offset must be non-negative")
+// replaces the file's contents (truncating it if data is shorter).  the new size is set, the old
+// parts are dropped, and the result is flushed all under the entry lock, and every read holds the same
+// lock for its whole duration, so a concurrent reader sees either the old or the new contents, never
+// a shorter size with stale parts still behind it.  dirty flush prerequisites (see SetFlushDependency)
+// are flushed first.  if the flush would be turned away (ErrBackendUnavailable) the file is left
+// unchanged.  returns the new version of the file
+func (s *FileStore) WriteFile(ctx context.Context, zoneId string, name string, data []byte) (int64, error) {
+	if err := s.checkWrite(zoneId, name); err != nil {
+		return 0, err
 	}
-	return withLock(s, zoneId, name, func(entry *CacheEntry) error {
-		err := entry.loadFileIntoCache(ctx)
+	return withPrerequisitesLocked(ctx, s, []cacheKey{{ZoneId: zoneId, Name: name}}, func(entries []*CacheEntry) (int64, error) {
+		entry := entries[0]
+		err := entry.loadFileForWrite(ctx)
 		if err != nil {
-			return err
+			return 0, err
 		}
-		file := entry.File
-		if offset > file.Size {
-			return fmt.Errorf("offset is past the end of the file")
+		if entry.File.Opts.enforcesMaxSize() && int64(len(data)) > entry.File.Opts.MaxSize {
+			// waiting can't help, the file is replaced as a whole
+			return 0, fmt.Errorf("%w: write of %d bytes exceeds max size %d", ErrFileFull, len(data), entry.File.Opts.MaxSize)
 		}
-		partMap := file.computePartMap(offset, int64(len(data)))
-		incompleteParts := incompletePartsFromMap(partMap)
-		err = entry.loadDataPartsIntoCache(ctx, incompleteParts)
-		if err != nil {
-			return err
+		if err := entry.checkReplaceFlush(); err != nil {
+			return 0, err
 		}
-		entry.writeAt(offset, data, false)
-		return nil
-	})
+		entry.writeAt(0, data, true)
+		version := entry.File.Version
+		// since WriteFile can *truncate* the file, we need to flush the file to the DB immediately
+		return version, entry.flushToDB(ctx, true)
+	})
 }
 
-func (s *FileStore) AppendData(ctx context.Context, zoneId string, name string, data []byte) error {
-	return withLock(s, zoneId, name, func(entry *CacheEntry) error {
-		err := entry.loadFileIntoCache(ctx)
+// a single WriteAt is atomic with respect to all other operations on the file: the entry lock is held
+// for the entire write, so a write that spans a part boundary is never interleaved with another writer.
+// returns the new version of the file
+func (s *FileStore) WriteAt(ctx context.Context, zoneId string, name string, offset int64, data []byte) (int64, error) {
+	return s.WriteAtWithOpts(ctx, zoneId, name, offset, data, WriteOpts{})
+}
+
+type WriteOpts struct {
+	// if set the write fails with ErrNoLease unless this is the file's current lease (see AcquireLease)
+	LeaseId string
+}
+
+// same as WriteAt, but with write options (the zero value of WriteOpts gives the same behavior as WriteAt)
+func (s *FileStore) WriteAtWithOpts(ctx context.Context, zoneId string, name string, offset int64, data []byte, opts WriteOpts) (int64, error) {
+	if err := s.checkWrite(zoneId, name); err != nil {
+		return 0, err
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("offset must be non-negative")
+	}
+	if err := s.waitForLowWater(ctx); err != nil {
+		return 0, err
+	}
+	s.flushPrerequisitesForWrite(ctx, zoneId, name)
+	return retryOnOverflow(ctx, func() (int64, error) {
+		return withLockRtn(s, zoneId, name, func(entry *CacheEntry) (int64, error) {
+			if opts.LeaseId != "" {
+				err := s.checkLease(zoneId, name, opts.LeaseId)
+				if err != nil {
+					return 0, err
+				}
+			}
+			err := entry.loadAndWriteAt(ctx, offset, data)
+			if err != nil {
+				return 0, err
+			}
+			version := entry.File.Version
+			entry.writeThrough(ctx)
+			return version, nil
+		})
+	})
+}
+
+// same as WriteAt, but creates the file (with opts) if it doesn't exist, and reports whether this call
+// created it.  the create-or-write decision is made under the entry lock, so of several concurrent
+// WriteAtEx calls on a missing file exactly one sees created=true, the rest write to the file it created.
+// a create only accepts offset 0 (like WriteAt, an offset past the end of the file is an error).
+// returns the new version of the file
+func (s *FileStore) WriteAtEx(ctx context.Context, zoneId string, name string, offset int64, data []byte, opts FileOptsType) (version int64, created bool, err error) {
+	if err := s.checkWrite(zoneId, name); err != nil {
+		return 0, false, err
+	}
+	if offset < 0 {
+		return 0, false, fmt.Errorf("offset must be non-negative")
+	}
+	opts, err = validateFileOpts(opts)
+	if err != nil {
+		return 0, false, err
+	}
+	if err := s.waitForLowWater(ctx); err != nil {
+		return 0, false, err
+	}
+	s.flushPrerequisitesForWrite(ctx, zoneId, name)
+	version, err = retryOnOverflow(ctx, func() (int64, error) {
+		return withLockRtn(s, zoneId, name, func(entry *CacheEntry) (int64, error) {
+			err := entry.loadFileIntoCache(ctx)
+			if err == fs.ErrNotExist {
+				if err := s.checkNewName(zoneId, name); err != nil {
+					return 0, err
+				}
+				if offset > 0 {
+					return 0, fmt.Errorf("offset is past the end of the file")
+				}
+				if opts.enforcesMaxSize() && int64(len(data)) > opts.MaxSize {
+					return 0, fmt.Errorf("%w: %d bytes of data exceeds max size %d", ErrFileFull, len(data), opts.MaxSize)
+				}
+				version, err := entry.createWithData(ctx, nil, opts, data)
+				created = err == nil
+				return version, err
+			}
+			if err != nil {
+				return 0, err
+			}
+			err = entry.loadAndWriteAt(ctx, offset, data)
+			if err != nil {
+				return 0, err
+			}
+			version := entry.File.Version
+			entry.writeThrough(ctx)
+			return version, nil
+		})
+	})
+	return version, created, err
+}
+
+// same as WriteAt, but also returns a future that resolves once the write is durable (flushed to the DB).
+// the future resolves no matter which flush persists the write (background flusher, FlushCache, Evict,
+// or a WriteFile that flushes the entry).  if the write itself fails the future is already resolved.
+func (s *FileStore) WriteAtAsync(ctx context.Context, zoneId string, name string, offset int64, data []byte) *WriteFuture {
+	future := makeWriteFuture()
+	if err := s.checkWrite(zoneId, name); err != nil {
+		future.resolve(err)
+		return future
+	}
+	if offset < 0 {
+		future.resolve(fmt.Errorf("offset must be non-negative"))
+		return future
+	}
+	if err := s.waitForLowWater(ctx); err != nil {
+		future.resolve(err)
+		return future
+	}
+	s.flushPrerequisitesForWrite(ctx, zoneId, name)
+	_, err := retryOnOverflow(ctx, func() (bool, error) {
+		return false, withLock(s, zoneId, name, func(entry *CacheEntry) error {
+			err := entry.loadAndWriteAt(ctx, offset, data)
+			if err != nil {
+				return err
+			}
+			entry.FlushWaiters = append(entry.FlushWaiters, future)
+			entry.writeThrough(ctx)
+			return nil
+		})
+	})
+	if err != nil {
+		future.resolve(err)
+	}
+	return future
+}
+
+// discards all data in a circular file (keeping its opts and meta), the next append starts at offset 0
+// the reset happens under the entry lock and is flushed immediately, so readers see either the full
+// old ring or the empty file.  returns the new version of the file.
+func (s *FileStore) ResetCircular(ctx context.Context, zoneId string, name string) (int64, error) {
+	if err := s.checkWrite(zoneId, name); err != nil {
+		return 0, err
+	}
+	return withPrerequisitesLocked(ctx, s, []cacheKey{{ZoneId: zoneId, Name: name}}, func(entries []*CacheEntry) (int64, error) {
+		entry := entries[0]
+		err := entry.loadFileForWrite(ctx)
+		if err != nil {
+			return 0, err
+		}
+		if !entry.File.Opts.Circular {
+			return 0, fmt.Errorf("file %s:%s is not a circular file", zoneId, name)
+		}
+		if err := entry.checkReplaceFlush(); err != nil {
+			return 0, err
+		}
+		entry.writeAt(0, nil, true)
+		version := entry.File.Version
+		return version, entry.flushToDB(ctx, true)
+	})
+}
+
+// the append offset (the current file size) is read under the entry lock, so concurrent appends
+// never overwrite or interleave with each other.  callers should prefer AppendData over computing an
+// offset from Stat and calling WriteAt, which is racy.  with FairAppends set, concurrent appends land in
+// the order they were called (an OverflowBlock append that has to wait for space rejoins at the back).
+// returns the new version of the file
+func (s *FileStore) AppendData(ctx context.Context, zoneId string, name string, data []byte) (int64, error) {
+	return s.appendData(ctx, zoneId, name, data, false)
+}
+
+// see writeAtImpl for adopt
+func (s *FileStore) appendData(ctx context.Context, zoneId string, name string, data []byte, adopt bool) (int64, error) {
+	if err := s.checkWrite(zoneId, name); err != nil {
+		return 0, err
+	}
+	if err := s.waitForLowWater(ctx); err != nil {
+		return 0, err
+	}
+	s.flushPrerequisitesForWrite(ctx, zoneId, name)
+	return retryOnOverflow(ctx, func() (int64, error) {
+		return withAppendLockRtn(s, zoneId, name, func(entry *CacheEntry) (int64, error) {
+			err := entry.loadFileForWrite(ctx)
+			if err != nil {
+				return 0, err
+			}
+			err = entry.checkOverflow(entry.File.Size + int64(len(data)))
+			if err != nil {
+				return 0, err
+			}
+			partMap := entry.File.computePartMap(entry.File.Size, int64(len(data)))
+			err = entry.File.checkPartMap(partMap)
+			if err != nil {
+				return 0, err
+			}
+			incompleteParts := incompletePartsFromMap(partMap)
+			if len(incompleteParts) > 0 {
+				err = entry.loadDataPartsIntoCache(ctx, incompleteParts)
+				if err != nil {
+					return 0, err
+				}
+			}
+			entry.writeAtImpl(entry.File.Size, data, false, adopt)
+			version := entry.File.Version
+			entry.writeThrough(ctx)
+			return version, nil
+		})
+	})
+}
+
+// returns the part size used by writeAt (the unit data is stored and flushed in).  writers that size
+// their buffers to a multiple of this and write at aligned offsets hit the full-part fast path.
+func (s *FileStore) PartSize() int64 {
+	return partDataSize
+}
+
+// low-level part access for tools that work at part granularity (e.g. compaction), most callers should
+// use ReadAt/WriteAt.  returns the written data of the part (up to PartSize bytes, a copy), or nil for a
+// part that was never written.  no offset math is done, so circular files are read by physical part.
+func (s *FileStore) ReadPartData(ctx context.Context, zoneId string, name string, partIdx int) ([]byte, error) {
+	if err := s.checkRead(zoneId, name); err != nil {
+		return nil, err
+	}
+	if partIdx < 0 {
+		return nil, fmt.Errorf("part index must be non-negative")
+	}
+	return withLockRtn(s, zoneId, name, func(entry *CacheEntry) ([]byte, error) {
+		_, err := entry.loadFileForRead(ctx)
+		if err != nil {
+			return nil, err
+		}
+		dataEntries, err := entry.loadDataPartsForRead(ctx, []int{partIdx})
+		if err != nil {
+			return nil, err
+		}
+		dce := dataEntries[partIdx]
+		if dce == nil {
+			return nil, nil
+		}
+		return append([]byte(nil), dce.Data...), nil
+	})
+}
+
+// low-level counterpart to ReadPartData: replaces the whole part with data (at most PartSize bytes, the
+// rest of the part reads as zeros).  the file's size is only updated when the part extends it, writing a
+// short part in the middle of a file never shrinks it.  not supported for circular files (their parts
+// don't map to a single logical offset).
+// returns the new version of the file
+func (s *FileStore) WritePartData(ctx context.Context, zoneId string, name string, partIdx int, data []byte) (int64, error) {
+	if err := s.checkWrite(zoneId, name); err != nil {
+		return 0, err
+	}
+	if partIdx < 0 {
+		return 0, fmt.Errorf("part index must be non-negative")
+	}
+	if int64(len(data)) > partDataSize {
+		return 0, fmt.Errorf("part data is %d bytes, more than the part size %d", len(data), partDataSize)
+	}
+	if err := s.waitForLowWater(ctx); err != nil {
+		return 0, err
+	}
+	s.flushPrerequisitesForWrite(ctx, zoneId, name)
+	return retryOnOverflow(ctx, func() (int64, error) {
+		return withLockRtn(s, zoneId, name, func(entry *CacheEntry) (int64, error) {
+			err := entry.loadFileForWrite(ctx)
+			if err != nil {
+				return 0, err
+			}
+			if entry.File.Opts.Circular {
+				return 0, fmt.Errorf("file %s:%s is circular, part writes are not supported", zoneId, name)
+			}
+			endOffset := int64(partIdx)*partDataSize + int64(len(data))
+			err = entry.checkOverflow(endOffset)
+			if err != nil {
+				return 0, err
+			}
+			dce := makeDataCacheEntry(partIdx)
+			dce.Data = make([]byte, len(data))
+			copy(dce.Data, data)
+			entry.DataEntries[partIdx] = dce
+			if endOffset > entry.File.Size {
+				entry.File.Size = endOffset
+			}
+			entry.File.ModTs = time.Now().UnixMilli()
+			entry.File.Version++
+			version := entry.File.Version
+			entry.writeThrough(ctx)
+			return version, nil
+		})
+	})
+}
+
+// replaces a set of parts and sets the file's size in one locked operation (readers see the file before or
+// after, never in between), e.g. for a compaction tool rewriting a file.  each part is replaced whole (at
+// most PartSize bytes, the rest of the part reads as zeros) and must end within newSize.  parts that aren't
+// given are kept, except those past newSize: a shrinking file drops them from the cache, and the next flush
+// deletes them from the DB.  not supported for circular files (like WritePartData).
+// returns the new version of the file
+func (s *FileStore) ReplaceParts(ctx context.Context, zoneId string, name string, parts map[int][]byte, newSize int64) (int64, error) {
+	if err := s.checkWrite(zoneId, name); err != nil {
+		return 0, err
+	}
+	if newSize < 0 {
+		return 0, fmt.Errorf("size must be non-negative")
+	}
+	for partIdx, data := range parts {
+		if partIdx < 0 {
+			return 0, fmt.Errorf("part index must be non-negative")
+		}
+		if int64(len(data)) > partDataSize {
+			return 0, fmt.Errorf("part %d is %d bytes, more than the part size %d", partIdx, len(data), partDataSize)
+		}
+		if int64(partIdx)*partDataSize+int64(len(data)) > newSize || (len(data) == 0 && int64(partIdx)*partDataSize >= newSize) {
+			return 0, fmt.Errorf("part %d ends past the new size %d", partIdx, newSize)
+		}
+	}
+	if err := s.waitForLowWater(ctx); err != nil {
+		return 0, err
+	}
+	s.flushPrerequisitesForWrite(ctx, zoneId, name)
+	return withLockRtn(s, zoneId, name, func(entry *CacheEntry) (int64, error) {
+		err := entry.loadFileForWrite(ctx)
 		if err != nil {
+			return 0, err
+		}
+		if entry.File.Opts.Circular {
+			return 0, fmt.Errorf("file %s:%s is circular, part writes are not supported", zoneId, name)
+		}
+		if newSize > entry.File.Size {
+			err = entry.checkOverflow(newSize)
+			if err != nil {
+				return 0, err
+			}
+		}
+		keepParts := int((newSize + partDataSize - 1) / partDataSize)
+		lastPartIdx, lastPartLen := int(newSize/partDataSize), newSize%partDataSize
+		_, lastPartGiven := parts[lastPartIdx]
+		shrinking := newSize < entry.File.Size
+		if shrinking && lastPartLen > 0 && !lastPartGiven {
+			// the kept part the new size cuts into must lose its tail (it would reappear if the file grew again)
+			err = entry.loadDataPartsIntoCache(ctx, []int{lastPartIdx})
+			if err != nil {
+				return 0, err
+			}
+			if dce := entry.DataEntries[lastPartIdx]; dce != nil && int64(len(dce.Data)) > lastPartLen {
+				dce.Data = dce.Data[:lastPartLen]
+			}
+		}
+		for partIdx, data := range parts {
+			dce := makeDataCacheEntry(partIdx)
+			dce.Data = make([]byte, len(data))
+			copy(dce.Data, data)
+			entry.DataEntries[partIdx] = dce
+		}
+		if shrinking {
+			for partIdx := range entry.DataEntries {
+				if partIdx >= keepParts {
+					delete(entry.DataEntries, partIdx)
+				}
+			}
+			if entry.truncatePartIdx < 0 || keepParts < entry.truncatePartIdx {
+				entry.truncatePartIdx = keepParts
+			}
+			s.notifySpaceFreed()
+		}
+		entry.File.Size = newSize
+		entry.File.ModTs = time.Now().UnixMilli()
+		entry.File.Version++
+		version := entry.File.Version
+		entry.writeThrough(ctx)
+		return version, nil
+	})
+}
+
+// streams r into the file, appending one part-sized chunk at a time (the whole stream is never buffered).
+// each chunk is a separate AppendData, so concurrent appends can land between chunks, and circular files
+// wrap as usual.  stops when r returns io.EOF, or on the first read/append error or ctx cancellation,
+// returning the number of bytes appended so far along with the error.
+// the first chunk only fills out the file's last part, after that each chunk is read straight into a new
+// part buffer that the cache adopts without copying (unless a concurrent append unaligned the file).
+func (s *FileStore) AppendFrom(ctx context.Context, zoneId string, name string, r io.Reader) (int64, error) {
+	var written int64
+	// only a hint for aligning chunks, the appends themselves report any error.  it is a read of the file,
+	// so callers that may only write it go without (their chunks are just not part-aligned)
+	var fileSize int64
+	if s.checkRead(zoneId, name) == nil {
+		fileSize, _ = withLockRtn(s, zoneId, name, func(entry *CacheEntry) (int64, error) {
+			file, err := entry.loadFileForRead(ctx)
+			if err != nil {
+				return 0, err
+			}
+			return file.Size, nil
+		})
+	}
+	chunkSize := partDataSize - fileSize%partDataSize
+	for {
+		if ctx.Err() != nil {
+			return written, ctx.Err()
+		}
+		buf := make([]byte, chunkSize)
+		chunkSize = partDataSize
+		n, readErr := io.ReadFull(r, buf)
+		if n > 0 {
+			_, err := s.appendData(ctx, zoneId, name, buf[:n], true)
+			if err != nil {
+				return written, err
+			}
+			written += int64(n)
+		}
+		if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+			return written, nil
+		}
+		if readErr != nil {
+			return written, fmt.Errorf("error reading input: %w", readErr)
+		}
+	}
+}
+
+// appends the logical contents of each source (in order) to the destination, one part-sized chunk at a
+// time, so no source is ever read into memory whole.  circular sources contribute the data they retain,
+// oldest first.  if the destination doesn't exist it is created as a regular file, if it does exist
+// appendToDst must be set (otherwise fs.ErrExist is returned and nothing is written).
+// every source is checked (it must exist and be readable) before the destination is created or written.
+// each source is copied up to the size it had when its copy started.  this isn't atomic: on a later error
+// (e.g. a source deleted mid-copy) the destination keeps what was appended so far, and a circular source
+// that wraps over data before it is copied fails with ErrEvicted rather than leaving a silent gap.
+func (s *FileStore) ConcatFiles(ctx context.Context, dstZoneId string, dstName string, srcKeys []FileKey, appendToDst bool) error {
+	for _, key := range srcKeys {
+		_, _, err := s.RetainedRange(ctx, key.ZoneId, key.Name)
+		if err != nil {
+			return fmt.Errorf("error reading source %s:%s: %w", key.ZoneId, key.Name, err)
+		}
+	}
+	err := s.MakeFile(ctx, dstZoneId, dstName, nil, FileOptsType{})
+	if err == fs.ErrExist {
+		if !appendToDst {
 			return err
 		}
-		partMap := entry.File.computePartMap(entry.File.Size, int64(len(data)))
-		incompleteParts := incompletePartsFromMap(partMap)
-		if len(incompleteParts) > 0 {
-			err = entry.loadDataPartsIntoCache(ctx, incompleteParts)
+	} else if err != nil {
+		return err
+	}
+	for _, key := range srcKeys {
+		startOffset, endOffset, err := s.RetainedRange(ctx, key.ZoneId, key.Name)
+		if err != nil {
+			return fmt.Errorf("error reading source %s:%s: %w", key.ZoneId, key.Name, err)
+		}
+		for offset := startOffset; offset < endOffset; {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			size := min(partDataSize-offset%partDataSize, endOffset-offset)
+			_, data, err := s.ReadAtWithOpts(ctx, key.ZoneId, key.Name, offset, size, ReadOpts{FailEvicted: true})
+			if err != nil {
+				return fmt.Errorf("error reading source %s:%s: %w", key.ZoneId, key.Name, err)
+			}
+			if len(data) == 0 {
+				// source was truncated while we were copying it
+				break
+			}
+			_, err = s.AppendData(ctx, dstZoneId, dstName, data)
 			if err != nil {
 				return err
 			}
+			offset += int64(len(data))
 		}
-		entry.writeAt(entry.File.Size, data, false)
-		return nil
+	}
+	return nil
+}
+
+// extends the file to size without writing any data.  the new region is sparse: no parts are
+// created until they are written, and unwritten parts read as zeros.  this lets a writer that knows
+// the final size issue WriteAt calls in any order.  preallocate never shrinks a file, and fails
+// up front if size exceeds the file's MaxSize (circular files cannot be preallocated).
+// returns the new version of the file
+func (s *FileStore) Preallocate(ctx context.Context, zoneId string, name string, size int64) (int64, error) {
+	if err := s.checkWrite(zoneId, name); err != nil {
+		return 0, err
+	}
+	if size < 0 {
+		return 0, fmt.Errorf("size must be non-negative")
+	}
+	return withLockRtn(s, zoneId, name, func(entry *CacheEntry) (int64, error) {
+		err := entry.loadFileForWrite(ctx)
+		if err != nil {
+			return 0, err
+		}
+		file := entry.File
+		if file.Opts.Circular {
+			return 0, fmt.Errorf("cannot preallocate circular file %s:%s", zoneId, name)
+		}
+		if file.Opts.MaxSize > 0 && size > file.Opts.MaxSize {
+			return 0, fmt.Errorf("preallocate size %d exceeds max size %d for file %s:%s", size, file.Opts.MaxSize, zoneId, name)
+		}
+		if size <= file.Size {
+			return file.Version, nil
+		}
+		file.Size = size
+		file.ModTs = time.Now().UnixMilli()
+		file.Version++
+		return file.Version, nil
 	})
 }
 
@@ -314,45 +1454,79 @@ func (s *FileStore) compactIJson(ctx context.Context, entry *CacheEntry) error {
 	return nil
 }
 
-func (s *FileStore) CompactIJson(ctx context.Context, zoneId string, name string) error {
-	return withLock(s, zoneId, name, func(entry *CacheEntry) error {
-		err := entry.loadFileIntoCache(ctx)
+// returns the new version of the file
+func (s *FileStore) CompactIJson(ctx context.Context, zoneId string, name string) (int64, error) {
+	if err := s.checkWrite(zoneId, name); err != nil {
+		return 0, err
+	}
+	s.flushPrerequisitesForWrite(ctx, zoneId, name)
+	return withLockRtn(s, zoneId, name, func(entry *CacheEntry) (int64, error) {
+		err := entry.loadFileForWrite(ctx)
 		if err != nil {
-			return err
+			return 0, err
 		}
 		if !entry.File.Opts.IJson {
-			return fmt.Errorf("file %s:%s is not an ijson file", zoneId, name)
+			return 0, fmt.Errorf("file %s:%s is not an ijson file", zoneId, name)
 		}
-		return s.compactIJson(ctx, entry)
+		err = s.compactIJson(ctx, entry)
+		if err != nil {
+			return 0, err
+		}
+		version := entry.File.Version
+		entry.writeThrough(ctx)
+		return version, nil
 	})
 }
 
-func (s *FileStore) AppendIJson(ctx context.Context, zoneId string, name string, command map[string]any) error {
+// returns the new version of the file
+func (s *FileStore) AppendIJson(ctx context.Context, zoneId string, name string, command map[string]any) (int64, error) {
+	if err := s.checkWrite(zoneId, name); err != nil {
+		return 0, err
+	}
 	data, err := ijson.ValidateAndMarshalCommand(command)
 	if err != nil {
-		return err
+		return 0, err
 	}
-	return withLock(s, zoneId, name, func(entry *CacheEntry) error {
-		err := entry.loadFileIntoCache(ctx)
+	if err := s.waitForLowWater(ctx); err != nil {
+		return 0, err
+	}
+	s.flushPrerequisitesForWrite(ctx, zoneId, name)
+	return retryOnOverflow(ctx, func() (int64, error) {
+		return s.appendIJson(ctx, zoneId, name, data)
+	})
+}
+
+func (s *FileStore) appendIJson(ctx context.Context, zoneId string, name string, data []byte) (int64, error) {
+	return withLockRtn(s, zoneId, name, func(entry *CacheEntry) (int64, error) {
+		err := entry.loadFileForWrite(ctx)
 		if err != nil {
-			return err
+			return 0, err
 		}
 		if !entry.File.Opts.IJson {
-			return fmt.Errorf("file %s:%s is not an ijson file", zoneId, name)
+			return 0, fmt.Errorf("file %s:%s is not an ijson file", zoneId, name)
+		}
+		err = entry.checkOverflow(entry.File.Size + int64(len(data)) + 1)
+		if err != nil {
+			return 0, err
 		}
 		partMap := entry.File.computePartMap(entry.File.Size, int64(len(data)))
+		err = entry.File.checkPartMap(partMap)
+		if err != nil {
+			return 0, err
+		}
 		incompleteParts := incompletePartsFromMap(partMap)
 		if len(incompleteParts) > 0 {
 			err = entry.loadDataPartsIntoCache(ctx, incompleteParts)
 			if err != nil {
-				return err
+				return 0, err
 			}
 		}
 		oldSize := entry.File.Size
-		entry.writeAt(entry.File.Size, data, false)
-		entry.writeAt(entry.File.Size, []byte("\n"), false)
+		entry.writeAt(entry.File.Size, append(data, '\n'), false)
+		// write-through (NoDataCache) happens after the compaction check below
+		defer entry.writeThrough(ctx)
 		if oldSize == 0 {
-			return nil
+			return entry.File.Version, nil
 		}
 		// check if we should compact
 		numCmds := metaIncrement(entry.File, IJsonNumCommands, 1)
@@ -361,10 +1535,10 @@ func (s *FileStore) AppendIJson(ctx context.Context, zoneId string, name string,
 		if numCmds > IJsonHighCommands || incRatio >= IJsonHighRatio || (numCmds > IJsonLowCommands && incRatio >= IJsonLowRatio) {
 			err := s.compactIJson(ctx, entry)
 			if err != nil {
-				return err
+				return 0, err
 			}
 		}
-		return nil
+		return entry.File.Version, nil
 	})
 }
 
@@ -374,7 +1548,11 @@ func (s *FileStore) GetAllZoneIds(ctx context.Context) ([]string, error) {
 
 // returns (offset, data, error)
 // we return the offset because the offset may have been adjusted if the size was too big (for circular files)
+// reads never populate the cache: parts that aren't dirty are read straight from the DB into the returned buffer.
 func (s *FileStore) ReadAt(ctx context.Context, zoneId string, name string, offset int64, size int64) (rtnOffset int64, rtnData []byte, rtnErr error) {
+	if err := s.checkRead(zoneId, name); err != nil {
+		return 0, nil, err
+	}
 	withLock(s, zoneId, name, func(entry *CacheEntry) error {
 		rtnOffset, rtnData, rtnErr = entry.readAt(ctx, offset, size, false)
 		return nil
@@ -382,8 +1560,99 @@ func (s *FileStore) ReadAt(ctx context.Context, zoneId string, name string, offs
 	return
 }
 
+type ReadOpts struct {
+	// never load from the DB, return ErrNotCached if the file or any requested part is not in the cache.
+	// note that sparse (never written) parts are never resident, so they also return ErrNotCached.
+	CacheOnly bool
+
+	// what happens when the requested range extends past the end of the file (see the PastEOF consts).
+	// ignored by ReadFile, which always reads up to the end.
+	PastEOF int
+
+	// fail with ErrEvicted when a circular file read starts before the oldest retained byte (see
+	// RetainedRange), instead of moving the read forward to the retained data
+	FailEvicted bool
+}
+
+// PastEOF read options.  for circular files the end of the file is the logical end (Size), like regular
+// files: the option only applies there.  a read that starts before the oldest retained byte is still
+// moved forward (see the returned offset) under every option, unless FailEvicted is set.
+const (
+	PastEOFShort = 0 // return only the data that exists (a short read, possibly empty)
+	PastEOFError = 1 // fail with an error wrapping io.EOF (nothing is returned)
+	PastEOFZero  = 2 // pad the returned data with zeros up to the requested size
+)
+
+// same as ReadAt, but with read options (the zero value of ReadOpts gives the same behavior as ReadAt)
+func (s *FileStore) ReadAtWithOpts(ctx context.Context, zoneId string, name string, offset int64, size int64, opts ReadOpts) (rtnOffset int64, rtnData []byte, rtnErr error) {
+	if err := s.checkRead(zoneId, name); err != nil {
+		return 0, nil, err
+	}
+	withLock(s, zoneId, name, func(entry *CacheEntry) error {
+		rtnOffset, rtnData, rtnErr = entry.readAtWithOpts(ctx, offset, size, false, opts, nil)
+		return nil
+	})
+	return
+}
+
+// same as ReadAt, but also returns the version of the file the data was read from.  the version is taken
+// under the same entry lock as the read, so no write can land in between: the data is exactly what that
+// version holds, and a client caching it can tell it is stale once StatVersion (or the version returned by
+// a write) differs.
+func (s *FileStore) ReadAtWithVersion(ctx context.Context, zoneId string, name string, offset int64, size int64) (rtnOffset int64, rtnData []byte, version int64, rtnErr error) {
+	if err := s.checkRead(zoneId, name); err != nil {
+		return 0, nil, 0, err
+	}
+	withLock(s, zoneId, name, func(entry *CacheEntry) error {
+		file, err := entry.loadFileForRead(ctx)
+		if err != nil {
+			rtnErr = err
+			return nil
+		}
+		version = file.Version
+		rtnOffset, rtnData, rtnErr = entry.readAt(ctx, offset, size, false)
+		if rtnErr != nil {
+			version = 0
+		}
+		return nil
+	})
+	return
+}
+
+// reads len(buf) bytes at offset into buf (like io.ReaderAt), so a caller can reuse one buffer across
+// reads.  returns the number of bytes read, which is less than len(buf) only with a non-nil error: a read
+// that runs past the end of the file returns the bytes up to the end and io.EOF.  the zero value of
+// ReadOpts gives this behavior, see ReadIntoWithOpts for the other PastEOF options.
+// data is never placed anywhere but at offset, so reading a circular file before its oldest retained
+// byte fails with ErrEvicted (as if ReadOpts.FailEvicted were set) instead of moving the read forward.
+func (s *FileStore) ReadInto(ctx context.Context, zoneId string, name string, offset int64, buf []byte) (int, error) {
+	return s.ReadIntoWithOpts(ctx, zoneId, name, offset, buf, ReadOpts{})
+}
+
+// same as ReadInto, but with read options.  PastEOFError fails (n == 0) with an error wrapping io.EOF, and
+// PastEOFZero fills the rest of buf with zeros (n == len(buf), no error).
+func (s *FileStore) ReadIntoWithOpts(ctx context.Context, zoneId string, name string, offset int64, buf []byte, opts ReadOpts) (int, error) {
+	if err := s.checkRead(zoneId, name); err != nil {
+		return 0, err
+	}
+	opts.FailEvicted = true
+	return withLockRtn(s, zoneId, name, func(entry *CacheEntry) (int, error) {
+		_, data, err := entry.readAtWithOpts(ctx, offset, int64(len(buf)), false, opts, buf)
+		if err != nil {
+			return 0, err
+		}
+		if len(data) < len(buf) {
+			return len(data), io.EOF
+		}
+		return len(data), nil
+	})
+}
+
 // returns (offset, data, error)
 func (s *FileStore) ReadFile(ctx context.Context, zoneId string, name string) (rtnOffset int64, rtnData []byte, rtnErr error) {
+	if err := s.checkRead(zoneId, name); err != nil {
+		return 0, nil, err
+	}
 	withLock(s, zoneId, name, func(entry *CacheEntry) error {
 		rtnOffset, rtnData, rtnErr = entry.readAt(ctx, 0, 0, true)
 		return nil
@@ -391,13 +1660,155 @@ func (s *FileStore) ReadFile(ctx context.Context, zoneId string, name string) (r
 	return
 }
 
+// returns (offset, data, error) for the first n bytes of the file (fewer if the file is smaller)
+// for circular files the read starts at the oldest retained byte (DataStartIdx), the same window start used by Tail
+func (s *FileStore) Head(ctx context.Context, zoneId string, name string, n int64) (rtnOffset int64, rtnData []byte, rtnErr error) {
+	if err := s.checkRead(zoneId, name); err != nil {
+		return 0, nil, err
+	}
+	if n < 0 {
+		return 0, nil, fmt.Errorf("head size must be non-negative")
+	}
+	withLock(s, zoneId, name, func(entry *CacheEntry) error {
+		file, err := entry.loadFileForRead(ctx)
+		if err != nil {
+			rtnErr = err
+			return nil
+		}
+		rtnOffset, rtnData, rtnErr = entry.readAt(ctx, file.DataStartIdx(), minInt64(n, file.DataLength()), false)
+		return nil
+	})
+	return
+}
+
+// returns (offset, data, error) for the last n bytes of the file (fewer if the file is smaller)
+// for circular files the read never reaches before the oldest retained byte (see DataStartIdx)
+// the read is a snapshot under the entry lock: a concurrent append is either fully included or not at all
+func (s *FileStore) Tail(ctx context.Context, zoneId string, name string, n int64) (rtnOffset int64, rtnData []byte, rtnErr error) {
+	if err := s.checkRead(zoneId, name); err != nil {
+		return 0, nil, err
+	}
+	if n < 0 {
+		return 0, nil, fmt.Errorf("tail size must be non-negative")
+	}
+	withLock(s, zoneId, name, func(entry *CacheEntry) error {
+		file, err := entry.loadFileForRead(ctx)
+		if err != nil {
+			rtnErr = err
+			return nil
+		}
+		offset := maxInt64(file.DataStartIdx(), file.Size-n)
+		rtnOffset, rtnData, rtnErr = entry.readAt(ctx, offset, file.Size-offset, false)
+		return nil
+	})
+	return
+}
+
+// returns (offset, data, error) for the size bytes ending at endOffset, for readers that page backward from
+// the end of a file (pass the returned offset as the next endOffset).  endOffset past the end of the file is
+// clamped to the end, and the read never reaches before the start of the file: the returned offset is where
+// the data actually starts, and the data is short if the start was hit (empty once the reader is there).
+// for circular files the start is the oldest retained byte (see RetainedRange), and an endOffset before it
+// (the data was overwritten since the reader got that offset) fails with ErrEvicted.
+func (s *FileStore) ReadReverse(ctx context.Context, zoneId string, name string, endOffset int64, size int64) (rtnOffset int64, rtnData []byte, rtnErr error) {
+	if err := s.checkRead(zoneId, name); err != nil {
+		return 0, nil, err
+	}
+	if endOffset < 0 || size < 0 {
+		return 0, nil, fmt.Errorf("end offset and size must be non-negative")
+	}
+	withLock(s, zoneId, name, func(entry *CacheEntry) error {
+		file, err := entry.loadFileForRead(ctx)
+		if err != nil {
+			rtnErr = err
+			return nil
+		}
+		startIdx := file.DataStartIdx()
+		endOffset = minInt64(endOffset, file.Size)
+		if endOffset < startIdx {
+			rtnErr = fmt.Errorf("%w: %s:%s end offset %d is before the oldest retained byte %d", ErrEvicted, zoneId, name, endOffset, startIdx)
+			return nil
+		}
+		offset := maxInt64(startIdx, endOffset-size)
+		rtnOffset, rtnData, rtnErr = entry.readAt(ctx, offset, endOffset-offset, false)
+		return nil
+	})
+	return
+}
+
 type FlushStats struct {
 	FlushDuration   time.Duration
 	NumDirtyEntries int
 	NumCommitted    int
+	NumDeferred     int // dirty entries skipped because of FlushRateLimit (background flusher only)
+	NumBlocked      int // dirty entries skipped because a flush prerequisite was still dirty (see SetFlushDependency)
+	NumNotDue       int // dirty entries held back until their jittered deadline (background flusher only, see FlushJitter)
+	NumDeleted      int // pending deletes applied (see BatchDeletes)
+}
+
+type CacheStats struct {
+	NumEntries      int   `json:"numentries"`      // resident cache entries
+	ResidentBytes   int64 `json:"residentbytes"`   // resident (dirty) part data
+	FlushesDeferred int64 `json:"flushesdeferred"` // total entry flushes deferred by FlushRateLimit
+	Throttled       bool  `json:"throttled"`       // the last background flush deferred at least one entry
+
+	Breaker         string `json:"breaker"`         // backend circuit breaker state (see the Breaker consts)
+	BackendFailures int    `json:"backendfailures"` // consecutive backend failures counted by the breaker
+
+	BudgetOverruns int64 `json:"budgetoverruns"` // times unflushable data pushed the cache over its limits (see MemoryPressure)
+}
+
+func (s *FileStore) CacheStats() CacheStats {
+	s.lock()
+	defer s.Lock.Unlock()
+	return CacheStats{
+		NumEntries:      len(s.Cache),
+		ResidentBytes:   s.ResidentBytes,
+		FlushesDeferred: s.flushesDeferred,
+		Throttled:       s.flushThrottled,
+		Breaker:         s.breakerState(),
+		BackendFailures: s.breaker.failures,
+		BudgetOverruns:  s.budgetOverruns,
+	}
+}
+
+// a resident part of a cached file.  parts have no dirty flag of their own: a part is only resident
+// while its file is dirty, and the whole file is flushed together, so every resident part is dirty
+// and shares the file's DirtyTs.
+type PartStatus struct {
+	PartIdx int   `json:"partidx"`
+	Length  int   `json:"length"`  // end of the written data in the part (holes inside it read as zero)
+	DirtyTs int64 `json:"dirtyts"` // when the file became dirty (unix millis)
+}
+
+// returns the parts of the file resident in the cache (sorted by PartIdx), for debugging flush behavior.
+// never loads from the DB, a clean or missing file has no resident parts.
+func (s *FileStore) PartStatus(zoneId string, name string) ([]PartStatus, error) {
+	if err := s.checkRead(zoneId, name); err != nil {
+		return nil, err
+	}
+	return withLockRtn(s, zoneId, name, func(entry *CacheEntry) ([]PartStatus, error) {
+		var parts []PartStatus
+		for partIdx, dce := range entry.DataEntries {
+			parts = append(parts, PartStatus{PartIdx: partIdx, Length: len(dce.Data), DirtyTs: entry.DirtyTs})
+		}
+		sort.Slice(parts, func(i, j int) bool {
+			return parts[i].PartIdx < parts[j].PartIdx
+		})
+		return parts, nil
+	})
 }
 
+// flushes every dirty entry (explicit flushes are never rate limited)
 func (s *FileStore) FlushCache(ctx context.Context) (stats FlushStats, rtnErr error) {
+	return s.flushCache(ctx, false)
+}
+
+// rateLimited is set by the background flusher: each entry flush takes a token from the FlushRateLimit
+// bucket.  entries that don't get a token are deferred to the next pass, unless they have been dirty for
+// DefaultFlushTime (the max-staleness bound), those are always flushed.  with FlushJitter, entries whose
+// own deadline is still ahead are held back too (see flushSchedule).
+func (s *FileStore) flushCache(ctx context.Context, rateLimited bool) (stats FlushStats, rtnErr error) {
 	wasFlushing := s.setUnlessFlushing()
 	if wasFlushing {
 		return stats, fmt.Errorf("flush already in progress")
@@ -408,25 +1819,308 @@ func (s *FileStore) FlushCache(ctx context.Context) (stats FlushStats, rtnErr er
 		stats.FlushDuration = time.Since(startTime)
 	}()
 
-	// get a copy of dirty keys so we can iterate without the lock
-	dirtyCacheKeys := s.getDirtyCacheKeys()
-	stats.NumDirtyEntries = len(dirtyCacheKeys)
-	for _, key := range dirtyCacheKeys {
+	numDeleted, err := s.flushQueuedDeletes(ctx)
+	stats.NumDeleted = numDeleted
+	if err != nil {
+		return stats, err
+	}
+	var sched *flushSchedule
+	if rateLimited {
+		sched = s.makeFlushSchedule()
+		defer s.setFlushNextDue(sched)
+	}
+	// get a copy of the resident keys so we can iterate without the lock
+	// (entry.File can only be checked under the entry lock, so dirtiness is checked in the loop)
+	cacheKeys := s.getCacheKeys()
+	if s.FlushBatchSize > 0 {
+		err := s.flushCacheBatched(ctx, rateLimited, sched, cacheKeys, &stats)
+		if rateLimited {
+			s.recordDeferredFlushes(stats.NumDeferred)
+		}
+		return stats, err
+	}
+	for _, key := range s.flushOrder(cacheKeys) {
+		var wasDirty, notDue, deferred bool
 		err := withLock(s, key.ZoneId, key.Name, func(entry *CacheEntry) error {
+			wasDirty = entry.File != nil
+			if wasDirty && sched.holdBack(key, entry.DirtyTs) {
+				notDue = true
+				return nil
+			}
+			if wasDirty && rateLimited {
+				isStale := time.Since(time.UnixMilli(entry.DirtyTs)) >= DefaultFlushTime
+				if !s.takeFlushToken(isStale) {
+					deferred = true
+					return nil
+				}
+			}
 			return entry.flushToDB(ctx, false)
 		})
+		if wasDirty {
+			stats.NumDirtyEntries++
+		}
+		if notDue {
+			stats.NumNotDue++
+			continue
+		}
+		if deferred {
+			stats.NumDeferred++
+			continue
+		}
 		if ctx.Err() != nil {
 			// transient error (also must stop the loop)
 			return stats, ctx.Err()
 		}
+		if errors.Is(err, ErrFlushBlocked) {
+			stats.NumBlocked++
+			continue
+		}
+		if errors.Is(err, ErrBackendUnavailable) {
+			// the breaker logged when it opened, no need to log every turned-away flush
+			return stats, err
+		}
 		if err != nil {
+			s.logf("filestore: error flushing %s:%s: %v\n", key.ZoneId, key.Name, err)
 			return stats, fmt.Errorf("error flushing cache entry[%v]: %v", key, err)
 		}
-		stats.NumCommitted++
+		if wasDirty {
+			stats.NumCommitted++
+		}
+	}
+	if rateLimited {
+		s.recordDeferredFlushes(stats.NumDeferred)
 	}
 	return stats, nil
 }
 
+// FlushBatchSize mode: dirty files are written together, one transaction per batch of about FlushBatchSize parts.
+// a file is never split across batches (a file with more parts than the batch size gets its own batch), so each
+// file's flush is still atomic, and a file's dirty state is always flushed in one piece.  every entry in a batch
+// stays locked until the batch commits, so writers to those files wait for the whole batch.  if a batch fails
+// it is rolled back (all of its files are still dirty) and each file is retried on its own, so one bad file
+// can't hold back the others and gets the usual per-file error handling.
+func (s *FileStore) flushCacheBatched(ctx context.Context, rateLimited bool, sched *flushSchedule, cacheKeys []cacheKey, stats *FlushStats) error {
+	// entry locks are taken in (zoneid, name) order, the same order SwapFiles uses
+	sort.Slice(cacheKeys, func(i, j int) bool {
+		if cacheKeys[i].ZoneId != cacheKeys[j].ZoneId {
+			return cacheKeys[i].ZoneId < cacheKeys[j].ZoneId
+		}
+		return cacheKeys[i].Name < cacheKeys[j].Name
+	})
+	var batch []*CacheEntry
+	var batchKeys map[cacheKey]bool
+	var unlockFns []func()
+	var batchParts int
+	var inBatch bool
+	var blockedKeys []cacheKey // dependents whose prerequisites weren't flushed yet, retried at the end
+	flushBatch := func() error {
+		defer func() {
+			for _, unlockFn := range unlockFns {
+				unlockFn()
+			}
+			s.quiesceLock.RUnlock()
+			batch, batchKeys, unlockFns, batchParts, inBatch = nil, nil, nil, 0, false
+		}()
+		if len(batch) == 0 {
+			return nil
+		}
+		_, err := withBreaker(s, ctx, func() (struct{}, error) {
+			return struct{}{}, WithTx(ctx, func(tx *TxWrap) error {
+				for _, entry := range batch {
+					err := entry.writeToDB(tx.Context(), entry.DataEntries, false)
+					if err != nil {
+						return fmt.Errorf("error flushing %s:%s: %w", entry.ZoneId, entry.Name, err)
+					}
+				}
+				return nil
+			})
+		})
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if errors.Is(err, ErrBackendUnavailable) {
+			// retrying file by file would just fail fast for each of them
+			return err
+		}
+		if err == nil {
+			for _, entry := range batch {
+				s.recordPartsFlushed(len(entry.DataEntries))
+				entry.resolveFlushWaiters(nil)
+				entry.clear()
+			}
+			stats.NumCommitted += len(batch)
+			return nil
+		}
+		s.logf("filestore: error flushing batch of %d files, retrying one at a time: %v\n", len(batch), err)
+		var firstErr error
+		entries := make(map[cacheKey]*CacheEntry, len(batch))
+		keys := make([]cacheKey, 0, len(batch))
+		for _, entry := range batch {
+			key := cacheKey{ZoneId: entry.ZoneId, Name: entry.Name}
+			entries[key] = entry
+			keys = append(keys, key)
+		}
+		for _, key := range s.flushOrder(keys) {
+			entry := entries[key]
+			err := entry.flushToDB(ctx, false)
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if errors.Is(err, ErrFlushBlocked) {
+				stats.NumBlocked++
+				continue
+			}
+			if err != nil {
+				s.logf("filestore: error flushing %s:%s: %v\n", entry.ZoneId, entry.Name, err)
+				if firstErr == nil {
+					firstErr = fmt.Errorf("error flushing cache entry[%s:%s]: %v", entry.ZoneId, entry.Name, err)
+				}
+				continue
+			}
+			stats.NumCommitted++
+		}
+		return firstErr
+	}
+	for _, key := range cacheKeys {
+		if !inBatch {
+			// held per batch (not for the whole flush) so SnapshotAll can get in between batches
+			s.quiesceLock.RLock()
+			inBatch = true
+		}
+		entry, unlockFn := s.lockEntry(key.ZoneId, key.Name)
+		if entry.File == nil {
+			unlockFn()
+			continue
+		}
+		stats.NumDirtyEntries++
+		if sched.holdBack(key, entry.DirtyTs) {
+			stats.NumNotDue++
+			unlockFn()
+			continue
+		}
+		if s.hasDirtyPrerequisite(key, batchKeys) {
+			blockedKeys = append(blockedKeys, key)
+			unlockFn()
+			continue
+		}
+		isStale := time.Since(time.UnixMilli(entry.DirtyTs)) >= DefaultFlushTime
+		if rateLimited && !s.takeFlushToken(isStale) {
+			stats.NumDeferred++
+			unlockFn()
+			continue
+		}
+		batch = append(batch, entry)
+		if batchKeys == nil {
+			batchKeys = make(map[cacheKey]bool)
+		}
+		batchKeys[key] = true
+		unlockFns = append(unlockFns, unlockFn)
+		// a file with no dirty parts still has its file row written
+		batchParts += max(len(entry.DataEntries), 1)
+		if batchParts >= s.FlushBatchSize {
+			err := flushBatch()
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if inBatch {
+		err := flushBatch()
+		if err != nil {
+			return err
+		}
+	}
+	// prerequisites that sort after their dependents have been flushed by now
+	for _, key := range s.flushOrder(blockedKeys) {
+		err := withLock(s, key.ZoneId, key.Name, func(entry *CacheEntry) error {
+			return entry.flushToDB(ctx, false)
+		})
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if errors.Is(err, ErrFlushBlocked) {
+			stats.NumBlocked++
+			continue
+		}
+		if err != nil {
+			s.logf("filestore: error flushing %s:%s: %v\n", key.ZoneId, key.Name, err)
+			return fmt.Errorf("error flushing cache entry[%v]: %v", key, err)
+		}
+		stats.NumCommitted++
+	}
+	return nil
+}
+
+// flushes any dirty state for the file and then drops it from the cache (persisted data is untouched).
+// this is a no-op if the file is not resident.  if the flush fails the entry stays resident.
+// dirty files are passed to OnDirtyEvict (if set) first, which can refuse the eviction.
+// an entry that is pinned by a concurrent operation is flushed, but only leaves the cache map
+// once its last pin is released.
+func (s *FileStore) Evict(ctx context.Context, zoneId string, name string) error {
+	if !s.isResident(zoneId, name) {
+		return nil
+	}
+	if s.OnDirtyEvict != nil {
+		isDirty, _ := withLockRtn(s, zoneId, name, func(entry *CacheEntry) (bool, error) {
+			return entry.File != nil, nil
+		})
+		if isDirty {
+			// called with no locks held, the hook may call back into the store
+			err := s.OnDirtyEvict(ctx, zoneId, name)
+			if err != nil {
+				return fmt.Errorf("eviction refused: %w", err)
+			}
+		}
+	}
+	_, err := withPrerequisitesLocked(ctx, s, []cacheKey{{ZoneId: zoneId, Name: name}}, func(entries []*CacheEntry) (struct{}, error) {
+		return struct{}{}, entries[0].flushToDB(ctx, false)
+	})
+	return err
+}
+
+// persists only the dirty parts in [partStart, partEnd) along with the file metadata (size, meta, etc.),
+// leaving other dirty parts for the background flusher.  part indexes are physical (they wrap for
+// circular files, see partIdxAtOffset).  if no other parts are dirty this is a full flush of the entry.
+// dirty flush prerequisites are flushed in full first.  WriteAtAsync futures only resolve on a full flush.
+func (s *FileStore) FlushRange(ctx context.Context, zoneId string, name string, partStart int, partEnd int) error {
+	if partStart < 0 || partEnd < partStart {
+		return fmt.Errorf("invalid part range [%d, %d)", partStart, partEnd)
+	}
+	_, err := withPrerequisitesLocked(ctx, s, []cacheKey{{ZoneId: zoneId, Name: name}}, func(entries []*CacheEntry) (struct{}, error) {
+		entry := entries[0]
+		if entry.File == nil {
+			// nothing dirty
+			return struct{}{}, nil
+		}
+		rangeEntries := make(map[int]*DataCacheEntry)
+		for partIdx, dce := range entry.DataEntries {
+			if partIdx >= partStart && partIdx < partEnd {
+				rangeEntries[partIdx] = dce
+			}
+		}
+		if len(rangeEntries) == len(entry.DataEntries) {
+			return struct{}{}, entry.flushToDB(ctx, false)
+		}
+		if s.hasDirtyPrerequisite(cacheKey{ZoneId: zoneId, Name: name}, nil) {
+			return struct{}{}, ErrFlushBlocked
+		}
+		_, err := withBreaker(s, ctx, func() (struct{}, error) {
+			return struct{}{}, entry.writeToDB(ctx, rangeEntries, false)
+		})
+		if err != nil {
+			return struct{}{}, fmt.Errorf("error flushing part range: %w", err)
+		}
+		s.recordPartsFlushed(len(rangeEntries))
+		// the truncate delete ran in the same transaction, running it again would drop the parts just written
+		entry.truncatePartIdx = -1
+		for partIdx := range rangeEntries {
+			delete(entry.DataEntries, partIdx)
+		}
+		return struct{}{}, nil
+	})
+	return err
+}
+
 ///////////////////////////////////
 
 func (f *WaveFile) partIdxAtOffset(offset int64) int {
@@ -456,6 +2150,21 @@ func getPartIdxsFromMap(partMap map[int]int) []int {
 	return partIdxs
 }
 
+// guards the circular path: every part a write touches must be inside the ring ([0, maxPart)), so a bad
+// offset or part computation fails the write instead of creating parts the ring never reads or flushes over
+func (file *WaveFile) checkPartMap(partMap map[int]int) error {
+	if !file.Opts.Circular {
+		return nil
+	}
+	maxPart := int(file.Opts.MaxSize / partDataSize)
+	for partIdx := range partMap {
+		if partIdx < 0 || partIdx >= maxPart {
+			return fmt.Errorf("circular file %s:%s: part %d is outside the ring [0, %d)", file.ZoneId, file.Name, partIdx, maxPart)
+		}
+	}
+	return nil
+}
+
 // returns a map of partIdx to amount of data to write to that part
 func (file *WaveFile) computePartMap(startOffset int64, size int64) map[int]int {
 	partMap := make(map[int]int)
@@ -478,27 +2187,73 @@ func (file *WaveFile) computePartMap(startOffset int64, size int64) map[int]int
 	return partMap
 }
 
-func (s *FileStore) getDirtyCacheKeys() []cacheKey {
-	s.Lock.Lock()
+func (s *FileStore) getCacheKeys() []cacheKey {
+	s.lock()
 	defer s.Lock.Unlock()
-	var dirtyCacheKeys []cacheKey
-	for key, entry := range s.Cache {
-		if entry.File != nil {
-			dirtyCacheKeys = append(dirtyCacheKeys, key)
+	var cacheKeys []cacheKey
+	for key := range s.Cache {
+		cacheKeys = append(cacheKeys, key)
+	}
+	return cacheKeys
+}
+
+func (s *FileStore) getResidentZoneKeys(zoneId string) []cacheKey {
+	s.lock()
+	defer s.Lock.Unlock()
+	var keys []cacheKey
+	for key := range s.Cache {
+		if key.ZoneId == zoneId {
+			keys = append(keys, key)
 		}
 	}
-	return dirtyCacheKeys
+	return keys
+}
+
+func (s *FileStore) isResident(zoneId string, name string) bool {
+	s.lock()
+	defer s.Lock.Unlock()
+	return s.Cache[cacheKey{ZoneId: zoneId, Name: name}] != nil
+}
+
+// token bucket for FlushRateLimit (burst is one second's worth of tokens, at least 1).
+// force always takes a token (going negative), so overdue flushes still count against the rate.
+func (s *FileStore) takeFlushToken(force bool) bool {
+	s.lock()
+	defer s.Lock.Unlock()
+	if s.FlushRateLimit <= 0 {
+		return true
+	}
+	burst := math.Max(1, s.FlushRateLimit)
+	now := time.Now()
+	if s.flushTokensTs.IsZero() {
+		s.flushTokens = burst
+	} else {
+		s.flushTokens = math.Min(burst, s.flushTokens+now.Sub(s.flushTokensTs).Seconds()*s.FlushRateLimit)
+	}
+	s.flushTokensTs = now
+	if s.flushTokens < 1 && !force {
+		return false
+	}
+	s.flushTokens--
+	return true
+}
+
+func (s *FileStore) recordDeferredFlushes(numDeferred int) {
+	s.lock()
+	defer s.Lock.Unlock()
+	s.flushesDeferred += int64(numDeferred)
+	s.flushThrottled = numDeferred > 0
 }
 
 func (s *FileStore) setIsFlushing(flushing bool) {
-	s.Lock.Lock()
+	s.lock()
 	defer s.Lock.Unlock()
 	s.IsFlushing = flushing
 }
 
 // returns old value of IsFlushing
 func (s *FileStore) setUnlessFlushing() bool {
-	s.Lock.Lock()
+	s.lock()
 	defer s.Lock.Unlock()
 	if s.IsFlushing {
 		return true
@@ -510,27 +2265,275 @@ func (s *FileStore) setUnlessFlushing() bool {
 func (s *FileStore) runFlushWithNewContext() (FlushStats, error) {
 	ctx, cancelFn := context.WithTimeout(context.Background(), DefaultFlushTime)
 	defer cancelFn()
-	return s.FlushCache(ctx)
+	return s.flushCache(ctx, true)
+}
+
+func (s *FileStore) runReapWithNewContext() (int, error) {
+	ctx, cancelFn := context.WithTimeout(context.Background(), DefaultFlushTime)
+	defer cancelFn()
+	return s.reapDeletedFiles(ctx)
 }
 
 func (s *FileStore) runFlusher() {
 	defer panichandler.PanicHandler("filestore flusher")
 	for {
-		stats, err := s.runFlushWithNewContext()
-		if err != nil || stats.NumDirtyEntries > 0 {
-			log.Printf("filestore flush: %d/%d entries flushed, err:%v\n", stats.NumCommitted, stats.NumDirtyEntries, err)
+		if s.flusherSweepDue() {
+			s.sampleDirtyRate(time.Now())
+			stats, err := s.runFlushWithNewContext()
+			if err != nil || stats.NumDirtyEntries > 0 || stats.NumDeleted > 0 {
+				s.logf("filestore flush: %d/%d entries flushed (%d deferred, %d not due), %d deletes, err:%v\n", stats.NumCommitted, stats.NumDirtyEntries, stats.NumDeferred, stats.NumNotDue, stats.NumDeleted, err)
+			}
+			s.degradeBudget(err != nil || stats.NumBlocked > 0)
+			numReaped, err := s.runReapWithNewContext()
+			if err != nil || numReaped > 0 {
+				s.logf("filestore reap: %d deleted files removed, err:%v\n", numReaped, err)
+			}
 		}
 		if stopFlush.Load() {
 			log.Printf("filestore flusher stopping\n")
 			return
 		}
-		time.Sleep(DefaultFlushTime)
+		s.flusherSleep(s.nextFlushDelay())
 	}
 }
 
+// stops the background flusher's timer-driven sweeps (e.g. to batch up a bulk import), until ResumeFlusher.
+// nothing is lost while paused: dirty data just stays resident, and explicit flushes (FlushCache, WriteFile,
+// Evict, FlushRange, ...) and NoDataCache write-through work as usual.  the flusher still sweeps while
+// writers are blocked at HighWater (it is the only thing that drains them), so pausing it never wedges
+// throttled writers, but without HighWater set nothing bounds the resident data while paused.
+// soft-deleted files aren't reaped while paused either.  pausing twice is a no-op.
+func (s *FileStore) PauseFlusher() {
+	s.lock()
+	defer s.Lock.Unlock()
+	s.flusherPaused = true
+}
+
+// resumes the sweeps stopped by PauseFlusher, starting with an immediate catch-up sweep (rather than
+// waiting out the rest of the flush interval).  a no-op if the flusher isn't paused.
+func (s *FileStore) ResumeFlusher() {
+	s.lock()
+	defer s.Lock.Unlock()
+	if !s.flusherPaused {
+		return
+	}
+	s.flusherPaused = false
+	s.wakeFlusher()
+}
+
+// true if the background flusher should sweep now: always, unless paused with no writers throttled
+func (s *FileStore) flusherSweepDue() bool {
+	s.lock()
+	defer s.Lock.Unlock()
+	return !s.flusherPaused || s.writeThrottled
+}
+
+// sleeps for delay, or until wakeFlusher is called
+func (s *FileStore) flusherSleep(delay time.Duration) {
+	s.lock()
+	if s.flusherWakeCh == nil {
+		s.flusherWakeCh = make(chan struct{})
+	}
+	wakeCh := s.flusherWakeCh
+	s.Lock.Unlock()
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-wakeCh:
+	}
+}
+
+// synchronized with Lock
+func (s *FileStore) wakeFlusher() {
+	if s.flusherWakeCh != nil {
+		close(s.flusherWakeCh)
+		s.flusherWakeCh = nil
+	}
+}
+
+// weight of the newest sample in dirtyRate (an exponential moving average)
+const dirtyRateSmoothing = 0.3
+
+// samples the write rate: the bytes written since the last sample over the time between samples.  this
+// counts writes, not resident bytes, so dirty data a pass couldn't flush (breaker open, rate limited,
+// blocked on a prerequisite) isn't counted again by the next sample.
+func (s *FileStore) sampleDirtyRate(now time.Time) {
+	numBytes := s.bytesWritten.Load()
+	s.lock()
+	defer s.Lock.Unlock()
+	if !s.lastSampleTs.IsZero() {
+		elapsed := now.Sub(s.lastSampleTs).Seconds()
+		if elapsed <= 0 {
+			// keep counting from the previous sample
+			return
+		}
+		sample := float64(numBytes-s.lastSampleBytes) / elapsed
+		s.dirtyRate += dirtyRateSmoothing * (sample - s.dirtyRate)
+	}
+	s.lastSampleTs = now
+	s.lastSampleBytes = numBytes
+}
+
+// the adaptive control function: interval = FlushTargetBytes / dirtyRate, clamped to
+// [FlushMinInterval, FlushMaxInterval].  it is driven by the write rate rather than by how much was
+// dirty at the last flush, which would feed back on itself (a shorter interval leaves less dirty data,
+// which lengthens the next interval, and so on).  the rate is smoothed so a single burst doesn't swing
+// the interval, and idle stores (no rate) flush at FlushMaxInterval.
+func (s *FileStore) baseFlushInterval() time.Duration {
+	maxInterval := s.FlushMaxInterval
+	if maxInterval <= 0 {
+		maxInterval = DefaultFlushTime
+	}
+	if s.FlushTargetBytes <= 0 {
+		return maxInterval
+	}
+	minInterval := min(max(s.FlushMinInterval, 0), maxInterval)
+	s.lock()
+	rate := s.dirtyRate
+	s.Lock.Unlock()
+	if rate <= 0 {
+		return maxInterval
+	}
+	secs := float64(s.FlushTargetBytes) / rate
+	if secs >= maxInterval.Seconds() {
+		return maxInterval
+	}
+	return max(time.Duration(secs*float64(time.Second)), minInterval)
+}
+
+// with FlushJitter each flush interval is drawn from [(1-FlushJitter)*interval, interval] where interval
+// is baseFlushInterval (this spreads out the passes of different stores), and the flusher wakes early for
+// the earliest deadline the last pass held back (see flushSchedule).  the jitter only ever shortens the
+// interval, so dirty data is still never older than FlushMaxInterval (DefaultFlushTime by default, plus
+// the flush itself) when the next flush starts.
+func (s *FileStore) nextFlushDelay() time.Duration {
+	interval := s.baseFlushInterval()
+	jitter := s.flushJitter()
+	if jitter <= 0 {
+		return interval
+	}
+	maxJitter := time.Duration(jitter * float64(interval))
+	delay := interval - time.Duration(s.randInt63n(int64(maxJitter)+1))
+	s.lock()
+	nextDue := s.flushNextDue
+	s.Lock.Unlock()
+	if nextDue > 0 {
+		delay = min(delay, max(time.Until(time.UnixMilli(nextDue)), 0))
+	}
+	return delay
+}
+
+// FlushJitter clamped to [0, 1]
+func (s *FileStore) flushJitter() float64 {
+	return min(max(s.FlushJitter, 0), 1)
+}
+
+// passes a deadline is rounded over, so files dirtied together take at most this many extra passes
+const flushScheduleSteps = 8
+
+// per-file flush deadlines for a background flush (FlushJitter only).  each file is due at
+// DirtyTs + interval - offset, where the offset is a hash of its key scaled to [0, FlushJitter*interval],
+// so files dirtied together are flushed spread out over the last FlushJitter of the interval instead of
+// in one pass.  a pass flushes the files due before the next step (FlushJitter*interval/flushScheduleSteps)
+// and the flusher wakes for the earliest one it held back, so no file is flushed after its deadline and
+// the max-staleness bound holds.  nil (every dirty file is due) without jitter, and while writes are
+// throttled (HighWater), when resident data has to be flushed right away.
+type flushSchedule struct {
+	store    *FileStore
+	interval time.Duration
+	cutoff   int64 // unix millis, files due after this are held back
+	nextDue  int64 // earliest deadline held back (0 = none)
+}
+
+func (s *FileStore) makeFlushSchedule() *flushSchedule {
+	jitter := s.flushJitter()
+	if jitter <= 0 {
+		return nil
+	}
+	s.lock()
+	throttled := s.writeThrottled
+	s.Lock.Unlock()
+	if throttled {
+		return nil
+	}
+	interval := s.baseFlushInterval()
+	step := time.Duration(jitter * float64(interval) / flushScheduleSteps)
+	return &flushSchedule{store: s, interval: interval, cutoff: time.Now().Add(step).UnixMilli()}
+}
+
+// true if the file isn't due yet (records its deadline).  files with flush dependencies are always due,
+// a per-file deadline could hold back a prerequisite while its dependent is due.  called with the entry
+// lock of key held.
+func (sched *flushSchedule) holdBack(key cacheKey, dirtyTs int64) bool {
+	if sched == nil {
+		return false
+	}
+	s := sched.store
+	s.lock()
+	hasDeps := s.hasFlushDeps(key)
+	s.Lock.Unlock()
+	if hasDeps {
+		return false
+	}
+	h := fnv.New64a()
+	h.Write([]byte(key.ZoneId))
+	h.Write([]byte{0})
+	h.Write([]byte(key.Name))
+	offset := float64(mix64(h.Sum64())>>11) / (1 << 53) * s.flushJitter() * float64(sched.interval)
+	dueTs := dirtyTs + (sched.interval - time.Duration(offset)).Milliseconds()
+	if dueTs <= sched.cutoff {
+		return false
+	}
+	if sched.nextDue == 0 || dueTs < sched.nextDue {
+		sched.nextDue = dueTs
+	}
+	return true
+}
+
+// splitmix64 finalizer, fnv alone barely changes the high bits for keys that differ in their last bytes
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+func (s *FileStore) setFlushNextDue(sched *flushSchedule) {
+	s.lock()
+	defer s.Lock.Unlock()
+	s.flushNextDue = 0
+	if sched != nil {
+		s.flushNextDue = sched.nextDue
+	}
+}
+
+// draws from RandSource if set (so tests can pin the sequence), otherwise from math/rand's global source
+func (s *FileStore) randInt63n(n int64) int64 {
+	if s.RandSource == nil {
+		return mathrand.Int63n(n)
+	}
+	// rand.Rand isn't safe for concurrent use
+	s.lock()
+	defer s.Lock.Unlock()
+	if s.rand == nil {
+		s.rand = mathrand.New(s.RandSource)
+	}
+	return s.rand.Int63n(n)
+}
+
 func minInt64(a, b int64) int64 {
 	if a < b {
 		return a
 	}
 	return b
 }
+
+func maxInt64(a, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
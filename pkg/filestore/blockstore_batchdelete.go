@@ -0,0 +1,42 @@
+// Copyright 2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package filestore
+
+import (
+	"context"
+	"fmt"
+)
+
+// BatchDeletes mode: DeleteFile only marks the file's row as deleted (a single UPDATE of its deletedts, the
+// cache side of the delete happens right away, under the entry lock, exactly as without the mode), and the
+// physical removal of the marked rows and their parts is applied in a single transaction by the next
+// FlushCache or background flush, so a bulk cleanup doesn't cost a row and part delete per file.  soft
+// deletes (DeleteRetention) are just the UPDATE in either mode, so there is nothing to batch for them.
+// only the removal is batched: each DeleteFile still costs one (small) transaction for its mark.
+//
+// the mark is in the DB before DeleteFile returns, so a marked file is never observable as a live file
+// (every query skips rows with a deletedts), not even after a crash: the pending removals are the marked rows
+// themselves, and the first flush after a restart applies them.  a MakeFile of the same name replaces the
+// marked row in its own transaction, the batch only ever removes rows that are still marked.
+
+// the deletedts of a file whose removal is pending (see BatchDeletes).  below every real deletion time, so
+// Undelete can't restore it and the reaper (see DeleteRetention) removes it too.
+const deletePendingTs = -1
+
+// removes every file marked by a BatchDeletes DeleteFile in one transaction, returns the number of files
+// removed
+func (s *FileStore) flushQueuedDeletes(ctx context.Context) (int, error) {
+	if !s.BatchDeletes {
+		return 0, nil
+	}
+	s.quiesceLock.RLock()
+	defer s.quiesceLock.RUnlock()
+	numDeleted, err := withBreaker(s, ctx, func() (int, error) {
+		return dbApplyPendingDeletes(ctx)
+	})
+	if err != nil {
+		return 0, fmt.Errorf("error applying queued deletes: %w", err)
+	}
+	return numDeleted, nil
+}
@@ -0,0 +1,136 @@
+// Copyright 2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package filestore
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"time"
+)
+
+// returned by DB loads and flushes while the backend circuit breaker is open (see BreakerThreshold)
+var ErrBackendUnavailable = errors.New("backend unavailable")
+
+const DefaultBreakerCooldown = 5 * time.Second
+
+// breaker states (see CacheStats)
+const (
+	BreakerClosed   = "closed"
+	BreakerOpen     = "open"
+	BreakerHalfOpen = "halfopen"
+)
+
+// backend circuit breaker, synchronized with FileStore.Lock.
+//
+// closed: everything goes to the DB, consecutive failures are counted.  after BreakerThreshold failures in
+// a row it opens: DB loads and flushes fail with ErrBackendUnavailable without touching the DB.  once the
+// cooldown has passed it is half-open: the next DB operation is let through as a probe (the others keep
+// failing fast), and the probe's result closes or re-opens it.
+//
+// only the cache's DB traffic goes through the breaker (file and part loads on a cache miss, and flushes),
+// so reads and writes of resident (dirty) files keep working while it is open.  a flush that is turned
+// away doesn't count towards the entry's FlushErrors, so an open breaker never makes dirty data get dropped.
+type backendBreaker struct {
+	failures  int       // consecutive backend failures
+	openUntil time.Time // zero while closed
+	probing   bool      // half-open and a probe is in flight
+}
+
+func (s *FileStore) breakerCooldown() time.Duration {
+	if s.BreakerCooldown <= 0 {
+		return DefaultBreakerCooldown
+	}
+	return s.BreakerCooldown
+}
+
+// returns ErrBackendUnavailable if the breaker is open (or half-open with a probe already in flight).
+// every nil return must be followed by breakerRecord.
+func (s *FileStore) breakerAllow() error {
+	if s.BreakerThreshold <= 0 {
+		return nil
+	}
+	s.lock()
+	defer s.Lock.Unlock()
+	b := &s.breaker
+	if b.openUntil.IsZero() {
+		return nil
+	}
+	if b.probing || time.Now().Before(b.openUntil) {
+		return ErrBackendUnavailable
+	}
+	b.probing = true
+	return nil
+}
+
+// same check as breakerAllow, but doesn't take the half-open probe.  for callers that must not change
+// anything when the operation they are about to do would be turned away.
+func (s *FileStore) breakerRejects() error {
+	if s.BreakerThreshold <= 0 {
+		return nil
+	}
+	s.lock()
+	defer s.Lock.Unlock()
+	b := &s.breaker
+	if b.openUntil.IsZero() {
+		return nil
+	}
+	if b.probing || time.Now().Before(b.openUntil) {
+		return ErrBackendUnavailable
+	}
+	return nil
+}
+
+// records the result of a DB operation let through by breakerAllow.  missing files are answers, not
+// backend failures, and an operation abandoned by its caller (ctx done) tells us nothing.
+func (s *FileStore) breakerRecord(ctx context.Context, err error) {
+	if s.BreakerThreshold <= 0 {
+		return
+	}
+	var tripped bool
+	var failures int
+	s.lock()
+	b := &s.breaker
+	b.probing = false
+	switch {
+	case err == nil || errors.Is(err, fs.ErrNotExist):
+		b.failures = 0
+		b.openUntil = time.Time{}
+	case ctx.Err() != nil:
+	default:
+		b.failures++
+		if b.failures >= s.BreakerThreshold {
+			tripped = b.openUntil.IsZero()
+			b.openUntil = time.Now().Add(s.breakerCooldown())
+		}
+		failures = b.failures
+	}
+	s.Lock.Unlock()
+	if tripped {
+		s.logf("filestore: backend failed %d times in a row, failing fast for %v: %v\n", failures, s.breakerCooldown(), err)
+	}
+}
+
+func withBreaker[T any](s *FileStore, ctx context.Context, fn func() (T, error)) (T, error) {
+	if err := s.breakerAllow(); err != nil {
+		var zero T
+		return zero, err
+	}
+	rtn, err := fn()
+	s.breakerRecord(ctx, err)
+	return rtn, err
+}
+
+// synchronized with Lock
+func (s *FileStore) breakerState() string {
+	b := &s.breaker
+	switch {
+	case b.openUntil.IsZero():
+		return BreakerClosed
+	case time.Now().Before(b.openUntil):
+		return BreakerOpen
+	default:
+		return BreakerHalfOpen
+	}
+}
@@ -5,10 +5,15 @@ package filestore
 
 import (
 	"bytes"
+	"container/heap"
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"io/fs"
+	mathrand "math/rand"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -21,23 +26,171 @@ type FileStore struct {
 	Lock       *sync.Mutex
 	Cache      map[cacheKey]*CacheEntry
 	IsFlushing bool
+	Logger     Logger     // optional, used to report anomalies (nil disables logging)
+	Authorizer Authorizer // optional, per-file access control (nil allows everything)
+	Dedup      bool       // store identical parts once in the DB (content-addressed + refcounted), costs a sha256 per flushed part
+	Compress   bool       // flate-compress non-deduplicated parts on flush (kept plain when that doesn't save space)
+
+	// optional, validate the zoneid and name of new files (see checkNewName), errors are wrapped in ErrInvalidName
+	NameValidator   func(name string) error
+	ZoneIdValidator func(zoneId string) error
+
+	// optional, computes the integrity checksum of MarshalFile/SnapshotAll blobs (nil = CRC32Checksummer)
+	Checksummer Checksummer
+
+	// UNSAFE, opt-in: Stat and ListFiles return the cache's live *WaveFile for dirty files instead of a
+	// DeepCopy.  the returned file (and its Meta map) is then shared with the store: any later write changes
+	// it under the caller, and a caller that modifies it corrupts the store (unflushed changes that never
+	// bump the version, or a data race on Meta).  only for embedded single-goroutine callers that never touch
+	// the store concurrently and never modify a returned file.  clean files are always fresh from the DB, so
+	// this only saves the copy for resident files.
+	UnsafeSharedFiles bool
+
+	CacheBudget   int64         // resident (dirty) part bytes allowed before WaitForBudget blocks (0 = unlimited)
+	HighWater     int64         // data writes block once ResidentBytes reaches this (0 = never), see waitForLowWater
+	LowWater      int64         // blocked writes resume once the flusher drains ResidentBytes to this
+	ResidentBytes int64         // synchronized with Lock, sum of CacheEntry.ResidentBytes
+	budgetCh      chan struct{} // closed (and replaced) when ResidentBytes shrinks, synchronized with Lock
+	spaceCh       chan struct{} // closed (and replaced) when any file shrinks, wakes OverflowBlock writers, synchronized with Lock
+	cleanCh       chan struct{} // closed (and replaced) when any entry becomes clean, wakes WaitClean, synchronized with Lock
+
+	LoadTimeout time.Duration   // max time for a single DB load on a cache miss, returns ErrBackendTimeout (0 = no timeout)
+	NoDataCache bool            // write-through mode, part data is flushed (and dropped) before each write returns
+	FlushJitter float64         // fraction of the flush interval (0-1) used to spread out flushes, per file and per pass (see flushSchedule)
+	RandSource  mathrand.Source // optional, used for all of the store's randomness (only flush jitter, nothing cryptographic), nil uses math/rand's global source
+
+	DeleteRetention time.Duration // if set, DeleteFile soft-deletes (recoverable with Undelete) and the flusher reaps after this window
+	FlushRateLimit  float64       // max entry flushes per second issued by the background flusher (0 = unlimited)
+	FlushBatchSize  int           // FlushCache writes dirty files together in transactions of about this many parts (0 = one transaction per file)
+	FairAppends     bool          // concurrent AppendData calls to the same file land in arrival order (FIFO), costs a store lock + broadcast per append
+	MeasureLockWait bool          // record time spent waiting to acquire Lock (see LockWaitStats), costs two timestamps per acquisition
+	BatchDeletes    bool          // only the physical removal is batched: DeleteFile still writes a delete mark per file, the next flush removes all marked files in one transaction (see deletePendingTs)
+
+	ThroughputWindow time.Duration                       // window Throughput averages over (0 = DefaultThroughputWindow, at most throughputBuckets seconds)
+	throughput       [throughputBuckets]throughputBucket // atomic, not synchronized with Lock
+	bytesWritten     atomic.Int64                        // running total of bytes written (to the cache), sampled by sampleDirtyRate
+
+	// adaptive flush interval (see baseFlushInterval), the background flusher aims to flush about
+	// FlushTargetBytes dirty bytes per pass, flushing more often (down to FlushMinInterval) under heavy writes.
+	// a FlushMaxInterval above DefaultFlushTime trades durability for fewer flushes: dirty data can then be
+	// up to FlushMaxInterval old (plus the flush itself) before the background flusher persists it.
+	FlushTargetBytes int64         // target dirty bytes per flush (0 = fixed interval)
+	FlushMinInterval time.Duration // shortest adaptive interval
+	FlushMaxInterval time.Duration // longest interval, also used when idle (0 = DefaultFlushTime)
+
+	// backend circuit breaker (see backendBreaker)
+	BreakerThreshold int           // consecutive DB failures that open the breaker (0 = no breaker)
+	BreakerCooldown  time.Duration // how long it stays open before a probe is let through (0 = DefaultBreakerCooldown)
+
+	// synchronized with Lock
+	flushTokens     float64
+	flushTokensTs   time.Time
+	flushesDeferred int64
+	flushThrottled  bool
+	lockWait        LockWaitStats
+	dirtySince      map[cacheKey]*dirtyItem // DirtyTs of every dirty entry, maintained by updateDirtyTs
+	dirtyOrder      dirtyHeap               // the items of dirtySince, oldest DirtyTs first (see OldestDirtyAge)
+	writeThrottled  bool                    // ResidentBytes crossed HighWater and has not yet drained to LowWater
+	leases          map[cacheKey]fileLease  // advisory leases (see AcquireLease)
+	dirtyRate       float64                 // smoothed bytes written/sec, sampled at the start of each background flush
+	lastSampleTs    time.Time               // when dirtyRate was last sampled
+	lastSampleBytes int64                   // bytesWritten at lastSampleTs
+	rand            *mathrand.Rand          // wraps RandSource (created on first use)
+	breaker         backendBreaker
+	contentHashes   map[cacheKey]contentHash // remembered ContentHash results, dropped when the file is deleted
+	flushDeps       map[cacheKey][]cacheKey  // dependent -> prerequisites (see SetFlushDependency)
+	flusherPaused   bool                     // see PauseFlusher
+	flusherWakeCh   chan struct{}            // closed (and replaced) to cut the background flusher's sleep short
+	overBudget      bool                     // see degradeBudget
+	budgetOverruns  int64                    // times degradeBudget gave up on the limits
+
+	// optional, called by Evict (with no locks held) when the file being evicted has unflushed state.
+	// returning an error refuses the eviction.  otherwise (or if nil) Evict flushes and then evicts,
+	// dirty data is never dropped.  it runs once per Evict, while the data is still resident, so it can
+	// read the file back through the store (e.g. to persist a derived index).  only dirty files are ever
+	// resident, and the background flusher and FlushRange (part ranges) never call it.
+	OnDirtyEvict func(ctx context.Context, zoneId string, name string) error
+
+	quiesceLock  sync.RWMutex // read-locked by every file operation, write-locked by SnapshotAll to quiesce the store
+	flushNextDue int64        // synchronized with Lock, earliest deadline the last background flush held back (unix millis, 0 = none), see flushSchedule
+}
+
+// Printf-style logger (*log.Logger satisfies this interface)
+type Logger interface {
+	Printf(format string, args ...any)
+}
+
+func (s *FileStore) logf(format string, args ...any) {
+	if s.Logger == nil {
+		return
+	}
+	s.Logger.Printf(format, args...)
 }
 
 type DataCacheEntry struct {
 	PartIdx int
-	Data    []byte // capacity is always ZoneDataPartSize
+	Data    []byte // len is the end of the written data (holes inside it read as zero), capacity grows with it up to partDataSize
 }
 
 // if File or DataEntries are not nil then they are dirty (need to be flushed to disk)
 type CacheEntry struct {
-	PinCount int // this is synchronzed with the FileStore lock (not the entry lock)
+	PinCount      int    // this is synchronzed with the FileStore lock (not the entry lock)
+	ResidentBytes int64  // last accounted size of DataEntries, also synchronized with the FileStore lock
+	appendTicket  uint64 // next FairAppends ticket to hand out, also synchronized with the FileStore lock
+
+	Store        *FileStore // owning store (read-only, used for store-level config)
+	Lock         *sync.Mutex
+	ZoneId       string
+	Name         string
+	File         *WaveFile
+	DataEntries  map[int]*DataCacheEntry // keyed by part index (sparse), dropped parts are deleted so there is no nil tail to compact
+	FlushErrors  int
+	FlushWaiters []*WriteFuture // resolved when the entry is next flushed (or dropped)
+	DirtyTs      int64          // when the entry became dirty (File was set), 0 if clean
+
+	appendServing uint64     // FairAppends ticket allowed to append next (synchronized with Lock)
+	appendCond    *sync.Cond // on Lock, broadcast when appendServing advances
+
+	truncatePartIdx int // persisted parts at or past this index are deleted by the next flush (-1 = none), see ReplaceParts
+}
+
+type WriteFuture struct {
+	once   sync.Once
+	doneCh chan struct{}
+	err    error
+}
+
+func makeWriteFuture() *WriteFuture {
+	return &WriteFuture{doneCh: make(chan struct{})}
+}
+
+// closed once the write has been flushed to the DB (or has failed)
+func (f *WriteFuture) Done() <-chan struct{} {
+	return f.doneCh
+}
+
+// returns the write/flush error, only valid after Done() is closed
+func (f *WriteFuture) Err() error {
+	select {
+	case <-f.doneCh:
+		return f.err
+	default:
+		return nil
+	}
+}
+
+func (f *WriteFuture) resolve(err error) {
+	f.once.Do(func() {
+		f.err = err
+		close(f.doneCh)
+	})
+}
 
-	Lock        *sync.Mutex
-	ZoneId      string
-	Name        string
-	File        *WaveFile
-	DataEntries map[int]*DataCacheEntry
-	FlushErrors int
+func (entry *CacheEntry) resolveFlushWaiters(err error) {
+	for _, future := range entry.FlushWaiters {
+		future.resolve(err)
+	}
+	entry.FlushWaiters = nil
 }
 
 //lint:ignore U1000 used for testing
@@ -51,20 +204,99 @@ func (e *CacheEntry) dump() string {
 	return buf.String()
 }
 
+// data must be exactly partDataSize bytes (it is copied)
+func makeFullDataCacheEntry(partIdx int, data []byte) *DataCacheEntry {
+	return &DataCacheEntry{
+		PartIdx: partIdx,
+		Data:    append([]byte(nil), data...)[:partDataSize:partDataSize],
+	}
+}
+
+// starts empty, writeToPart grows the buffer as data is written
 func makeDataCacheEntry(partIdx int) *DataCacheEntry {
 	return &DataCacheEntry{
 		PartIdx: partIdx,
-		Data:    make([]byte, 0, partDataSize),
 	}
 }
 
+// smallest buffer writeToPart allocates for a part
+const minPartCap = 64
+
+// part buffers double (up to partDataSize) as they fill, so a dirty tiny file doesn't hold a whole part's
+// worth of memory until it is flushed
+func growPartCap(curCap int64, needed int64) int64 {
+	newCap := max(curCap*2, minPartCap)
+	for newCap < needed {
+		newCap *= 2
+	}
+	return min(newCap, partDataSize)
+}
+
+// upper bounds of the LockWaitStats histogram buckets
+var lockWaitBuckets = []time.Duration{
+	time.Microsecond,
+	10 * time.Microsecond,
+	100 * time.Microsecond,
+	time.Millisecond,
+	10 * time.Millisecond,
+	100 * time.Millisecond,
+}
+
+type LockWaitStats struct {
+	Count     int64           `json:"count"`
+	TotalWait time.Duration   `json:"totalwait"`
+	MaxWait   time.Duration   `json:"maxwait"`
+	Buckets   []time.Duration `json:"buckets"` // upper bounds (inclusive)
+	Counts    []int64         `json:"counts"`  // one per bucket, plus a final count for waits above the last bucket
+}
+
+// acquires the store lock, every s.Lock acquisition in the store goes through here
+func (s *FileStore) lock() {
+	if !s.MeasureLockWait {
+		s.Lock.Lock()
+		return
+	}
+	startTs := time.Now()
+	s.Lock.Lock()
+	s.recordLockWait(time.Since(startTs))
+}
+
+// must hold s.Lock
+func (s *FileStore) recordLockWait(wait time.Duration) {
+	stats := &s.lockWait
+	if stats.Counts == nil {
+		stats.Buckets = lockWaitBuckets
+		stats.Counts = make([]int64, len(lockWaitBuckets)+1)
+	}
+	stats.Count++
+	stats.TotalWait += wait
+	stats.MaxWait = max(stats.MaxWait, wait)
+	bucketIdx := len(lockWaitBuckets)
+	for idx, bound := range lockWaitBuckets {
+		if wait <= bound {
+			bucketIdx = idx
+			break
+		}
+	}
+	stats.Counts[bucketIdx]++
+}
+
+// returns the lock wait histogram recorded while MeasureLockWait was set (counts are cumulative)
+func (s *FileStore) LockWaitStats() LockWaitStats {
+	s.lock()
+	defer s.Lock.Unlock()
+	rtn := s.lockWait
+	rtn.Counts = append([]int64(nil), s.lockWait.Counts...)
+	return rtn
+}
+
 // will create new entries
 func (s *FileStore) getEntryAndPin(zoneId string, name string) *CacheEntry {
-	s.Lock.Lock()
+	s.lock()
 	defer s.Lock.Unlock()
 	entry := s.Cache[cacheKey{ZoneId: zoneId, Name: name}]
 	if entry == nil {
-		entry = makeCacheEntry(zoneId, name)
+		entry = makeCacheEntry(s, zoneId, name)
 		s.Cache[cacheKey{ZoneId: zoneId, Name: name}] = entry
 	}
 	entry.PinCount++
@@ -72,22 +304,325 @@ func (s *FileStore) getEntryAndPin(zoneId string, name string) *CacheEntry {
 }
 
 func (s *FileStore) unpinEntryAndTryDelete(zoneId string, name string) {
-	s.Lock.Lock()
+	s.lock()
 	defer s.Lock.Unlock()
 	entry := s.Cache[cacheKey{ZoneId: zoneId, Name: name}]
 	if entry == nil {
+		s.logf("filestore: unpin called on missing cache entry %s:%s\n", zoneId, name)
 		return
 	}
 	entry.PinCount--
+	if entry.PinCount < 0 {
+		s.logf("filestore: negative pin count (%d) for cache entry %s:%s\n", entry.PinCount, zoneId, name)
+	}
 	if entry.PinCount <= 0 && entry.File == nil {
 		delete(s.Cache, cacheKey{ZoneId: zoneId, Name: name})
 	}
 }
 
+// pins every key (duplicates are pinned once per occurrence) so the entries stay in the cache, and
+// returns a func that releases exactly those pins.  the returned func is safe to call more than once.
+func (s *FileStore) PinAll(keys []FileKey) (unpinAll func()) {
+	pinned := make([]FileKey, 0, len(keys))
+	for _, key := range keys {
+		s.getEntryAndPin(key.ZoneId, key.Name)
+		pinned = append(pinned, key)
+	}
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			for _, key := range pinned {
+				s.unpinEntryAndTryDelete(key.ZoneId, key.Name)
+			}
+		})
+	}
+}
+
+// must hold the entry lock
+func (entry *CacheEntry) residentBytes() int64 {
+	var rtn int64
+	for _, dce := range entry.DataEntries {
+		rtn += int64(cap(dce.Data))
+	}
+	return rtn
+}
+
+// must hold the entry lock (takes the store lock, which is never held while acquiring an entry lock)
+func (s *FileStore) updateResidentBytes(entry *CacheEntry) {
+	newSize := entry.residentBytes()
+	s.lock()
+	defer s.Lock.Unlock()
+	delta := newSize - entry.ResidentBytes
+	if delta == 0 {
+		return
+	}
+	entry.ResidentBytes = newSize
+	s.ResidentBytes += delta
+	if delta < 0 && s.budgetCh != nil {
+		close(s.budgetCh)
+		s.budgetCh = nil
+	}
+}
+
+// blocks until the resident (unflushed) part data is below CacheBudget, or ctx is done.
+// waiters are woken whenever a flush (or delete) shrinks the cache, so this relies on the
+// background flusher (or explicit flushes) to make progress.  returns right away while the store is
+// over budget because its dirty data can't be flushed (see degradeBudget).
+func (s *FileStore) WaitForBudget(ctx context.Context) error {
+	for {
+		s.lock()
+		if s.CacheBudget <= 0 || s.ResidentBytes < s.CacheBudget || s.overBudget {
+			s.Lock.Unlock()
+			return nil
+		}
+		if s.budgetCh == nil {
+			s.budgetCh = make(chan struct{})
+		}
+		waitCh := s.budgetCh
+		s.Lock.Unlock()
+		select {
+		case <-waitCh:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// returns an upper bound on the resident bytes a write of size bytes at offset would add to the cache, so
+// a loader can compare it with CacheBudget - ResidentBytes (see CacheStats) and flush or chunk first.  every
+// part the write touches is counted at a full part (buffers grow with their data, but a part is never more
+// than that), less what already resident parts hold.  this is a planning aid: concurrent writes and flushes
+// can change residency before the write runs.  NoDataCache writes drop their parts once flushed (the
+// estimate is their peak).
+func (s *FileStore) EstimateWriteFootprint(ctx context.Context, zoneId string, name string, offset int64, size int64) (int64, error) {
+	if offset < 0 {
+		return 0, fmt.Errorf("offset cannot be negative")
+	}
+	return s.estimateWriteFootprint(ctx, zoneId, name, offset, size)
+}
+
+// same as EstimateWriteFootprint, for an AppendData of size bytes (at the file's current end)
+func (s *FileStore) EstimateAppendFootprint(ctx context.Context, zoneId string, name string, size int64) (int64, error) {
+	return s.estimateWriteFootprint(ctx, zoneId, name, -1, size)
+}
+
+// offset -1 is the end of the file
+func (s *FileStore) estimateWriteFootprint(ctx context.Context, zoneId string, name string, offset int64, size int64) (int64, error) {
+	if err := s.checkRead(zoneId, name); err != nil {
+		return 0, err
+	}
+	if size <= 0 {
+		return 0, nil
+	}
+	return withLockRtn(s, zoneId, name, func(entry *CacheEntry) (int64, error) {
+		file, err := entry.loadFileForRead(ctx)
+		if err != nil {
+			return 0, err
+		}
+		if offset < 0 {
+			offset = file.Size
+		}
+		firstPart := offset / partDataSize
+		numParts := (offset+size-1)/partDataSize - firstPart + 1
+		inRange := func(partIdx int) bool {
+			return int64(partIdx) >= firstPart && int64(partIdx) < firstPart+numParts
+		}
+		if file.Opts.Circular {
+			// part indexes wrap, so a long write touches each of the ring's parts at most once
+			maxParts := file.Opts.MaxSize / partDataSize
+			numParts = min(numParts, maxParts)
+			startPart := firstPart % maxParts
+			inRange = func(partIdx int) bool {
+				return (int64(partIdx)-startPart+maxParts)%maxParts < numParts
+			}
+		}
+		estimate := numParts * partDataSize
+		for partIdx, dce := range entry.DataEntries {
+			if inRange(partIdx) {
+				estimate -= int64(cap(dce.Data))
+			}
+		}
+		return estimate, nil
+	})
+}
+
+// producer throttling for data writes (HighWater/LowWater).  once ResidentBytes reaches HighWater every
+// writer blocks until the flusher drains it to LowWater, the gap keeps writers from flapping on and off
+// around a single threshold.  must be called before taking any lock: waiters hold nothing, so the flusher
+// (which needs the entry locks) can always make progress.
+func (s *FileStore) waitForLowWater(ctx context.Context) error {
+	for {
+		s.lock()
+		if s.HighWater <= 0 {
+			s.writeThrottled = false
+			s.Lock.Unlock()
+			return nil
+		}
+		if s.writeThrottled && s.ResidentBytes <= min(s.LowWater, s.HighWater) {
+			s.writeThrottled = false
+		} else if !s.writeThrottled && s.ResidentBytes >= s.HighWater {
+			s.writeThrottled = true
+			if s.flusherPaused {
+				// a paused flusher only sweeps for throttled writers, don't make them wait out its interval
+				s.wakeFlusher()
+			}
+		}
+		if !s.writeThrottled || s.overBudget {
+			s.Lock.Unlock()
+			return nil
+		}
+		if s.budgetCh == nil {
+			s.budgetCh = make(chan struct{})
+		}
+		waitCh := s.budgetCh
+		s.Lock.Unlock()
+		select {
+		case <-waitCh:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// the limits waiters would wait on are exceeded (HighWater throttling or CacheBudget), synchronized with Lock
+func (s *FileStore) isOverLimit() bool {
+	if s.HighWater > 0 && s.writeThrottled && s.ResidentBytes > min(s.LowWater, s.HighWater) {
+		return true
+	}
+	return s.CacheBudget > 0 && s.ResidentBytes >= s.CacheBudget
+}
+
+// the degradation for resident data that can't be flushed (backend down, breaker open, flushes blocked by
+// SetFlushDependency, ...).  only flushes shrink the cache (pins never hold back dirty data: a pinned entry
+// is still flushed, it just stays in the map), so blocked writers would otherwise wait forever.  called by
+// the background flusher after each sweep: if the sweep failed (or was blocked) and the limits are still
+// exceeded, the store goes over budget: waiters are released, and until a sweep brings the cache back under
+// the limits writes proceed without throttling (a warning is logged, and the overrun is counted in
+// CacheStats.BudgetOverruns).  check MemoryPressure to react, e.g. by pausing producers.
+func (s *FileStore) degradeBudget(sweepFailed bool) {
+	s.lock()
+	defer s.Lock.Unlock()
+	overLimit := s.isOverLimit()
+	if !overLimit {
+		if s.overBudget {
+			s.overBudget = false
+			s.logf("filestore: resident data back under the limits (%d bytes)\n", s.ResidentBytes)
+		}
+		return
+	}
+	if s.overBudget || !sweepFailed {
+		return
+	}
+	s.overBudget = true
+	s.budgetOverruns++
+	s.logf("filestore: dirty data can't be flushed, letting writes exceed the cache limits (%d bytes resident)\n", s.ResidentBytes)
+	if s.budgetCh != nil {
+		close(s.budgetCh)
+		s.budgetCh = nil
+	}
+}
+
+type MemoryPressure struct {
+	ResidentBytes int64 `json:"residentbytes"` // resident (dirty) part data
+	HighWater     int64 `json:"highwater"`     // see FileStore.HighWater (0 = no throttling)
+	CacheBudget   int64 `json:"cachebudget"`   // see FileStore.CacheBudget (0 = unlimited)
+	Throttled     bool  `json:"throttled"`     // data writes are blocked until the flusher drains to LowWater
+	OverBudget    bool  `json:"overbudget"`    // the limits are exceeded and can't be flushed back under, writes aren't throttled (see degradeBudget)
+}
+
+// a snapshot of how close the cache is to its limits, so callers can back off before (or while) the
+// store degrades
+func (s *FileStore) MemoryPressure() MemoryPressure {
+	s.lock()
+	defer s.Lock.Unlock()
+	return MemoryPressure{
+		ResidentBytes: s.ResidentBytes,
+		HighWater:     s.HighWater,
+		CacheBudget:   s.CacheBudget,
+		Throttled:     s.writeThrottled && !s.overBudget,
+		OverBudget:    s.overBudget,
+	}
+}
+
+// wakes every OverflowBlock writer (they recheck their own file), called whenever a file may have shrunk
+func (s *FileStore) notifySpaceFreed() {
+	s.lock()
+	defer s.Lock.Unlock()
+	if s.spaceCh != nil {
+		close(s.spaceCh)
+		s.spaceCh = nil
+	}
+}
+
+type overflowBlockedError struct {
+	waitCh chan struct{}
+}
+
+func (e *overflowBlockedError) Error() string {
+	return ErrFileFull.Error()
+}
+
+func (e *overflowBlockedError) Unwrap() error {
+	return ErrFileFull
+}
+
+// must hold the entry lock.  returns ErrFileFull if growing the file to endOffset would take it past
+// MaxSize (OverflowError and OverflowBlock files only).  for OverflowBlock the error carries the channel
+// to wait on, taken under the entry lock so a shrink that happens after we unlock can't be missed.
+func (entry *CacheEntry) checkOverflow(endOffset int64) error {
+	opts := entry.File.Opts
+	if !opts.enforcesMaxSize() || endOffset <= opts.MaxSize || endOffset <= entry.File.Size {
+		return nil
+	}
+	if opts.OverflowPolicy != OverflowBlock {
+		return fmt.Errorf("%w: write to offset %d exceeds max size %d", ErrFileFull, endOffset, opts.MaxSize)
+	}
+	s := entry.Store
+	s.lock()
+	defer s.Lock.Unlock()
+	if s.spaceCh == nil {
+		s.spaceCh = make(chan struct{})
+	}
+	return &overflowBlockedError{waitCh: s.spaceCh}
+}
+
+// runs fn (a write that takes the entry lock) again each time an OverflowBlock file it is blocked on
+// may have freed space, until it succeeds, fails for another reason, or ctx is done
+func retryOnOverflow[T any](ctx context.Context, fn func() (T, error)) (T, error) {
+	for {
+		rtn, err := fn()
+		var blockedErr *overflowBlockedError
+		if !errors.As(err, &blockedErr) {
+			return rtn, err
+		}
+		select {
+		case <-blockedErr.waitCh:
+		case <-ctx.Done():
+			return rtn, fmt.Errorf("%w: %w", ErrFileFull, ctx.Err())
+		}
+	}
+}
+
 func (entry *CacheEntry) clear() {
 	entry.File = nil
 	entry.DataEntries = make(map[int]*DataCacheEntry)
 	entry.FlushErrors = 0
+	entry.truncatePartIdx = -1
+}
+
+// writes the file and the given dirty parts to the DB, first deleting the persisted parts a truncation
+// dropped (in the same transaction).  a replace write deletes every persisted part anyway.
+func (entry *CacheEntry) writeToDB(ctx context.Context, dataEntries map[int]*DataCacheEntry, replace bool) error {
+	if entry.truncatePartIdx < 0 || replace {
+		return dbWriteCacheEntry(ctx, entry.File, dataEntries, replace, entry.Store.partWriteOpts())
+	}
+	return WithTx(ctx, func(tx *TxWrap) error {
+		err := dbDeleteFilePartsFrom(tx.Context(), entry.ZoneId, entry.Name, entry.truncatePartIdx)
+		if err != nil {
+			return err
+		}
+		return dbWriteCacheEntry(tx.Context(), entry.File, dataEntries, false, entry.Store.partWriteOpts())
+	})
 }
 
 func (entry *CacheEntry) getOrCreateDataCacheEntry(partIdx int) *DataCacheEntry {
@@ -97,6 +632,18 @@ func (entry *CacheEntry) getOrCreateDataCacheEntry(partIdx int) *DataCacheEntry
 	return entry.DataEntries[partIdx]
 }
 
+// same as loadFileIntoCache, but also returns ErrSealed if the file's data can't be written
+func (entry *CacheEntry) loadFileForWrite(ctx context.Context) error {
+	err := entry.loadFileIntoCache(ctx)
+	if err != nil {
+		return err
+	}
+	if entry.File.Sealed {
+		return ErrSealed
+	}
+	return nil
+}
+
 // returns err if file does not exist
 func (entry *CacheEntry) loadFileIntoCache(ctx context.Context) error {
 	if entry.File != nil {
@@ -115,7 +662,9 @@ func (entry *CacheEntry) loadFileForRead(ctx context.Context) (*WaveFile, error)
 	if entry.File != nil {
 		return entry.File, nil
 	}
-	file, err := dbGetZoneFile(ctx, entry.ZoneId, entry.Name)
+	file, err := withLoadTimeout(entry.Store, ctx, func(loadCtx context.Context) (*WaveFile, error) {
+		return dbGetZoneFile(loadCtx, entry.ZoneId, entry.Name)
+	})
 	if err != nil {
 		return nil, fmt.Errorf("error getting file: %w", err)
 	}
@@ -126,11 +675,157 @@ func (entry *CacheEntry) loadFileForRead(ctx context.Context) (*WaveFile, error)
 }
 
 func withLock(s *FileStore, zoneId string, name string, fn func(*CacheEntry) error) error {
+	s.quiesceLock.RLock()
+	defer s.quiesceLock.RUnlock()
+	return withEntryLock(s, zoneId, name, fn)
+}
+
+// same as withLock but ignores the quiesce lock (only for use while the store is quiesced)
+func withEntryLock(s *FileStore, zoneId string, name string, fn func(*CacheEntry) error) error {
+	entry, unlockFn := s.lockEntry(zoneId, name)
+	defer unlockFn()
+	return fn(entry)
+}
+
+// pins and locks the entry (ignoring the quiesce lock), the returned func must be called to release it.
+// callers that hold several entry locks at once must take them in (zoneid, name) order.
+func (s *FileStore) lockEntry(zoneId string, name string) (*CacheEntry, func()) {
 	entry := s.getEntryAndPin(zoneId, name)
-	defer s.unpinEntryAndTryDelete(zoneId, name)
 	entry.Lock.Lock()
-	defer entry.Lock.Unlock()
-	return fn(entry)
+	return entry, func() {
+		// accounted while still holding the entry lock so concurrent updates to the same entry can't be reordered
+		entry.updateDirtyTs()
+		s.updateResidentBytes(entry)
+		entry.Lock.Unlock()
+		s.unpinEntryAndTryDelete(zoneId, name)
+	}
+}
+
+// must hold the entry lock.  the store's dirtySince index is only touched when the entry becomes
+// dirty or clean, so the common case (an already dirty entry) doesn't take the store lock.
+func (entry *CacheEntry) updateDirtyTs() {
+	if entry.File == nil && entry.DirtyTs != 0 {
+		entry.DirtyTs = 0
+		entry.Store.setDirtySince(entry, 0)
+	} else if entry.File != nil && entry.DirtyTs == 0 {
+		entry.DirtyTs = time.Now().UnixMilli()
+		entry.Store.setDirtySince(entry, entry.DirtyTs)
+	}
+}
+
+type dirtyItem struct {
+	key     cacheKey
+	dirtyTs int64
+	index   int // position in dirtyOrder
+}
+
+// min-heap on dirtyTs (container/heap), synchronized with Lock
+type dirtyHeap []*dirtyItem
+
+func (h dirtyHeap) Len() int           { return len(h) }
+func (h dirtyHeap) Less(i, j int) bool { return h[i].dirtyTs < h[j].dirtyTs }
+
+func (h dirtyHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *dirtyHeap) Push(x any) {
+	item := x.(*dirtyItem)
+	item.index = len(*h)
+	*h = append(*h, item)
+}
+
+func (h *dirtyHeap) Pop() any {
+	old := *h
+	item := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return item
+}
+
+func (s *FileStore) setDirtySince(entry *CacheEntry, dirtyTs int64) {
+	s.lock()
+	defer s.Lock.Unlock()
+	key := cacheKey{ZoneId: entry.ZoneId, Name: entry.Name}
+	item := s.dirtySince[key]
+	if dirtyTs == 0 {
+		if item != nil {
+			heap.Remove(&s.dirtyOrder, item.index)
+			delete(s.dirtySince, key)
+		}
+		if s.cleanCh != nil {
+			close(s.cleanCh)
+			s.cleanCh = nil
+		}
+		return
+	}
+	if item != nil {
+		item.dirtyTs = dirtyTs
+		heap.Fix(&s.dirtyOrder, item.index)
+		return
+	}
+	if s.dirtySince == nil {
+		s.dirtySince = make(map[cacheKey]*dirtyItem)
+	}
+	item = &dirtyItem{key: key, dirtyTs: dirtyTs}
+	heap.Push(&s.dirtyOrder, item)
+	s.dirtySince[key] = item
+}
+
+// waits (without forcing a flush) until the file has no unflushed state, e.g. until the background flusher
+// has persisted a burst of writes.  returns immediately if the file is clean (or doesn't exist).  a file
+// that keeps being written may never become clean, so callers should bound the wait with ctx.
+func (s *FileStore) WaitClean(ctx context.Context, zoneId string, name string) error {
+	key := cacheKey{ZoneId: zoneId, Name: name}
+	for {
+		s.lock()
+		if _, isDirty := s.dirtySince[key]; !isDirty {
+			s.Lock.Unlock()
+			return nil
+		}
+		if s.cleanCh == nil {
+			s.cleanCh = make(chan struct{})
+		}
+		waitCh := s.cleanCh
+		s.Lock.Unlock()
+		select {
+		case <-waitCh:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// how long the oldest unflushed state has been waiting (0 if nothing is dirty), i.e. how far behind
+// the flusher is.  ages are tracked per entry (from the first write since its last flush) in a heap that
+// is updated as entries become dirty or clean, so this is O(1) and cheap enough to poll.
+func (s *FileStore) OldestDirtyAge() time.Duration {
+	s.lock()
+	defer s.Lock.Unlock()
+	if len(s.dirtyOrder) == 0 {
+		return 0
+	}
+	return time.Since(time.UnixMilli(s.dirtyOrder[0].dirtyTs))
+}
+
+// resident (dirty) part bytes per zone, for flush schedulers that prioritize the zones with the most at
+// risk.  bytes are counted like CacheStats.ResidentBytes (whole part buffers), so the zones add up to it.
+// every zone with a dirty file is included (a file with only a meta or size change counts 0 bytes).  a
+// snapshot taken under the store lock, in one pass over the dirty entries.
+func (s *FileStore) DirtyByZone() map[string]int64 {
+	s.lock()
+	defer s.Lock.Unlock()
+	rtn := make(map[string]int64)
+	for key := range s.dirtySince {
+		var residentBytes int64
+		if entry := s.Cache[key]; entry != nil {
+			residentBytes = entry.ResidentBytes
+		}
+		rtn[key.ZoneId] += residentBytes
+	}
+	return rtn
 }
 
 func withLockRtn[T any](s *FileStore, zoneId string, name string, fn func(*CacheEntry) (T, error)) (T, error) {
@@ -143,6 +838,38 @@ func withLockRtn[T any](s *FileStore, zoneId string, name string, fn func(*Cache
 	return rtnVal, rtnErr
 }
 
+// same as withLockRtn, but with FairAppends set callers are admitted in the order they arrived (a ticket
+// is taken before contending for the entry lock) rather than whoever wins the lock.  the pin keeps the
+// entry (and so its ticket queue) alive while callers wait their turn.
+func withAppendLockRtn[T any](s *FileStore, zoneId string, name string, fn func(*CacheEntry) (T, error)) (T, error) {
+	if !s.FairAppends {
+		return withLockRtn(s, zoneId, name, fn)
+	}
+	s.quiesceLock.RLock()
+	defer s.quiesceLock.RUnlock()
+	entry := s.getEntryAndPin(zoneId, name)
+	s.lock()
+	ticket := entry.appendTicket
+	entry.appendTicket++
+	s.Lock.Unlock()
+	entry.Lock.Lock()
+	for entry.appendServing != ticket {
+		entry.appendCond.Wait()
+	}
+	defer func() {
+		entry.appendServing++
+		entry.appendCond.Broadcast()
+		entry.updateDirtyTs()
+		s.updateResidentBytes(entry)
+		entry.Lock.Unlock()
+		s.unpinEntryAndTryDelete(zoneId, name)
+	}()
+	return fn(entry)
+}
+
+// writes into the part in place.  there is no per-part dirty flag (dirtiness is tracked per CacheEntry and
+// only transitions once per flush cycle), so tiny writes into an already cached part cost just the copy --
+// buffering them in front of the part would add a second copy without saving any bookkeeping.
 func (dce *DataCacheEntry) writeToPart(offset int64, data []byte) (int64, *DataCacheEntry) {
 	leftInPart := partDataSize - offset
 	toWrite := int64(len(data))
@@ -150,6 +877,16 @@ func (dce *DataCacheEntry) writeToPart(offset int64, data []byte) (int64, *DataC
 		toWrite = leftInPart
 	}
 	if int64(len(dce.Data)) < offset+toWrite {
+		if offset+toWrite > int64(cap(dce.Data)) {
+			newData := make([]byte, len(dce.Data), growPartCap(int64(cap(dce.Data)), offset+toWrite))
+			copy(newData, dce.Data)
+			dce.Data = newData
+		}
+		// the bytes past len aren't guaranteed to be zero (e.g. a decoded part whose buffer was used as
+		// scratch space), so a gap between the old end and offset must be cleared explicitly
+		if offset > int64(len(dce.Data)) {
+			clear(dce.Data[len(dce.Data):offset])
+		}
 		dce.Data = dce.Data[:offset+toWrite]
 	}
 	copy(dce.Data[offset:], data[:toWrite])
@@ -157,8 +894,15 @@ func (dce *DataCacheEntry) writeToPart(offset int64, data []byte) (int64, *DataC
 }
 
 func (entry *CacheEntry) writeAt(offset int64, data []byte, replace bool) {
+	entry.writeAtImpl(offset, data, replace, false)
+}
+
+// with adopt set, whole aligned parts keep data's memory instead of copying it (so the caller must not
+// reuse or modify data afterwards)
+func (entry *CacheEntry) writeAtImpl(offset int64, data []byte, replace bool, adopt bool) {
 	if replace {
 		entry.File.Size = 0
+		defer entry.Store.notifySpaceFreed()
 	}
 	if entry.File.Opts.Circular {
 		startCirFileOffset := entry.File.Size - entry.File.Opts.MaxSize
@@ -180,16 +924,25 @@ func (entry *CacheEntry) writeAt(offset int64, data []byte, replace bool) {
 		}
 	}
 	endWriteOffset := offset + int64(len(data))
+	entry.Store.recordBytesWritten(int64(len(data)))
 	if replace {
 		entry.DataEntries = make(map[int]*DataCacheEntry)
 	}
 	for len(data) > 0 {
-		partIdx := int(offset / partDataSize)
-		if entry.File.Opts.Circular {
-			maxPart := int(entry.File.Opts.MaxSize / partDataSize)
-			partIdx = partIdx % maxPart
-		}
+		partIdx := entry.File.partIdxAtOffset(offset)
 		partOffset := offset % partDataSize
+		if partOffset == 0 && int64(len(data)) >= partDataSize && entry.DataEntries[partIdx] == nil {
+			// fast path for full aligned parts (bulk sequential writers), no zero-fill + copy into a fresh buffer.
+			// parts that are already cached are overwritten in place below (no allocation).
+			if adopt {
+				entry.DataEntries[partIdx] = &DataCacheEntry{PartIdx: partIdx, Data: data[:partDataSize:partDataSize]}
+			} else {
+				entry.DataEntries[partIdx] = makeFullDataCacheEntry(partIdx, data[:partDataSize])
+			}
+			data = data[partDataSize:]
+			offset += partDataSize
+			continue
+		}
 		partData := entry.getOrCreateDataCacheEntry(partIdx)
 		nw, newDce := partData.writeToPart(partOffset, data)
 		entry.DataEntries[partIdx] = newDce
@@ -200,13 +953,67 @@ func (entry *CacheEntry) writeAt(offset int64, data []byte, replace bool) {
 		entry.File.Size = endWriteOffset
 	}
 	entry.File.ModTs = time.Now().UnixMilli()
+	entry.File.Version++
+}
+
+// loads the file and any partially overwritten parts into the cache, then writes (used by WriteAt)
+func (entry *CacheEntry) loadAndWriteAt(ctx context.Context, offset int64, data []byte) error {
+	err := entry.loadFileForWrite(ctx)
+	if err != nil {
+		return err
+	}
+	file := entry.File
+	if offset > file.Size {
+		return fmt.Errorf("offset is past the end of the file")
+	}
+	err = entry.checkOverflow(offset + int64(len(data)))
+	if err != nil {
+		return err
+	}
+	partMap := file.computePartMap(offset, int64(len(data)))
+	err = file.checkPartMap(partMap)
+	if err != nil {
+		return err
+	}
+	incompleteParts := incompletePartsFromMap(partMap)
+	err = entry.loadDataPartsIntoCache(ctx, incompleteParts)
+	if err != nil {
+		return err
+	}
+	entry.writeAt(offset, data, false)
+	return nil
+}
+
+// in NoDataCache mode dirty part data is flushed (and dropped from the cache) before the write returns.
+// partial parts were already loaded from the DB by the write (read-modify-write), so the flush is complete.
+// a failed flush is logged and left dirty for the background flusher to retry (the write itself succeeded).
+// the writer flushed the file's prerequisites before taking the entry lock (see flushPrerequisitesForWrite),
+// one written again since then holds the flush back without it being logged.
+// must be called after the caller is done with entry.File (the flush clears it).
+func (entry *CacheEntry) writeThrough(ctx context.Context) {
+	if !entry.Store.NoDataCache || len(entry.DataEntries) == 0 {
+		return
+	}
+	err := entry.flushToDB(ctx, false)
+	if err != nil && !errors.Is(err, ErrFlushBlocked) {
+		entry.Store.logf("filestore: write-through flush failed for %s:%s: %v\n", entry.ZoneId, entry.Name, err)
+	}
 }
 
 // returns (realOffset, data, error)
 func (entry *CacheEntry) readAt(ctx context.Context, offset int64, size int64, readFull bool) (int64, []byte, error) {
+	return entry.readAtWithOpts(ctx, offset, size, readFull, ReadOpts{}, nil)
+}
+
+// returns (realOffset, data, error)
+// if dst is non-nil the data is read into dst[:0] (no allocation when it has room for the result)
+func (entry *CacheEntry) readAtWithOpts(ctx context.Context, offset int64, size int64, readFull bool, opts ReadOpts, dst []byte) (int64, []byte, error) {
 	if offset < 0 {
 		return 0, nil, fmt.Errorf("offset cannot be negative")
 	}
+	if opts.CacheOnly && entry.File == nil {
+		return 0, nil, ErrNotCached
+	}
 	file, err := entry.loadFileForRead(ctx)
 	if err != nil {
 		return 0, nil, err
@@ -214,8 +1021,15 @@ func (entry *CacheEntry) readAt(ctx context.Context, offset int64, size int64, r
 	if readFull {
 		size = file.Size - offset
 	}
+	var padSize int64
 	if offset+size > file.Size {
-		size = file.Size - offset
+		switch opts.PastEOF {
+		case PastEOFError:
+			return 0, nil, fmt.Errorf("%w: read of %d bytes at offset %d is past the end of the file (size %d)", io.EOF, size, offset, file.Size)
+		case PastEOFZero:
+			padSize = offset + size - max(file.Size, offset)
+		}
+		size = max(file.Size-offset, 0)
 	}
 	if file.Opts.Circular {
 		realDataOffset := int64(0)
@@ -223,43 +1037,63 @@ func (entry *CacheEntry) readAt(ctx context.Context, offset int64, size int64, r
 			realDataOffset = file.Size - file.Opts.MaxSize
 		}
 		if offset < realDataOffset {
+			if opts.FailEvicted {
+				return 0, nil, fmt.Errorf("%w: read at offset %d, oldest retained offset is %d", ErrEvicted, offset, realDataOffset)
+			}
 			truncateAmt := realDataOffset - offset
 			offset += truncateAmt
 			size -= truncateAmt
 		}
 	}
 	partMap := file.computePartMap(offset, size)
+	if opts.CacheOnly && len(entry.prunePartsWithCache(getPartIdxsFromMap(partMap))) > 0 {
+		return 0, nil, ErrNotCached
+	}
 	dataEntryMap, err := entry.loadDataPartsForRead(ctx, getPartIdxsFromMap(partMap))
 	if err != nil {
 		return 0, nil, err
 	}
 	// combine the entries into a single byte slice
 	// note that we only want part of the first and last part depending on offset and size
-	rtnData := make([]byte, 0, size)
+	rtnData := dst[:0]
+	if dst == nil {
+		rtnData = make([]byte, 0, size)
+	}
 	amtLeftToRead := size
 	curReadOffset := offset
 	for amtLeftToRead > 0 {
 		partIdx := file.partIdxAtOffset(curReadOffset)
 		partDataEntry := dataEntryMap[partIdx]
 		var partData []byte
-		if partDataEntry == nil {
-			partData = make([]byte, partDataSize)
-		} else {
-			partData = partDataEntry.Data[0:partDataSize]
+		if partDataEntry != nil {
+			partData = partDataEntry.Data
 		}
 		partOffset := curReadOffset % partDataSize
 		amtToRead := minInt64(partDataSize-partOffset, amtLeftToRead)
-		rtnData = append(rtnData, partData[partOffset:partOffset+amtToRead]...)
+		// anything past the part's written data (or a missing part) reads as zeros
+		dataEnd := min(partOffset+amtToRead, int64(len(partData)))
+		if partOffset < dataEnd {
+			rtnData = append(rtnData, partData[partOffset:dataEnd]...)
+		}
+		rtnData = append(rtnData, make([]byte, partOffset+amtToRead-max(partOffset, dataEnd))...)
 		amtLeftToRead -= amtToRead
 		curReadOffset += amtToRead
 	}
+	if padSize > 0 {
+		rtnData = append(rtnData, make([]byte, padSize)...)
+	}
 	return offset, rtnData, nil
 }
 
-func prunePartsWithCache(dataEntries map[int]*DataCacheEntry, parts []int) []int {
+// returns the parts that have to be loaded from the DB: the ones not in the cache, less the persisted
+// parts a truncation dropped (see ReplaceParts), those are missing until the next flush deletes them.
+func (entry *CacheEntry) prunePartsWithCache(parts []int) []int {
 	var rtn []int
 	for _, partIdx := range parts {
-		if dataEntries[partIdx] != nil {
+		if entry.DataEntries[partIdx] != nil {
+			continue
+		}
+		if entry.truncatePartIdx >= 0 && partIdx >= entry.truncatePartIdx {
 			continue
 		}
 		rtn = append(rtn, partIdx)
@@ -267,13 +1101,36 @@ func prunePartsWithCache(dataEntries map[int]*DataCacheEntry, parts []int) []int
 	return rtn
 }
 
+func (entry *CacheEntry) loadDataPartsFromDB(ctx context.Context, parts []int) (map[int]*DataCacheEntry, error) {
+	return withLoadTimeout(entry.Store, ctx, func(loadCtx context.Context) (map[int]*DataCacheEntry, error) {
+		return dbGetFileParts(loadCtx, entry.ZoneId, entry.Name, parts)
+	})
+}
+
+// runs a DB load bounded by the store's LoadTimeout (and gated by its circuit breaker).  only our own
+// deadline is reported as ErrBackendTimeout, cancellation of the caller's ctx is returned as is.
+func withLoadTimeout[T any](s *FileStore, ctx context.Context, fn func(context.Context) (T, error)) (T, error) {
+	return withBreaker(s, ctx, func() (T, error) {
+		if s.LoadTimeout <= 0 {
+			return fn(ctx)
+		}
+		loadCtx, cancelFn := context.WithTimeout(ctx, s.LoadTimeout)
+		defer cancelFn()
+		rtn, err := fn(loadCtx)
+		if err != nil && ctx.Err() == nil && errors.Is(loadCtx.Err(), context.DeadlineExceeded) {
+			return rtn, fmt.Errorf("%w (after %v): %w", ErrBackendTimeout, s.LoadTimeout, err)
+		}
+		return rtn, err
+	})
+}
+
 func (entry *CacheEntry) loadDataPartsIntoCache(ctx context.Context, parts []int) error {
-	parts = prunePartsWithCache(entry.DataEntries, parts)
+	parts = entry.prunePartsWithCache(parts)
 	if len(parts) == 0 {
 		// parts are already loaded
 		return nil
 	}
-	dbDataParts, err := dbGetFileParts(ctx, entry.ZoneId, entry.Name, parts)
+	dbDataParts, err := entry.loadDataPartsFromDB(ctx, parts)
 	if err != nil {
 		return fmt.Errorf("error getting data parts: %w", err)
 	}
@@ -287,11 +1144,11 @@ func (entry *CacheEntry) loadDataPartsForRead(ctx context.Context, parts []int)
 	if len(parts) == 0 {
 		return nil, nil
 	}
-	dbParts := prunePartsWithCache(entry.DataEntries, parts)
+	dbParts := entry.prunePartsWithCache(parts)
 	var dbDataParts map[int]*DataCacheEntry
 	if len(dbParts) > 0 {
 		var err error
-		dbDataParts, err = dbGetFileParts(ctx, entry.ZoneId, entry.Name, dbParts)
+		dbDataParts, err = entry.loadDataPartsFromDB(ctx, dbParts)
 		if err != nil {
 			return nil, fmt.Errorf("error getting data parts: %w", err)
 		}
@@ -311,8 +1168,9 @@ func (entry *CacheEntry) loadDataPartsForRead(ctx context.Context, parts []int)
 	return rtn, nil
 }
 
-func makeCacheEntry(zoneId string, name string) *CacheEntry {
-	return &CacheEntry{
+func makeCacheEntry(store *FileStore, zoneId string, name string) *CacheEntry {
+	entry := &CacheEntry{
+		Store:       store,
 		Lock:        &sync.Mutex{},
 		ZoneId:      zoneId,
 		Name:        name,
@@ -320,14 +1178,46 @@ func makeCacheEntry(zoneId string, name string) *CacheEntry {
 		File:        nil,
 		DataEntries: make(map[int]*DataCacheEntry),
 		FlushErrors: 0,
+
+		truncatePartIdx: -1,
 	}
+	entry.appendCond = sync.NewCond(entry.Lock)
+	return entry
 }
 
+// for writes that replace the file's contents and flush them right away: returns the error that flush
+// would be turned away with (a dirty prerequisite, which withPrerequisitesLocked rules out, or an open
+// breaker), so the write can fail before changing anything.
+// must be called with the entry lock held.
+func (entry *CacheEntry) checkReplaceFlush() error {
+	if entry.Store.hasDirtyPrerequisite(cacheKey{ZoneId: entry.ZoneId, Name: entry.Name}, nil) {
+		return ErrFlushBlocked
+	}
+	return entry.Store.breakerRejects()
+}
+
+// must be called with the entry lock held (all callers go through withLock).  writeToPart mutates
+// DataCacheEntry.Data in place, so there is no unlocked flush window: the flush writes the parts to
+// the DB and clears them while holding the same lock that every writer needs.  the lock also serializes
+// flushes of the entry (background, FlushCache, FlushRange, Evict, ...): a second flush finds it clean.
 func (entry *CacheEntry) flushToDB(ctx context.Context, replace bool) error {
 	if entry.File == nil {
 		return nil
 	}
-	err := dbWriteCacheEntry(ctx, entry.File, entry.DataEntries, replace)
+	if replace {
+		// if this flush doesn't happen, the deferred one (not a replace) must still drop every persisted part
+		entry.truncatePartIdx = 0
+	}
+	if entry.Store.hasDirtyPrerequisite(cacheKey{ZoneId: entry.ZoneId, Name: entry.Name}, nil) {
+		// not a failure, the entry is flushed once its prerequisites are (see SetFlushDependency)
+		return ErrFlushBlocked
+	}
+	if err := entry.Store.breakerAllow(); err != nil {
+		// not counted in FlushErrors, the entry stays dirty until the backend is back
+		return err
+	}
+	err := entry.writeToDB(ctx, entry.DataEntries, replace)
+	entry.Store.breakerRecord(ctx, err)
 	if ctx.Err() != nil {
 		// transient error
 		return ctx.Err()
@@ -336,12 +1226,17 @@ func (entry *CacheEntry) flushToDB(ctx context.Context, replace bool) error {
 		flushErrorCount.Add(1)
 		entry.FlushErrors++
 		if entry.FlushErrors > 3 {
+			entry.Store.logf("filestore: dropping dirty data for %s:%s after %d flush errors: %v\n", entry.ZoneId, entry.Name, entry.FlushErrors, err)
+			err = fmt.Errorf("too many flush errors (clearing entry): %w", err)
+			entry.resolveFlushWaiters(err)
 			entry.clear()
-			return fmt.Errorf("too many flush errors (clearing entry): %w", err)
+			return err
 		}
 		return err
 	}
 	// clear cache entry (data is now in db)
+	entry.Store.recordPartsFlushed(len(entry.DataEntries))
+	entry.resolveFlushWaiters(nil)
 	entry.clear()
 	return nil
 }
@@ -0,0 +1,96 @@
+// Copyright 2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package filestore
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+)
+
+// computes the integrity checksum of MarshalFile (and so SnapshotAll) blobs.  the Id is stored in each
+// blob next to the checksum, so a blob stays verifiable whichever checksummer wrote it: unmarshaling looks
+// the algorithm up by id (the built-ins always, a custom one if it is the store's Checksummer).
+// ids below ChecksumCustomMinId are reserved for the built-in algorithms, a custom Checksummer using one
+// is rejected (its blobs would be verified with the built-in algorithm).
+type Checksummer interface {
+	Id() uint8
+	Sum(data []byte) []byte
+	Size() int // length of every Sum
+}
+
+// built-in checksummer ids
+const (
+	ChecksumCRC32  = 1
+	ChecksumSHA256 = 2
+
+	ChecksumCustomMinId = 128 // lowest id a custom Checksummer may use
+)
+
+var (
+	CRC32Checksummer  Checksummer = crc32Checksummer{}  // crc32/IEEE, the default: cheap, catches corruption but not tampering
+	SHA256Checksummer Checksummer = sha256Checksummer{} // collision resistant
+)
+
+type crc32Checksummer struct{}
+
+func (crc32Checksummer) Id() uint8 { return ChecksumCRC32 }
+func (crc32Checksummer) Size() int { return 4 }
+
+func (crc32Checksummer) Sum(data []byte) []byte {
+	return binary.BigEndian.AppendUint32(nil, crc32.ChecksumIEEE(data))
+}
+
+type sha256Checksummer struct{}
+
+func (sha256Checksummer) Id() uint8 { return ChecksumSHA256 }
+func (sha256Checksummer) Size() int { return sha256.Size }
+
+func (sha256Checksummer) Sum(data []byte) []byte {
+	sum := sha256.Sum256(data)
+	return sum[:]
+}
+
+// the checksummer new blobs are written with
+func (s *FileStore) checksummer() (Checksummer, error) {
+	if s.Checksummer == nil {
+		return CRC32Checksummer, nil
+	}
+	if err := validateChecksummer(s.Checksummer); err != nil {
+		return nil, err
+	}
+	return s.Checksummer, nil
+}
+
+// the built-ins can be set as the store's Checksummer, any other one must use a custom id
+func validateChecksummer(c Checksummer) error {
+	switch c.(type) {
+	case crc32Checksummer, sha256Checksummer:
+		return nil
+	}
+	if c.Id() < ChecksumCustomMinId {
+		return fmt.Errorf("invalid checksummer: id %d is reserved for the built-in algorithms (custom ids start at %d)", c.Id(), ChecksumCustomMinId)
+	}
+	if sumLen := len(c.Sum(nil)); sumLen != c.Size() {
+		return fmt.Errorf("invalid checksummer %d: sum is %d bytes, Size is %d", c.Id(), sumLen, c.Size())
+	}
+	return nil
+}
+
+// the checksummer to verify a blob written with id
+func (s *FileStore) checksummerById(id uint8) (Checksummer, error) {
+	switch {
+	case id == ChecksumCRC32:
+		return CRC32Checksummer, nil
+	case id == ChecksumSHA256:
+		return SHA256Checksummer, nil
+	case s.Checksummer != nil && s.Checksummer.Id() == id:
+		if err := validateChecksummer(s.Checksummer); err != nil {
+			return nil, err
+		}
+		return s.Checksummer, nil
+	}
+	return nil, fmt.Errorf("unknown checksum algorithm %d", id)
+}
@@ -4,42 +4,217 @@
 package filestore
 
 import (
+	"bytes"
+	"compress/flate"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"io"
 	"io/fs"
 	"os"
 
 	"github.com/wavetermdev/waveterm/pkg/util/dbutil"
 )
 
+// persisted layout, for tools that read the DB directly.  file metadata is not an opaque blob: each field
+// has its own column, and the format is versioned by the schema migrations (db/migrations-filestore), so a
+// reader can check the migration version instead of a per-row format tag.  there is no codec hook, every
+// store shares the DB (see globalDB), so a per-store encoding would make rows unreadable to the others.
+//   db_wave_file  zoneid, name, size, createdts, modts, version, sealed, deletedts (0 unless soft-deleted,
+//                 deletePendingTs while a BatchDeletes removal is pending),
+//                 opts (FileOptsType as json), meta (FileMeta as json)
+//   db_file_data  zoneid, name, partidx, data, encoding (see PartEncodingPlain), datahash (set for
+//                 deduplicated parts, whose data is then in db_file_blob)
+//   db_file_blob  datahash, data, refcount
+
 // can return fs.ErrExist
+// a soft-deleted file with the same name is hard-deleted first (it can no longer be undeleted)
 func dbInsertFile(ctx context.Context, file *WaveFile) error {
 	// will fail if file already exists
 	return WithTx(ctx, func(tx *TxWrap) error {
-		query := "SELECT zoneid FROM db_wave_file WHERE zoneid = ? AND name = ?"
+		query := "SELECT zoneid FROM db_wave_file WHERE zoneid = ? AND name = ? AND deletedts = 0"
 		if tx.Exists(query, file.ZoneId, file.Name) {
 			return fs.ErrExist
 		}
-		query = "INSERT INTO db_wave_file (zoneid, name, size, createdts, modts, opts, meta) VALUES (?, ?, ?, ?, ?, ?, ?)"
-		tx.Exec(query, file.ZoneId, file.Name, file.Size, file.CreatedTs, file.ModTs, dbutil.QuickJson(file.Opts), dbutil.QuickJson(file.Meta))
+		hardDeleteFile(tx, file.ZoneId, file.Name)
+		query = "INSERT INTO db_wave_file (zoneid, name, size, createdts, modts, version, opts, meta) VALUES (?, ?, ?, ?, ?, ?, ?, ?)"
+		tx.Exec(query, file.ZoneId, file.Name, file.Size, file.CreatedTs, file.ModTs, file.Version, dbutil.QuickJson(file.Opts), dbutil.QuickJson(file.Meta))
 		return nil
 	})
 }
 
 func dbDeleteFile(ctx context.Context, zoneId string, name string) error {
 	return WithTx(ctx, func(tx *TxWrap) error {
-		query := "DELETE FROM db_wave_file WHERE zoneid = ? AND name = ?"
-		tx.Exec(query, zoneId, name)
-		query = "DELETE FROM db_file_data WHERE zoneid = ? AND name = ?"
+		hardDeleteFile(tx, zoneId, name)
+		return nil
+	})
+}
+
+func hardDeleteFile(tx *TxWrap, zoneId string, name string) {
+	query := "DELETE FROM db_wave_file WHERE zoneid = ? AND name = ?"
+	tx.Exec(query, zoneId, name)
+	releasePartBlobs(tx, "zoneid = ? AND name = ?", zoneId, name)
+	query = "DELETE FROM db_file_data WHERE zoneid = ? AND name = ?"
+	tx.Exec(query, zoneId, name)
+}
+
+// marks the file as deleted (hidden from every query) but keeps its data until it is reaped
+func dbSoftDeleteFile(ctx context.Context, zoneId string, name string, deletedTs int64) error {
+	return WithTx(ctx, func(tx *TxWrap) error {
+		query := "UPDATE db_wave_file SET deletedts = ? WHERE zoneid = ? AND name = ? AND deletedts = 0"
+		tx.Exec(query, deletedTs, zoneId, name)
+		return nil
+	})
+}
+
+// removes every file marked with deletePendingTs (see BatchDeletes) in a single transaction
+func dbApplyPendingDeletes(ctx context.Context) (int, error) {
+	return WithTxRtn(ctx, func(tx *TxWrap) (int, error) {
+		type fileKey struct {
+			ZoneId string `db:"zoneid"`
+			Name   string `db:"name"`
+		}
+		var keys []fileKey
+		query := "SELECT zoneid, name FROM db_wave_file WHERE deletedts = ?"
+		tx.Select(&keys, query, deletePendingTs)
+		for _, key := range keys {
+			hardDeleteFile(tx, key.ZoneId, key.Name)
+		}
+		return len(keys), nil
+	})
+}
+
+// restores a file soft-deleted at or after minDeletedTs, returns fs.ErrExist if a live file
+// has the name, and fs.ErrNotExist if there is no (unexpired) soft-deleted file
+func dbUndeleteFile(ctx context.Context, zoneId string, name string, minDeletedTs int64) error {
+	return WithTx(ctx, func(tx *TxWrap) error {
+		query := "SELECT deletedts FROM db_wave_file WHERE zoneid = ? AND name = ?"
+		var deletedTs int64
+		found := tx.Get(&deletedTs, query, zoneId, name)
+		if found && deletedTs == 0 {
+			return fs.ErrExist
+		}
+		if !found || deletedTs < minDeletedTs {
+			return fs.ErrNotExist
+		}
+		query = "UPDATE db_wave_file SET deletedts = 0 WHERE zoneid = ? AND name = ?"
 		tx.Exec(query, zoneId, name)
 		return nil
 	})
 }
 
+// returns fs.ErrNotExist if the file does not exist
+func dbSetFileSealed(ctx context.Context, zoneId string, name string, sealed bool) error {
+	return WithTx(ctx, func(tx *TxWrap) error {
+		query := "SELECT zoneid FROM db_wave_file WHERE zoneid = ? AND name = ? AND deletedts = 0"
+		if !tx.Exists(query, zoneId, name) {
+			return fs.ErrNotExist
+		}
+		query = "UPDATE db_wave_file SET sealed = ? WHERE zoneid = ? AND name = ? AND deletedts = 0"
+		tx.Exec(query, sealed, zoneId, name)
+		return nil
+	})
+}
+
+// swaps the contents (parts, size, opts, meta) of two files in a single transaction.  each file keeps
+// its name and createdts, and its version is bumped.  returns fs.ErrNotExist if either file is missing.
+func dbSwapFiles(ctx context.Context, zoneId string, nameA string, nameB string, modTs int64) error {
+	return WithTx(ctx, func(tx *TxWrap) error {
+		fileA, err := dbGetZoneFile(tx.Context(), zoneId, nameA)
+		if err != nil {
+			return err
+		}
+		fileB, err := dbGetZoneFile(tx.Context(), zoneId, nameB)
+		if err != nil {
+			return err
+		}
+		if fileA == nil || fileB == nil {
+			return fs.ErrNotExist
+		}
+		if fileA.Sealed || fileB.Sealed {
+			return ErrSealed
+		}
+		// parts are moved through a temporary name to avoid primary key conflicts
+		tmpName := "\x00swap:" + nameA
+		query := "UPDATE db_file_data SET name = ? WHERE zoneid = ? AND name = ?"
+		tx.Exec(query, tmpName, zoneId, nameA)
+		tx.Exec(query, nameA, zoneId, nameB)
+		tx.Exec(query, nameB, zoneId, tmpName)
+		query = "UPDATE db_wave_file SET size = ?, modts = ?, version = ?, opts = ?, meta = ? WHERE zoneid = ? AND name = ?"
+		tx.Exec(query, fileB.Size, modTs, fileA.Version+1, dbutil.QuickJson(fileB.Opts), dbutil.QuickJson(fileB.Meta), zoneId, nameA)
+		tx.Exec(query, fileA.Size, modTs, fileB.Version+1, dbutil.QuickJson(fileA.Opts), dbutil.QuickJson(fileA.Meta), zoneId, nameB)
+		return nil
+	})
+}
+
+// deletes the file's persisted parts at or past partIdx (joins the caller's transaction if there is one)
+func dbDeleteFilePartsFrom(ctx context.Context, zoneId string, name string, partIdx int) error {
+	return WithTx(ctx, func(tx *TxWrap) error {
+		releasePartBlobs(tx, "zoneid = ? AND name = ? AND partidx >= ?", zoneId, name, partIdx)
+		query := "DELETE FROM db_file_data WHERE zoneid = ? AND name = ? AND partidx >= ?"
+		tx.Exec(query, zoneId, name, partIdx)
+		return nil
+	})
+}
+
+// replaces the file's opts and bumps its version in a single transaction.  the change is checked
+// against the stored file (see checkOptsChange).  returns the new version.
+func dbUpdateFileOpts(ctx context.Context, zoneId string, name string, opts FileOptsType, modTs int64) (int64, error) {
+	return WithTxRtn(ctx, func(tx *TxWrap) (int64, error) {
+		file, err := dbGetZoneFile(tx.Context(), zoneId, name)
+		if err != nil {
+			return 0, err
+		}
+		if file == nil {
+			return 0, fs.ErrNotExist
+		}
+		err = checkOptsChange(file, opts)
+		if err != nil {
+			return 0, err
+		}
+		query := "UPDATE db_wave_file SET modts = ?, version = ?, opts = ? WHERE zoneid = ? AND name = ?"
+		tx.Exec(query, modTs, file.Version+1, dbutil.QuickJson(opts), zoneId, name)
+		return file.Version + 1, nil
+	})
+}
+
+// hard-deletes files that were soft-deleted before cutoffTs, returns the number of files removed
+func dbReapDeletedFiles(ctx context.Context, cutoffTs int64) (int, error) {
+	return WithTxRtn(ctx, func(tx *TxWrap) (int, error) {
+		type fileKey struct {
+			ZoneId string `db:"zoneid"`
+			Name   string `db:"name"`
+		}
+		var keys []fileKey
+		query := "SELECT zoneid, name FROM db_wave_file WHERE deletedts <> 0 AND deletedts < ?"
+		tx.Select(&keys, query, cutoffTs)
+		for _, key := range keys {
+			hardDeleteFile(tx, key.ZoneId, key.Name)
+		}
+		return len(keys), nil
+	})
+}
+
+// decrements the refcount of the shared (deduplicated) blobs referenced by the matching db_file_data rows,
+// removing blobs that are no longer referenced.  must be called before the rows are deleted or replaced.
+func releasePartBlobs(tx *TxWrap, whereClause string, args ...any) {
+	var hashes []string
+	query := "SELECT datahash FROM db_file_data WHERE datahash <> '' AND " + whereClause
+	tx.Select(&hashes, query, args...)
+	if len(hashes) == 0 {
+		return
+	}
+	for _, hash := range hashes {
+		tx.Exec("UPDATE db_file_blob SET refcount = refcount - 1 WHERE datahash = ?", hash)
+	}
+	tx.Exec("DELETE FROM db_file_blob WHERE refcount <= 0")
+}
+
 func dbGetZoneFileNames(ctx context.Context, zoneId string) ([]string, error) {
 	return WithTxRtn(ctx, func(tx *TxWrap) ([]string, error) {
 		var files []string
-		query := "SELECT name FROM db_wave_file WHERE zoneid = ?"
+		query := "SELECT name FROM db_wave_file WHERE zoneid = ? AND deletedts = 0"
 		tx.Select(&files, query, zoneId)
 		return files, nil
 	})
@@ -47,16 +222,25 @@ func dbGetZoneFileNames(ctx context.Context, zoneId string) ([]string, error) {
 
 func dbGetZoneFile(ctx context.Context, zoneId string, name string) (*WaveFile, error) {
 	return WithTxRtn(ctx, func(tx *TxWrap) (*WaveFile, error) {
-		query := "SELECT * FROM db_wave_file WHERE zoneid = ? AND name = ?"
+		query := "SELECT * FROM db_wave_file WHERE zoneid = ? AND name = ? AND deletedts = 0"
 		file := dbutil.GetMappable[*WaveFile](tx, query, zoneId, name)
 		return file, nil
 	})
 }
 
+// only zoneid and name are selected
+func dbGetFilesModifiedSince(ctx context.Context, modTs int64) ([]*WaveFile, error) {
+	return WithTxRtn(ctx, func(tx *TxWrap) ([]*WaveFile, error) {
+		query := "SELECT zoneid, name FROM db_wave_file WHERE deletedts = 0 AND modts >= ?"
+		files := dbutil.SelectMappable[*WaveFile](tx, query, modTs)
+		return files, nil
+	})
+}
+
 func dbGetAllZoneIds(ctx context.Context) ([]string, error) {
 	return WithTxRtn(ctx, func(tx *TxWrap) ([]string, error) {
 		var ids []string
-		query := "SELECT DISTINCT zoneid FROM db_wave_file"
+		query := "SELECT DISTINCT zoneid FROM db_wave_file WHERE deletedts = 0"
 		tx.Select(&ids, query)
 		return ids, nil
 	})
@@ -67,51 +251,199 @@ func dbGetFileParts(ctx context.Context, zoneId string, name string, parts []int
 		return nil, nil
 	}
 	return WithTxRtn(ctx, func(tx *TxWrap) (map[int]*DataCacheEntry, error) {
-		var data []*DataCacheEntry
-		query := "SELECT partidx, data FROM db_file_data WHERE zoneid = ? AND name = ? AND partidx IN (SELECT value FROM json_each(?))"
+		var data []*dbPartRow
+		// deduplicated parts store their data in db_file_blob (keyed by datahash), blobs are always plain
+		query := `SELECT d.partidx, COALESCE(b.data, d.data) AS data, d.encoding
+		          FROM db_file_data d LEFT JOIN db_file_blob b ON d.datahash <> '' AND b.datahash = d.datahash
+		          WHERE d.zoneid = ? AND d.name = ? AND d.partidx IN (SELECT value FROM json_each(?))`
 		tx.Select(&data, query, zoneId, name, dbutil.QuickJsonArr(parts))
 		rtn := make(map[int]*DataCacheEntry)
 		for _, d := range data {
-			if cap(d.Data) != int(partDataSize) {
-				newData := make([]byte, len(d.Data), partDataSize)
-				copy(newData, d.Data)
-				d.Data = newData
+			partData, err := decodePartData(d.Data, d.Encoding)
+			if err != nil {
+				return nil, fmt.Errorf("error decoding part %d: %w", d.PartIdx, err)
+			}
+			if cap(partData) > int(partDataSize) {
+				newData := make([]byte, len(partData))
+				copy(newData, partData)
+				partData = newData
 			}
-			rtn[d.PartIdx] = d
+			rtn[d.PartIdx] = &DataCacheEntry{PartIdx: d.PartIdx, Data: partData}
 		}
 		return rtn, nil
 	})
 }
 
+func dbGetFilePartIdxs(ctx context.Context, zoneId string, name string) ([]int, error) {
+	return WithTxRtn(ctx, func(tx *TxWrap) ([]int, error) {
+		var partIdxs []int
+		query := "SELECT partidx FROM db_file_data WHERE zoneid = ? AND name = ? ORDER BY partidx"
+		tx.Select(&partIdxs, query, zoneId, name)
+		return partIdxs, nil
+	})
+}
+
 func dbGetZoneFiles(ctx context.Context, zoneId string) ([]*WaveFile, error) {
 	return WithTxRtn(ctx, func(tx *TxWrap) ([]*WaveFile, error) {
-		query := "SELECT * FROM db_wave_file WHERE zoneid = ?"
+		query := "SELECT * FROM db_wave_file WHERE zoneid = ? AND deletedts = 0"
+		files := dbutil.SelectMappable[*WaveFile](tx, query, zoneId)
+		return files, nil
+	})
+}
+
+func dbGetAllFiles(ctx context.Context) ([]*WaveFile, error) {
+	return WithTxRtn(ctx, func(tx *TxWrap) ([]*WaveFile, error) {
+		query := "SELECT * FROM db_wave_file WHERE deletedts = 0 ORDER BY zoneid, name"
+		files := dbutil.SelectMappable[*WaveFile](tx, query)
+		return files, nil
+	})
+}
+
+// does not select meta (or createdts)
+func dbGetZoneFileInfos(ctx context.Context, zoneId string) ([]*WaveFile, error) {
+	return WithTxRtn(ctx, func(tx *TxWrap) ([]*WaveFile, error) {
+		query := "SELECT zoneid, name, size, modts, version, opts FROM db_wave_file WHERE zoneid = ? AND deletedts = 0"
 		files := dbutil.SelectMappable[*WaveFile](tx, query, zoneId)
 		return files, nil
 	})
 }
 
-func dbWriteCacheEntry(ctx context.Context, file *WaveFile, dataEntries map[int]*DataCacheEntry, replace bool) error {
+func dbGetZoneFileCount(ctx context.Context, zoneId string) (int, error) {
+	return WithTxRtn(ctx, func(tx *TxWrap) (int, error) {
+		query := "SELECT count(*) FROM db_wave_file WHERE zoneid = ? AND deletedts = 0"
+		return tx.GetInt(query, zoneId), nil
+	})
+}
+
+func dbGetFileCounts(ctx context.Context) (map[string]int, error) {
+	return WithTxRtn(ctx, func(tx *TxWrap) (map[string]int, error) {
+		var rows []struct {
+			ZoneId string `db:"zoneid"`
+			Count  int    `db:"count"`
+		}
+		query := "SELECT zoneid, count(*) AS count FROM db_wave_file WHERE deletedts = 0 GROUP BY zoneid"
+		tx.Select(&rows, query)
+		rtn := make(map[string]int, len(rows))
+		for _, row := range rows {
+			rtn[row.ZoneId] = row.Count
+		}
+		return rtn, nil
+	})
+}
+
+// if dedup is set, part data is stored once per content hash in db_file_blob (refcounted)
+func dbGetZoneDiskUsage(ctx context.Context, zoneId string) (int64, error) {
+	return WithTxRtn(ctx, func(tx *TxWrap) (int64, error) {
+		query := `SELECT COALESCE(sum(length(data)), 0) FROM db_file_data WHERE zoneid = ? AND datahash = ''`
+		rtn := tx.GetInt64(query, zoneId)
+		query = `SELECT COALESCE(sum(length(data)), 0) FROM db_file_blob
+		         WHERE datahash IN (SELECT datahash FROM db_file_data WHERE zoneid = ? AND datahash <> '')`
+		rtn += tx.GetInt64(query, zoneId)
+		return rtn, nil
+	})
+}
+
+func dbWriteCacheEntry(ctx context.Context, file *WaveFile, dataEntries map[int]*DataCacheEntry, replace bool, opts partWriteOpts) error {
 	return WithTx(ctx, func(tx *TxWrap) error {
-		query := `SELECT zoneid FROM db_wave_file WHERE zoneid = ? AND name = ?`
+		query := `SELECT zoneid FROM db_wave_file WHERE zoneid = ? AND name = ? AND deletedts = 0`
 		if !tx.Exists(query, file.ZoneId, file.Name) {
 			// since deletion is synchronous this stops us from writing to a deleted file
 			return os.ErrNotExist
 		}
 		// we don't update CreatedTs or Opts
-		query = `UPDATE db_wave_file SET size = ?, modts = ?, meta = ? WHERE zoneid = ? AND name = ?`
-		tx.Exec(query, file.Size, file.ModTs, dbutil.QuickJson(file.Meta), file.ZoneId, file.Name)
+		query = `UPDATE db_wave_file SET size = ?, modts = ?, version = ?, meta = ? WHERE zoneid = ? AND name = ?`
+		tx.Exec(query, file.Size, file.ModTs, file.Version, dbutil.QuickJson(file.Meta), file.ZoneId, file.Name)
 		if replace {
+			releasePartBlobs(tx, "zoneid = ? AND name = ?", file.ZoneId, file.Name)
 			query = `DELETE FROM db_file_data WHERE zoneid = ? AND name = ?`
 			tx.Exec(query, file.ZoneId, file.Name)
+		} else if len(dataEntries) > 0 {
+			partIdxs := make([]int, 0, len(dataEntries))
+			for partIdx := range dataEntries {
+				partIdxs = append(partIdxs, partIdx)
+			}
+			releasePartBlobs(tx, "zoneid = ? AND name = ? AND partidx IN (SELECT value FROM json_each(?))", file.ZoneId, file.Name, dbutil.QuickJsonArr(partIdxs))
 		}
-		dataPartQuery := `REPLACE INTO db_file_data (zoneid, name, partidx, data) VALUES (?, ?, ?, ?)`
+		dataPartQuery := `REPLACE INTO db_file_data (zoneid, name, partidx, data, datahash, encoding) VALUES (?, ?, ?, ?, ?, ?)`
+		blobQuery := `INSERT INTO db_file_blob (datahash, data, refcount) VALUES (?, ?, 1)
+		              ON CONFLICT(datahash) DO UPDATE SET refcount = refcount + 1`
 		for partIdx, dataEntry := range dataEntries {
 			if partIdx != dataEntry.PartIdx {
 				panic(fmt.Sprintf("partIdx:%d and dataEntry.PartIdx:%d do not match", partIdx, dataEntry.PartIdx))
 			}
-			tx.Exec(dataPartQuery, file.ZoneId, file.Name, dataEntry.PartIdx, dataEntry.Data)
+			if !opts.Dedup {
+				data, encoding := encodePartData(dataEntry.Data, opts.Compress)
+				tx.Exec(dataPartQuery, file.ZoneId, file.Name, dataEntry.PartIdx, data, "", encoding)
+				continue
+			}
+			hash := partDataHash(dataEntry.Data)
+			tx.Exec(blobQuery, hash, dataEntry.Data)
+			tx.Exec(dataPartQuery, file.ZoneId, file.Name, dataEntry.PartIdx, []byte{}, hash, PartEncodingPlain)
 		}
 		return nil
 	})
 }
+
+// every db_file_data row records how its data column is encoded.  parts written before the encoding
+// column existed default to PartEncodingPlain, so a file can freely mix plain and compressed parts
+// (e.g. after Compress is turned on or off).  the encoding lives in its own column rather than in a
+// header byte because a header can't be told apart from old plain data that happens to start with it.
+const (
+	PartEncodingPlain = 0
+	PartEncodingFlate = 1
+)
+
+type partWriteOpts struct {
+	Dedup    bool
+	Compress bool
+}
+
+type dbPartRow struct {
+	PartIdx  int    `db:"partidx"`
+	Data     []byte `db:"data"`
+	Encoding int    `db:"encoding"`
+}
+
+func (s *FileStore) partWriteOpts() partWriteOpts {
+	return partWriteOpts{Dedup: s.Dedup, Compress: s.Compress}
+}
+
+// falls back to plain if compression doesn't make the part smaller
+func encodePartData(data []byte, compress bool) ([]byte, int) {
+	if !compress || len(data) == 0 {
+		return data, PartEncodingPlain
+	}
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, flate.BestSpeed)
+	if err != nil {
+		return data, PartEncodingPlain
+	}
+	w.Write(data)
+	if w.Close() != nil || buf.Len() >= len(data) {
+		return data, PartEncodingPlain
+	}
+	return buf.Bytes(), PartEncodingFlate
+}
+
+func decodePartData(data []byte, encoding int) ([]byte, error) {
+	switch encoding {
+	case PartEncodingPlain:
+		return data, nil
+	case PartEncodingFlate:
+		rtn, err := io.ReadAll(io.LimitReader(flate.NewReader(bytes.NewReader(data)), partDataSize+1))
+		if err != nil {
+			return nil, err
+		}
+		if int64(len(rtn)) > partDataSize {
+			return nil, fmt.Errorf("decompressed part is larger than the part size %d", partDataSize)
+		}
+		return rtn, nil
+	default:
+		return nil, fmt.Errorf("unknown part encoding %d", encoding)
+	}
+}
+
+func partDataHash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
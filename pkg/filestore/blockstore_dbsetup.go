@@ -27,6 +27,8 @@ const FilestoreDBName = "filestore.db"
 
 type TxWrap = txwrap.TxWrap
 
+// shared by every FileStore (there is no per-store backend), so a store can't be forked onto an
+// independent copy of its data -- tests isolate themselves by re-initializing this db (see initDb)
 var globalDB *sqlx.DB
 var useTestingDb bool // just for testing (forces GetDB() to return an in-memory db)
 
@@ -0,0 +1,306 @@
+// Copyright 2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package filestore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// returned by flushes of a file while one of its flush prerequisites (see SetFlushDependency) is dirty.
+// operations that flush a single file right away flush its prerequisites first, holding their entry locks,
+// so they never return it.  FlushCache counts it in NumBlocked.
+var ErrFlushBlocked = errors.New("flush blocked by a dirty prerequisite")
+
+// declares that dependent must never be flushed while prerequisite has unflushed writes, e.g. so an index
+// file is never persisted ahead of the data file it points into.  dependencies are transitive and must be
+// acyclic (a dependency that would close a cycle is rejected).  they are kept in memory by name (the
+// files don't have to exist yet, and nothing is persisted), adding one that exists is a no-op.
+//
+// FlushCache flushes prerequisites before their dependents, and skips (counts in NumBlocked) a dependent
+// whose prerequisite is still dirty, e.g. because its flush failed or was deferred.  in FlushBatchSize mode
+// a dependent and its prerequisite may commit in the same transaction.  operations that flush the dependent
+// alone (WriteFile, ResetCircular, Seal, UpdateOpts, Evict, FlushRange, SwapFiles, ...) lock its
+// prerequisites and flush the dirty ones first, and fail only if one of those flushes does.  NoDataCache
+// writes flush them first too, a prerequisite written again in between leaves the write's data dirty for
+// the background flusher.  MakeFileWithData writes a new file straight to the DB, it is not held back by prerequisites.
+func (s *FileStore) SetFlushDependency(dependentKey FileKey, prerequisiteKey FileKey) error {
+	dependent, prerequisite := cacheKey(dependentKey), cacheKey(prerequisiteKey)
+	if dependent == prerequisite {
+		return fmt.Errorf("file %s:%s cannot depend on itself", dependent.ZoneId, dependent.Name)
+	}
+	s.lock()
+	defer s.Lock.Unlock()
+	if s.dependsOn(prerequisite, dependent) {
+		return fmt.Errorf("flush dependency of %s:%s on %s:%s would create a cycle", dependent.ZoneId, dependent.Name, prerequisite.ZoneId, prerequisite.Name)
+	}
+	for _, key := range s.flushDeps[dependent] {
+		if key == prerequisite {
+			return nil
+		}
+	}
+	if s.flushDeps == nil {
+		s.flushDeps = make(map[cacheKey][]cacheKey)
+	}
+	s.flushDeps[dependent] = append(s.flushDeps[dependent], prerequisite)
+	return nil
+}
+
+// removes a dependency added by SetFlushDependency (a no-op if there is none)
+func (s *FileStore) RemoveFlushDependency(dependentKey FileKey, prerequisiteKey FileKey) {
+	dependent, prerequisite := cacheKey(dependentKey), cacheKey(prerequisiteKey)
+	s.lock()
+	defer s.Lock.Unlock()
+	prereqs := s.flushDeps[dependent]
+	for idx, key := range prereqs {
+		if key == prerequisite {
+			prereqs = append(prereqs[:idx:idx], prereqs[idx+1:]...)
+			break
+		}
+	}
+	if len(prereqs) == 0 {
+		delete(s.flushDeps, dependent)
+		return
+	}
+	s.flushDeps[dependent] = prereqs
+}
+
+// true if key transitively depends on target, synchronized with Lock
+func (s *FileStore) dependsOn(key cacheKey, target cacheKey) bool {
+	visited := make(map[cacheKey]bool)
+	var visit func(cacheKey) bool
+	visit = func(k cacheKey) bool {
+		if k == target {
+			return true
+		}
+		if visited[k] {
+			return false
+		}
+		visited[k] = true
+		for _, prereq := range s.flushDeps[k] {
+			if visit(prereq) {
+				return true
+			}
+		}
+		return false
+	}
+	for _, prereq := range s.flushDeps[key] {
+		if visit(prereq) {
+			return true
+		}
+	}
+	return false
+}
+
+// true if key is the dependent or the prerequisite of any flush dependency, synchronized with Lock
+func (s *FileStore) hasFlushDeps(key cacheKey) bool {
+	if len(s.flushDeps[key]) > 0 {
+		return true
+	}
+	for _, prereqs := range s.flushDeps {
+		for _, prereq := range prereqs {
+			if prereq == key {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// true if any (transitive) prerequisite of key is dirty, not counting the ones in flushingWith (files
+// committing in the same transaction).  called with the entry lock of key held.
+func (s *FileStore) hasDirtyPrerequisite(key cacheKey, flushingWith map[cacheKey]bool) bool {
+	s.lock()
+	defer s.Lock.Unlock()
+	if len(s.flushDeps[key]) == 0 {
+		return false
+	}
+	visited := make(map[cacheKey]bool)
+	var visit func(cacheKey) bool
+	visit = func(k cacheKey) bool {
+		if visited[k] {
+			return false
+		}
+		visited[k] = true
+		if _, isDirty := s.dirtySince[k]; isDirty && !flushingWith[k] {
+			return true
+		}
+		for _, prereq := range s.flushDeps[k] {
+			if visit(prereq) {
+				return true
+			}
+		}
+		return false
+	}
+	for _, prereq := range s.flushDeps[key] {
+		if visit(prereq) {
+			return true
+		}
+	}
+	return false
+}
+
+// returns keys reordered so that every file comes after its (transitive) prerequisites, otherwise keeping
+// their order.  keys without dependencies are returned unchanged.
+func (s *FileStore) flushOrder(keys []cacheKey) []cacheKey {
+	s.lock()
+	defer s.Lock.Unlock()
+	if len(s.flushDeps) == 0 {
+		return keys
+	}
+	inKeys := make(map[cacheKey]bool, len(keys))
+	for _, key := range keys {
+		inKeys[key] = true
+	}
+	rtn := make([]cacheKey, 0, len(keys))
+	visited := make(map[cacheKey]bool)
+	var visit func(cacheKey)
+	visit = func(k cacheKey) {
+		if visited[k] {
+			return
+		}
+		visited[k] = true
+		// walks through prerequisites that aren't in keys, their own prerequisites may be
+		for _, prereq := range s.flushDeps[k] {
+			visit(prereq)
+		}
+		if inKeys[k] {
+			rtn = append(rtn, k)
+		}
+	}
+	for _, key := range keys {
+		visit(key)
+	}
+	return rtn
+}
+
+// the dirty (transitive) prerequisites of key, in flush order
+func (s *FileStore) dirtyPrerequisites(key cacheKey) []cacheKey {
+	s.lock()
+	if len(s.flushDeps[key]) == 0 {
+		s.Lock.Unlock()
+		return nil
+	}
+	var dirty []cacheKey
+	visited := make(map[cacheKey]bool)
+	var visit func(cacheKey)
+	visit = func(k cacheKey) {
+		if visited[k] {
+			return
+		}
+		visited[k] = true
+		if _, isDirty := s.dirtySince[k]; isDirty {
+			dirty = append(dirty, k)
+		}
+		for _, prereq := range s.flushDeps[k] {
+			visit(prereq)
+		}
+	}
+	for _, prereq := range s.flushDeps[key] {
+		visit(prereq)
+	}
+	s.Lock.Unlock()
+	return s.flushOrder(dirty)
+}
+
+// flushes the dirty prerequisites of each of keys, prerequisites first, each under its own entry lock.
+// must be called with no entry lock held (entry locks are only ever nested in (zoneid, name) order).
+func (s *FileStore) flushPrerequisites(ctx context.Context, keys ...cacheKey) error {
+	for _, key := range keys {
+		for _, prereq := range s.dirtyPrerequisites(key) {
+			err := withLock(s, prereq.ZoneId, prereq.Name, func(entry *CacheEntry) error {
+				return entry.flushToDB(ctx, false)
+			})
+			if err != nil {
+				return fmt.Errorf("error flushing prerequisite %s:%s: %w", prereq.ZoneId, prereq.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// the (transitive) prerequisites of keys, dirty or not, each once.  a file in keys is only included if it
+// is a prerequisite of another one.
+func (s *FileStore) allPrerequisites(keys []cacheKey) []cacheKey {
+	s.lock()
+	defer s.Lock.Unlock()
+	var rtn []cacheKey
+	visited := make(map[cacheKey]bool)
+	var visit func(cacheKey)
+	visit = func(k cacheKey) {
+		if visited[k] {
+			return
+		}
+		visited[k] = true
+		rtn = append(rtn, k)
+		for _, prereq := range s.flushDeps[k] {
+			visit(prereq)
+		}
+	}
+	for _, key := range keys {
+		for _, prereq := range s.flushDeps[key] {
+			visit(prereq)
+		}
+	}
+	return rtn
+}
+
+// runs fn, an operation that flushes the files in keys right away, with their entries (in keys order)
+// locked.  the entries of all of their prerequisites are locked too, and dirty ones are flushed
+// (prerequisites first) before fn runs, so no writer can dirty a prerequisite again before fn's own
+// flush.  entry locks are taken in (zoneid, name) order, the same order SwapFiles and FlushCache use.
+func withPrerequisitesLocked[T any](ctx context.Context, s *FileStore, keys []cacheKey, fn func([]*CacheEntry) (T, error)) (T, error) {
+	var rtn T
+	s.quiesceLock.RLock()
+	defer s.quiesceLock.RUnlock()
+	prereqs := s.allPrerequisites(keys)
+	lockKeys := make([]cacheKey, 0, len(keys)+len(prereqs))
+	lockKeys = append(lockKeys, keys...)
+	lockKeys = append(lockKeys, prereqs...)
+	sort.Slice(lockKeys, func(i, j int) bool {
+		if lockKeys[i].ZoneId != lockKeys[j].ZoneId {
+			return lockKeys[i].ZoneId < lockKeys[j].ZoneId
+		}
+		return lockKeys[i].Name < lockKeys[j].Name
+	})
+	entries := make(map[cacheKey]*CacheEntry, len(lockKeys))
+	for i, key := range lockKeys {
+		if i > 0 && key == lockKeys[i-1] {
+			// a file in keys that is also a prerequisite of another one
+			continue
+		}
+		entry, unlockFn := s.lockEntry(key.ZoneId, key.Name)
+		defer unlockFn()
+		entries[key] = entry
+	}
+	for _, prereq := range s.flushOrder(prereqs) {
+		entry := entries[prereq]
+		err := entry.flushToDB(ctx, false)
+		// the store's dirty index is otherwise only updated on unlock, and fn's flush checks it
+		entry.updateDirtyTs()
+		if err != nil {
+			return rtn, fmt.Errorf("error flushing prerequisite %s:%s: %w", prereq.ZoneId, prereq.Name, err)
+		}
+	}
+	keyEntries := make([]*CacheEntry, len(keys))
+	for i, key := range keys {
+		keyEntries[i] = entries[key]
+	}
+	return fn(keyEntries)
+}
+
+// NoDataCache mode: flushes the dirty prerequisites of a file before a write to it, so the write's
+// write-through flush isn't turned away.  a failed prerequisite flush is logged, the write still goes
+// ahead and its data stays dirty for the background flusher (which flushes in dependency order).
+func (s *FileStore) flushPrerequisitesForWrite(ctx context.Context, zoneId string, name string) {
+	if !s.NoDataCache {
+		return
+	}
+	err := s.flushPrerequisites(ctx, cacheKey{ZoneId: zoneId, Name: name})
+	if err != nil {
+		s.logf("filestore: write-through of %s:%s held back: %v\n", zoneId, name, err)
+	}
+}
@@ -0,0 +1,161 @@
+// Copyright 2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package filestore
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/wavetermdev/waveterm/pkg/util/dbutil"
+)
+
+const (
+	FsckOrphanPart    = "orphan-part"    // part data with no file row
+	FsckPartPastSize  = "part-past-size" // part extends past the file size (or past the ring for circular files)
+	FsckOversizedPart = "oversized-part" // part holds more than partDataSize bytes
+	FsckMissingBlob   = "missing-blob"   // deduplicated part references a blob that does not exist
+	FsckBlobRefCount  = "blob-refcount"  // blob refcount does not match the number of referencing parts
+	FsckDirtyOrphan   = "dirty-orphan"   // resident dirty entry whose file is missing from the DB (flush will fail)
+	FsckCacheMismatch = "cache-mismatch" // resident entry disagrees with the DB on a static field
+	FsckFlushErrors   = "flush-errors"   // resident dirty entry that has failed to flush
+)
+
+const fsckNoPart = -1
+
+type FsckIssue struct {
+	Category string `json:"category"`
+	ZoneId   string `json:"zoneid"`
+	Name     string `json:"name"`
+	PartIdx  int    `json:"partidx"` // -1 if the issue is not about a specific part
+	Details  string `json:"details"`
+}
+
+type FsckReport struct {
+	NumFiles int         `json:"numfiles"`
+	NumParts int         `json:"numparts"`
+	Issues   []FsckIssue `json:"issues"`
+}
+
+func (r *FsckReport) addIssue(category string, zoneId string, name string, partIdx int, format string, args ...any) {
+	r.Issues = append(r.Issues, FsckIssue{
+		Category: category,
+		ZoneId:   zoneId,
+		Name:     name,
+		PartIdx:  partIdx,
+		Details:  fmt.Sprintf(format, args...),
+	})
+}
+
+type fsckPartInfo struct {
+	ZoneId      string `db:"zoneid"`
+	Name        string `db:"name"`
+	PartIdx     int    `db:"partidx"`
+	DataLen     int64  `db:"datalen"`
+	DataHash    string `db:"datahash"`
+	MissingBlob bool   `db:"missingblob"`
+}
+
+type fsckBlobInfo struct {
+	DataHash string `db:"datahash"`
+	RefCount int    `db:"refcount"`
+	NumRefs  int    `db:"numrefs"`
+}
+
+// read-only consistency check of the DB (and of resident dirty entries against the DB).
+// safe to run while the store is in use: the DB checks run in a single read transaction, and each
+// resident entry is checked under its own lock.  soft-deleted files are checked like live files.
+func (s *FileStore) Fsck(ctx context.Context) (*FsckReport, error) {
+	report := &FsckReport{}
+	err := WithTx(ctx, func(tx *TxWrap) error {
+		files := dbutil.SelectMappable[*WaveFile](tx, "SELECT * FROM db_wave_file")
+		var parts []*fsckPartInfo
+		// datalen is the stored length, which is smaller than the part data for compressed parts
+		query := `SELECT d.zoneid, d.name, d.partidx, d.datahash,
+		                 COALESCE(length(b.data), length(d.data)) AS datalen,
+		                 (d.datahash <> '' AND b.datahash IS NULL) AS missingblob
+		          FROM db_file_data d LEFT JOIN db_file_blob b ON d.datahash <> '' AND b.datahash = d.datahash`
+		tx.Select(&parts, query)
+		var blobs []*fsckBlobInfo
+		query = `SELECT b.datahash, b.refcount, (SELECT count(*) FROM db_file_data d WHERE d.datahash = b.datahash) AS numrefs
+		         FROM db_file_blob b`
+		tx.Select(&blobs, query)
+		fileMap := make(map[cacheKey]*WaveFile)
+		for _, file := range files {
+			fileMap[cacheKey{ZoneId: file.ZoneId, Name: file.Name}] = file
+		}
+		report.NumFiles = len(files)
+		report.NumParts = len(parts)
+		for _, part := range parts {
+			fsckCheckPart(report, fileMap[cacheKey{ZoneId: part.ZoneId, Name: part.Name}], part)
+		}
+		for _, blob := range blobs {
+			if blob.RefCount != blob.NumRefs {
+				report.addIssue(FsckBlobRefCount, "", "", fsckNoPart, "blob %s has refcount %d but %d referencing parts", blob.DataHash, blob.RefCount, blob.NumRefs)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error checking db: %w", err)
+	}
+	for _, key := range s.getCacheKeys() {
+		err := withLock(s, key.ZoneId, key.Name, func(entry *CacheEntry) error {
+			return fsckCheckEntry(ctx, report, entry)
+		})
+		if err != nil {
+			return nil, fmt.Errorf("error checking cache entry %s:%s: %w", key.ZoneId, key.Name, err)
+		}
+	}
+	return report, nil
+}
+
+func fsckCheckPart(report *FsckReport, file *WaveFile, part *fsckPartInfo) {
+	if file == nil {
+		report.addIssue(FsckOrphanPart, part.ZoneId, part.Name, part.PartIdx, "part has no file (%d bytes)", part.DataLen)
+		return
+	}
+	if part.MissingBlob {
+		report.addIssue(FsckMissingBlob, part.ZoneId, part.Name, part.PartIdx, "blob %s does not exist", part.DataHash)
+	}
+	if part.DataLen > partDataSize {
+		report.addIssue(FsckOversizedPart, part.ZoneId, part.Name, part.PartIdx, "part has %d bytes (part size %d)", part.DataLen, partDataSize)
+	}
+	if file.Opts.Circular {
+		if file.Opts.MaxSize > 0 && int64(part.PartIdx) >= file.Opts.MaxSize/partDataSize {
+			report.addIssue(FsckPartPastSize, part.ZoneId, part.Name, part.PartIdx, "part is past the ring (max size %d)", file.Opts.MaxSize)
+		}
+		return
+	}
+	if int64(part.PartIdx)*partDataSize+part.DataLen > file.Size {
+		report.addIssue(FsckPartPastSize, part.ZoneId, part.Name, part.PartIdx, "part (%d bytes) extends past the file size %d", part.DataLen, file.Size)
+	}
+}
+
+// must hold the entry lock
+func fsckCheckEntry(ctx context.Context, report *FsckReport, entry *CacheEntry) error {
+	if entry.File == nil {
+		return nil
+	}
+	if entry.FlushErrors > 0 {
+		report.addIssue(FsckFlushErrors, entry.ZoneId, entry.Name, fsckNoPart, "%d failed flush attempts", entry.FlushErrors)
+	}
+	dbFile, err := dbGetZoneFile(ctx, entry.ZoneId, entry.Name)
+	if err != nil {
+		return err
+	}
+	if dbFile == nil {
+		report.addIssue(FsckDirtyOrphan, entry.ZoneId, entry.Name, fsckNoPart, "dirty entry (%d parts) has no file in the db", len(entry.DataEntries))
+		return nil
+	}
+	if dbFile.CreatedTs != entry.File.CreatedTs {
+		report.addIssue(FsckCacheMismatch, entry.ZoneId, entry.Name, fsckNoPart, "createdts %d != db createdts %d", entry.File.CreatedTs, dbFile.CreatedTs)
+	}
+	if dbFile.Opts != entry.File.Opts {
+		report.addIssue(FsckCacheMismatch, entry.ZoneId, entry.Name, fsckNoPart, "opts %+v != db opts %+v", entry.File.Opts, dbFile.Opts)
+	}
+	if dbFile.Version > entry.File.Version {
+		report.addIssue(FsckCacheMismatch, entry.ZoneId, entry.Name, fsckNoPart, "version %d is older than db version %d", entry.File.Version, dbFile.Version)
+	}
+	return nil
+}
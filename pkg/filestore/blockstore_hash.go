@@ -0,0 +1,219 @@
+// Copyright 2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package filestore
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+)
+
+// returned by VerifiedWriter.Close when the file's contents don't match the expected hash
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+// a computed ContentHash, valid while the file's (CreatedTs, Version) is unchanged
+type contentHash struct {
+	CreatedTs int64
+	Version   int64
+	Hash      []byte
+}
+
+// returns the SHA-256 of the file's logical contents: the bytes ReadFile would return, so for circular
+// files only the retained data, in logical order (sparse holes hash as zeros).  opts, meta, and timestamps
+// are not included, so files with the same data hash the same, whatever zone they are in.
+//
+// the data is read one part at a time (never the whole file at once) under the entry lock, so the hash is
+// of a single version of the file.  the result is remembered until the file's version changes (every data
+// and meta change bumps it), so repeated calls on an unchanged file don't re-read it.
+func (s *FileStore) ContentHash(ctx context.Context, zoneId string, name string) ([]byte, error) {
+	if err := s.checkRead(zoneId, name); err != nil {
+		return nil, err
+	}
+	return withLockRtn(s, zoneId, name, func(entry *CacheEntry) ([]byte, error) {
+		file, err := entry.loadFileForRead(ctx)
+		if err != nil {
+			return nil, err
+		}
+		key := cacheKey{ZoneId: zoneId, Name: name}
+		s.lock()
+		cached, found := s.contentHashes[key]
+		s.Lock.Unlock()
+		if found && cached.CreatedTs == file.CreatedTs && cached.Version == file.Version {
+			return append([]byte(nil), cached.Hash...), nil
+		}
+		hasher := sha256.New()
+		for offset := file.DataStartIdx(); offset < file.Size; {
+			chunkSize := partDataSize - offset%partDataSize
+			_, data, err := entry.readAt(ctx, offset, chunkSize, false)
+			if err != nil {
+				return nil, err
+			}
+			hasher.Write(data)
+			offset += chunkSize
+		}
+		hash := hasher.Sum(nil)
+		s.lock()
+		if s.contentHashes == nil {
+			s.contentHashes = make(map[cacheKey]contentHash)
+		}
+		s.contentHashes[key] = contentHash{CreatedTs: file.CreatedTs, Version: file.Version, Hash: hash}
+		s.Lock.Unlock()
+		return append([]byte(nil), hash...), nil
+	})
+}
+
+// must hold the entry lock
+func (s *FileStore) dropContentHash(zoneId string, name string) {
+	s.lock()
+	defer s.Lock.Unlock()
+	delete(s.contentHashes, cacheKey{ZoneId: zoneId, Name: name})
+}
+
+// appends to a file and checks its final contents against an expected SHA-256 on Close, for ingesting
+// data with a known checksum (see NewVerifiedWriter).  not safe for concurrent use.
+//
+// writes are buffered and go to the store one part at a time: the first chunk fills out the file's last
+// part, after that every chunk is a whole aligned part handed to the cache without copying (like
+// AppendFrom), so only the final fragment (on Flush or Close) is a partial-part write.  like bufio.Writer,
+// after an append fails every later Write and Flush returns the same error.
+type VerifiedWriter struct {
+	s                *FileStore
+	ctx              context.Context
+	zoneId           string
+	name             string
+	expectedHash     []byte
+	deleteOnMismatch bool
+	closed           bool
+	buf              []byte // pending data, cap is the distance to the next part boundary
+	nextChunk        int64  // cap of the next buf, 0 until the file's size has been looked up
+	err              error
+}
+
+// returns a writer whose Writes append to the (existing) file, and whose Close checks the ContentHash of
+// the file against expectedHash.  the hash covers the whole file, so this is meant for filling a new, empty
+// file; other appends to the file while the writer is open make the check fail.  on a mismatch Close
+// returns ErrChecksumMismatch, after deleting the file if deleteOnMismatch is set (otherwise the file is
+// left as written, for the caller to inspect or delete).
+// the hash is computed from what the store returns for the file, not from the bytes handed to Write, so
+// Close also catches data lost or mangled on the way into the store.
+func (s *FileStore) NewVerifiedWriter(ctx context.Context, zoneId string, name string, expectedHash []byte, deleteOnMismatch bool) *VerifiedWriter {
+	return &VerifiedWriter{
+		s:                s,
+		ctx:              ctx,
+		zoneId:           zoneId,
+		name:             name,
+		expectedHash:     append([]byte(nil), expectedHash...),
+		deleteOnMismatch: deleteOnMismatch,
+	}
+}
+
+func (w *VerifiedWriter) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, fs.ErrClosed
+	}
+	if w.err != nil {
+		return 0, w.err
+	}
+	var written int
+	for len(p) > 0 {
+		if w.buf == nil {
+			w.buf = make([]byte, 0, w.nextChunkSize())
+		}
+		n := copy(w.buf[len(w.buf):cap(w.buf)], p)
+		w.buf = w.buf[:len(w.buf)+n]
+		p = p[n:]
+		written += n
+		if len(w.buf) == cap(w.buf) {
+			if err := w.writeBuf(); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+// writes out the buffered partial part and flushes the file to the DB, for callers that need what has been
+// written so far to be durable mid-stream
+func (w *VerifiedWriter) Flush() error {
+	if w.closed {
+		return fs.ErrClosed
+	}
+	if err := w.writeBuf(); err != nil {
+		return err
+	}
+	_, err := withPrerequisitesLocked(w.ctx, w.s, []cacheKey{{ZoneId: w.zoneId, Name: w.name}}, func(entries []*CacheEntry) (struct{}, error) {
+		return struct{}{}, entries[0].flushToDB(w.ctx, false)
+	})
+	return err
+}
+
+// checks the file's contents against the expected hash, see NewVerifiedWriter.  closing twice is a no-op.
+func (w *VerifiedWriter) Close() error {
+	if w.closed {
+		return nil
+	}
+	err := w.writeBuf()
+	w.closed = true
+	if err != nil {
+		return err
+	}
+	hash, err := w.s.ContentHash(w.ctx, w.zoneId, w.name)
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(hash, w.expectedHash) {
+		return nil
+	}
+	mismatchErr := fmt.Errorf("%w for file %s:%s: expected %s, got %s", ErrChecksumMismatch, w.zoneId, w.name, hex.EncodeToString(w.expectedHash), hex.EncodeToString(hash))
+	if w.deleteOnMismatch {
+		if err := w.s.DeleteFile(w.ctx, w.zoneId, w.name); err != nil {
+			return fmt.Errorf("%w (error deleting file: %v)", mismatchErr, err)
+		}
+	}
+	return mismatchErr
+}
+
+// the size of the next buffer: up to the next part boundary of the file.  the file's size is only looked
+// up once (it is a hint, the appends report any error, and a concurrent append just costs alignment).
+func (w *VerifiedWriter) nextChunkSize() int64 {
+	if w.nextChunk > 0 {
+		return w.nextChunk
+	}
+	fileSize, _ := withLockRtn(w.s, w.zoneId, w.name, func(entry *CacheEntry) (int64, error) {
+		file, err := entry.loadFileForRead(w.ctx)
+		if err != nil {
+			return 0, err
+		}
+		return file.Size, nil
+	})
+	return partDataSize - fileSize%partDataSize
+}
+
+// appends the buffered data.  a full buffer ends at a part boundary, if it is a whole part the cache adopts
+// it (so buffers are never reused).
+func (w *VerifiedWriter) writeBuf() error {
+	if w.err != nil {
+		return w.err
+	}
+	if len(w.buf) == 0 {
+		return nil
+	}
+	buf := w.buf
+	w.buf = nil
+	if len(buf) == cap(buf) {
+		w.nextChunk = partDataSize
+	} else {
+		w.nextChunk = int64(cap(buf) - len(buf))
+	}
+	_, err := w.s.appendData(w.ctx, w.zoneId, w.name, buf, len(buf) == cap(buf))
+	if err != nil {
+		w.err = err
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+// Copyright 2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package filestore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// returned by AcquireLease when another holder has an unexpired lease on the file
+var ErrLeaseHeld = errors.New("file is leased")
+
+// returned by writes with WriteOpts.LeaseId (and by ReleaseLease) when the lease isn't the file's current lease
+var ErrNoLease = errors.New("no valid lease")
+
+type fileLease struct {
+	LeaseId   string
+	ExpiresTs time.Time
+}
+
+// grants an advisory lease on the file for ttl, for coordinating application-level writers.  leases are
+// advisory: only writes that pass WriteOpts.LeaseId are checked, other writes are never blocked.  leases
+// are held in memory (they don't survive a restart) and expire on their own, an expired lease can be
+// taken by anyone.
+//
+// leases change hands under the entry lock, the same lock a write holds while it checks its lease and
+// writes.  so a write that found its lease valid always completes before the lease can expire into
+// someone else's hands, and a write that starts after expiry fails with ErrNoLease.
+func (s *FileStore) AcquireLease(ctx context.Context, zoneId string, name string, ttl time.Duration) (string, error) {
+	if err := s.checkWrite(zoneId, name); err != nil {
+		return "", err
+	}
+	if ttl <= 0 {
+		return "", fmt.Errorf("lease ttl must be positive")
+	}
+	return withLockRtn(s, zoneId, name, func(entry *CacheEntry) (string, error) {
+		_, err := entry.loadFileForRead(ctx)
+		if err != nil {
+			return "", err
+		}
+		now := time.Now()
+		key := cacheKey{ZoneId: zoneId, Name: name}
+		s.lock()
+		defer s.Lock.Unlock()
+		for leaseKey, lease := range s.leases {
+			if !now.Before(lease.ExpiresTs) {
+				delete(s.leases, leaseKey)
+			}
+		}
+		if _, found := s.leases[key]; found {
+			return "", ErrLeaseHeld
+		}
+		if s.leases == nil {
+			s.leases = make(map[cacheKey]fileLease)
+		}
+		leaseId := uuid.NewString()
+		s.leases[key] = fileLease{LeaseId: leaseId, ExpiresTs: now.Add(ttl)}
+		return leaseId, nil
+	})
+}
+
+// releases a lease early, fails with ErrNoLease if leaseId isn't the file's current (unexpired) lease
+func (s *FileStore) ReleaseLease(zoneId string, name string, leaseId string) error {
+	if err := s.checkWrite(zoneId, name); err != nil {
+		return err
+	}
+	return withLock(s, zoneId, name, func(entry *CacheEntry) error {
+		err := s.checkLease(zoneId, name, leaseId)
+		if err != nil {
+			return err
+		}
+		s.lock()
+		defer s.Lock.Unlock()
+		delete(s.leases, cacheKey{ZoneId: zoneId, Name: name})
+		return nil
+	})
+}
+
+// must hold the entry lock (so the lease can't change hands until the caller releases it)
+func (s *FileStore) checkLease(zoneId string, name string, leaseId string) error {
+	s.lock()
+	defer s.Lock.Unlock()
+	lease, found := s.leases[cacheKey{ZoneId: zoneId, Name: name}]
+	if !found || lease.LeaseId != leaseId || !time.Now().Before(lease.ExpiresTs) {
+		return fmt.Errorf("%w: %s:%s", ErrNoLease, zoneId, name)
+	}
+	return nil
+}
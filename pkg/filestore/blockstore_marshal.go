@@ -0,0 +1,383 @@
+// Copyright 2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package filestore
+
+// compact binary export format for a single wave file
+// layout (all integers are big-endian):
+//   magic     [4]byte  "WFSF"
+//   version   uint16
+//   checksum  uint8    (id of the Checksummer that computed the trailing checksum)
+//   opts      uint32 length + json
+//   meta      uint32 length + json
+//   createdts int64
+//   modts     int64
+//   size      int64  (logical size of the file)
+//   datastart int64  (logical offset of the first data byte, non-zero for wrapped circular files)
+//   data      uint64 length + bytes (file data in logical order)
+//   sum       [Checksummer.Size()]byte (over every byte after the magic and version, up to the sum)
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+)
+
+const (
+	MarshalMagic   = "WFSF"
+	MarshalVersion = 2
+)
+
+const marshalHeaderSize = len(MarshalMagic) + 2
+
+// whole-store snapshot format (see SnapshotAll), all integers are big-endian:
+//   magic     [4]byte  "WFSS"
+//   version   uint16
+//   count     uint64   (number of files)
+//   per file: uint16 length + zoneid, uint16 length + name, uint64 length + MarshalFile blob
+
+const (
+	SnapshotMagic   = "WFSS"
+	SnapshotVersion = 1
+)
+
+func marshalWaveFile(file *WaveFile, dataStart int64, data []byte, checksummer Checksummer) ([]byte, error) {
+	optsBytes, err := json.Marshal(file.Opts)
+	if err != nil {
+		return nil, fmt.Errorf("error marshaling opts: %w", err)
+	}
+	metaBytes, err := json.Marshal(file.Meta)
+	if err != nil {
+		return nil, fmt.Errorf("error marshaling meta: %w", err)
+	}
+	var buf bytes.Buffer
+	buf.WriteString(MarshalMagic)
+	binary.Write(&buf, binary.BigEndian, uint16(MarshalVersion))
+	buf.WriteByte(checksummer.Id())
+	binary.Write(&buf, binary.BigEndian, uint32(len(optsBytes)))
+	buf.Write(optsBytes)
+	binary.Write(&buf, binary.BigEndian, uint32(len(metaBytes)))
+	buf.Write(metaBytes)
+	binary.Write(&buf, binary.BigEndian, file.CreatedTs)
+	binary.Write(&buf, binary.BigEndian, file.ModTs)
+	binary.Write(&buf, binary.BigEndian, file.Size)
+	binary.Write(&buf, binary.BigEndian, dataStart)
+	binary.Write(&buf, binary.BigEndian, uint64(len(data)))
+	buf.Write(data)
+	buf.Write(checksummer.Sum(buf.Bytes()[marshalHeaderSize:]))
+	return buf.Bytes(), nil
+}
+
+// returns (file, dataStart, data, error)
+// the returned file does not have ZoneId or Name set.  getChecksummer maps the blob's checksum id to the
+// algorithm to verify it with.
+func unmarshalWaveFile(blob []byte, getChecksummer func(id uint8) (Checksummer, error)) (*WaveFile, int64, []byte, error) {
+	if len(blob) < marshalHeaderSize+1 {
+		return nil, 0, nil, fmt.Errorf("invalid file blob: too short")
+	}
+	if string(blob[:len(MarshalMagic)]) != MarshalMagic {
+		return nil, 0, nil, fmt.Errorf("invalid file blob: bad magic")
+	}
+	version := binary.BigEndian.Uint16(blob[len(MarshalMagic):marshalHeaderSize])
+	if version != MarshalVersion {
+		return nil, 0, nil, fmt.Errorf("invalid file blob: unsupported version %d", version)
+	}
+	checksummer, err := getChecksummer(blob[marshalHeaderSize])
+	if err != nil {
+		return nil, 0, nil, fmt.Errorf("invalid file blob: %w", err)
+	}
+	sumSize := checksummer.Size()
+	// the checksum id byte and the sum
+	if len(blob) < marshalHeaderSize+1+sumSize {
+		return nil, 0, nil, fmt.Errorf("invalid file blob: too short")
+	}
+	payload := blob[marshalHeaderSize : len(blob)-sumSize]
+	if !bytes.Equal(checksummer.Sum(payload), blob[len(blob)-sumSize:]) {
+		return nil, 0, nil, fmt.Errorf("invalid file blob: checksum mismatch")
+	}
+	payload = payload[1:]
+	rd := bytes.NewReader(payload)
+	readBytes := func(n uint64) ([]byte, error) {
+		if n > uint64(rd.Len()) {
+			return nil, fmt.Errorf("invalid file blob: truncated")
+		}
+		rtn := make([]byte, n)
+		rd.Read(rtn)
+		return rtn, nil
+	}
+	var file WaveFile
+	var optsLen, metaLen uint32
+	if err := binary.Read(rd, binary.BigEndian, &optsLen); err != nil {
+		return nil, 0, nil, fmt.Errorf("invalid file blob: %w", err)
+	}
+	optsBytes, err := readBytes(uint64(optsLen))
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	if err := json.Unmarshal(optsBytes, &file.Opts); err != nil {
+		return nil, 0, nil, fmt.Errorf("invalid file blob: error unmarshaling opts: %w", err)
+	}
+	if err := binary.Read(rd, binary.BigEndian, &metaLen); err != nil {
+		return nil, 0, nil, fmt.Errorf("invalid file blob: %w", err)
+	}
+	metaBytes, err := readBytes(uint64(metaLen))
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	if err := json.Unmarshal(metaBytes, &file.Meta); err != nil {
+		return nil, 0, nil, fmt.Errorf("invalid file blob: error unmarshaling meta: %w", err)
+	}
+	var dataStart int64
+	var dataLen uint64
+	for _, ptr := range []any{&file.CreatedTs, &file.ModTs, &file.Size, &dataStart, &dataLen} {
+		if err := binary.Read(rd, binary.BigEndian, ptr); err != nil {
+			return nil, 0, nil, fmt.Errorf("invalid file blob: %w", err)
+		}
+	}
+	data, err := readBytes(dataLen)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	if rd.Len() != 0 {
+		return nil, 0, nil, fmt.Errorf("invalid file blob: %d trailing bytes", rd.Len())
+	}
+	if dataStart < 0 || dataStart+int64(len(data)) != file.Size {
+		return nil, 0, nil, fmt.Errorf("invalid file blob: data range does not match size")
+	}
+	return &file, dataStart, data, nil
+}
+
+// returns a self-describing binary blob with the file's opts, meta, and data (see UnmarshalFile)
+func (s *FileStore) MarshalFile(ctx context.Context, zoneId string, name string) ([]byte, error) {
+	if err := s.checkRead(zoneId, name); err != nil {
+		return nil, err
+	}
+	return withLockRtn(s, zoneId, name, func(entry *CacheEntry) ([]byte, error) {
+		file, err := entry.loadFileForRead(ctx)
+		if err != nil {
+			return nil, err
+		}
+		dataStart, data, err := entry.readAt(ctx, 0, 0, true)
+		if err != nil {
+			return nil, err
+		}
+		checksummer, err := s.checksummer()
+		if err != nil {
+			return nil, err
+		}
+		return marshalWaveFile(file, dataStart, data, checksummer)
+	})
+}
+
+// restores a file from a blob created by MarshalFile (the file must not already exist)
+// the blob's checksum is verified before anything is written, and the file is created with all of its
+// data in a single DB transaction (like MakeFileWithData), so a failed restore leaves nothing behind
+func (s *FileStore) UnmarshalFile(ctx context.Context, zoneId string, name string, blob []byte) error {
+	file, dataStart, data, err := s.decodeFileBlob(zoneId, name, blob)
+	if err != nil {
+		return err
+	}
+	return withLock(s, zoneId, name, func(entry *CacheEntry) error {
+		if entry.File != nil {
+			return fs.ErrExist
+		}
+		_, err := entry.createFileWithData(ctx, file, dataStart, data)
+		return err
+	})
+}
+
+// checks that zoneId:name can be restored and decodes blob (see unmarshalWaveFile) into the file to create
+// returns (file, dataStart, data, error)
+func (s *FileStore) decodeFileBlob(zoneId string, name string, blob []byte) (*WaveFile, int64, []byte, error) {
+	if err := s.checkWrite(zoneId, name); err != nil {
+		return nil, 0, nil, err
+	}
+	if err := s.checkNewName(zoneId, name); err != nil {
+		return nil, 0, nil, err
+	}
+	file, dataStart, data, err := unmarshalWaveFile(blob, s.checksummerById)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	file.Opts, err = validateFileOpts(file.Opts)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	file.ZoneId = zoneId
+	file.Name = name
+	file.Size = 0
+	return file, dataStart, data, nil
+}
+
+// writes a consistent point-in-time dump of every file in the store to w (restore with RestoreAll).
+//
+// consistency model: the store is quiesced (every file operation blocks, in-flight ones finish first)
+// while all dirty entries are flushed and a DB read transaction takes its snapshot.  so the dump contains
+// every write that completed before SnapshotAll was called and none that started after.  the quiesce is
+// released as soon as the transaction has its snapshot and the files are streamed from that transaction.
+// the DB uses a single connection, so while the dump is streaming, operations that need the DB (cache
+// misses, flushes) wait for it to finish.  operations on resident files proceed normally.
+//
+// the output is deterministic, so dumps can be checksummed to detect drift: files are ordered by
+// (zoneid, name), data is emitted in logical order (how parts are split, encoded, or deduplicated
+// doesn't show), meta is json with sorted keys, and the only timestamps are the files' own createdts
+// and modts.  two dumps of the same state are byte-identical, as is a dump of a RestoreAll of it.
+func (s *FileStore) SnapshotAll(ctx context.Context, w io.Writer) error {
+	checksummer, err := s.checksummer()
+	if err != nil {
+		return err
+	}
+	s.quiesceLock.Lock()
+	quiesced := true
+	defer func() {
+		if quiesced {
+			s.quiesceLock.Unlock()
+		}
+	}()
+	// prerequisites first, a dependent flushed before them would be blocked
+	for _, key := range s.flushOrder(s.getCacheKeys()) {
+		err := withEntryLock(s, key.ZoneId, key.Name, func(entry *CacheEntry) error {
+			return entry.flushToDB(ctx, false)
+		})
+		if err != nil {
+			return fmt.Errorf("error flushing %s:%s for snapshot: %w", key.ZoneId, key.Name, err)
+		}
+	}
+	return WithTx(ctx, func(tx *TxWrap) error {
+		txCtx := tx.Context()
+		files, err := dbGetAllFiles(txCtx)
+		if err != nil {
+			return fmt.Errorf("error getting files for snapshot: %w", err)
+		}
+		// the read transaction has its snapshot, let other operations proceed
+		s.quiesceLock.Unlock()
+		quiesced = false
+		bufWriter := bufio.NewWriter(w)
+		bufWriter.WriteString(SnapshotMagic)
+		binary.Write(bufWriter, binary.BigEndian, uint16(SnapshotVersion))
+		binary.Write(bufWriter, binary.BigEndian, uint64(len(files)))
+		for _, file := range files {
+			// detached entry (not in the cache), so all reads come from the transaction
+			entry := makeCacheEntry(s, file.ZoneId, file.Name)
+			dataStart, data, err := entry.readAt(txCtx, 0, 0, true)
+			if err != nil {
+				return fmt.Errorf("error reading %s:%s for snapshot: %w", file.ZoneId, file.Name, err)
+			}
+			blob, err := marshalWaveFile(file, dataStart, data, checksummer)
+			if err != nil {
+				return err
+			}
+			writeSnapshotString(bufWriter, file.ZoneId)
+			writeSnapshotString(bufWriter, file.Name)
+			binary.Write(bufWriter, binary.BigEndian, uint64(len(blob)))
+			_, err = bufWriter.Write(blob)
+			if err != nil {
+				return fmt.Errorf("error writing snapshot: %w", err)
+			}
+		}
+		err = bufWriter.Flush()
+		if err != nil {
+			return fmt.Errorf("error writing snapshot: %w", err)
+		}
+		return nil
+	})
+}
+
+// restores every file from a dump created by SnapshotAll.  none of the files may already exist
+// (returns fs.ErrExist).  the whole dump is read and every blob is verified before anything is written,
+// then all of the files are created in a single DB transaction, so a failed restore leaves nothing
+// behind.  the store is quiesced (see SnapshotAll) while that transaction runs.
+func (s *FileStore) RestoreAll(ctx context.Context, r io.Reader) error {
+	bufReader := bufio.NewReader(r)
+	header := make([]byte, len(SnapshotMagic)+2)
+	_, err := io.ReadFull(bufReader, header)
+	if err != nil {
+		return fmt.Errorf("invalid snapshot: %w", err)
+	}
+	if string(header[:len(SnapshotMagic)]) != SnapshotMagic {
+		return fmt.Errorf("invalid snapshot: bad magic")
+	}
+	version := binary.BigEndian.Uint16(header[len(SnapshotMagic):])
+	if version != SnapshotVersion {
+		return fmt.Errorf("invalid snapshot: unsupported version %d", version)
+	}
+	var count uint64
+	err = binary.Read(bufReader, binary.BigEndian, &count)
+	if err != nil {
+		return fmt.Errorf("invalid snapshot: %w", err)
+	}
+	type restoredFile struct {
+		file      *WaveFile
+		dataStart int64
+		data      []byte
+	}
+	var restored []restoredFile
+	for i := uint64(0); i < count; i++ {
+		zoneId, err := readSnapshotString(bufReader)
+		if err != nil {
+			return err
+		}
+		name, err := readSnapshotString(bufReader)
+		if err != nil {
+			return err
+		}
+		var blobLen uint64
+		err = binary.Read(bufReader, binary.BigEndian, &blobLen)
+		if err != nil {
+			return fmt.Errorf("invalid snapshot: %w", err)
+		}
+		// grows as data arrives (a corrupt length can't force a huge allocation)
+		var blobBuf bytes.Buffer
+		_, err = io.CopyN(&blobBuf, bufReader, int64(blobLen))
+		if err != nil {
+			return fmt.Errorf("invalid snapshot: %w", err)
+		}
+		file, dataStart, data, err := s.decodeFileBlob(zoneId, name, blobBuf.Bytes())
+		if err != nil {
+			return fmt.Errorf("error restoring %s:%s: %w", zoneId, name, err)
+		}
+		restored = append(restored, restoredFile{file: file, dataStart: dataStart, data: data})
+	}
+	// the transaction is open while the entry locks are taken, so nothing else may hold one and wait on the DB
+	s.quiesceLock.Lock()
+	defer s.quiesceLock.Unlock()
+	return WithTx(ctx, func(tx *TxWrap) error {
+		for _, rf := range restored {
+			err := withEntryLock(s, rf.file.ZoneId, rf.file.Name, func(entry *CacheEntry) error {
+				if entry.File != nil {
+					return fs.ErrExist
+				}
+				_, err := entry.createFileWithData(tx.Context(), rf.file, rf.dataStart, rf.data)
+				return err
+			})
+			if err != nil {
+				return fmt.Errorf("error restoring %s:%s: %w", rf.file.ZoneId, rf.file.Name, err)
+			}
+		}
+		return nil
+	})
+}
+
+func writeSnapshotString(w *bufio.Writer, str string) {
+	binary.Write(w, binary.BigEndian, uint16(len(str)))
+	w.WriteString(str)
+}
+
+func readSnapshotString(r io.Reader) (string, error) {
+	var strLen uint16
+	err := binary.Read(r, binary.BigEndian, &strLen)
+	if err != nil {
+		return "", fmt.Errorf("invalid snapshot: %w", err)
+	}
+	buf := make([]byte, strLen)
+	_, err = io.ReadFull(r, buf)
+	if err != nil {
+		return "", fmt.Errorf("invalid snapshot: %w", err)
+	}
+	return string(buf), nil
+}
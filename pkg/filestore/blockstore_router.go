@@ -0,0 +1,129 @@
+// Copyright 2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package filestore
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// virtual nodes per store on the hash ring, more nodes spread zones more evenly
+const routerReplicas = 64
+
+type routerNode struct {
+	Hash      uint64
+	StoreName string
+}
+
+// routes each zone to one of several FileStores using consistent hashing, so adding or removing a store
+// only moves the zones that hashed to it (about 1/n of them).  stores are identified by name (not by
+// pointer) so the routing is stable across restarts as long as the same names are used.
+//
+// all FileStores share the same DB, so a zone that moves to another store still sees its data.  its old
+// store may hold unflushed writes though: callers should FlushCache the old stores after changing the set
+// of stores (before writing to moved zones through the router).
+type StoreRouter struct {
+	lock   *sync.RWMutex
+	stores map[string]*FileStore
+	ring   []routerNode // sorted by Hash
+}
+
+func MakeStoreRouter() *StoreRouter {
+	return &StoreRouter{
+		lock:   &sync.RWMutex{},
+		stores: make(map[string]*FileStore),
+	}
+}
+
+func routerHash(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return h.Sum64()
+}
+
+// adds (or replaces) the store with the given name
+func (r *StoreRouter) AddStore(name string, store *FileStore) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if _, found := r.stores[name]; !found {
+		for i := 0; i < routerReplicas; i++ {
+			r.ring = append(r.ring, routerNode{Hash: routerHash(name + "#" + strconv.Itoa(i)), StoreName: name})
+		}
+		sort.Slice(r.ring, func(i, j int) bool {
+			return r.ring[i].Hash < r.ring[j].Hash
+		})
+	}
+	r.stores[name] = store
+}
+
+// removes the store with the given name (a no-op if it was never added)
+func (r *StoreRouter) RemoveStore(name string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if _, found := r.stores[name]; !found {
+		return
+	}
+	delete(r.stores, name)
+	newRing := make([]routerNode, 0, len(r.ring))
+	for _, node := range r.ring {
+		if node.StoreName != name {
+			newRing = append(newRing, node)
+		}
+	}
+	r.ring = newRing
+}
+
+// returns the name and store that zoneId routes to, or an error if the router has no stores
+func (r *StoreRouter) Route(zoneId string) (string, *FileStore, error) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	if len(r.ring) == 0 {
+		return "", nil, fmt.Errorf("store router has no stores")
+	}
+	hash := routerHash(zoneId)
+	idx := sort.Search(len(r.ring), func(i int) bool {
+		return r.ring[i].Hash >= hash
+	})
+	if idx == len(r.ring) {
+		idx = 0
+	}
+	name := r.ring[idx].StoreName
+	return name, r.stores[name], nil
+}
+
+func (r *StoreRouter) WriteAt(ctx context.Context, zoneId string, name string, offset int64, data []byte) (int64, error) {
+	_, store, err := r.Route(zoneId)
+	if err != nil {
+		return 0, err
+	}
+	return store.WriteAt(ctx, zoneId, name, offset, data)
+}
+
+func (r *StoreRouter) ReadAt(ctx context.Context, zoneId string, name string, offset int64, size int64) (int64, []byte, error) {
+	_, store, err := r.Route(zoneId)
+	if err != nil {
+		return 0, nil, err
+	}
+	return store.ReadAt(ctx, zoneId, name, offset, size)
+}
+
+func (r *StoreRouter) Stat(ctx context.Context, zoneId string, name string) (*WaveFile, error) {
+	_, store, err := r.Route(zoneId)
+	if err != nil {
+		return nil, err
+	}
+	return store.Stat(ctx, zoneId, name)
+}
+
+func (r *StoreRouter) DeleteFile(ctx context.Context, zoneId string, name string) error {
+	_, store, err := r.Route(zoneId)
+	if err != nil {
+		return err
+	}
+	return store.DeleteFile(ctx, zoneId, name)
+}
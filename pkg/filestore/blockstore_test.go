@@ -6,11 +6,18 @@ package filestore
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/binary"
 	"errors"
 	"fmt"
+	"io"
 	"io/fs"
 	"log"
+	"math"
+	mathrand "math/rand"
 	"reflect"
+	"sort"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"testing"
@@ -20,7 +27,7 @@ import (
 	"github.com/wavetermdev/waveterm/pkg/ijson"
 )
 
-func initDb(t *testing.T) {
+func initDb(t testing.TB) {
 	t.Logf("initializing db for %q", t.Name())
 	useTestingDb = true
 	partDataSize = 50
@@ -32,8 +39,11 @@ func initDb(t *testing.T) {
 	}
 }
 
-func cleanupDb(t *testing.T) {
+func cleanupDb(t testing.TB) {
 	t.Logf("cleaning up db for %q", t.Name())
+	if err := WFS.checkInvariants(); err != nil {
+		t.Errorf("cache invariant violated: %v", err)
+	}
 	if globalDB != nil {
 		globalDB.Close()
 		globalDB = nil
@@ -59,6 +69,143 @@ func (s *FileStore) clearCache() {
 	s.Lock.Lock()
 	defer s.Lock.Unlock()
 	s.Cache = make(map[cacheKey]*CacheEntry)
+	s.ResidentBytes = 0
+	s.dirtySince = nil
+	s.dirtyOrder = nil
+	s.writeThrottled = false
+	s.leases = nil
+	s.throughput = [throughputBuckets]throughputBucket{}
+	s.breaker = backendBreaker{}
+	s.contentHashes = nil
+	s.flushDeps = nil
+	s.flusherPaused = false
+	s.overBudget = false
+	s.budgetOverruns = 0
+}
+
+// walks the cache and returns an error describing the first violated invariant.
+// must only be called when the store is idle (no operations in flight).
+func (s *FileStore) checkInvariants() error {
+	s.Lock.Lock()
+	entries := make(map[cacheKey]*CacheEntry)
+	for key, entry := range s.Cache {
+		entries[key] = entry
+	}
+	storeResidentBytes := s.ResidentBytes
+	dirtySince := make(map[cacheKey]int64)
+	for key, item := range s.dirtySince {
+		dirtySince[key] = item.dirtyTs
+	}
+	var heapErr error
+	if len(s.dirtyOrder) != len(s.dirtySince) {
+		heapErr = fmt.Errorf("dirty heap has %d items, dirty index has %d", len(s.dirtyOrder), len(s.dirtySince))
+	}
+	for idx, item := range s.dirtyOrder {
+		if heapErr == nil && (item.index != idx || s.dirtySince[item.key] != item) {
+			heapErr = fmt.Errorf("dirty heap item %d (%s:%s) is out of sync with the dirty index", idx, item.key.ZoneId, item.key.Name)
+		}
+		if heapErr == nil && idx > 0 && item.dirtyTs < s.dirtyOrder[(idx-1)/2].dirtyTs {
+			heapErr = fmt.Errorf("dirty heap order violated at item %d", idx)
+		}
+	}
+	s.Lock.Unlock()
+	if heapErr != nil {
+		return heapErr
+	}
+	var totalResidentBytes int64
+	for key, entry := range entries {
+		err := checkEntryInvariants(s, key, entry)
+		if err != nil {
+			return fmt.Errorf("entry %s:%s: %w", key.ZoneId, key.Name, err)
+		}
+		s.Lock.Lock()
+		totalResidentBytes += entry.ResidentBytes
+		s.Lock.Unlock()
+	}
+	if storeResidentBytes != totalResidentBytes {
+		return fmt.Errorf("store resident bytes %d != sum of entry resident bytes %d", storeResidentBytes, totalResidentBytes)
+	}
+	for key, entry := range entries {
+		entry.Lock.Lock()
+		dirtyTs := entry.DirtyTs
+		entry.Lock.Unlock()
+		if dirtySince[key] != dirtyTs {
+			return fmt.Errorf("entry %s:%s: dirty index ts %d != entry dirty ts %d", key.ZoneId, key.Name, dirtySince[key], dirtyTs)
+		}
+		delete(dirtySince, key)
+	}
+	if len(dirtySince) > 0 {
+		return fmt.Errorf("%d dirty index entries without a cache entry", len(dirtySince))
+	}
+	return nil
+}
+
+func checkEntryInvariants(s *FileStore, key cacheKey, entry *CacheEntry) error {
+	entry.Lock.Lock()
+	defer entry.Lock.Unlock()
+	s.Lock.Lock()
+	pinCount := entry.PinCount
+	residentBytes := entry.ResidentBytes
+	s.Lock.Unlock()
+	if entry.ZoneId != key.ZoneId || entry.Name != key.Name {
+		return fmt.Errorf("cache key does not match entry (%s:%s)", entry.ZoneId, entry.Name)
+	}
+	if entry.Store != s {
+		return fmt.Errorf("entry belongs to a different store")
+	}
+	if pinCount < 0 {
+		return fmt.Errorf("negative pin count %d", pinCount)
+	}
+	if pinCount == 0 && entry.File == nil {
+		return fmt.Errorf("unpinned clean entry was not removed from the cache")
+	}
+	if residentBytes != entry.residentBytes() {
+		return fmt.Errorf("accounted resident bytes %d != actual %d", residentBytes, entry.residentBytes())
+	}
+	if entry.FlushErrors < 0 {
+		return fmt.Errorf("negative flush error count %d", entry.FlushErrors)
+	}
+	file := entry.File
+	if file == nil {
+		if len(entry.DataEntries) > 0 {
+			return fmt.Errorf("%d dirty parts without a file", len(entry.DataEntries))
+		}
+		if len(entry.FlushWaiters) > 0 {
+			return fmt.Errorf("%d flush waiters without a file", len(entry.FlushWaiters))
+		}
+		return nil
+	}
+	if file.ZoneId != entry.ZoneId || file.Name != entry.Name {
+		return fmt.Errorf("file %s:%s does not match entry", file.ZoneId, file.Name)
+	}
+	if file.Size < 0 {
+		return fmt.Errorf("negative file size %d", file.Size)
+	}
+	if file.Opts.Circular && (file.Opts.MaxSize <= 0 || file.Opts.MaxSize%partDataSize != 0) {
+		return fmt.Errorf("circular max size %d is not a positive multiple of the part size", file.Opts.MaxSize)
+	}
+	for partIdx, dce := range entry.DataEntries {
+		if dce == nil {
+			return fmt.Errorf("nil data entry for part %d", partIdx)
+		}
+		if dce.PartIdx != partIdx {
+			return fmt.Errorf("part %d stored under index %d", dce.PartIdx, partIdx)
+		}
+		if partIdx < 0 {
+			return fmt.Errorf("negative part index %d", partIdx)
+		}
+		if cap(dce.Data) > int(partDataSize) {
+			return fmt.Errorf("part %d capacity %d > part size %d", partIdx, cap(dce.Data), partDataSize)
+		}
+		if file.Opts.Circular {
+			if int64(partIdx) >= file.Opts.MaxSize/partDataSize {
+				return fmt.Errorf("circular part %d is past the ring (max size %d)", partIdx, file.Opts.MaxSize)
+			}
+		} else if int64(partIdx)*partDataSize+int64(len(dce.Data)) > file.Size {
+			return fmt.Errorf("part %d (len %d) extends past the file size %d", partIdx, len(dce.Data), file.Size)
+		}
+	}
+	return nil
 }
 
 //lint:ignore U1000 used for testing
@@ -226,7 +373,7 @@ func TestSetMeta(t *testing.T) {
 	if WFS.getCacheSize() != 0 {
 		t.Errorf("cache size mismatch -- should have 0 entries after create")
 	}
-	err = WFS.WriteMeta(ctx, zoneId, "testfile", map[string]any{"a": 5, "b": "hello", "q": 8}, false)
+	_, err = WFS.WriteMeta(ctx, zoneId, "testfile", map[string]any{"a": 5, "b": "hello", "q": 8}, false)
 	if err != nil {
 		t.Fatalf("error setting meta: %v", err)
 	}
@@ -241,7 +388,7 @@ func TestSetMeta(t *testing.T) {
 	if WFS.getCacheSize() != 1 {
 		t.Errorf("cache size mismatch")
 	}
-	err = WFS.WriteMeta(ctx, zoneId, "testfile", map[string]any{"a": 6, "c": "world", "d": 7, "q": nil}, true)
+	_, err = WFS.WriteMeta(ctx, zoneId, "testfile", map[string]any{"a": 6, "c": "world", "d": 7, "q": nil}, true)
 	if err != nil {
 		t.Fatalf("error setting meta: %v", err)
 	}
@@ -254,7 +401,7 @@ func TestSetMeta(t *testing.T) {
 	}
 	checkMapsEqual(t, map[string]any{"a": 6, "b": "hello", "c": "world", "d": 7}, file.Meta, "meta")
 
-	err = WFS.WriteMeta(ctx, zoneId, "testfile-notexist", map[string]any{"a": 6}, true)
+	_, err = WFS.WriteMeta(ctx, zoneId, "testfile-notexist", map[string]any{"a": 6}, true)
 	if err == nil {
 		t.Fatalf("expected error setting meta")
 	}
@@ -327,14 +474,14 @@ func TestAppend(t *testing.T) {
 	if err != nil {
 		t.Fatalf("error creating file: %v", err)
 	}
-	err = WFS.AppendData(ctx, zoneId, fileName, []byte("hello"))
+	_, err = WFS.AppendData(ctx, zoneId, fileName, []byte("hello"))
 	if err != nil {
 		t.Fatalf("error appending data: %v", err)
 	}
 	// fmt.Print(GBS.dump())
 	checkFileSize(t, ctx, zoneId, fileName, 5)
 	checkFileData(t, ctx, zoneId, fileName, "hello")
-	err = WFS.AppendData(ctx, zoneId, fileName, []byte(" world"))
+	_, err = WFS.AppendData(ctx, zoneId, fileName, []byte(" world"))
 	if err != nil {
 		t.Fatalf("error appending data: %v", err)
 	}
@@ -355,17 +502,17 @@ func TestWriteFile(t *testing.T) {
 	if err != nil {
 		t.Fatalf("error creating file: %v", err)
 	}
-	err = WFS.WriteFile(ctx, zoneId, fileName, []byte("hello world!"))
+	_, err = WFS.WriteFile(ctx, zoneId, fileName, []byte("hello world!"))
 	if err != nil {
 		t.Fatalf("error writing data: %v", err)
 	}
 	checkFileData(t, ctx, zoneId, fileName, "hello world!")
-	err = WFS.WriteFile(ctx, zoneId, fileName, []byte("goodbye world!"))
+	_, err = WFS.WriteFile(ctx, zoneId, fileName, []byte("goodbye world!"))
 	if err != nil {
 		t.Fatalf("error writing data: %v", err)
 	}
 	checkFileData(t, ctx, zoneId, fileName, "goodbye world!")
-	err = WFS.WriteFile(ctx, zoneId, fileName, []byte("hello"))
+	_, err = WFS.WriteFile(ctx, zoneId, fileName, []byte("hello"))
 	if err != nil {
 		t.Fatalf("error writing data: %v", err)
 	}
@@ -376,12 +523,12 @@ func TestWriteFile(t *testing.T) {
 	if err != nil {
 		t.Fatalf("error creating file: %v", err)
 	}
-	err = WFS.WriteFile(ctx, zoneId, "c1", []byte("123456789 123456789 123456789 123456789 123456789 apple"))
+	_, err = WFS.WriteFile(ctx, zoneId, "c1", []byte("123456789 123456789 123456789 123456789 123456789 apple"))
 	if err != nil {
 		t.Fatalf("error writing data: %v", err)
 	}
 	checkFileData(t, ctx, zoneId, "c1", "6789 123456789 123456789 123456789 123456789 apple")
-	err = WFS.AppendData(ctx, zoneId, "c1", []byte(" banana"))
+	_, err = WFS.AppendData(ctx, zoneId, "c1", []byte(" banana"))
 	if err != nil {
 		t.Fatalf("error appending data: %v", err)
 	}
@@ -398,35 +545,35 @@ func TestCircularWrites(t *testing.T) {
 	if err != nil {
 		t.Fatalf("error creating file: %v", err)
 	}
-	err = WFS.WriteFile(ctx, zoneId, "c1", []byte("123456789 123456789 123456789 123456789 123456789 "))
+	_, err = WFS.WriteFile(ctx, zoneId, "c1", []byte("123456789 123456789 123456789 123456789 123456789 "))
 	if err != nil {
 		t.Fatalf("error writing data: %v", err)
 	}
 	checkFileData(t, ctx, zoneId, "c1", "123456789 123456789 123456789 123456789 123456789 ")
-	err = WFS.AppendData(ctx, zoneId, "c1", []byte("apple"))
+	_, err = WFS.AppendData(ctx, zoneId, "c1", []byte("apple"))
 	if err != nil {
 		t.Fatalf("error appending data: %v", err)
 	}
 	checkFileData(t, ctx, zoneId, "c1", "6789 123456789 123456789 123456789 123456789 apple")
-	err = WFS.WriteAt(ctx, zoneId, "c1", 0, []byte("foo"))
+	_, err = WFS.WriteAt(ctx, zoneId, "c1", 0, []byte("foo"))
 	if err != nil {
 		t.Fatalf("error writing data: %v", err)
 	}
 	// content should be unchanged because write is before the beginning of circular offset
 	checkFileData(t, ctx, zoneId, "c1", "6789 123456789 123456789 123456789 123456789 apple")
-	err = WFS.WriteAt(ctx, zoneId, "c1", 5, []byte("a"))
+	_, err = WFS.WriteAt(ctx, zoneId, "c1", 5, []byte("a"))
 	if err != nil {
 		t.Fatalf("error writing data: %v", err)
 	}
 	checkFileSize(t, ctx, zoneId, "c1", 55)
 	checkFileData(t, ctx, zoneId, "c1", "a789 123456789 123456789 123456789 123456789 apple")
-	err = WFS.AppendData(ctx, zoneId, "c1", []byte(" banana"))
+	_, err = WFS.AppendData(ctx, zoneId, "c1", []byte(" banana"))
 	if err != nil {
 		t.Fatalf("error appending data: %v", err)
 	}
 	checkFileSize(t, ctx, zoneId, "c1", 62)
 	checkFileData(t, ctx, zoneId, "c1", "3456789 123456789 123456789 123456789 apple banana")
-	err = WFS.WriteAt(ctx, zoneId, "c1", 20, []byte("foo"))
+	_, err = WFS.WriteAt(ctx, zoneId, "c1", 20, []byte("foo"))
 	if err != nil {
 		t.Fatalf("error writing data: %v", err)
 	}
@@ -436,7 +583,7 @@ func TestCircularWrites(t *testing.T) {
 	if offset != 12 {
 		t.Errorf("offset mismatch: expected 12, got %d", offset)
 	}
-	err = WFS.AppendData(ctx, zoneId, "c1", []byte(" world"))
+	_, err = WFS.AppendData(ctx, zoneId, "c1", []byte(" world"))
 	if err != nil {
 		t.Fatalf("error appending data: %v", err)
 	}
@@ -446,7 +593,7 @@ func TestCircularWrites(t *testing.T) {
 		t.Errorf("offset mismatch: expected 18, got %d", offset)
 	}
 	checkFileData(t, ctx, zoneId, "c1", "9 foo456789 123456789 123456789 apple banana world")
-	err = WFS.AppendData(ctx, zoneId, "c1", []byte(" 123456789 123456789 123456789 123456789 bar456789 123456789"))
+	_, err = WFS.AppendData(ctx, zoneId, "c1", []byte(" 123456789 123456789 123456789 123456789 bar456789 123456789"))
 	if err != nil {
 		t.Fatalf("error appending data: %v", err)
 	}
@@ -487,7 +634,7 @@ func TestMultiPart(t *testing.T) {
 	if err != nil {
 		t.Fatalf("error creating file: %v", err)
 	}
-	err = WFS.AppendData(ctx, zoneId, fileName, []byte(data))
+	_, err = WFS.AppendData(ctx, zoneId, fileName, []byte(data))
 	if err != nil {
 		t.Fatalf("error appending data: %v", err)
 	}
@@ -562,7 +709,7 @@ func TestSimpleDBFlush(t *testing.T) {
 	if err != nil {
 		t.Fatalf("error creating file: %v", err)
 	}
-	err = WFS.WriteFile(ctx, zoneId, fileName, []byte("hello world!"))
+	_, err = WFS.WriteFile(ctx, zoneId, fileName, []byte("hello world!"))
 	if err != nil {
 		t.Fatalf("error writing data: %v", err)
 	}
@@ -602,7 +749,7 @@ func TestConcurrentAppend(t *testing.T) {
 			const hexChars = "0123456789abcdef"
 			ch := hexChars[n]
 			for j := 0; j < 100; j++ {
-				err := WFS.AppendData(ctx, zoneId, fileName, []byte{ch})
+				_, err := WFS.AppendData(ctx, zoneId, fileName, []byte{ch})
 				if err != nil {
 					t.Errorf("error appending data (%d): %v", n, err)
 				}
@@ -683,7 +830,7 @@ func TestIJson(t *testing.T) {
 		t.Fatalf("error creating file: %v", err)
 	}
 	rootSet := ijson.MakeSetCommand(nil, map[string]any{"tag": "div", "class": "root"})
-	err = WFS.AppendIJson(ctx, zoneId, fileName, rootSet)
+	_, err = WFS.AppendIJson(ctx, zoneId, fileName, rootSet)
 	if err != nil {
 		t.Fatalf("error appending ijson: %v", err)
 	}
@@ -703,7 +850,7 @@ func TestIJson(t *testing.T) {
 		t.Errorf("data mismatch: expected %v, got %v", rootSet["data"], outData)
 	}
 	childrenAppend := ijson.MakeAppendCommand(ijson.Path{"children"}, map[string]any{"tag": "div", "class": "child"})
-	err = WFS.AppendIJson(ctx, zoneId, fileName, childrenAppend)
+	_, err = WFS.AppendIJson(ctx, zoneId, fileName, childrenAppend)
 	if err != nil {
 		t.Fatalf("error appending ijson: %v", err)
 	}
@@ -725,7 +872,7 @@ func TestIJson(t *testing.T) {
 	if !jsonDeepEqual(ijson.M{"tag": "div", "class": "root", "children": ijson.A{ijson.M{"tag": "div", "class": "child"}}}, outData) {
 		t.Errorf("data mismatch: expected %v, got %v", rootSet["data"], outData)
 	}
-	err = WFS.CompactIJson(ctx, zoneId, fileName)
+	_, err = WFS.CompactIJson(ctx, zoneId, fileName)
 	if err != nil {
 		t.Fatalf("error compacting ijson: %v", err)
 	}
@@ -748,3 +895,5944 @@ func TestIJson(t *testing.T) {
 		t.Errorf("data mismatch: expected %v, got %v", rootSet["data"], outData)
 	}
 }
+
+func TestMarshalFile(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	data := makeText(120)
+	err := WFS.MakeFile(ctx, zoneId, "m1", FileMeta{"foo": "bar"}, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	_, err = WFS.AppendData(ctx, zoneId, "m1", []byte(data))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	blob, err := WFS.MarshalFile(ctx, zoneId, "m1")
+	if err != nil {
+		t.Fatalf("error marshaling file: %v", err)
+	}
+	err = WFS.UnmarshalFile(ctx, zoneId, "m1", blob)
+	if !errors.Is(err, fs.ErrExist) {
+		t.Errorf("expected fs.ErrExist unmarshaling over existing file, got: %v", err)
+	}
+	err = WFS.UnmarshalFile(ctx, zoneId, "m2", blob)
+	if err != nil {
+		t.Fatalf("error unmarshaling file: %v", err)
+	}
+	checkFileSize(t, ctx, zoneId, "m2", 120)
+	checkFileData(t, ctx, zoneId, "m2", data)
+	file, err := WFS.Stat(ctx, zoneId, "m2")
+	if err != nil {
+		t.Fatalf("error stating file: %v", err)
+	}
+	if file.Meta["foo"] != "bar" {
+		t.Errorf("meta mismatch: %v", file.Meta)
+	}
+
+	// circular file (wrapped)
+	err = WFS.MakeFile(ctx, zoneId, "c1", nil, FileOptsType{Circular: true, MaxSize: 50})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	_, err = WFS.AppendData(ctx, zoneId, "c1", []byte(data))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	blob, err = WFS.MarshalFile(ctx, zoneId, "c1")
+	if err != nil {
+		t.Fatalf("error marshaling file: %v", err)
+	}
+	err = WFS.UnmarshalFile(ctx, zoneId, "c2", blob)
+	if err != nil {
+		t.Fatalf("error unmarshaling file: %v", err)
+	}
+	checkFileSize(t, ctx, zoneId, "c2", 120)
+	checkFileData(t, ctx, zoneId, "c2", data[70:])
+	offset, _, _ := WFS.ReadFile(ctx, zoneId, "c2")
+	if offset != 70 {
+		t.Errorf("offset mismatch: expected 70, got %d", offset)
+	}
+
+	// corruption is detected
+	blob[len(blob)/2] ^= 0xff
+	err = WFS.UnmarshalFile(ctx, zoneId, "c3", blob)
+	if err == nil {
+		t.Errorf("expected error unmarshaling corrupted blob")
+	}
+	_, err = WFS.Stat(ctx, zoneId, "c3")
+	if err != fs.ErrNotExist {
+		t.Errorf("expected corrupted blob to not create a file, got: %v", err)
+	}
+}
+
+// xor of all bytes, only for exercising custom checksummer ids
+type xorChecksummer struct{}
+
+func (xorChecksummer) Id() uint8 { return 200 }
+func (xorChecksummer) Size() int { return 1 }
+
+func (xorChecksummer) Sum(data []byte) []byte {
+	var sum byte
+	for _, b := range data {
+		sum ^= b
+	}
+	return []byte{sum}
+}
+
+// a custom checksummer claiming a reserved id, or a Size its Sum doesn't match
+type badChecksummer struct {
+	id   uint8
+	size int
+}
+
+func (c badChecksummer) Id() uint8 { return c.id }
+func (c badChecksummer) Size() int { return c.size }
+
+func (badChecksummer) Sum(data []byte) []byte {
+	return xorChecksummer{}.Sum(data)
+}
+
+func TestMarshalChecksummer(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+	defer func() { WFS.Checksummer = nil }()
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	data := makeText(120)
+	err := WFS.MakeFile(ctx, zoneId, "m1", FileMeta{"foo": "bar"}, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	_, err = WFS.AppendData(ctx, zoneId, "m1", []byte(data))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	marshal := func(checksummer Checksummer) []byte {
+		t.Helper()
+		WFS.Checksummer = checksummer
+		blob, err := WFS.MarshalFile(ctx, zoneId, "m1")
+		if err != nil {
+			t.Fatalf("error marshaling file: %v", err)
+		}
+		return blob
+	}
+	crcBlob := marshal(nil)
+	shaBlob := marshal(SHA256Checksummer)
+	xorBlob := marshal(xorChecksummer{})
+	for _, tc := range []struct {
+		blob []byte
+		id   uint8
+		size int
+	}{{crcBlob, ChecksumCRC32, 4}, {shaBlob, ChecksumSHA256, 32}, {xorBlob, 200, 1}} {
+		if tc.blob[len(MarshalMagic)+2] != tc.id {
+			t.Errorf("expected checksum id %d in the blob, got %d", tc.id, tc.blob[len(MarshalMagic)+2])
+		}
+		if len(tc.blob)-len(crcBlob) != tc.size-4 {
+			t.Errorf("expected a %d byte checksum, blob is %d bytes (crc32 blob %d)", tc.size, len(tc.blob), len(crcBlob))
+		}
+	}
+
+	// the built-in algorithms are always verifiable, whatever the store writes with
+	WFS.Checksummer = xorChecksummer{}
+	for idx, blob := range [][]byte{crcBlob, shaBlob, xorBlob} {
+		name := fmt.Sprintf("r%d", idx)
+		err = WFS.UnmarshalFile(ctx, zoneId, name, blob)
+		if err != nil {
+			t.Fatalf("error unmarshaling blob %d: %v", idx, err)
+		}
+		checkFileData(t, ctx, zoneId, name, data)
+	}
+	// no room for the checksum after the checksum id
+	shortBlob := []byte(MarshalMagic)
+	shortBlob = binary.BigEndian.AppendUint16(shortBlob, MarshalVersion)
+	shortBlob = append(shortBlob, 200)
+	err = WFS.UnmarshalFile(ctx, zoneId, "x0", shortBlob)
+	if err == nil || !strings.Contains(err.Error(), "too short") {
+		t.Errorf("expected a too short error, got %v", err)
+	}
+	// a custom one only if it is the store's
+	WFS.Checksummer = nil
+	err = WFS.UnmarshalFile(ctx, zoneId, "x1", xorBlob)
+	if err == nil || !strings.Contains(err.Error(), "unknown checksum algorithm") {
+		t.Errorf("expected an unknown checksum algorithm error, got %v", err)
+	}
+	corrupted := append([]byte(nil), shaBlob...)
+	corrupted[len(corrupted)/2] ^= 0xff
+	err = WFS.UnmarshalFile(ctx, zoneId, "x2", corrupted)
+	if err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Errorf("expected a checksum mismatch, got %v", err)
+	}
+
+	// custom checksummers with a built-in (or reserved) id or a wrong Size are rejected
+	for _, bad := range []badChecksummer{{id: ChecksumCRC32, size: 1}, {id: 3, size: 1}, {id: 201, size: 4}} {
+		WFS.Checksummer = bad
+		_, err = WFS.MarshalFile(ctx, zoneId, "m1")
+		if err == nil || !strings.Contains(err.Error(), "invalid checksummer") {
+			t.Errorf("expected an invalid checksummer error for %+v, got %v", bad, err)
+		}
+		err = WFS.SnapshotAll(ctx, io.Discard)
+		if err == nil || !strings.Contains(err.Error(), "invalid checksummer") {
+			t.Errorf("expected an invalid checksummer error snapshotting with %+v, got %v", bad, err)
+		}
+	}
+	// and not used to verify blobs carrying their id
+	WFS.Checksummer = badChecksummer{id: 200, size: 4}
+	err = WFS.UnmarshalFile(ctx, zoneId, "x3", xorBlob)
+	if err == nil || !strings.Contains(err.Error(), "invalid checksummer") {
+		t.Errorf("expected an invalid checksummer error, got %v", err)
+	}
+}
+
+func TestPreallocate(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	fileName := "p1"
+	err := WFS.MakeFile(ctx, zoneId, fileName, nil, FileOptsType{MaxSize: 200})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	_, err = WFS.Preallocate(ctx, zoneId, fileName, 300)
+	if err == nil {
+		t.Errorf("expected error preallocating past max size")
+	}
+	_, err = WFS.Preallocate(ctx, zoneId, fileName, 120)
+	if err != nil {
+		t.Fatalf("error preallocating file: %v", err)
+	}
+	checkFileSize(t, ctx, zoneId, fileName, 120)
+	checkFileByteCount(t, ctx, zoneId, fileName, 0, 120)
+	_, err = WFS.WriteAt(ctx, zoneId, fileName, 100, []byte("world"))
+	if err != nil {
+		t.Fatalf("error writing data: %v", err)
+	}
+	_, err = WFS.WriteAt(ctx, zoneId, fileName, 10, []byte("hello"))
+	if err != nil {
+		t.Fatalf("error writing data: %v", err)
+	}
+	_, err = WFS.FlushCache(ctx)
+	if err != nil {
+		t.Fatalf("error flushing cache: %v", err)
+	}
+	checkFileSize(t, ctx, zoneId, fileName, 120)
+	checkFileDataAt(t, ctx, zoneId, fileName, 10, "hello")
+	checkFileDataAt(t, ctx, zoneId, fileName, 100, "world")
+	checkFileByteCount(t, ctx, zoneId, fileName, 0, 110)
+	// preallocate never shrinks
+	_, err = WFS.Preallocate(ctx, zoneId, fileName, 50)
+	if err != nil {
+		t.Fatalf("error preallocating file: %v", err)
+	}
+	checkFileSize(t, ctx, zoneId, fileName, 120)
+}
+
+type recordingLogger struct {
+	lock sync.Mutex
+	msgs []string
+}
+
+func (l *recordingLogger) Printf(format string, args ...any) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.msgs = append(l.msgs, fmt.Sprintf(format, args...))
+}
+
+// returns the logged messages that contain all of substrs
+func (l *recordingLogger) matching(substrs ...string) []string {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	var rtn []string
+	for _, msg := range l.msgs {
+		matches := true
+		for _, substr := range substrs {
+			if !strings.Contains(msg, substr) {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			rtn = append(rtn, msg)
+		}
+	}
+	return rtn
+}
+
+func TestLogger(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	if WFS.Logger != nil {
+		t.Fatalf("expected no logger by default")
+	}
+	logger := &recordingLogger{}
+	WFS.Logger = logger
+	defer func() { WFS.Logger = nil }()
+	zoneId := uuid.NewString()
+
+	WFS.unpinEntryAndTryDelete(zoneId, "missing")
+	if len(logger.matching("unpin", zoneId, "missing")) != 1 {
+		t.Errorf("expected an unpin message for %s:missing, got %q", zoneId, logger.matching())
+	}
+
+	err := WFS.MakeFile(ctx, zoneId, "bad", nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	_, err = WFS.AppendData(ctx, zoneId, "bad", []byte("hello"))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	err = dbDeleteFile(ctx, zoneId, "bad")
+	if err != nil {
+		t.Fatalf("error deleting file from db: %v", err)
+	}
+	// the 4th failure drops the dirty data
+	for i := 0; i < 4; i++ {
+		_, err = WFS.FlushCache(ctx)
+		if err == nil {
+			t.Fatalf("expected flush error for a file missing from the db")
+		}
+	}
+	if len(logger.matching("error flushing", zoneId, "bad")) != 4 {
+		t.Errorf("expected 4 flush failure messages for %s:bad, got %q", zoneId, logger.matching())
+	}
+	if len(logger.matching("dropping dirty data", zoneId, "bad")) != 1 {
+		t.Errorf("expected a dirty data message for %s:bad, got %q", zoneId, logger.matching())
+	}
+	// the failures above were intentional
+	flushErrorCount.Store(0)
+}
+
+// a circular file is a regular file until it first fills up, then keeps only the last MaxSize bytes
+func TestCircularBeforeWrap(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	fileName := "cm1"
+	err := WFS.MakeFile(ctx, zoneId, fileName, nil, FileOptsType{Circular: true, MaxSize: 100})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	data := makeText(140)
+	_, err = WFS.AppendData(ctx, zoneId, fileName, []byte(data[:80]))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	// below max size the file behaves as a regular file
+	checkFileSize(t, ctx, zoneId, fileName, 80)
+	checkFileData(t, ctx, zoneId, fileName, data[:80])
+	_, err = WFS.AppendData(ctx, zoneId, fileName, []byte(data[80:]))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	// past max size only the last 100 bytes are retained
+	checkFileSize(t, ctx, zoneId, fileName, 140)
+	checkFileData(t, ctx, zoneId, fileName, data[40:])
+	offset, _, _ := WFS.ReadFile(ctx, zoneId, fileName)
+	if offset != 40 {
+		t.Errorf("offset mismatch: expected 40, got %d", offset)
+	}
+	_, err = WFS.FlushCache(ctx)
+	if err != nil {
+		t.Fatalf("error flushing cache: %v", err)
+	}
+	checkFileData(t, ctx, zoneId, fileName, data[40:])
+	checkFileDataAt(t, ctx, zoneId, fileName, 100, data[100:120])
+}
+
+func TestEvict(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	fileName := "e1"
+	err := WFS.MakeFile(ctx, zoneId, fileName, nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	// not resident, should be a no-op
+	err = WFS.Evict(ctx, zoneId, fileName)
+	if err != nil {
+		t.Fatalf("error evicting non-resident file: %v", err)
+	}
+	_, err = WFS.AppendData(ctx, zoneId, fileName, []byte("hello world"))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	if WFS.getCacheSize() != 1 {
+		t.Errorf("cache size mismatch: expected 1, got %d", WFS.getCacheSize())
+	}
+	err = WFS.Evict(ctx, zoneId, fileName)
+	if err != nil {
+		t.Fatalf("error evicting file: %v", err)
+	}
+	if WFS.getCacheSize() != 0 {
+		t.Errorf("cache size mismatch after evict: expected 0, got %d", WFS.getCacheSize())
+	}
+	checkFileSize(t, ctx, zoneId, fileName, 11)
+	checkFileData(t, ctx, zoneId, fileName, "hello world")
+}
+
+func TestConcurrentOverlappingWrites(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+	ctx, cancelFn := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	fileName := "ow1"
+	err := WFS.MakeFile(ctx, zoneId, fileName, nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	_, err = WFS.WriteFile(ctx, zoneId, fileName, bytes.Repeat([]byte{'.'}, 120))
+	if err != nil {
+		t.Fatalf("error writing data: %v", err)
+	}
+	checkUniform := func(data []byte) bool {
+		for _, b := range data {
+			if b != data[0] {
+				return false
+			}
+		}
+		return true
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			// 60 bytes starting at offset 20 spans the part boundary at 50 (and touches 3 parts at 100)
+			writeData := bytes.Repeat([]byte{byte('a' + n)}, 60)
+			for j := 0; j < 50; j++ {
+				_, err := WFS.WriteAt(ctx, zoneId, fileName, 20, writeData)
+				if err != nil {
+					t.Errorf("error writing data (%d): %v", n, err)
+					return
+				}
+				_, rdata, err := WFS.ReadAt(ctx, zoneId, fileName, 20, 60)
+				if err != nil {
+					t.Errorf("error reading data (%d): %v", n, err)
+					return
+				}
+				if !checkUniform(rdata) {
+					t.Errorf("torn write detected: %q", rdata)
+					return
+				}
+				if j == 25 {
+					WFS.FlushCache(ctx)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	_, rdata, err := WFS.ReadAt(ctx, zoneId, fileName, 20, 60)
+	if err != nil {
+		t.Fatalf("error reading data: %v", err)
+	}
+	if !checkUniform(rdata) {
+		t.Errorf("torn write detected: %q", rdata)
+	}
+	checkFileDataAt(t, ctx, zoneId, fileName, 0, makeRepeat('.', 20))
+	checkFileDataAt(t, ctx, zoneId, fileName, 80, makeRepeat('.', 40))
+
+	// concurrent appends of fixed size records (8 bytes, not a divisor of the part size)
+	appendName := "ow2"
+	err = WFS.MakeFile(ctx, zoneId, appendName, nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				_, err := WFS.AppendData(ctx, zoneId, appendName, []byte(fmt.Sprintf("<%d:%04d>", n, j)))
+				if err != nil {
+					t.Errorf("error appending data (%d): %v", n, err)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	_, fullData, err := WFS.ReadFile(ctx, zoneId, appendName)
+	if err != nil {
+		t.Fatalf("error reading file: %v", err)
+	}
+	if len(fullData) != 8*50*8 {
+		t.Fatalf("size mismatch: expected %d, got %d", 8*50*8, len(fullData))
+	}
+	nextRecord := make(map[int]int)
+	for i := 0; i < len(fullData); i += 8 {
+		var n, j int
+		_, err := fmt.Sscanf(string(fullData[i:i+8]), "<%d:%04d>", &n, &j)
+		if err != nil {
+			t.Fatalf("interleaved record at offset %d: %q", i, fullData[i:i+8])
+		}
+		if nextRecord[n] != j {
+			t.Fatalf("out of order record for writer %d: expected %d, got %d", n, nextRecord[n], j)
+		}
+		nextRecord[n]++
+	}
+}
+
+func makeRepeat(ch byte, n int) string {
+	return string(bytes.Repeat([]byte{ch}, n))
+}
+
+func TestTail(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	data := makeText(130)
+	err := WFS.MakeFile(ctx, zoneId, "t1", nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	_, err = WFS.AppendData(ctx, zoneId, "t1", []byte(data))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	offset, rdata, err := WFS.Tail(ctx, zoneId, "t1", 60)
+	if err != nil {
+		t.Fatalf("error reading tail: %v", err)
+	}
+	if offset != 70 || string(rdata) != data[70:] {
+		t.Errorf("tail mismatch: offset %d, data %q", offset, rdata)
+	}
+	offset, rdata, err = WFS.Tail(ctx, zoneId, "t1", 500)
+	if err != nil {
+		t.Fatalf("error reading tail: %v", err)
+	}
+	if offset != 0 || string(rdata) != data {
+		t.Errorf("tail mismatch (short file): offset %d, data %q", offset, rdata)
+	}
+
+	// circular file, tail cannot go past the retained window
+	err = WFS.MakeFile(ctx, zoneId, "c1", nil, FileOptsType{Circular: true, MaxSize: 50})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	_, err = WFS.AppendData(ctx, zoneId, "c1", []byte(data))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	offset, rdata, err = WFS.Tail(ctx, zoneId, "c1", 20)
+	if err != nil {
+		t.Fatalf("error reading tail: %v", err)
+	}
+	if offset != 110 || string(rdata) != data[110:] {
+		t.Errorf("circular tail mismatch: offset %d, data %q", offset, rdata)
+	}
+	offset, rdata, err = WFS.Tail(ctx, zoneId, "c1", 100)
+	if err != nil {
+		t.Fatalf("error reading tail: %v", err)
+	}
+	if offset != 80 || string(rdata) != data[80:] {
+		t.Errorf("circular tail mismatch (past window): offset %d, data %q", offset, rdata)
+	}
+}
+
+func TestHead(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	data := makeText(130)
+	err := WFS.MakeFile(ctx, zoneId, "h1", nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	_, err = WFS.AppendData(ctx, zoneId, "h1", []byte(data))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	offset, rdata, err := WFS.Head(ctx, zoneId, "h1", 60)
+	if err != nil {
+		t.Fatalf("error reading head: %v", err)
+	}
+	if offset != 0 || string(rdata) != data[:60] {
+		t.Errorf("head mismatch: offset %d, data %q", offset, rdata)
+	}
+	_, rdata, err = WFS.Head(ctx, zoneId, "h1", 500)
+	if err != nil {
+		t.Fatalf("error reading head: %v", err)
+	}
+	if string(rdata) != data {
+		t.Errorf("head mismatch (short file): data %q", rdata)
+	}
+
+	// circular file, head starts at the oldest retained byte
+	err = WFS.MakeFile(ctx, zoneId, "c1", nil, FileOptsType{Circular: true, MaxSize: 50})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	_, err = WFS.AppendData(ctx, zoneId, "c1", []byte(data))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	offset, rdata, err = WFS.Head(ctx, zoneId, "c1", 20)
+	if err != nil {
+		t.Fatalf("error reading head: %v", err)
+	}
+	if offset != 80 || string(rdata) != data[80:100] {
+		t.Errorf("circular head mismatch: offset %d, data %q", offset, rdata)
+	}
+	offset, rdata, err = WFS.Head(ctx, zoneId, "c1", 100)
+	if err != nil {
+		t.Fatalf("error reading head: %v", err)
+	}
+	if offset != 80 || string(rdata) != data[80:] {
+		t.Errorf("circular head mismatch (past window): offset %d, data %q", offset, rdata)
+	}
+}
+
+func TestReadCacheOnly(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	fileName := "co1"
+	data := makeText(120)
+	err := WFS.MakeFile(ctx, zoneId, fileName, nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	cacheOnly := ReadOpts{CacheOnly: true}
+	_, _, err = WFS.ReadAtWithOpts(ctx, zoneId, fileName, 0, 10, cacheOnly)
+	if err != ErrNotCached {
+		t.Errorf("expected ErrNotCached for non-resident file, got: %v", err)
+	}
+	_, err = WFS.AppendData(ctx, zoneId, fileName, []byte(data))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	_, rdata, err := WFS.ReadAtWithOpts(ctx, zoneId, fileName, 40, 30, cacheOnly)
+	if err != nil {
+		t.Fatalf("error reading resident data: %v", err)
+	}
+	if string(rdata) != data[40:70] {
+		t.Errorf("data mismatch: expected %q, got %q", data[40:70], rdata)
+	}
+	_, err = WFS.FlushCache(ctx)
+	if err != nil {
+		t.Fatalf("error flushing cache: %v", err)
+	}
+	_, _, err = WFS.ReadAtWithOpts(ctx, zoneId, fileName, 40, 30, cacheOnly)
+	if err != ErrNotCached {
+		t.Errorf("expected ErrNotCached after flush, got: %v", err)
+	}
+	// default opts fall back to the DB
+	_, rdata, err = WFS.ReadAtWithOpts(ctx, zoneId, fileName, 40, 30, ReadOpts{})
+	if err != nil {
+		t.Fatalf("error reading data: %v", err)
+	}
+	if string(rdata) != data[40:70] {
+		t.Errorf("data mismatch: expected %q, got %q", data[40:70], rdata)
+	}
+}
+
+func TestVersion(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	fileName := "v1"
+	err := WFS.MakeFile(ctx, zoneId, fileName, nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	version, err := WFS.StatVersion(ctx, zoneId, fileName)
+	if err != nil {
+		t.Fatalf("error getting version: %v", err)
+	}
+	if version != 0 {
+		t.Errorf("version mismatch: expected 0, got %d", version)
+	}
+	lastVersion := version
+	checkVersion := func(msg string, version int64, err error) {
+		if err != nil {
+			t.Fatalf("%s: %v", msg, err)
+		}
+		if version <= lastVersion {
+			t.Errorf("%s: version did not increase (%d => %d)", msg, lastVersion, version)
+		}
+		statVersion, err := WFS.StatVersion(ctx, zoneId, fileName)
+		if err != nil {
+			t.Fatalf("%s: error getting version: %v", msg, err)
+		}
+		if statVersion != version {
+			t.Errorf("%s: stat version mismatch: expected %d, got %d", msg, version, statVersion)
+		}
+		lastVersion = version
+	}
+	version, err = WFS.AppendData(ctx, zoneId, fileName, []byte("hello"))
+	checkVersion("append", version, err)
+	version, err = WFS.WriteAt(ctx, zoneId, fileName, 0, []byte("j"))
+	checkVersion("writeat", version, err)
+	version, err = WFS.WriteMeta(ctx, zoneId, fileName, FileMeta{"a": 1}, true)
+	checkVersion("writemeta", version, err)
+	version, err = WFS.WriteFile(ctx, zoneId, fileName, []byte("hi"))
+	checkVersion("writefile (truncate)", version, err)
+	_, err = WFS.AppendData(ctx, zoneId, fileName, []byte(" there"))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	versionBeforeFlush, _ := WFS.StatVersion(ctx, zoneId, fileName)
+	_, err = WFS.FlushCache(ctx)
+	if err != nil {
+		t.Fatalf("error flushing cache: %v", err)
+	}
+	versionAfterFlush, err := WFS.StatVersion(ctx, zoneId, fileName)
+	if err != nil {
+		t.Fatalf("error getting version: %v", err)
+	}
+	if versionBeforeFlush != versionAfterFlush {
+		t.Errorf("flush changed version: %d => %d", versionBeforeFlush, versionAfterFlush)
+	}
+}
+
+func TestListFileInfos(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	err := WFS.MakeFile(ctx, zoneId, "f1", FileMeta{"a": 1}, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	err = WFS.MakeFile(ctx, zoneId, "c1", nil, FileOptsType{Circular: true, MaxSize: 50})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	err = WFS.MakeFile(ctx, uuid.NewString(), "other", nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	_, err = WFS.AppendData(ctx, zoneId, "f1", []byte("hello"))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	infos, err := WFS.ListFileInfos(ctx, zoneId)
+	if err != nil {
+		t.Fatalf("error listing files: %v", err)
+	}
+	if len(infos) != 2 {
+		t.Fatalf("file count mismatch: expected 2, got %d", len(infos))
+	}
+	for _, info := range infos {
+		switch info.Name {
+		case "f1":
+			if info.Size != 5 || !info.Dirty || info.Circular || info.Version != 1 {
+				t.Errorf("file info mismatch for f1: %+v", info)
+			}
+		case "c1":
+			if info.Size != 0 || info.Dirty || !info.Circular {
+				t.Errorf("file info mismatch for c1: %+v", info)
+			}
+		default:
+			t.Errorf("unexpected file %q", info.Name)
+		}
+	}
+	_, err = WFS.FlushCache(ctx)
+	if err != nil {
+		t.Fatalf("error flushing cache: %v", err)
+	}
+	infos, err = WFS.ListFileInfos(ctx, zoneId)
+	if err != nil {
+		t.Fatalf("error listing files: %v", err)
+	}
+	for _, info := range infos {
+		if info.Name == "f1" && (info.Size != 5 || info.Dirty || info.Version != 1) {
+			t.Errorf("file info mismatch for f1 after flush: %+v", info)
+		}
+	}
+}
+
+func TestResetCircular(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	err := WFS.MakeFile(ctx, zoneId, "f1", nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	_, err = WFS.ResetCircular(ctx, zoneId, "f1")
+	if err == nil {
+		t.Errorf("expected error resetting non-circular file")
+	}
+	err = WFS.MakeFile(ctx, zoneId, "c1", FileMeta{"a": "b"}, FileOptsType{Circular: true, MaxSize: 100})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	_, err = WFS.AppendData(ctx, zoneId, "c1", []byte(makeText(230)))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	_, err = WFS.ResetCircular(ctx, zoneId, "c1")
+	if err != nil {
+		t.Fatalf("error resetting file: %v", err)
+	}
+	checkFileSize(t, ctx, zoneId, "c1", 0)
+	checkFileData(t, ctx, zoneId, "c1", "")
+	_, err = WFS.AppendData(ctx, zoneId, "c1", []byte("hello"))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	_, err = WFS.FlushCache(ctx)
+	if err != nil {
+		t.Fatalf("error flushing cache: %v", err)
+	}
+	checkFileSize(t, ctx, zoneId, "c1", 5)
+	checkFileData(t, ctx, zoneId, "c1", "hello")
+	file, err := WFS.Stat(ctx, zoneId, "c1")
+	if err != nil {
+		t.Fatalf("error stating file: %v", err)
+	}
+	if !file.Opts.Circular || file.Opts.MaxSize != 100 || file.Meta["a"] != "b" {
+		t.Errorf("opts/meta not preserved: %+v", file)
+	}
+}
+
+func TestFlushDuringWrites(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+	ctx, cancelFn := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	fileName := "fw1"
+	err := WFS.MakeFile(ctx, zoneId, fileName, nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	_, err = WFS.WriteFile(ctx, zoneId, fileName, bytes.Repeat([]byte{'.'}, 100))
+	if err != nil {
+		t.Fatalf("error writing data: %v", err)
+	}
+	var wg sync.WaitGroup
+	var writersDone atomic.Bool
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for !writersDone.Load() {
+			// ignore errors (flush may already be in progress)
+			WFS.FlushCache(ctx)
+		}
+	}()
+	var writerWg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		writerWg.Add(1)
+		go func(n int) {
+			defer writerWg.Done()
+			writeData := bytes.Repeat([]byte{byte('a' + n)}, 100)
+			for j := 0; j < 100; j++ {
+				_, err := WFS.WriteAt(ctx, zoneId, fileName, 0, writeData)
+				if err != nil {
+					t.Errorf("error writing data (%d): %v", n, err)
+					return
+				}
+			}
+		}(i)
+	}
+	writerWg.Wait()
+	writersDone.Store(true)
+	wg.Wait()
+	_, err = WFS.FlushCache(ctx)
+	if err != nil {
+		t.Fatalf("error flushing cache: %v", err)
+	}
+	if WFS.getCacheSize() != 0 {
+		t.Errorf("cache size mismatch: expected 0, got %d", WFS.getCacheSize())
+	}
+	// data read back from the DB must be from a single write (no torn parts)
+	_, rdata, err := WFS.ReadFile(ctx, zoneId, fileName)
+	if err != nil {
+		t.Fatalf("error reading data: %v", err)
+	}
+	if len(rdata) != 100 || !bytes.Equal(rdata, bytes.Repeat(rdata[:1], 100)) {
+		t.Errorf("torn flush detected: %q", rdata)
+	}
+}
+
+func TestWriteAtAsync(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	fileName := "wa1"
+	err := WFS.MakeFile(ctx, zoneId, fileName, nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	future := WFS.WriteAtAsync(ctx, zoneId, fileName, 0, []byte("hello world"))
+	select {
+	case <-future.Done():
+		t.Fatalf("future resolved before flush (err: %v)", future.Err())
+	default:
+	}
+	checkFileData(t, ctx, zoneId, fileName, "hello world")
+	_, err = WFS.FlushCache(ctx)
+	if err != nil {
+		t.Fatalf("error flushing cache: %v", err)
+	}
+	select {
+	case <-future.Done():
+	case <-ctx.Done():
+		t.Fatalf("future not resolved after flush")
+	}
+	if future.Err() != nil {
+		t.Fatalf("unexpected future error: %v", future.Err())
+	}
+
+	// failed writes resolve immediately
+	future = WFS.WriteAtAsync(ctx, zoneId, fileName, 100, []byte("past end"))
+	select {
+	case <-future.Done():
+	default:
+		t.Fatalf("future for failed write should already be resolved")
+	}
+	if future.Err() == nil {
+		t.Fatalf("expected error for write past end of file")
+	}
+
+	// deleting the file before the flush resolves with fs.ErrNotExist
+	future = WFS.WriteAtAsync(ctx, zoneId, fileName, 0, []byte("HELLO"))
+	err = WFS.DeleteFile(ctx, zoneId, fileName)
+	if err != nil {
+		t.Fatalf("error deleting file: %v", err)
+	}
+	<-future.Done()
+	if !errors.Is(future.Err(), fs.ErrNotExist) {
+		t.Fatalf("expected fs.ErrNotExist, got %v", future.Err())
+	}
+}
+
+func getBlobCounts(t *testing.T, ctx context.Context) (int, int) {
+	type blobCounts struct {
+		NumBlobs int
+		NumRefs  int
+	}
+	counts, err := WithTxRtn(ctx, func(tx *TxWrap) (blobCounts, error) {
+		var rtn blobCounts
+		rtn.NumBlobs = tx.GetInt("SELECT count(*) FROM db_file_blob")
+		rtn.NumRefs = tx.GetInt("SELECT COALESCE(sum(refcount), 0) FROM db_file_blob")
+		return rtn, nil
+	})
+	if err != nil {
+		t.Fatalf("error getting blob counts: %v", err)
+	}
+	return counts.NumBlobs, counts.NumRefs
+}
+
+func TestDedup(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+	WFS.Dedup = true
+	defer func() { WFS.Dedup = false }()
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	// 3 parts: two identical full parts + a short tail
+	text := makeRepeat('a', 100) + "tail"
+	for _, fileName := range []string{"d1", "d2"} {
+		err := WFS.MakeFile(ctx, zoneId, fileName, nil, FileOptsType{})
+		if err != nil {
+			t.Fatalf("error creating file: %v", err)
+		}
+		_, err = WFS.WriteFile(ctx, zoneId, fileName, []byte(text))
+		if err != nil {
+			t.Fatalf("error writing file: %v", err)
+		}
+	}
+	numBlobs, numRefs := getBlobCounts(t, ctx)
+	if numBlobs != 2 || numRefs != 6 {
+		t.Fatalf("blob counts mismatch: expected (2, 6), got (%d, %d)", numBlobs, numRefs)
+	}
+	checkFileData(t, ctx, zoneId, "d1", text)
+	checkFileData(t, ctx, zoneId, "d2", text)
+
+	// overwriting a part releases the old blob reference
+	_, err := WFS.WriteAt(ctx, zoneId, "d1", 100, []byte("TAIL"))
+	if err != nil {
+		t.Fatalf("error writing data: %v", err)
+	}
+	_, err = WFS.FlushCache(ctx)
+	if err != nil {
+		t.Fatalf("error flushing cache: %v", err)
+	}
+	numBlobs, numRefs = getBlobCounts(t, ctx)
+	if numBlobs != 3 || numRefs != 6 {
+		t.Fatalf("blob counts mismatch after overwrite: expected (3, 6), got (%d, %d)", numBlobs, numRefs)
+	}
+	checkFileData(t, ctx, zoneId, "d1", makeRepeat('a', 100)+"TAIL")
+	checkFileData(t, ctx, zoneId, "d2", text)
+
+	err = WFS.DeleteFile(ctx, zoneId, "d1")
+	if err != nil {
+		t.Fatalf("error deleting file: %v", err)
+	}
+	numBlobs, numRefs = getBlobCounts(t, ctx)
+	if numBlobs != 2 || numRefs != 3 {
+		t.Fatalf("blob counts mismatch after delete: expected (2, 3), got (%d, %d)", numBlobs, numRefs)
+	}
+	checkFileData(t, ctx, zoneId, "d2", text)
+
+	// files written without dedup don't use the blob table
+	WFS.Dedup = false
+	_, err = WFS.WriteFile(ctx, zoneId, "d2", []byte(text))
+	if err != nil {
+		t.Fatalf("error writing file: %v", err)
+	}
+	numBlobs, numRefs = getBlobCounts(t, ctx)
+	if numBlobs != 0 || numRefs != 0 {
+		t.Fatalf("blob counts mismatch after non-dedup write: expected (0, 0), got (%d, %d)", numBlobs, numRefs)
+	}
+	checkFileData(t, ctx, zoneId, "d2", text)
+}
+
+func TestAlignedPartWrite(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	fileName := "ap1"
+	err := WFS.MakeFile(ctx, zoneId, fileName, nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	if WFS.PartSize() != 50 {
+		t.Fatalf("part size mismatch: expected 50, got %d", WFS.PartSize())
+	}
+	// two full aligned parts + a partial part
+	text := makeRepeat('a', 50) + makeRepeat('b', 50) + "cc"
+	_, err = WFS.WriteAt(ctx, zoneId, fileName, 0, []byte(text))
+	if err != nil {
+		t.Fatalf("error writing data: %v", err)
+	}
+	err = withLock(WFS, zoneId, fileName, func(entry *CacheEntry) error {
+		for partIdx := 0; partIdx < 2; partIdx++ {
+			if cap(entry.DataEntries[partIdx].Data) != int(partDataSize) {
+				t.Errorf("part %d capacity mismatch: expected %d, got %d", partIdx, partDataSize, cap(entry.DataEntries[partIdx].Data))
+			}
+		}
+		// the partial part only holds what was written (rounded up)
+		if cap(entry.DataEntries[2].Data) > int(partDataSize) || len(entry.DataEntries[2].Data) != 2 {
+			t.Errorf("unexpected partial part len %d cap %d", len(entry.DataEntries[2].Data), cap(entry.DataEntries[2].Data))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("error checking cache entry: %v", err)
+	}
+	// overwrite a cached full part in place, and append into the partial part
+	_, err = WFS.WriteAt(ctx, zoneId, fileName, 50, []byte(makeRepeat('B', 50)))
+	if err != nil {
+		t.Fatalf("error writing data: %v", err)
+	}
+	_, err = WFS.AppendData(ctx, zoneId, fileName, []byte("dd"))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	expected := makeRepeat('a', 50) + makeRepeat('B', 50) + "ccdd"
+	checkFileData(t, ctx, zoneId, fileName, expected)
+	_, err = WFS.FlushCache(ctx)
+	if err != nil {
+		t.Fatalf("error flushing cache: %v", err)
+	}
+	checkFileData(t, ctx, zoneId, fileName, expected)
+}
+
+func TestWaitForBudget(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+	WFS.CacheBudget = 100
+	defer func() { WFS.CacheBudget = 0 }()
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	fileName := "wb1"
+	err := WFS.MakeFile(ctx, zoneId, fileName, nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	err = WFS.WaitForBudget(ctx)
+	if err != nil {
+		t.Fatalf("error waiting for empty cache: %v", err)
+	}
+	_, err = WFS.AppendData(ctx, zoneId, fileName, []byte(makeText(150)))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	shortCtx, shortCancelFn := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer shortCancelFn()
+	err = WFS.WaitForBudget(shortCtx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline exceeded while over budget, got %v", err)
+	}
+	var wg sync.WaitGroup
+	var numDone atomic.Int32
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := WFS.WaitForBudget(ctx)
+			if err != nil {
+				t.Errorf("error waiting for budget: %v", err)
+				return
+			}
+			numDone.Add(1)
+		}()
+	}
+	time.Sleep(20 * time.Millisecond)
+	if numDone.Load() != 0 {
+		t.Fatalf("waiters returned while over budget")
+	}
+	_, err = WFS.FlushCache(ctx)
+	if err != nil {
+		t.Fatalf("error flushing cache: %v", err)
+	}
+	wg.Wait()
+	if numDone.Load() != 10 {
+		t.Fatalf("expected 10 waiters to finish, got %d", numDone.Load())
+	}
+}
+
+func TestWriteWatermarks(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+	WFS.HighWater = 150
+	WFS.LowWater = 50
+	defer func() {
+		WFS.HighWater = 0
+		WFS.LowWater = 0
+	}()
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	for _, name := range []string{"f1", "f2", "f3"} {
+		err := WFS.MakeFile(ctx, zoneId, name, nil, FileOptsType{})
+		if err != nil {
+			t.Fatalf("error creating file: %v", err)
+		}
+		_, err = WFS.AppendData(ctx, zoneId, name, []byte(makeText(50)))
+		if err != nil {
+			t.Fatalf("error appending data: %v", err)
+		}
+	}
+	shortCtx, shortCancelFn := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer shortCancelFn()
+	_, err := WFS.AppendData(shortCtx, zoneId, "f1", []byte("x"))
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected write to block at the high water mark, got %v", err)
+	}
+	writeErrCh := make(chan error, 1)
+	go func() {
+		_, err := WFS.WriteAt(ctx, zoneId, "f1", 50, []byte("x"))
+		writeErrCh <- err
+	}()
+	// draining below the high water mark isn't enough, writers stay blocked until the low water mark
+	err = WFS.Evict(ctx, zoneId, "f3")
+	if err != nil {
+		t.Fatalf("error evicting file: %v", err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	select {
+	case err := <-writeErrCh:
+		t.Fatalf("expected write to stay blocked above the low water mark, got %v", err)
+	default:
+	}
+	err = WFS.Evict(ctx, zoneId, "f2")
+	if err != nil {
+		t.Fatalf("error evicting file: %v", err)
+	}
+	err = <-writeErrCh
+	if err != nil {
+		t.Fatalf("error writing data: %v", err)
+	}
+	checkFileSize(t, ctx, zoneId, "f1", 51)
+}
+
+func TestOpsAfterDelete(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	fileName := "od1"
+	err := WFS.MakeFile(ctx, zoneId, fileName, nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	// writer keeps appending until the file is deleted out from under it
+	var deleted atomic.Bool
+	writerDone := make(chan struct{})
+	go func() {
+		defer close(writerDone)
+		for {
+			wasDeleted := deleted.Load()
+			_, err := WFS.AppendData(ctx, zoneId, fileName, []byte("hello"))
+			if err == nil && wasDeleted {
+				t.Errorf("append succeeded after delete")
+				return
+			}
+			if err != nil {
+				if !errors.Is(err, fs.ErrNotExist) {
+					t.Errorf("expected fs.ErrNotExist, got %v", err)
+				}
+				return
+			}
+		}
+	}()
+	time.Sleep(5 * time.Millisecond)
+	err = WFS.DeleteFile(ctx, zoneId, fileName)
+	if err != nil {
+		t.Fatalf("error deleting file: %v", err)
+	}
+	deleted.Store(true)
+	<-writerDone
+	_, err = WFS.WriteAt(ctx, zoneId, fileName, 0, []byte("x"))
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("WriteAt: expected fs.ErrNotExist, got %v", err)
+	}
+	_, err = WFS.WriteMeta(ctx, zoneId, fileName, FileMeta{"a": 1}, true)
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("WriteMeta: expected fs.ErrNotExist, got %v", err)
+	}
+	_, _, err = WFS.ReadAt(ctx, zoneId, fileName, 0, 5)
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("ReadAt: expected fs.ErrNotExist, got %v", err)
+	}
+	_, _, err = WFS.ReadFile(ctx, zoneId, fileName)
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("ReadFile: expected fs.ErrNotExist, got %v", err)
+	}
+	_, err = WFS.FlushCache(ctx)
+	if err != nil {
+		t.Fatalf("error flushing cache: %v", err)
+	}
+	_, err = WFS.Stat(ctx, zoneId, fileName)
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("file was resurrected after delete: %v", err)
+	}
+	if WFS.getCacheSize() != 0 {
+		t.Errorf("cache size mismatch: expected 0, got %d", WFS.getCacheSize())
+	}
+}
+
+func TestLoadTimeout(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	fileName := "lt1"
+	err := WFS.MakeFile(ctx, zoneId, fileName, nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	_, err = WFS.WriteFile(ctx, zoneId, fileName, []byte("hello world"))
+	if err != nil {
+		t.Fatalf("error writing file: %v", err)
+	}
+	WFS.LoadTimeout = 20 * time.Millisecond
+	defer func() { WFS.LoadTimeout = 0 }()
+	// the db only allows one connection, so holding a transaction open stalls every load
+	txStarted := make(chan struct{})
+	releaseTx := make(chan struct{})
+	txDone := make(chan struct{})
+	go func() {
+		defer close(txDone)
+		WithTx(ctx, func(tx *TxWrap) error {
+			close(txStarted)
+			<-releaseTx
+			return nil
+		})
+	}()
+	<-txStarted
+	_, _, err = WFS.ReadFile(ctx, zoneId, fileName)
+	if !errors.Is(err, ErrBackendTimeout) {
+		t.Errorf("expected ErrBackendTimeout, got %v", err)
+	}
+	_, err = WFS.AppendData(ctx, zoneId, fileName, []byte("!"))
+	if !errors.Is(err, ErrBackendTimeout) {
+		t.Errorf("expected ErrBackendTimeout for write load, got %v", err)
+	}
+	close(releaseTx)
+	<-txDone
+	checkFileData(t, ctx, zoneId, fileName, "hello world")
+}
+
+func TestTouch(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	fileName := "t1"
+	err := WFS.Touch(ctx, zoneId, fileName)
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("expected fs.ErrNotExist for missing file, got %v", err)
+	}
+	err = WFS.MakeFile(ctx, zoneId, fileName, nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	version, err := WFS.WriteFile(ctx, zoneId, fileName, []byte("hello"))
+	if err != nil {
+		t.Fatalf("error writing file: %v", err)
+	}
+	before, err := WFS.Stat(ctx, zoneId, fileName)
+	if err != nil {
+		t.Fatalf("error stating file: %v", err)
+	}
+	time.Sleep(5 * time.Millisecond)
+	err = WFS.Touch(ctx, zoneId, fileName)
+	if err != nil {
+		t.Fatalf("error touching file: %v", err)
+	}
+	_, err = WFS.FlushCache(ctx)
+	if err != nil {
+		t.Fatalf("error flushing cache: %v", err)
+	}
+	after, err := WFS.Stat(ctx, zoneId, fileName)
+	if err != nil {
+		t.Fatalf("error stating file: %v", err)
+	}
+	if after.ModTs <= before.ModTs {
+		t.Errorf("modts not updated: before %d, after %d", before.ModTs, after.ModTs)
+	}
+	if after.Version != version {
+		t.Errorf("version mismatch: expected %d, got %d", version, after.Version)
+	}
+	checkFileData(t, ctx, zoneId, fileName, "hello")
+}
+
+func TestDiskUsage(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	checkUsage := func(expected int64) {
+		t.Helper()
+		usage, err := WFS.DiskUsage(ctx, zoneId)
+		if err != nil {
+			t.Fatalf("error getting disk usage: %v", err)
+		}
+		if usage != expected {
+			t.Errorf("disk usage mismatch: expected %d, got %d", expected, usage)
+		}
+	}
+	err := WFS.MakeFile(ctx, zoneId, "f1", nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	_, err = WFS.AppendData(ctx, zoneId, "f1", []byte(makeText(120)))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	// dirty data is not counted
+	checkUsage(0)
+	_, err = WFS.FlushCache(ctx)
+	if err != nil {
+		t.Fatalf("error flushing cache: %v", err)
+	}
+	checkUsage(120)
+	// sparse files only store the parts that were written
+	err = WFS.MakeFile(ctx, zoneId, "f2", nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	_, err = WFS.Preallocate(ctx, zoneId, "f2", 500)
+	if err != nil {
+		t.Fatalf("error preallocating file: %v", err)
+	}
+	_, err = WFS.WriteAt(ctx, zoneId, "f2", 200, []byte("hello"))
+	if err != nil {
+		t.Fatalf("error writing data: %v", err)
+	}
+	_, err = WFS.FlushCache(ctx)
+	if err != nil {
+		t.Fatalf("error flushing cache: %v", err)
+	}
+	checkUsage(125)
+	// shared blobs are only counted once
+	WFS.Dedup = true
+	defer func() { WFS.Dedup = false }()
+	err = WFS.MakeFile(ctx, zoneId, "f3", nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	_, err = WFS.WriteFile(ctx, zoneId, "f3", []byte(makeRepeat('x', 100)))
+	if err != nil {
+		t.Fatalf("error writing file: %v", err)
+	}
+	checkUsage(175)
+}
+
+func TestOnDirtyEvict(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	fileName := "de1"
+	err := WFS.MakeFile(ctx, zoneId, fileName, nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	_, err = WFS.AppendData(ctx, zoneId, fileName, []byte("hello"))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	errRefused := errors.New("refused")
+	var numCalls int
+	refuse := true
+	WFS.OnDirtyEvict = func(ctx context.Context, hookZoneId string, hookName string) error {
+		numCalls++
+		// calling back into the store (same file) must not deadlock
+		_, _, err := WFS.ReadFile(ctx, hookZoneId, hookName)
+		if err != nil {
+			t.Errorf("error reading file from hook: %v", err)
+		}
+		if refuse {
+			return errRefused
+		}
+		return nil
+	}
+	defer func() { WFS.OnDirtyEvict = nil }()
+	err = WFS.Evict(ctx, zoneId, fileName)
+	if !errors.Is(err, errRefused) {
+		t.Fatalf("expected refused eviction, got %v", err)
+	}
+	if WFS.getCacheSize() != 1 {
+		t.Fatalf("refused eviction should keep the entry resident")
+	}
+	refuse = false
+	err = WFS.Evict(ctx, zoneId, fileName)
+	if err != nil {
+		t.Fatalf("error evicting file: %v", err)
+	}
+	if WFS.getCacheSize() != 0 {
+		t.Fatalf("cache size mismatch after evict: expected 0, got %d", WFS.getCacheSize())
+	}
+	checkFileData(t, ctx, zoneId, fileName, "hello")
+	// clean (non-resident) files don't call the hook
+	err = WFS.Evict(ctx, zoneId, fileName)
+	if err != nil {
+		t.Fatalf("error evicting file: %v", err)
+	}
+	if numCalls != 2 {
+		t.Errorf("hook call count mismatch: expected 2, got %d", numCalls)
+	}
+}
+
+func TestSnapshotAll(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId1 := uuid.NewString()
+	zoneId2 := uuid.NewString()
+	err := WFS.MakeFile(ctx, zoneId1, "f1", FileMeta{"a": "b"}, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	_, err = WFS.WriteFile(ctx, zoneId1, "f1", []byte(makeText(120)))
+	if err != nil {
+		t.Fatalf("error writing file: %v", err)
+	}
+	err = WFS.MakeFile(ctx, zoneId2, "c1", nil, FileOptsType{Circular: true, MaxSize: 100})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	circularText := makeText(230)
+	// left dirty, the snapshot must flush it
+	_, err = WFS.AppendData(ctx, zoneId2, "c1", []byte(circularText))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	// concurrent appends must show up whole (or not at all)
+	err = WFS.MakeFile(ctx, zoneId2, "log", nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	stopCh := make(chan struct{})
+	writerDone := make(chan struct{})
+	go func() {
+		defer close(writerDone)
+		for {
+			select {
+			case <-stopCh:
+				return
+			default:
+			}
+			_, err := WFS.AppendData(ctx, zoneId2, "log", []byte("hello"))
+			if err != nil {
+				t.Errorf("error appending data: %v", err)
+				return
+			}
+		}
+	}()
+	var buf bytes.Buffer
+	err = WFS.SnapshotAll(ctx, &buf)
+	close(stopCh)
+	<-writerDone
+	if err != nil {
+		t.Fatalf("error taking snapshot: %v", err)
+	}
+
+	// restore into a fresh db
+	cleanupDb(t)
+	initDb(t)
+	err = WFS.RestoreAll(ctx, bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("error restoring snapshot: %v", err)
+	}
+	checkFileData(t, ctx, zoneId1, "f1", makeText(120))
+	file, err := WFS.Stat(ctx, zoneId1, "f1")
+	if err != nil {
+		t.Fatalf("error stating file: %v", err)
+	}
+	if file.Meta["a"] != "b" {
+		t.Errorf("meta mismatch: %v", file.Meta)
+	}
+	checkFileSize(t, ctx, zoneId2, "c1", 230)
+	checkFileDataAt(t, ctx, zoneId2, "c1", 130, circularText[130:])
+	_, logData, err := WFS.ReadFile(ctx, zoneId2, "log")
+	if err != nil {
+		t.Fatalf("error reading file: %v", err)
+	}
+	if len(logData)%5 != 0 || string(logData) != strings.Repeat("hello", len(logData)/5) {
+		t.Errorf("torn write in snapshot: %q", logData)
+	}
+	err = WFS.RestoreAll(ctx, bytes.NewReader(buf.Bytes()))
+	if !errors.Is(err, fs.ErrExist) {
+		t.Errorf("expected fs.ErrExist restoring over existing files, got %v", err)
+	}
+	// a failed restore is rolled back as a whole, whichever order the files come in
+	for _, key := range []cacheKey{{ZoneId: zoneId1, Name: "f1"}, {ZoneId: zoneId2, Name: "c1"}} {
+		err = WFS.DeleteFile(ctx, key.ZoneId, key.Name)
+		if err != nil {
+			t.Fatalf("error deleting file: %v", err)
+		}
+	}
+	err = WFS.RestoreAll(ctx, bytes.NewReader(buf.Bytes()))
+	if !errors.Is(err, fs.ErrExist) {
+		t.Errorf("expected fs.ErrExist restoring over an existing file, got %v", err)
+	}
+	for _, key := range []cacheKey{{ZoneId: zoneId1, Name: "f1"}, {ZoneId: zoneId2, Name: "c1"}} {
+		_, err = WFS.Stat(ctx, key.ZoneId, key.Name)
+		if !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("expected %s to not be restored by a failed restore, got %v", key.Name, err)
+		}
+	}
+	err = WFS.RestoreAll(ctx, bytes.NewReader(buf.Bytes()[:buf.Len()-3]))
+	if err == nil {
+		t.Errorf("expected error restoring truncated snapshot")
+	}
+	cleanupDb(t)
+	initDb(t)
+	err = WFS.RestoreAll(ctx, bytes.NewReader(buf.Bytes()[:buf.Len()-3]))
+	if err == nil {
+		t.Errorf("expected error restoring truncated snapshot")
+	}
+	files, err := WFS.ListFiles(ctx, zoneId1)
+	if err != nil {
+		t.Fatalf("error listing files: %v", err)
+	}
+	if len(files) != 0 {
+		t.Errorf("expected a truncated snapshot to restore nothing, got %d files", len(files))
+	}
+}
+
+func TestNoDataCache(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+	WFS.NoDataCache = true
+	defer func() { WFS.NoDataCache = false }()
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	fileName := "nc1"
+	err := WFS.MakeFile(ctx, zoneId, fileName, nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	checkCacheEmpty := func() {
+		t.Helper()
+		if WFS.getCacheSize() != 0 {
+			t.Fatalf("cache size mismatch: expected 0, got %d", WFS.getCacheSize())
+		}
+	}
+	var expected string
+	for i := 0; i < 5; i++ {
+		text := makeText(37)
+		_, err = WFS.AppendData(ctx, zoneId, fileName, []byte(text))
+		if err != nil {
+			t.Fatalf("error appending data: %v", err)
+		}
+		expected += text
+		checkCacheEmpty()
+	}
+	checkFileData(t, ctx, zoneId, fileName, expected)
+	// partial-part overwrite spanning a part boundary (read-modify-write from the DB)
+	_, err = WFS.WriteAt(ctx, zoneId, fileName, 45, []byte("XXXXXXXXXX"))
+	if err != nil {
+		t.Fatalf("error writing data: %v", err)
+	}
+	checkCacheEmpty()
+	expected = expected[:45] + "XXXXXXXXXX" + expected[55:]
+	checkFileData(t, ctx, zoneId, fileName, expected)
+	future := WFS.WriteAtAsync(ctx, zoneId, fileName, 0, []byte("Y"))
+	select {
+	case <-future.Done():
+	default:
+		t.Fatalf("write-through future should be resolved on return")
+	}
+	if future.Err() != nil {
+		t.Fatalf("unexpected future error: %v", future.Err())
+	}
+	checkCacheEmpty()
+	checkFileData(t, ctx, zoneId, fileName, "Y"+expected[1:])
+	// meta-only changes stay cached
+	_, err = WFS.WriteMeta(ctx, zoneId, fileName, FileMeta{"a": 1}, true)
+	if err != nil {
+		t.Fatalf("error writing meta: %v", err)
+	}
+	if WFS.getCacheSize() != 1 {
+		t.Errorf("expected meta change to stay cached")
+	}
+	err = WFS.MakeFile(ctx, zoneId, "ij", nil, FileOptsType{IJson: true})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		_, err = WFS.AppendIJson(ctx, zoneId, "ij", ijson.MakeSetCommand(ijson.Path{"k"}, i))
+		if err != nil {
+			t.Fatalf("error appending ijson: %v", err)
+		}
+	}
+	_, data, err := WFS.ReadFile(ctx, zoneId, "ij")
+	if err != nil {
+		t.Fatalf("error reading file: %v", err)
+	}
+	if bytes.Count(data, []byte("\n")) != 3 {
+		t.Errorf("expected 3 ijson commands, got %q", data)
+	}
+}
+
+func TestCheckInvariants(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+	store := &FileStore{Lock: &sync.Mutex{}, Cache: make(map[cacheKey]*CacheEntry)}
+	makeEntry := func() *CacheEntry {
+		entry := makeCacheEntry(store, "zone", "file")
+		entry.File = &WaveFile{ZoneId: "zone", Name: "file", Size: 60}
+		entry.DataEntries[1] = makeDataCacheEntry(1)
+		entry.DataEntries[1].writeToPart(0, make([]byte, 10))
+		entry.ResidentBytes = entry.residentBytes()
+		store.Cache[cacheKey{ZoneId: "zone", Name: "file"}] = entry
+		store.ResidentBytes = entry.ResidentBytes
+		return entry
+	}
+	makeEntry()
+	if err := store.checkInvariants(); err != nil {
+		t.Fatalf("unexpected invariant error: %v", err)
+	}
+	corruptions := map[string]func(entry *CacheEntry){
+		"negative pin count": func(entry *CacheEntry) { entry.PinCount = -1 },
+		"clean unpinned":     func(entry *CacheEntry) { entry.File = nil; entry.DataEntries = make(map[int]*DataCacheEntry) },
+		"dirty without file": func(entry *CacheEntry) { entry.File = nil; entry.PinCount = 1 },
+		"part past size":     func(entry *CacheEntry) { entry.File.Size = 55 },
+		"part index":         func(entry *CacheEntry) { entry.DataEntries[2] = entry.DataEntries[1] },
+		"part capacity":      func(entry *CacheEntry) { entry.DataEntries[1].Data = make([]byte, 10, partDataSize+1) },
+		"resident bytes":     func(entry *CacheEntry) { entry.DataEntries[0] = makeFullDataCacheEntry(0, make([]byte, partDataSize)) },
+		"store accounting":   func(entry *CacheEntry) { store.ResidentBytes++ },
+	}
+	for name, corruptFn := range corruptions {
+		corruptFn(makeEntry())
+		if err := store.checkInvariants(); err == nil {
+			t.Errorf("%s: expected invariant error", name)
+		}
+	}
+}
+
+func TestMakeFileWithData(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	fileName := "mf1"
+	// writes are update-only (there is no MustExist option, it would be the default), only the
+	// create-or-write APIs (WriteAtEx, IncrementCounter) create a missing file
+	updateFns := map[string]func(name string) error{
+		"WriteAt": func(name string) error {
+			_, err := WFS.WriteAt(ctx, zoneId, name, 0, []byte("hello"))
+			return err
+		},
+		"WriteFile": func(name string) error {
+			_, err := WFS.WriteFile(ctx, zoneId, name, []byte("hello"))
+			return err
+		},
+		"AppendData": func(name string) error {
+			_, err := WFS.AppendData(ctx, zoneId, name, []byte("hello"))
+			return err
+		},
+		"WritePartData": func(name string) error {
+			_, err := WFS.WritePartData(ctx, zoneId, name, 0, []byte("hello"))
+			return err
+		},
+	}
+	for fnName, updateFn := range updateFns {
+		err := updateFn(fileName)
+		if !errors.Is(err, fs.ErrNotExist) {
+			t.Fatalf("%s: expected fs.ErrNotExist writing a missing file, got %v", fnName, err)
+		}
+		_, err = WFS.Stat(ctx, zoneId, fileName)
+		if !errors.Is(err, fs.ErrNotExist) {
+			t.Fatalf("%s created a missing file", fnName)
+		}
+	}
+	_, created, err := WFS.WriteAtEx(ctx, zoneId, "ex1", 0, []byte("hello"), FileOptsType{})
+	if err != nil || !created {
+		t.Fatalf("expected WriteAtEx to create a missing file, got created=%v err=%v", created, err)
+	}
+	_, err = WFS.IncrementCounter(ctx, zoneId, "counter1", 1)
+	if err != nil {
+		t.Fatalf("expected IncrementCounter to create a missing file, got %v", err)
+	}
+	text := makeText(120)
+	err = WFS.MakeFileWithData(ctx, zoneId, fileName, FileMeta{"a": "b"}, FileOptsType{}, []byte(text))
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	if WFS.getCacheSize() != 0 {
+		t.Errorf("cache size mismatch: expected 0, got %d", WFS.getCacheSize())
+	}
+	checkFileSize(t, ctx, zoneId, fileName, 120)
+	checkFileData(t, ctx, zoneId, fileName, text)
+	err = WFS.MakeFileWithData(ctx, zoneId, fileName, nil, FileOptsType{}, []byte("other"))
+	if !errors.Is(err, fs.ErrExist) {
+		t.Fatalf("expected fs.ErrExist, got %v", err)
+	}
+	checkFileData(t, ctx, zoneId, fileName, text)
+	// circular files keep only the last MaxSize bytes
+	err = WFS.MakeFileWithData(ctx, zoneId, "c1", nil, FileOptsType{Circular: true, MaxSize: 100}, []byte(text))
+	if err != nil {
+		t.Fatalf("error creating circular file: %v", err)
+	}
+	checkFileSize(t, ctx, zoneId, "c1", 120)
+	checkFileDataAt(t, ctx, zoneId, "c1", 20, text[20:])
+}
+
+func TestFlushRange(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	fileName := "fr1"
+	err := WFS.MakeFile(ctx, zoneId, fileName, nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	text := makeText(230)
+	_, err = WFS.AppendData(ctx, zoneId, fileName, []byte(text))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	err = WFS.FlushRange(ctx, zoneId, fileName, 0, 2)
+	if err != nil {
+		t.Fatalf("error flushing range: %v", err)
+	}
+	dbFile, err := dbGetZoneFile(ctx, zoneId, fileName)
+	if err != nil || dbFile == nil {
+		t.Fatalf("error getting file from db: %v", err)
+	}
+	if dbFile.Size != 230 {
+		t.Errorf("db size mismatch: expected 230, got %d", dbFile.Size)
+	}
+	dbParts, err := dbGetFileParts(ctx, zoneId, fileName, []int{0, 1, 2, 3, 4})
+	if err != nil {
+		t.Fatalf("error getting parts from db: %v", err)
+	}
+	if len(dbParts) != 2 || dbParts[0] == nil || dbParts[1] == nil {
+		t.Errorf("expected only parts 0 and 1 in the db, got %d parts", len(dbParts))
+	}
+	err = withLock(WFS, zoneId, fileName, func(entry *CacheEntry) error {
+		if entry.File == nil || len(entry.DataEntries) != 3 {
+			t.Errorf("expected 3 dirty parts to remain, got %d", len(entry.DataEntries))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("error checking cache entry: %v", err)
+	}
+	checkFileData(t, ctx, zoneId, fileName, text)
+	// a range covering the remaining dirty parts is a full flush
+	err = WFS.FlushRange(ctx, zoneId, fileName, 2, 10)
+	if err != nil {
+		t.Fatalf("error flushing range: %v", err)
+	}
+	if WFS.getCacheSize() != 0 {
+		t.Errorf("cache size mismatch: expected 0, got %d", WFS.getCacheSize())
+	}
+	checkFileData(t, ctx, zoneId, fileName, text)
+	err = WFS.FlushRange(ctx, zoneId, fileName, 3, 1)
+	if err == nil {
+		t.Errorf("expected error for invalid range")
+	}
+}
+
+func TestFlushJitter(t *testing.T) {
+	store := &FileStore{Lock: &sync.Mutex{}, Cache: make(map[cacheKey]*CacheEntry)}
+	if store.nextFlushDelay() != DefaultFlushTime {
+		t.Errorf("expected no jitter by default")
+	}
+	store.FlushJitter = 0.5
+	var sawJitter bool
+	for i := 0; i < 100; i++ {
+		delay := store.nextFlushDelay()
+		if delay > DefaultFlushTime || delay < DefaultFlushTime/2 {
+			t.Fatalf("delay %v out of range", delay)
+		}
+		if delay != DefaultFlushTime {
+			sawJitter = true
+		}
+	}
+	if !sawJitter {
+		t.Errorf("expected jittered delays")
+	}
+	store.FlushJitter = 5
+	for i := 0; i < 100; i++ {
+		delay := store.nextFlushDelay()
+		if delay > DefaultFlushTime || delay < 0 {
+			t.Fatalf("delay %v out of range", delay)
+		}
+	}
+
+	// files dirtied together are flushed spread out over the last FlushJitter of the interval, none of
+	// them later than the interval.  time is simulated by aging every DirtyTs between passes.
+	initDb(t)
+	defer cleanupDb(t)
+	WFS.FlushJitter = 0.5
+	defer func() {
+		WFS.FlushJitter = 0
+		WFS.flushNextDue = 0
+	}()
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	const numFiles = 20
+	for i := 0; i < numFiles; i++ {
+		fileName := fmt.Sprintf("j%d", i)
+		err := WFS.MakeFile(ctx, zoneId, fileName, nil, FileOptsType{})
+		if err != nil {
+			t.Fatalf("error creating file: %v", err)
+		}
+		_, err = WFS.AppendData(ctx, zoneId, fileName, []byte("hello"))
+		if err != nil {
+			t.Fatalf("error appending data: %v", err)
+		}
+	}
+	const agingStep = 250 * time.Millisecond
+	var numFlushed, flushPasses int
+	for age := time.Duration(0); age <= DefaultFlushTime; age += agingStep {
+		if age > 0 {
+			for i := 0; i < numFiles; i++ {
+				withLock(WFS, zoneId, fmt.Sprintf("j%d", i), func(entry *CacheEntry) error {
+					if entry.File != nil {
+						entry.DirtyTs -= agingStep.Milliseconds()
+					}
+					return nil
+				})
+			}
+		}
+		stats, err := WFS.flushCache(ctx, true)
+		if err != nil {
+			t.Fatalf("error flushing cache: %v", err)
+		}
+		if stats.NumCommitted+stats.NumNotDue != numFiles-numFlushed {
+			t.Fatalf("expected every dirty file to be flushed or held back, got %+v", stats)
+		}
+		if stats.NumCommitted > 0 {
+			if age < DefaultFlushTime/2-agingStep*2 {
+				t.Errorf("expected no flushes before the jitter window, %d flushed at %v", stats.NumCommitted, age)
+			}
+			flushPasses++
+		}
+		numFlushed += stats.NumCommitted
+		if stats.NumNotDue > 0 {
+			if delay := WFS.nextFlushDelay(); delay > DefaultFlushTime-age {
+				t.Errorf("expected the flusher to wake for the next deadline, delay %v at %v", delay, age)
+			}
+		}
+	}
+	if numFlushed != numFiles {
+		t.Errorf("expected every file to be flushed within the interval, %d of %d were", numFlushed, numFiles)
+	}
+	if flushPasses < 3 {
+		t.Errorf("expected the files to be flushed over several passes, got %d", flushPasses)
+	}
+}
+
+func TestAdaptiveFlushInterval(t *testing.T) {
+	store := &FileStore{Lock: &sync.Mutex{}, Cache: make(map[cacheKey]*CacheEntry)}
+	if store.nextFlushDelay() != DefaultFlushTime {
+		t.Errorf("expected a fixed interval by default")
+	}
+	store.FlushTargetBytes = 1000
+	store.FlushMinInterval = 100 * time.Millisecond
+	if store.nextFlushDelay() != DefaultFlushTime {
+		t.Errorf("expected the max interval before any writes")
+	}
+	// feed a steady write rate of (dirtyBytes / 1s) until the smoothed rate converges
+	startTs := time.Now()
+	sampleTs := startTs
+	store.sampleDirtyRate(sampleTs)
+	steadyRate := func(dirtyBytes int64) time.Duration {
+		for i := 0; i < 50; i++ {
+			sampleTs = sampleTs.Add(time.Second)
+			store.recordBytesWritten(dirtyBytes)
+			store.sampleDirtyRate(sampleTs)
+		}
+		return store.nextFlushDelay()
+	}
+	if delay := steadyRate(100); delay != DefaultFlushTime {
+		t.Errorf("expected a light write rate to use the max interval, got %v", delay)
+	}
+	if delay := steadyRate(2000); delay < 490*time.Millisecond || delay > 510*time.Millisecond {
+		t.Errorf("expected about 500ms for 2000 bytes/sec, got %v", delay)
+	}
+	if delay := steadyRate(1000000); delay != 100*time.Millisecond {
+		t.Errorf("expected a heavy write rate to be clamped to the min interval, got %v", delay)
+	}
+	// a single burst only moves the smoothed rate part of the way
+	steadyRate(2000)
+	sampleTs = sampleTs.Add(time.Second)
+	store.recordBytesWritten(20000)
+	store.sampleDirtyRate(sampleTs)
+	if delay := store.nextFlushDelay(); delay < 100*time.Millisecond || delay > 200*time.Millisecond {
+		t.Errorf("expected a burst to shorten the interval smoothly, got %v", delay)
+	}
+	store.FlushMaxInterval = time.Second
+	store.dirtyRate = 1
+	if delay := store.nextFlushDelay(); delay != time.Second {
+		t.Errorf("expected FlushMaxInterval to bound the interval, got %v", delay)
+	}
+	// a max above DefaultFlushTime is honored (idle stores flush less often)
+	store.FlushMaxInterval = time.Minute
+	store.dirtyRate = 0
+	if delay := store.nextFlushDelay(); delay != time.Minute {
+		t.Errorf("expected a FlushMaxInterval above DefaultFlushTime to be used, got %v", delay)
+	}
+}
+
+// dirty data a sweep leaves resident (here deferred by FlushRateLimit) is not new writes, sampling it again
+// on the next sweeps must not raise the rate and shrink the interval
+func TestAdaptiveFlushIntervalUnflushed(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+	WFS.FlushTargetBytes = 1000
+	WFS.FlushMinInterval = 10 * time.Millisecond
+	WFS.FlushRateLimit = 0.001
+	defer func() {
+		WFS.FlushTargetBytes = 0
+		WFS.FlushMinInterval = 0
+		WFS.FlushRateLimit = 0
+		WFS.flushTokensTs = time.Time{}
+		WFS.flushesDeferred = 0
+		WFS.flushThrottled = false
+		WFS.dirtyRate = 0
+		WFS.lastSampleTs = time.Time{}
+	}()
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	sampleTs := time.Now()
+	WFS.sampleDirtyRate(sampleTs)
+	for _, fileName := range []string{"u1", "u2", "u3"} {
+		err := WFS.MakeFile(ctx, zoneId, fileName, nil, FileOptsType{})
+		if err != nil {
+			t.Fatalf("error creating file: %v", err)
+		}
+		_, err = WFS.AppendData(ctx, zoneId, fileName, []byte(makeText(150)))
+		if err != nil {
+			t.Fatalf("error appending data: %v", err)
+		}
+	}
+	sampleTs = sampleTs.Add(time.Second)
+	WFS.sampleDirtyRate(sampleTs)
+	firstDelay := WFS.nextFlushDelay()
+	for i := 0; i < 10; i++ {
+		stats, err := WFS.flushCache(ctx, true)
+		if err != nil {
+			t.Fatalf("error flushing cache: %v", err)
+		}
+		if stats.NumDeferred == 0 {
+			t.Fatalf("expected the sweep to defer entries, got %+v", stats)
+		}
+		// an early wake, the next sample comes soon after
+		sampleTs = sampleTs.Add(10 * time.Millisecond)
+		WFS.sampleDirtyRate(sampleTs)
+		if delay := WFS.nextFlushDelay(); delay < firstDelay {
+			t.Fatalf("expected unflushed data not to shrink the interval, got %v after %v", delay, firstDelay)
+		}
+	}
+	if WFS.CacheStats().NumEntries == 0 {
+		t.Errorf("expected dirty data to stay resident")
+	}
+}
+
+func TestRandSource(t *testing.T) {
+	var delays [2][]time.Duration
+	for i := range delays {
+		store := &FileStore{Lock: &sync.Mutex{}, Cache: make(map[cacheKey]*CacheEntry), FlushJitter: 0.5, RandSource: mathrand.NewSource(42)}
+		for j := 0; j < 20; j++ {
+			delays[i] = append(delays[i], store.nextFlushDelay())
+		}
+	}
+	if !reflect.DeepEqual(delays[0], delays[1]) {
+		t.Fatalf("expected the same seed to give the same flush delays:\n%v\n%v", delays[0], delays[1])
+	}
+}
+
+func TestSoftDelete(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+	WFS.DeleteRetention = time.Hour
+	defer func() { WFS.DeleteRetention = 0 }()
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	fileName := "sd1"
+	err := WFS.MakeFileWithData(ctx, zoneId, fileName, nil, FileOptsType{}, []byte("hello world"))
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	err = WFS.DeleteFile(ctx, zoneId, fileName)
+	if err != nil {
+		t.Fatalf("error deleting file: %v", err)
+	}
+	_, err = WFS.Stat(ctx, zoneId, fileName)
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("expected soft-deleted file to be hidden, got %v", err)
+	}
+	files, err := WFS.ListFiles(ctx, zoneId)
+	if err != nil {
+		t.Fatalf("error listing files: %v", err)
+	}
+	if len(files) != 0 {
+		t.Fatalf("expected soft-deleted file to be hidden from listing")
+	}
+	_, err = WFS.AppendData(ctx, zoneId, fileName, []byte("!"))
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("expected fs.ErrNotExist writing a soft-deleted file, got %v", err)
+	}
+	err = WFS.Undelete(ctx, zoneId, fileName)
+	if err != nil {
+		t.Fatalf("error undeleting file: %v", err)
+	}
+	checkFileData(t, ctx, zoneId, fileName, "hello world")
+	err = WFS.Undelete(ctx, zoneId, fileName)
+	if !errors.Is(err, fs.ErrExist) {
+		t.Fatalf("expected fs.ErrExist undeleting a live file, got %v", err)
+	}
+
+	// recreating the name replaces the soft-deleted file
+	err = WFS.DeleteFile(ctx, zoneId, fileName)
+	if err != nil {
+		t.Fatalf("error deleting file: %v", err)
+	}
+	err = WFS.MakeFile(ctx, zoneId, fileName, nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error recreating file: %v", err)
+	}
+	checkFileSize(t, ctx, zoneId, fileName, 0)
+	err = WFS.Undelete(ctx, zoneId, fileName)
+	if !errors.Is(err, fs.ErrExist) {
+		t.Fatalf("expected fs.ErrExist, got %v", err)
+	}
+
+	// expired files are reaped and can't be undeleted
+	err = WFS.DeleteFile(ctx, zoneId, fileName)
+	if err != nil {
+		t.Fatalf("error deleting file: %v", err)
+	}
+	numReaped, err := WFS.reapDeletedFiles(ctx)
+	if err != nil || numReaped != 0 {
+		t.Fatalf("expected nothing to reap within the window, got %d (err: %v)", numReaped, err)
+	}
+	WFS.DeleteRetention = time.Millisecond
+	time.Sleep(5 * time.Millisecond)
+	numReaped, err = WFS.reapDeletedFiles(ctx)
+	if err != nil || numReaped != 1 {
+		t.Fatalf("expected 1 reaped file, got %d (err: %v)", numReaped, err)
+	}
+	err = WFS.Undelete(ctx, zoneId, fileName)
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("expected fs.ErrNotExist after reap, got %v", err)
+	}
+
+	// default (no retention) is an immediate hard delete
+	WFS.DeleteRetention = 0
+	err = WFS.MakeFile(ctx, zoneId, fileName, nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	err = WFS.DeleteFile(ctx, zoneId, fileName)
+	if err != nil {
+		t.Fatalf("error deleting file: %v", err)
+	}
+	err = WFS.Undelete(ctx, zoneId, fileName)
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("expected fs.ErrNotExist, got %v", err)
+	}
+}
+
+func TestFsck(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	WFS.Dedup = true
+	defer func() { WFS.Dedup = false }()
+	err := WFS.MakeFileWithData(ctx, zoneId, "f1", nil, FileOptsType{}, []byte(makeText(120)))
+	WFS.Dedup = false
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	err = WFS.MakeFileWithData(ctx, zoneId, "f2", nil, FileOptsType{}, []byte(makeText(80)))
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	err = WFS.MakeFile(ctx, zoneId, "dirty", nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	_, err = WFS.AppendData(ctx, zoneId, "dirty", []byte("hello"))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	report, err := WFS.Fsck(ctx)
+	if err != nil {
+		t.Fatalf("error running fsck: %v", err)
+	}
+	if len(report.Issues) != 0 || report.NumFiles != 3 || report.NumParts != 5 {
+		t.Fatalf("unexpected fsck report for a clean store: %+v", report)
+	}
+	err = WithTx(ctx, func(tx *TxWrap) error {
+		tx.Exec("INSERT INTO db_file_data (zoneid, name, partidx, data) VALUES (?, 'gone', 0, x'00')", zoneId)
+		tx.Exec("UPDATE db_wave_file SET size = 60 WHERE zoneid = ? AND name = 'f2'", zoneId)
+		tx.Exec("UPDATE db_file_blob SET refcount = refcount + 1")
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("error corrupting db: %v", err)
+	}
+	// delete the dirty file behind the cache's back
+	err = dbDeleteFile(ctx, zoneId, "dirty")
+	if err != nil {
+		t.Fatalf("error deleting file: %v", err)
+	}
+	report, err = WFS.Fsck(ctx)
+	if err != nil {
+		t.Fatalf("error running fsck: %v", err)
+	}
+	categories := make(map[string]int)
+	for _, issue := range report.Issues {
+		categories[issue.Category]++
+	}
+	expected := map[string]int{FsckOrphanPart: 1, FsckPartPastSize: 1, FsckBlobRefCount: 2, FsckDirtyOrphan: 1}
+	if !reflect.DeepEqual(categories, expected) {
+		t.Errorf("fsck issue mismatch: expected %v, got %v (%+v)", expected, categories, report.Issues)
+	}
+	// the dirty entry can't be flushed anymore, drop it so cleanup doesn't count a flush error
+	WFS.clearCache()
+}
+
+func TestSwapFiles(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	textA := makeText(120)
+	textB := "next"
+	err := WFS.MakeFileWithData(ctx, zoneId, "current", FileMeta{"which": "a"}, FileOptsType{}, []byte(textA))
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	err = WFS.MakeFile(ctx, zoneId, "next", FileMeta{"which": "b"}, FileOptsType{Circular: true, MaxSize: 100})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	// left dirty, the swap must flush it
+	_, err = WFS.AppendData(ctx, zoneId, "next", []byte(textB))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	versionA, _ := WFS.StatVersion(ctx, zoneId, "current")
+	versionB, _ := WFS.StatVersion(ctx, zoneId, "next")
+	err = WFS.SwapFiles(ctx, zoneId, "current", "next")
+	if err != nil {
+		t.Fatalf("error swapping files: %v", err)
+	}
+	checkFileData(t, ctx, zoneId, "current", textB)
+	checkFileData(t, ctx, zoneId, "next", textA)
+	current, err := WFS.Stat(ctx, zoneId, "current")
+	if err != nil {
+		t.Fatalf("error stating file: %v", err)
+	}
+	if !current.Opts.Circular || current.Meta["which"] != "b" || current.Version != versionA+1 {
+		t.Errorf("swapped file mismatch: %+v", current)
+	}
+	next, err := WFS.Stat(ctx, zoneId, "next")
+	if err != nil {
+		t.Fatalf("error stating file: %v", err)
+	}
+	if next.Opts.Circular || next.Meta["which"] != "a" || next.Version != versionB+1 {
+		t.Errorf("swapped file mismatch: %+v", next)
+	}
+	err = WFS.SwapFiles(ctx, zoneId, "current", "missing")
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected fs.ErrNotExist, got %v", err)
+	}
+	checkFileData(t, ctx, zoneId, "current", textB)
+	err = WFS.SwapFiles(ctx, zoneId, "current", "current")
+	if err == nil {
+		t.Errorf("expected error swapping a file with itself")
+	}
+}
+
+type failingReader struct {
+	data []byte
+	err  error
+}
+
+func (r *failingReader) Read(buf []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, r.err
+	}
+	n := copy(buf, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+func TestAppendFrom(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	fileName := "af1"
+	err := WFS.MakeFile(ctx, zoneId, fileName, nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	text := makeText(237)
+	written, err := WFS.AppendFrom(ctx, zoneId, fileName, strings.NewReader(text))
+	if err != nil {
+		t.Fatalf("error appending from reader: %v", err)
+	}
+	if written != 237 {
+		t.Errorf("written mismatch: expected 237, got %d", written)
+	}
+	checkFileData(t, ctx, zoneId, fileName, text)
+
+	// reader errors return the bytes written so far
+	errRead := errors.New("read failed")
+	written, err = WFS.AppendFrom(ctx, zoneId, fileName, &failingReader{data: []byte("abc"), err: errRead})
+	if !errors.Is(err, errRead) {
+		t.Fatalf("expected read error, got %v", err)
+	}
+	if written != 3 {
+		t.Errorf("written mismatch: expected 3, got %d", written)
+	}
+	checkFileData(t, ctx, zoneId, fileName, text+"abc")
+
+	// circular files wrap
+	err = WFS.MakeFile(ctx, zoneId, "c1", nil, FileOptsType{Circular: true, MaxSize: 100})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	_, err = WFS.AppendFrom(ctx, zoneId, "c1", strings.NewReader(text))
+	if err != nil {
+		t.Fatalf("error appending from reader: %v", err)
+	}
+	checkFileSize(t, ctx, zoneId, "c1", 237)
+	checkFileDataAt(t, ctx, zoneId, "c1", 137, text[137:])
+
+	cancelledCtx, cancelledFn := context.WithCancel(ctx)
+	cancelledFn()
+	written, err = WFS.AppendFrom(cancelledCtx, zoneId, fileName, strings.NewReader(text))
+	if !errors.Is(err, context.Canceled) || written != 0 {
+		t.Errorf("expected context.Canceled with nothing written, got %d, %v", written, err)
+	}
+}
+
+func TestFlushRateLimit(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+	WFS.FlushRateLimit = 1
+	defer func() {
+		WFS.FlushRateLimit = 0
+		WFS.flushTokensTs = time.Time{}
+		WFS.flushesDeferred = 0
+		WFS.flushThrottled = false
+	}()
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	fileNames := []string{"r1", "r2", "r3"}
+	for _, fileName := range fileNames {
+		err := WFS.MakeFile(ctx, zoneId, fileName, nil, FileOptsType{})
+		if err != nil {
+			t.Fatalf("error creating file: %v", err)
+		}
+		_, err = WFS.AppendData(ctx, zoneId, fileName, []byte("hello"))
+		if err != nil {
+			t.Fatalf("error appending data: %v", err)
+		}
+	}
+	stats, err := WFS.flushCache(ctx, true)
+	if err != nil {
+		t.Fatalf("error flushing cache: %v", err)
+	}
+	if stats.NumCommitted != 1 || stats.NumDeferred != 2 {
+		t.Fatalf("expected 1 committed and 2 deferred, got %+v", stats)
+	}
+	cacheStats := WFS.CacheStats()
+	if !cacheStats.Throttled || cacheStats.FlushesDeferred != 2 || cacheStats.NumEntries != 2 {
+		t.Errorf("cache stats mismatch: %+v", cacheStats)
+	}
+	// entries dirty for longer than the max staleness are flushed even without tokens
+	for _, fileName := range fileNames {
+		withLock(WFS, zoneId, fileName, func(entry *CacheEntry) error {
+			if entry.DirtyTs != 0 {
+				entry.DirtyTs -= DefaultFlushTime.Milliseconds()
+			}
+			return nil
+		})
+	}
+	stats, err = WFS.flushCache(ctx, true)
+	if err != nil {
+		t.Fatalf("error flushing cache: %v", err)
+	}
+	if stats.NumCommitted != 2 || stats.NumDeferred != 0 {
+		t.Fatalf("expected 2 committed and 0 deferred, got %+v", stats)
+	}
+	cacheStats = WFS.CacheStats()
+	if cacheStats.Throttled || cacheStats.FlushesDeferred != 2 || cacheStats.NumEntries != 0 {
+		t.Errorf("cache stats mismatch: %+v", cacheStats)
+	}
+	for _, fileName := range fileNames {
+		checkFileData(t, ctx, zoneId, fileName, "hello")
+	}
+}
+
+func getPartEncodings(t *testing.T, ctx context.Context, zoneId string, name string) map[int]int {
+	rows, err := WithTxRtn(ctx, func(tx *TxWrap) ([]*dbPartRow, error) {
+		var rtn []*dbPartRow
+		tx.Select(&rtn, "SELECT partidx, encoding FROM db_file_data WHERE zoneid = ? AND name = ?", zoneId, name)
+		return rtn, nil
+	})
+	if err != nil {
+		t.Fatalf("error getting part encodings: %v", err)
+	}
+	encodings := make(map[int]int)
+	for _, row := range rows {
+		encodings[row.PartIdx] = row.Encoding
+	}
+	return encodings
+}
+
+func TestPartEncoding(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+	// go's flate only compresses blocks this small at the highest level, so use bigger parts
+	partDataSize = 1000
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	err := WFS.MakeFile(ctx, zoneId, "f1", nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	// part 0 is written plain, part 1 compressed (compressible), part 2 stays plain (too short to shrink)
+	_, err = WFS.WriteFile(ctx, zoneId, "f1", []byte(makeRepeat('a', 1000)))
+	if err != nil {
+		t.Fatalf("error writing file: %v", err)
+	}
+	WFS.Compress = true
+	defer func() { WFS.Compress = false }()
+	_, err = WFS.AppendData(ctx, zoneId, "f1", []byte(makeRepeat('b', 1000)+"xyz"))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	_, err = WFS.FlushCache(ctx)
+	if err != nil {
+		t.Fatalf("error flushing cache: %v", err)
+	}
+	encodings := getPartEncodings(t, ctx, zoneId, "f1")
+	expected := map[int]int{0: PartEncodingPlain, 1: PartEncodingFlate, 2: PartEncodingPlain}
+	if !reflect.DeepEqual(encodings, expected) {
+		t.Fatalf("part encodings mismatch: expected %v, got %v", expected, encodings)
+	}
+	checkFileData(t, ctx, zoneId, "f1", makeRepeat('a', 1000)+makeRepeat('b', 1000)+"xyz")
+
+	// a partial write to a compressed part decodes it, and the result is re-encoded on flush
+	WFS.Compress = false
+	_, err = WFS.WriteAt(ctx, zoneId, "f1", 1010, []byte("cc"))
+	if err != nil {
+		t.Fatalf("error writing data: %v", err)
+	}
+	_, err = WFS.FlushCache(ctx)
+	if err != nil {
+		t.Fatalf("error flushing cache: %v", err)
+	}
+	if encodings = getPartEncodings(t, ctx, zoneId, "f1"); encodings[1] != PartEncodingPlain {
+		t.Fatalf("expected part 1 to be rewritten plain, got encoding %d", encodings[1])
+	}
+	checkFileData(t, ctx, zoneId, "f1", makeRepeat('a', 1000)+makeRepeat('b', 10)+"cc"+makeRepeat('b', 988)+"xyz")
+
+	// unknown encodings are an error, not garbage data
+	err = WithTx(ctx, func(tx *TxWrap) error {
+		tx.Exec("UPDATE db_file_data SET encoding = 99 WHERE zoneid = ? AND name = ? AND partidx = 0", zoneId, "f1")
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("error updating part encoding: %v", err)
+	}
+	_, _, err = WFS.ReadFile(ctx, zoneId, "f1")
+	if err == nil {
+		t.Fatalf("expected error reading part with unknown encoding")
+	}
+}
+
+func TestPinAll(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	err := WFS.MakeFile(ctx, zoneId, "f1", nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	keys := []FileKey{{ZoneId: zoneId, Name: "f1"}, {ZoneId: zoneId, Name: "f2"}, {ZoneId: zoneId, Name: "f1"}}
+	unpinAll := WFS.PinAll(keys)
+	if entry := WFS.getEntryAndPin(zoneId, "f1"); entry.PinCount != 3 {
+		t.Fatalf("expected f1 pin count 3 (2 + this lookup), got %d", entry.PinCount)
+	}
+	WFS.unpinEntryAndTryDelete(zoneId, "f1")
+	// pinned entries survive a flush (which would otherwise drop clean entries)
+	_, err = WFS.AppendData(ctx, zoneId, "f1", []byte("hello"))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	_, err = WFS.FlushCache(ctx)
+	if err != nil {
+		t.Fatalf("error flushing cache: %v", err)
+	}
+	if WFS.getCacheSize() != 2 {
+		t.Fatalf("expected 2 pinned cache entries, got %d", WFS.getCacheSize())
+	}
+	unpinAll()
+	unpinAll()
+	if WFS.getCacheSize() != 0 {
+		t.Fatalf("expected empty cache after unpinAll, got %d entries", WFS.getCacheSize())
+	}
+	checkFileData(t, ctx, zoneId, "f1", "hello")
+}
+
+func TestOverflowPolicy(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	for _, opts := range []FileOptsType{
+		{OverflowPolicy: OverflowError},
+		{MaxSize: 100, Circular: true, OverflowPolicy: OverflowBlock},
+		{MaxSize: 100, OverflowPolicy: "bogus"},
+	} {
+		err := WFS.MakeFile(ctx, zoneId, "bad", nil, opts)
+		if err == nil {
+			t.Fatalf("expected error creating file with opts %+v", opts)
+		}
+	}
+
+	// error: nothing is written, overwrites within MaxSize are fine
+	err := WFS.MakeFile(ctx, zoneId, "err", nil, FileOptsType{MaxSize: 100, OverflowPolicy: OverflowError})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	_, err = WFS.AppendData(ctx, zoneId, "err", []byte(makeRepeat('a', 80)))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	_, err = WFS.AppendData(ctx, zoneId, "err", []byte(makeRepeat('b', 30)))
+	if !errors.Is(err, ErrFileFull) {
+		t.Fatalf("expected ErrFileFull appending past max size, got %v", err)
+	}
+	_, err = WFS.WriteAt(ctx, zoneId, "err", 70, []byte(makeRepeat('c', 30)))
+	if err != nil {
+		t.Fatalf("error writing up to max size: %v", err)
+	}
+	_, err = WFS.WriteFile(ctx, zoneId, "err", []byte(makeRepeat('d', 101)))
+	if !errors.Is(err, ErrFileFull) {
+		t.Fatalf("expected ErrFileFull from oversized WriteFile, got %v", err)
+	}
+	checkFileData(t, ctx, zoneId, "err", makeRepeat('a', 70)+makeRepeat('c', 30))
+
+	err = WFS.MakeFile(ctx, zoneId, "drop", nil, FileOptsType{MaxSize: 100, OverflowPolicy: "dropoldest"})
+	if err == nil {
+		t.Fatalf("expected error for a drop-oldest policy (that is a circular file)")
+	}
+
+	// block: the append waits until the file is truncated
+	err = WFS.MakeFileWithData(ctx, zoneId, "block", nil, FileOptsType{MaxSize: 100, OverflowPolicy: OverflowBlock}, []byte(makeRepeat('a', 100)))
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	appendErrCh := make(chan error, 1)
+	go func() {
+		_, err := WFS.AppendData(ctx, zoneId, "block", []byte("tail"))
+		appendErrCh <- err
+	}()
+	select {
+	case err := <-appendErrCh:
+		t.Fatalf("expected append to block, got %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	_, err = WFS.WriteFile(ctx, zoneId, "block", []byte("head:"))
+	if err != nil {
+		t.Fatalf("error writing file: %v", err)
+	}
+	err = <-appendErrCh
+	if err != nil {
+		t.Fatalf("error from blocked append: %v", err)
+	}
+	checkFileData(t, ctx, zoneId, "block", "head:tail")
+	shortCtx, shortCancelFn := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer shortCancelFn()
+	_, err = WFS.AppendData(shortCtx, zoneId, "block", []byte(makeRepeat('x', 100)))
+	if !errors.Is(err, ErrFileFull) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected ErrFileFull + deadline exceeded from blocked append, got %v", err)
+	}
+	checkFileData(t, ctx, zoneId, "block", "head:tail")
+}
+
+func TestLockWaitStats(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	if stats := WFS.LockWaitStats(); stats.Count != 0 {
+		t.Fatalf("expected no lock waits recorded by default, got %d", stats.Count)
+	}
+	WFS.MeasureLockWait = true
+	err := WFS.MakeFile(ctx, zoneId, "f1", nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			WFS.AppendData(ctx, zoneId, "f1", []byte("hello"))
+		}()
+	}
+	wg.Wait()
+	WFS.MeasureLockWait = false
+	stats := WFS.LockWaitStats()
+	if stats.Count == 0 {
+		t.Fatalf("expected lock waits to be recorded")
+	}
+	if len(stats.Counts) != len(stats.Buckets)+1 {
+		t.Fatalf("expected %d bucket counts, got %d", len(stats.Buckets)+1, len(stats.Counts))
+	}
+	var total int64
+	for _, count := range stats.Counts {
+		total += count
+	}
+	if total != stats.Count {
+		t.Fatalf("bucket counts sum to %d, expected %d", total, stats.Count)
+	}
+	_, err = WFS.AppendData(ctx, zoneId, "f1", []byte("hello"))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	if newStats := WFS.LockWaitStats(); newStats.Count != stats.Count {
+		t.Fatalf("expected no lock waits recorded after disabling, got %d new", newStats.Count-stats.Count)
+	}
+}
+
+func TestWriteToPartZeroFillsGap(t *testing.T) {
+	// a buffer with stale bytes past len (like one used as scratch space by a decoder)
+	buf := bytes.Repeat([]byte{'x'}, int(partDataSize))
+	dce := &DataCacheEntry{PartIdx: 0, Data: buf[:5]}
+	copy(dce.Data, "hello")
+	dce.writeToPart(10, []byte("world"))
+	expected := "hello" + string(make([]byte, 5)) + "world"
+	if string(dce.Data) != expected {
+		t.Fatalf("part data mismatch: expected %q, got %q", expected, dce.Data)
+	}
+	// writes inside the existing data don't touch anything past it
+	dce.writeToPart(0, []byte("HE"))
+	if string(dce.Data) != "HEllo"+string(make([]byte, 5))+"world" || buf[15] != 'x' {
+		t.Fatalf("unexpected part data after overwrite: %q", dce.Data)
+	}
+}
+
+func TestStoreRouter(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	router := MakeStoreRouter()
+	_, _, err := router.Route("zone")
+	if err == nil {
+		t.Fatalf("expected error routing with no stores")
+	}
+	for _, name := range []string{"s1", "s2", "s3"} {
+		router.AddStore(name, &FileStore{Lock: &sync.Mutex{}, Cache: make(map[cacheKey]*CacheEntry)})
+	}
+	zoneIds := make([]string, 1000)
+	routes := make(map[string]string)
+	for i := range zoneIds {
+		zoneIds[i] = uuid.NewString()
+		routes[zoneIds[i]], _, _ = router.Route(zoneIds[i])
+	}
+	// adding a store only moves zones to the new store
+	router.AddStore("s4", &FileStore{Lock: &sync.Mutex{}, Cache: make(map[cacheKey]*CacheEntry)})
+	numMoved := 0
+	for _, zoneId := range zoneIds {
+		storeName, _, _ := router.Route(zoneId)
+		if storeName != routes[zoneId] {
+			if storeName != "s4" {
+				t.Fatalf("zone moved from %s to %s (expected s4)", routes[zoneId], storeName)
+			}
+			numMoved++
+		}
+	}
+	if numMoved == 0 || numMoved > len(zoneIds)/2 {
+		t.Fatalf("expected roughly a quarter of the zones to move, %d of %d moved", numMoved, len(zoneIds))
+	}
+	router.RemoveStore("s4")
+	for _, zoneId := range zoneIds {
+		if storeName, _, _ := router.Route(zoneId); storeName != routes[zoneId] {
+			t.Fatalf("zone did not return to %s after removing s4 (routed to %s)", routes[zoneId], storeName)
+		}
+	}
+
+	zoneId := zoneIds[0]
+	_, store, _ := router.Route(zoneId)
+	err = store.MakeFile(ctx, zoneId, "f1", nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	_, err = router.WriteAt(ctx, zoneId, "f1", 0, []byte("hello"))
+	if err != nil {
+		t.Fatalf("error writing data: %v", err)
+	}
+	if store.getCacheSize() != 1 {
+		t.Fatalf("expected write to go through the routed store")
+	}
+	_, data, err := router.ReadAt(ctx, zoneId, "f1", 0, 5)
+	if err != nil || string(data) != "hello" {
+		t.Fatalf("read mismatch: %q, err: %v", data, err)
+	}
+	file, err := router.Stat(ctx, zoneId, "f1")
+	if err != nil || file.Size != 5 {
+		t.Fatalf("stat mismatch: %+v, err: %v", file, err)
+	}
+	err = router.DeleteFile(ctx, zoneId, "f1")
+	if err != nil {
+		t.Fatalf("error deleting file: %v", err)
+	}
+	if _, err = router.Stat(ctx, zoneId, "f1"); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("expected fs.ErrNotExist after delete, got %v", err)
+	}
+}
+
+func TestSeal(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	err := WFS.Seal(ctx, zoneId, "missing")
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("expected fs.ErrNotExist sealing a missing file, got %v", err)
+	}
+	for _, name := range []string{"f1", "f2"} {
+		err = WFS.MakeFile(ctx, zoneId, name, nil, FileOptsType{})
+		if err != nil {
+			t.Fatalf("error creating file: %v", err)
+		}
+	}
+	// dirty data is flushed by the seal
+	_, err = WFS.AppendData(ctx, zoneId, "f1", []byte("hello"))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	err = WFS.Seal(ctx, zoneId, "f1")
+	if err != nil {
+		t.Fatalf("error sealing file: %v", err)
+	}
+	if WFS.getCacheSize() != 0 {
+		t.Fatalf("expected seal to flush the file")
+	}
+	checkFileData(t, ctx, zoneId, "f1", "hello")
+	file, err := WFS.Stat(ctx, zoneId, "f1")
+	if err != nil || !file.Sealed {
+		t.Fatalf("expected sealed file, got %+v, err: %v", file, err)
+	}
+	writeErrs := map[string]error{}
+	_, writeErrs["WriteFile"] = WFS.WriteFile(ctx, zoneId, "f1", []byte("bye"))
+	_, writeErrs["WriteAt"] = WFS.WriteAt(ctx, zoneId, "f1", 0, []byte("H"))
+	writeErrs["WriteAtAsync"] = WFS.WriteAtAsync(ctx, zoneId, "f1", 0, []byte("H")).Err()
+	_, writeErrs["AppendData"] = WFS.AppendData(ctx, zoneId, "f1", []byte("!"))
+	_, writeErrs["Preallocate"] = WFS.Preallocate(ctx, zoneId, "f1", 100)
+	writeErrs["SwapFiles"] = WFS.SwapFiles(ctx, zoneId, "f1", "f2")
+	for op, err := range writeErrs {
+		if !errors.Is(err, ErrSealed) {
+			t.Fatalf("expected ErrSealed from %s, got %v", op, err)
+		}
+	}
+	// meta can still change, and the seal is kept across flushes
+	_, err = WFS.WriteMeta(ctx, zoneId, "f1", FileMeta{"done": true}, true)
+	if err != nil {
+		t.Fatalf("error writing meta: %v", err)
+	}
+	_, err = WFS.FlushCache(ctx)
+	if err != nil {
+		t.Fatalf("error flushing cache: %v", err)
+	}
+	file, err = WFS.Stat(ctx, zoneId, "f1")
+	if err != nil || !file.Sealed || file.Meta["done"] != true {
+		t.Fatalf("expected sealed file with meta, got %+v, err: %v", file, err)
+	}
+	checkFileData(t, ctx, zoneId, "f1", "hello")
+
+	err = WFS.Unseal(ctx, zoneId, "f1")
+	if err != nil {
+		t.Fatalf("error unsealing file: %v", err)
+	}
+	_, err = WFS.AppendData(ctx, zoneId, "f1", []byte("!"))
+	if err != nil {
+		t.Fatalf("error appending to unsealed file: %v", err)
+	}
+	checkFileData(t, ctx, zoneId, "f1", "hello!")
+
+	err = WFS.Seal(ctx, zoneId, "f1")
+	if err != nil {
+		t.Fatalf("error sealing file: %v", err)
+	}
+	err = WFS.DeleteFile(ctx, zoneId, "f1")
+	if err != nil {
+		t.Fatalf("error deleting sealed file: %v", err)
+	}
+}
+
+func TestOldestDirtyAge(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	if age := WFS.OldestDirtyAge(); age != 0 {
+		t.Fatalf("expected no dirty age for an empty cache, got %v", age)
+	}
+	for _, name := range []string{"f1", "f2"} {
+		err := WFS.MakeFile(ctx, zoneId, name, nil, FileOptsType{})
+		if err != nil {
+			t.Fatalf("error creating file: %v", err)
+		}
+	}
+	_, err := WFS.AppendData(ctx, zoneId, "f1", []byte("hello"))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	time.Sleep(30 * time.Millisecond)
+	_, err = WFS.AppendData(ctx, zoneId, "f2", []byte("hello"))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	// more writes to a dirty entry don't reset its age
+	_, err = WFS.AppendData(ctx, zoneId, "f1", []byte("world"))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	if age := WFS.OldestDirtyAge(); age < 30*time.Millisecond {
+		t.Fatalf("expected oldest dirty age >= 30ms, got %v", age)
+	}
+	err = WFS.FlushRange(ctx, zoneId, "f1", 0, 1)
+	if err != nil {
+		t.Fatalf("error flushing f1: %v", err)
+	}
+	if age := WFS.OldestDirtyAge(); age >= 30*time.Millisecond {
+		t.Fatalf("expected f1 to no longer count as dirty, got age %v", age)
+	}
+	_, err = WFS.FlushCache(ctx)
+	if err != nil {
+		t.Fatalf("error flushing cache: %v", err)
+	}
+	if age := WFS.OldestDirtyAge(); age != 0 {
+		t.Fatalf("expected no dirty age after flush, got %v", age)
+	}
+}
+
+type testAuthorizer struct {
+	readOnly    map[string]bool
+	writeOnly   map[string]bool
+	noAccess    map[string]bool
+	deniedReads atomic.Int32
+}
+
+func (a *testAuthorizer) CanRead(zoneId string, name string) bool {
+	if a.noAccess[name] || a.writeOnly[name] {
+		a.deniedReads.Add(1)
+		return false
+	}
+	return true
+}
+
+func (a *testAuthorizer) CanWrite(zoneId string, name string) bool {
+	return !a.noAccess[name] && !a.readOnly[name]
+}
+
+func TestAuthorizer(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	for _, name := range []string{"rw", "ro", "wo", "secret"} {
+		err := WFS.MakeFileWithData(ctx, zoneId, name, nil, FileOptsType{}, []byte("hello"))
+		if err != nil {
+			t.Fatalf("error creating file: %v", err)
+		}
+	}
+	authorizer := &testAuthorizer{
+		readOnly:  map[string]bool{"ro": true},
+		writeOnly: map[string]bool{"wo": true},
+		noAccess:  map[string]bool{"secret": true},
+	}
+	WFS.Authorizer = authorizer
+	defer func() { WFS.Authorizer = nil }()
+
+	_, err := WFS.AppendData(ctx, zoneId, "rw", []byte("!"))
+	if err != nil {
+		t.Fatalf("error appending to writable file: %v", err)
+	}
+	checkFileData(t, ctx, zoneId, "ro", "hello")
+	errs := map[string]error{}
+	_, errs["AppendData ro"] = WFS.AppendData(ctx, zoneId, "ro", []byte("!"))
+	_, errs["WriteAt ro"] = WFS.WriteAt(ctx, zoneId, "ro", 0, []byte("H"))
+	errs["WriteAtAsync ro"] = WFS.WriteAtAsync(ctx, zoneId, "ro", 0, []byte("H")).Err()
+	errs["DeleteFile ro"] = WFS.DeleteFile(ctx, zoneId, "ro")
+	errs["SwapFiles rw/ro"] = WFS.SwapFiles(ctx, zoneId, "rw", "ro")
+	_, errs["Stat secret"] = WFS.Stat(ctx, zoneId, "secret")
+	_, _, errs["ReadFile secret"] = WFS.ReadFile(ctx, zoneId, "secret")
+	_, errs["MarshalFile secret"] = WFS.MarshalFile(ctx, zoneId, "secret")
+	_, errs["AppendFrom secret"] = WFS.AppendFrom(ctx, zoneId, "secret", strings.NewReader("!"))
+	_, errs["Stat wo"] = WFS.Stat(ctx, zoneId, "wo")
+	for op, err := range errs {
+		if !errors.Is(err, ErrForbidden) {
+			t.Fatalf("expected ErrForbidden from %s, got %v", op, err)
+		}
+	}
+	// denied operations don't touch the cache
+	if WFS.getCacheSize() != 1 {
+		t.Fatalf("expected only the rw file to be resident, got %d entries", WFS.getCacheSize())
+	}
+	// AppendFrom's size lookup is a read, a write-only caller appends without it
+	deniedReads := authorizer.deniedReads.Load()
+	_, err = WFS.AppendFrom(ctx, zoneId, "wo", strings.NewReader(" world"))
+	if err != nil {
+		t.Fatalf("error appending to write-only file: %v", err)
+	}
+	if authorizer.deniedReads.Load() != deniedReads+1 {
+		t.Errorf("expected AppendFrom to check read access once, got %d denied reads", authorizer.deniedReads.Load()-deniedReads)
+	}
+	WFS.Authorizer = nil
+	checkFileData(t, ctx, zoneId, "ro", "hello")
+	checkFileData(t, ctx, zoneId, "secret", "hello")
+	checkFileData(t, ctx, zoneId, "rw", "hello!")
+	checkFileData(t, ctx, zoneId, "wo", "hello world")
+}
+
+func TestReadPastEOF(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	err := WFS.MakeFileWithData(ctx, zoneId, "f1", nil, FileOptsType{}, []byte("hello"))
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	zeros := func(n int) string { return string(make([]byte, n)) }
+	for _, tc := range []struct {
+		pastEOF  int
+		offset   int64
+		size     int64
+		expected string
+	}{
+		{PastEOFShort, 3, 5, "lo"},
+		{PastEOFShort, 10, 2, ""},
+		{PastEOFZero, 3, 5, "lo" + zeros(3)},
+		{PastEOFZero, 10, 2, zeros(2)},
+		{PastEOFError, 0, 5, "hello"},
+	} {
+		_, data, err := WFS.ReadAtWithOpts(ctx, zoneId, "f1", tc.offset, tc.size, ReadOpts{PastEOF: tc.pastEOF})
+		if err != nil {
+			t.Fatalf("error reading (%+v): %v", tc, err)
+		}
+		if string(data) != tc.expected {
+			t.Fatalf("read mismatch (%+v): got %q", tc, data)
+		}
+	}
+	_, _, err = WFS.ReadAtWithOpts(ctx, zoneId, "f1", 3, 5, ReadOpts{PastEOF: PastEOFError})
+	if !errors.Is(err, io.EOF) {
+		t.Fatalf("expected io.EOF reading past the end, got %v", err)
+	}
+
+	// circular files: the start moves forward, padding only applies at the end
+	err = WFS.MakeFile(ctx, zoneId, "c1", nil, FileOptsType{MaxSize: 50, Circular: true})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	_, err = WFS.AppendData(ctx, zoneId, "c1", []byte(makeRepeat('a', 60)))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	offset, data, err := WFS.ReadAtWithOpts(ctx, zoneId, "c1", 0, 70, ReadOpts{PastEOF: PastEOFZero})
+	if err != nil {
+		t.Fatalf("error reading circular file: %v", err)
+	}
+	if offset != 10 || string(data) != makeRepeat('a', 50)+zeros(10) {
+		t.Fatalf("circular read mismatch: offset %d, data %q", offset, data)
+	}
+}
+
+func TestIncrementCounter(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	val, err := WFS.IncrementCounter(ctx, zoneId, "counter", 5)
+	if err != nil || val != 5 {
+		t.Fatalf("expected new counter to be 5, got %d, err: %v", val, err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 5; j++ {
+				_, err := WFS.IncrementCounter(ctx, zoneId, "counter", 1)
+				if err != nil {
+					t.Errorf("error incrementing counter: %v", err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	val, err = WFS.IncrementCounter(ctx, zoneId, "counter", -10)
+	if err != nil || val != 95 {
+		t.Fatalf("expected counter to be 95, got %d, err: %v", val, err)
+	}
+	_, err = WFS.FlushCache(ctx)
+	if err != nil {
+		t.Fatalf("error flushing cache: %v", err)
+	}
+	_, data, err := WFS.ReadFile(ctx, zoneId, "counter")
+	if err != nil || len(data) != CounterSize || binary.BigEndian.Uint64(data) != 95 {
+		t.Fatalf("unexpected counter file contents %v, err: %v", data, err)
+	}
+	err = WFS.MakeFileWithData(ctx, zoneId, "notcounter", nil, FileOptsType{}, []byte("hello"))
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	_, err = WFS.IncrementCounter(ctx, zoneId, "notcounter", 1)
+	if err == nil {
+		t.Fatalf("expected error incrementing a file that isn't a counter")
+	}
+	checkFileData(t, ctx, zoneId, "notcounter", "hello")
+}
+
+func TestFlushBatchSize(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+	WFS.FlushBatchSize = 3
+	defer func() { WFS.FlushBatchSize = 0 }()
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	names := []string{"a1", "a2", "bad", "c1", "c2"}
+	for _, name := range names {
+		err := WFS.MakeFile(ctx, zoneId, name, nil, FileOptsType{})
+		if err != nil {
+			t.Fatalf("error creating file: %v", err)
+		}
+		// 2 parts per file
+		_, err = WFS.AppendData(ctx, zoneId, name, []byte(makeRepeat('a', 60)))
+		if err != nil {
+			t.Fatalf("error appending data: %v", err)
+		}
+	}
+	_, err := WFS.AppendData(ctx, zoneId, "a1", []byte("!"))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	stats, err := WFS.FlushCache(ctx)
+	if err != nil {
+		t.Fatalf("error flushing cache: %v", err)
+	}
+	if stats.NumDirtyEntries != 5 || stats.NumCommitted != 5 || WFS.getCacheSize() != 0 {
+		t.Fatalf("unexpected flush stats %+v (cache size %d)", stats, WFS.getCacheSize())
+	}
+	checkFileData(t, ctx, zoneId, "a1", makeRepeat('a', 60)+"!")
+	checkFileData(t, ctx, zoneId, "c2", makeRepeat('a', 60))
+
+	// a failing file rolls back its batch, then the others in the batch are flushed one at a time
+	WFS.FlushBatchSize = 100
+	for _, name := range names {
+		_, err = WFS.AppendData(ctx, zoneId, name, []byte("?"))
+		if err != nil {
+			t.Fatalf("error appending data: %v", err)
+		}
+	}
+	err = dbDeleteFile(ctx, zoneId, "bad")
+	if err != nil {
+		t.Fatalf("error deleting file from db: %v", err)
+	}
+	stats, err = WFS.FlushCache(ctx)
+	if err == nil {
+		t.Fatalf("expected flush error for a file missing from the db")
+	}
+	if stats.NumCommitted != 4 || WFS.getCacheSize() != 1 {
+		t.Fatalf("expected the 4 good files to be flushed, got stats %+v (cache size %d)", stats, WFS.getCacheSize())
+	}
+	for _, name := range []string{"a1", "a2", "c1", "c2"} {
+		_, data, err := WFS.ReadFile(ctx, zoneId, name)
+		if err != nil || !strings.HasSuffix(string(data), "?") {
+			t.Fatalf("expected %s to be flushed, got %q, err: %v", name, data, err)
+		}
+	}
+	err = WFS.DeleteFile(ctx, zoneId, "bad")
+	if err != nil {
+		t.Fatalf("error deleting file: %v", err)
+	}
+	// the failure above was intentional
+	flushErrorCount.Store(0)
+}
+
+func TestWaitClean(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	err := WFS.WaitClean(ctx, zoneId, "missing")
+	if err != nil {
+		t.Fatalf("expected WaitClean on a missing file to return immediately, got %v", err)
+	}
+	err = WFS.MakeFile(ctx, zoneId, "f1", nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	_, err = WFS.AppendData(ctx, zoneId, "f1", []byte("hello"))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	shortCtx, shortCancelFn := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer shortCancelFn()
+	err = WFS.WaitClean(shortCtx, zoneId, "f1")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected WaitClean on a dirty file to time out, got %v", err)
+	}
+	waitErrCh := make(chan error, 1)
+	go func() {
+		waitErrCh <- WFS.WaitClean(ctx, zoneId, "f1")
+	}()
+	time.Sleep(20 * time.Millisecond)
+	select {
+	case err := <-waitErrCh:
+		t.Fatalf("expected WaitClean to wait for the flush, got %v", err)
+	default:
+	}
+	_, err = WFS.FlushCache(ctx)
+	if err != nil {
+		t.Fatalf("error flushing cache: %v", err)
+	}
+	err = <-waitErrCh
+	if err != nil {
+		t.Fatalf("error from WaitClean: %v", err)
+	}
+}
+
+func TestFairAppends(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+	WFS.FairAppends = true
+	defer func() {
+		WFS.FairAppends = false
+	}()
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	err := WFS.MakeFile(ctx, zoneId, "log", nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	// hold the entry lock so every append queues up, then check they land in the order they arrived
+	entry, unlockFn := WFS.lockEntry(zoneId, "log")
+	const numWriters = 8
+	var wg sync.WaitGroup
+	for i := 0; i < numWriters; i++ {
+		wg.Add(1)
+		go func(idx int) {
+			defer wg.Done()
+			_, err := WFS.AppendData(ctx, zoneId, "log", []byte{byte('a' + idx)})
+			if err != nil {
+				t.Errorf("error appending data: %v", err)
+			}
+		}(i)
+		for {
+			WFS.lock()
+			ticket := entry.appendTicket
+			WFS.Lock.Unlock()
+			if ticket == uint64(i+1) {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	unlockFn()
+	wg.Wait()
+	checkFileData(t, ctx, zoneId, "log", "abcdefgh")
+
+	// under contention, every writer gets all of its appends in
+	const appendsPerWriter = 50
+	for i := 0; i < numWriters; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < appendsPerWriter; j++ {
+				_, err := WFS.AppendData(ctx, zoneId, "log", []byte("x"))
+				if err != nil {
+					t.Errorf("error appending data: %v", err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	checkFileSize(t, ctx, zoneId, "log", numWriters+numWriters*appendsPerWriter)
+}
+
+func TestRetainedRange(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	_, _, err := WFS.RetainedRange(ctx, zoneId, "missing")
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("expected ErrNotExist for a missing file, got %v", err)
+	}
+	err = WFS.MakeFile(ctx, zoneId, "ring", nil, FileOptsType{Circular: true, MaxSize: 100})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	checkRange := func(expectedStart int64, expectedEnd int64) {
+		t.Helper()
+		start, end, err := WFS.RetainedRange(ctx, zoneId, "ring")
+		if err != nil {
+			t.Fatalf("error getting retained range: %v", err)
+		}
+		if start != expectedStart || end != expectedEnd {
+			t.Fatalf("expected retained range [%d, %d), got [%d, %d)", expectedStart, expectedEnd, start, end)
+		}
+	}
+	checkRange(0, 0)
+	_, err = WFS.AppendData(ctx, zoneId, "ring", []byte(strings.Repeat("a", 80)))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	checkRange(0, 80)
+	_, err = WFS.AppendData(ctx, zoneId, "ring", []byte(strings.Repeat("b", 50)))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	checkRange(30, 130)
+
+	// by default a read of evicted data moves forward, with FailEvicted it errors
+	offset, data, err := WFS.ReadAt(ctx, zoneId, "ring", 0, 60)
+	if err != nil {
+		t.Fatalf("error reading data: %v", err)
+	}
+	if offset != 30 || string(data) != strings.Repeat("a", 30) {
+		t.Fatalf("expected read moved to offset 30, got offset %d data %q", offset, data)
+	}
+	_, _, err = WFS.ReadAtWithOpts(ctx, zoneId, "ring", 0, 60, ReadOpts{FailEvicted: true})
+	if !errors.Is(err, ErrEvicted) {
+		t.Fatalf("expected ErrEvicted, got %v", err)
+	}
+	offset, data, err = WFS.ReadAtWithOpts(ctx, zoneId, "ring", 30, 60, ReadOpts{FailEvicted: true})
+	if err != nil {
+		t.Fatalf("error reading retained data: %v", err)
+	}
+	if offset != 30 || string(data) != strings.Repeat("a", 50)+strings.Repeat("b", 10) {
+		t.Fatalf("unexpected retained read, offset %d data %q", offset, data)
+	}
+}
+
+func TestPartStatus(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	err := WFS.MakeFile(ctx, zoneId, "f1", nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	_, err = WFS.AppendData(ctx, zoneId, "f1", []byte(strings.Repeat("x", 120)))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	parts, err := WFS.PartStatus(zoneId, "f1")
+	if err != nil {
+		t.Fatalf("error getting part status: %v", err)
+	}
+	if len(parts) != 3 {
+		t.Fatalf("expected 3 resident parts, got %v", parts)
+	}
+	if parts[0].PartIdx != 0 || parts[0].Length != 50 || parts[2].PartIdx != 2 || parts[2].Length != 20 {
+		t.Fatalf("unexpected part status %v", parts)
+	}
+	if parts[0].DirtyTs == 0 || parts[0].DirtyTs != parts[2].DirtyTs {
+		t.Fatalf("expected parts to share the file's DirtyTs, got %v", parts)
+	}
+	_, err = WFS.FlushCache(ctx)
+	if err != nil {
+		t.Fatalf("error flushing cache: %v", err)
+	}
+	parts, err = WFS.PartStatus(zoneId, "f1")
+	if err != nil {
+		t.Fatalf("error getting part status: %v", err)
+	}
+	if len(parts) != 0 {
+		t.Fatalf("expected no resident parts after flush, got %v", parts)
+	}
+}
+
+func TestCircularPartRange(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	err := WFS.MakeFile(ctx, zoneId, "ring", nil, FileOptsType{Circular: true, MaxSize: 100})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	// wrap the ring many times, then write at an offset far beyond MaxSize
+	for i := 0; i < 40; i++ {
+		_, err = WFS.AppendData(ctx, zoneId, "ring", []byte(strings.Repeat("a", 25)))
+		if err != nil {
+			t.Fatalf("error appending data: %v", err)
+		}
+	}
+	_, err = WFS.WriteAt(ctx, zoneId, "ring", 990, []byte("0123456789"))
+	if err != nil {
+		t.Fatalf("error writing data: %v", err)
+	}
+	parts, err := WFS.PartStatus(zoneId, "ring")
+	if err != nil {
+		t.Fatalf("error getting part status: %v", err)
+	}
+	for _, part := range parts {
+		if part.PartIdx < 0 || part.PartIdx >= 2 {
+			t.Fatalf("part %d created outside the ring", part.PartIdx)
+		}
+	}
+	checkFileDataAt(t, ctx, zoneId, "ring", 980, strings.Repeat("a", 10)+"0123456789")
+
+	file, err := WFS.Stat(ctx, zoneId, "ring")
+	if err != nil {
+		t.Fatalf("error getting file: %v", err)
+	}
+	err = file.checkPartMap(map[int]int{1: 10, 2: 10})
+	if err == nil {
+		t.Fatalf("expected error for a part outside the ring")
+	}
+}
+
+func TestDBPartIndexes(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	err := WFS.MakeFile(ctx, zoneId, "f1", nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	_, err = WFS.AppendData(ctx, zoneId, "f1", []byte(strings.Repeat("x", 120)))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	partIdxs, err := WFS.DBPartIndexes(ctx, zoneId, "f1")
+	if err != nil {
+		t.Fatalf("error getting part indexes: %v", err)
+	}
+	if len(partIdxs) != 0 {
+		t.Fatalf("expected no persisted parts before flush, got %v", partIdxs)
+	}
+	_, err = WFS.FlushCache(ctx)
+	if err != nil {
+		t.Fatalf("error flushing cache: %v", err)
+	}
+	partIdxs, err = WFS.DBPartIndexes(ctx, zoneId, "f1")
+	if err != nil {
+		t.Fatalf("error getting part indexes: %v", err)
+	}
+	if !reflect.DeepEqual(partIdxs, []int{0, 1, 2}) {
+		t.Fatalf("expected parts [0 1 2], got %v", partIdxs)
+	}
+}
+
+func TestConcatFiles(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	err := WFS.MakeFileWithData(ctx, zoneId, "src1", nil, FileOptsType{}, []byte(strings.Repeat("a", 70)))
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	// flushed source, read back from the DB
+	_, err = WFS.FlushCache(ctx)
+	if err != nil {
+		t.Fatalf("error flushing cache: %v", err)
+	}
+	err = WFS.MakeFile(ctx, zoneId, "ring", nil, FileOptsType{Circular: true, MaxSize: 100})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	_, err = WFS.AppendData(ctx, zoneId, "ring", []byte(strings.Repeat("b", 80)+strings.Repeat("c", 40)))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	srcKeys := []FileKey{{ZoneId: zoneId, Name: "src1"}, {ZoneId: zoneId, Name: "ring"}}
+	err = WFS.ConcatFiles(ctx, zoneId, "dst", srcKeys, false)
+	if err != nil {
+		t.Fatalf("error concatenating files: %v", err)
+	}
+	expected := strings.Repeat("a", 70) + strings.Repeat("b", 60) + strings.Repeat("c", 40)
+	checkFileData(t, ctx, zoneId, "dst", expected)
+
+	err = WFS.ConcatFiles(ctx, zoneId, "dst", srcKeys[:1], false)
+	if !errors.Is(err, fs.ErrExist) {
+		t.Fatalf("expected ErrExist for an existing destination, got %v", err)
+	}
+	err = WFS.ConcatFiles(ctx, zoneId, "dst", srcKeys[:1], true)
+	if err != nil {
+		t.Fatalf("error appending to destination: %v", err)
+	}
+	checkFileData(t, ctx, zoneId, "dst", expected+strings.Repeat("a", 70))
+
+	// sources are checked before the destination is created
+	err = WFS.ConcatFiles(ctx, zoneId, "dst2", []FileKey{srcKeys[0], {ZoneId: zoneId, Name: "missing"}}, false)
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("expected ErrNotExist for a missing source, got %v", err)
+	}
+	_, err = WFS.Stat(ctx, zoneId, "dst2")
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected no destination after a failed source check, got %v", err)
+	}
+}
+
+func TestPartData(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	err := WFS.MakeFileWithData(ctx, zoneId, "f1", nil, FileOptsType{}, []byte(strings.Repeat("a", 120)))
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	_, err = WFS.FlushCache(ctx)
+	if err != nil {
+		t.Fatalf("error flushing cache: %v", err)
+	}
+	data, err := WFS.ReadPartData(ctx, zoneId, "f1", 2)
+	if err != nil {
+		t.Fatalf("error reading part: %v", err)
+	}
+	if string(data) != strings.Repeat("a", 20) {
+		t.Fatalf("unexpected part data %q", data)
+	}
+	data, err = WFS.ReadPartData(ctx, zoneId, "f1", 5)
+	if err != nil || data != nil {
+		t.Fatalf("expected no data for an unwritten part, got %q, err %v", data, err)
+	}
+	// a short part in the middle replaces the part but doesn't shrink the file
+	_, err = WFS.WritePartData(ctx, zoneId, "f1", 1, []byte("hello"))
+	if err != nil {
+		t.Fatalf("error writing part: %v", err)
+	}
+	checkFileData(t, ctx, zoneId, "f1", strings.Repeat("a", 50)+"hello"+string(make([]byte, 45))+strings.Repeat("a", 20))
+	// a part past the end extends the file (the gap is sparse)
+	_, err = WFS.WritePartData(ctx, zoneId, "f1", 4, []byte("world"))
+	if err != nil {
+		t.Fatalf("error writing part: %v", err)
+	}
+	checkFileSize(t, ctx, zoneId, "f1", 205)
+	checkFileDataAt(t, ctx, zoneId, "f1", 200, "world")
+	_, err = WFS.WritePartData(ctx, zoneId, "f1", 0, []byte(strings.Repeat("x", 51)))
+	if err == nil {
+		t.Fatalf("expected error writing more than a part")
+	}
+	err = WFS.MakeFile(ctx, zoneId, "ring", nil, FileOptsType{Circular: true, MaxSize: 100})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	_, err = WFS.WritePartData(ctx, zoneId, "ring", 0, []byte("x"))
+	if err == nil {
+		t.Fatalf("expected error writing a part of a circular file")
+	}
+}
+
+func TestWriteAtEx(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	_, _, err := WFS.WriteAtEx(ctx, zoneId, "f1", 5, []byte("hello"), FileOptsType{})
+	if err == nil {
+		t.Fatalf("expected error creating a file at a non-zero offset")
+	}
+	// concurrent writers to a missing file, exactly one creates it
+	const numWriters = 10
+	var wg sync.WaitGroup
+	var numCreated atomic.Int32
+	for i := 0; i < numWriters; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, created, err := WFS.WriteAtEx(ctx, zoneId, "f1", 0, []byte("hello"), FileOptsType{MaxSize: 100})
+			if err != nil {
+				t.Errorf("error writing data: %v", err)
+				return
+			}
+			if created {
+				numCreated.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	if numCreated.Load() != 1 {
+		t.Fatalf("expected exactly one writer to create the file, got %d", numCreated.Load())
+	}
+	checkFileData(t, ctx, zoneId, "f1", "hello")
+	version, created, err := WFS.WriteAtEx(ctx, zoneId, "f1", 5, []byte(" world"), FileOptsType{})
+	if err != nil || created {
+		t.Fatalf("expected a write to the existing file, got created=%v err=%v", created, err)
+	}
+	file, err := WFS.Stat(ctx, zoneId, "f1")
+	if err != nil {
+		t.Fatalf("error getting file: %v", err)
+	}
+	if file.Version != version || file.Opts.MaxSize != 100 {
+		t.Fatalf("unexpected file version %d (expected %d) or opts %v", file.Version, version, file.Opts)
+	}
+	checkFileData(t, ctx, zoneId, "f1", "hello world")
+}
+
+func TestLeases(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	_, err := WFS.AcquireLease(ctx, zoneId, "f1", time.Minute)
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("expected ErrNotExist leasing a missing file, got %v", err)
+	}
+	err = WFS.MakeFile(ctx, zoneId, "f1", nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	leaseId, err := WFS.AcquireLease(ctx, zoneId, "f1", time.Minute)
+	if err != nil {
+		t.Fatalf("error acquiring lease: %v", err)
+	}
+	_, err = WFS.AcquireLease(ctx, zoneId, "f1", time.Minute)
+	if !errors.Is(err, ErrLeaseHeld) {
+		t.Fatalf("expected ErrLeaseHeld, got %v", err)
+	}
+	_, err = WFS.WriteAtWithOpts(ctx, zoneId, "f1", 0, []byte("hello"), WriteOpts{LeaseId: leaseId})
+	if err != nil {
+		t.Fatalf("error writing with lease: %v", err)
+	}
+	_, err = WFS.WriteAtWithOpts(ctx, zoneId, "f1", 0, []byte("HELLO"), WriteOpts{LeaseId: "bogus"})
+	if !errors.Is(err, ErrNoLease) {
+		t.Fatalf("expected ErrNoLease for the wrong lease, got %v", err)
+	}
+	// leases are advisory, writes that don't ask for one aren't checked
+	_, err = WFS.WriteAt(ctx, zoneId, "f1", 5, []byte(" world"))
+	if err != nil {
+		t.Fatalf("error writing without lease: %v", err)
+	}
+	checkFileData(t, ctx, zoneId, "f1", "hello world")
+	err = WFS.ReleaseLease(zoneId, "f1", leaseId)
+	if err != nil {
+		t.Fatalf("error releasing lease: %v", err)
+	}
+	err = WFS.ReleaseLease(zoneId, "f1", leaseId)
+	if !errors.Is(err, ErrNoLease) {
+		t.Fatalf("expected ErrNoLease releasing twice, got %v", err)
+	}
+	_, err = WFS.WriteAtWithOpts(ctx, zoneId, "f1", 0, []byte("HELLO"), WriteOpts{LeaseId: leaseId})
+	if !errors.Is(err, ErrNoLease) {
+		t.Fatalf("expected ErrNoLease after release, got %v", err)
+	}
+
+	// expired leases can be taken over
+	shortLeaseId, err := WFS.AcquireLease(ctx, zoneId, "f1", 10*time.Millisecond)
+	if err != nil {
+		t.Fatalf("error acquiring lease: %v", err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	_, err = WFS.WriteAtWithOpts(ctx, zoneId, "f1", 0, []byte("HELLO"), WriteOpts{LeaseId: shortLeaseId})
+	if !errors.Is(err, ErrNoLease) {
+		t.Fatalf("expected ErrNoLease for an expired lease, got %v", err)
+	}
+	_, err = WFS.AcquireLease(ctx, zoneId, "f1", time.Minute)
+	if err != nil {
+		t.Fatalf("error acquiring lease after expiry: %v", err)
+	}
+}
+
+func TestNameValidator(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	// created before the validator is set, stays usable
+	err := WFS.MakeFile(ctx, zoneId, "Legacy", nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	_, err = WFS.IncrementCounter(ctx, zoneId, "LegacyCounter", 1)
+	if err != nil {
+		t.Fatalf("error creating counter: %v", err)
+	}
+	WFS.NameValidator = func(name string) error {
+		if name != strings.ToLower(name) {
+			return fmt.Errorf("names must be lowercase")
+		}
+		return nil
+	}
+	WFS.ZoneIdValidator = func(zoneId string) error {
+		return uuid.Validate(zoneId)
+	}
+	defer func() {
+		WFS.NameValidator = nil
+		WFS.ZoneIdValidator = nil
+	}()
+	err = WFS.MakeFile(ctx, zoneId, "ok", nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file with a valid name: %v", err)
+	}
+	createFns := map[string]func(zoneId string, name string) error{
+		"MakeFile": func(zoneId string, name string) error {
+			return WFS.MakeFile(ctx, zoneId, name, nil, FileOptsType{})
+		},
+		"MakeFileWithData": func(zoneId string, name string) error {
+			return WFS.MakeFileWithData(ctx, zoneId, name, nil, FileOptsType{}, []byte("x"))
+		},
+		"WriteAtEx": func(zoneId string, name string) error {
+			_, _, err := WFS.WriteAtEx(ctx, zoneId, name, 0, []byte("x"), FileOptsType{})
+			return err
+		},
+		"IncrementCounter": func(zoneId string, name string) error {
+			_, err := WFS.IncrementCounter(ctx, zoneId, name, 1)
+			return err
+		},
+		"ConcatFiles": func(zoneId string, name string) error {
+			return WFS.ConcatFiles(ctx, zoneId, name, nil, false)
+		},
+	}
+	for fnName, createFn := range createFns {
+		err = createFn(zoneId, "Bad")
+		if !errors.Is(err, ErrInvalidName) {
+			t.Errorf("%s: expected ErrInvalidName for a bad name, got %v", fnName, err)
+		}
+		err = createFn("not-a-uuid", "ok")
+		if !errors.Is(err, ErrInvalidName) {
+			t.Errorf("%s: expected ErrInvalidName for a bad zoneid, got %v", fnName, err)
+		}
+	}
+	_, err = WFS.AppendData(ctx, zoneId, "Legacy", []byte("hello"))
+	if err != nil {
+		t.Fatalf("error writing to a file created before the validator: %v", err)
+	}
+	// the create-or-write APIs only validate when they create
+	_, created, err := WFS.WriteAtEx(ctx, zoneId, "Legacy", 0, []byte("j"), FileOptsType{})
+	if err != nil || created {
+		t.Fatalf("expected WriteAtEx to write to a file created before the validator, got created=%v err=%v", created, err)
+	}
+	val, err := WFS.IncrementCounter(ctx, zoneId, "LegacyCounter", 1)
+	if err != nil || val != 2 {
+		t.Fatalf("expected IncrementCounter to update a counter created before the validator, got %d err=%v", val, err)
+	}
+}
+
+func TestThroughput(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+	WFS.ThroughputWindow = 10 * time.Second
+	defer func() { WFS.ThroughputWindow = 0 }()
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	stats := WFS.Throughput()
+	if stats.Window != 10*time.Second || stats.BytesPerSec != 0 || stats.PartsPerSec != 0 {
+		t.Fatalf("expected no throughput on an idle store, got %+v", stats)
+	}
+	err := WFS.MakeFile(ctx, zoneId, "f1", nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	_, err = WFS.AppendData(ctx, zoneId, "f1", []byte(makeText(200)))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	_, err = WFS.FlushCache(ctx)
+	if err != nil {
+		t.Fatalf("error flushing cache: %v", err)
+	}
+	stats = WFS.Throughput()
+	if stats.BytesPerSec != 20 || stats.PartsPerSec != 0.4 {
+		t.Fatalf("expected 20 bytes/sec and 0.4 parts/sec over 10s, got %+v", stats)
+	}
+	WFS.ThroughputWindow = time.Hour
+	if stats := WFS.Throughput(); stats.Window != throughputBuckets*time.Second {
+		t.Fatalf("expected the window to be capped, got %v", stats.Window)
+	}
+}
+
+func TestDeleteIfVersion(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	err := WFS.DeleteIfVersion(ctx, zoneId, "f1", 0)
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("expected ErrNotExist for a missing file, got %v", err)
+	}
+	err = WFS.MakeFile(ctx, zoneId, "f1", nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	version, err := WFS.AppendData(ctx, zoneId, "f1", []byte("hello"))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	// pinned and dirty, the version is still checked against the cached file
+	unpinAll := WFS.PinAll([]FileKey{{ZoneId: zoneId, Name: "f1"}})
+	err = WFS.DeleteIfVersion(ctx, zoneId, "f1", version-1)
+	if !errors.Is(err, ErrVersionMismatch) {
+		t.Fatalf("expected ErrVersionMismatch, got %v", err)
+	}
+	checkFileData(t, ctx, zoneId, "f1", "hello")
+	err = WFS.DeleteIfVersion(ctx, zoneId, "f1", version)
+	if err != nil {
+		t.Fatalf("error deleting file: %v", err)
+	}
+	if WFS.getCacheSize() != 1 {
+		t.Fatalf("expected the pinned entry to stay in the cache until unpinned")
+	}
+	unpinAll()
+	if WFS.getCacheSize() != 0 {
+		t.Fatalf("expected the entry to be dropped once unpinned")
+	}
+	_, err = WFS.Stat(ctx, zoneId, "f1")
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("expected the file to be deleted, got %v", err)
+	}
+}
+
+func TestUpdateOpts(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	_, err := WFS.UpdateOpts(ctx, zoneId, "f1", FileOptsType{})
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("expected ErrNotExist for a missing file, got %v", err)
+	}
+	err = WFS.MakeFile(ctx, zoneId, "f1", nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	oldVersion, err := WFS.AppendData(ctx, zoneId, "f1", []byte("hello"))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	// dirty data is flushed before the opts change, and the new opts apply to the next write
+	version, err := WFS.UpdateOpts(ctx, zoneId, "f1", FileOptsType{MaxSize: 8, OverflowPolicy: OverflowError})
+	if err != nil {
+		t.Fatalf("error updating opts: %v", err)
+	}
+	if version != oldVersion+1 {
+		t.Errorf("version mismatch: expected %d, got %d", oldVersion+1, version)
+	}
+	file, err := WFS.Stat(ctx, zoneId, "f1")
+	if err != nil {
+		t.Fatalf("error stating file: %v", err)
+	}
+	if file.Opts.OverflowPolicy != OverflowError || file.Opts.MaxSize != 8 {
+		t.Errorf("opts not updated: %+v", file.Opts)
+	}
+	checkFileData(t, ctx, zoneId, "f1", "hello")
+	_, err = WFS.AppendData(ctx, zoneId, "f1", []byte(" world"))
+	if !errors.Is(err, ErrFileFull) {
+		t.Fatalf("expected ErrFileFull after the opts change, got %v", err)
+	}
+	_, err = WFS.UpdateOpts(ctx, zoneId, "f1", FileOptsType{IJson: true})
+	if err == nil {
+		t.Fatalf("expected error turning on ijson for a file with data")
+	}
+	_, err = WFS.UpdateOpts(ctx, zoneId, "f1", FileOptsType{Circular: true, MaxSize: 100})
+	if err == nil {
+		t.Fatalf("expected error making a file with data circular")
+	}
+	_, err = WFS.UpdateOpts(ctx, zoneId, "f1", FileOptsType{Circular: true})
+	if err == nil {
+		t.Fatalf("expected invalid opts to be rejected")
+	}
+
+	// the ring size of a circular file can only change while it is empty
+	err = WFS.MakeFile(ctx, zoneId, "c1", nil, FileOptsType{Circular: true, MaxSize: 100})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	_, err = WFS.UpdateOpts(ctx, zoneId, "c1", FileOptsType{Circular: true, MaxSize: 200})
+	if err != nil {
+		t.Fatalf("error updating opts of an empty file: %v", err)
+	}
+	_, err = WFS.AppendData(ctx, zoneId, "c1", []byte("hello"))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	_, err = WFS.UpdateOpts(ctx, zoneId, "c1", FileOptsType{Circular: true, MaxSize: 100})
+	if err == nil {
+		t.Fatalf("expected error changing the max size of a circular file with data")
+	}
+	checkFileData(t, ctx, zoneId, "c1", "hello")
+}
+
+// run with -race: readers interleaved with truncating WriteFiles must see a whole pre- or post-truncate file
+func TestConcurrentTruncateReads(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+	ctx, cancelFn := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	fileName := "tr1"
+	err := WFS.MakeFile(ctx, zoneId, fileName, nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	// 70 bytes ends inside part 1, so the short file both drops parts and leaves a partial one
+	longData := bytes.Repeat([]byte{'L'}, 230)
+	shortData := bytes.Repeat([]byte{'S'}, 70)
+	_, err = WFS.WriteFile(ctx, zoneId, fileName, longData)
+	if err != nil {
+		t.Fatalf("error writing data: %v", err)
+	}
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			data := shortData
+			if i%2 == 1 {
+				data = longData
+			}
+			_, err := WFS.WriteFile(ctx, zoneId, fileName, data)
+			if err != nil {
+				t.Errorf("error writing data: %v", err)
+				return
+			}
+		}
+	}()
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				_, rdata, err := WFS.ReadFile(ctx, zoneId, fileName)
+				if err != nil {
+					t.Errorf("error reading file: %v", err)
+					return
+				}
+				if !bytes.Equal(rdata, longData) && !bytes.Equal(rdata, shortData) {
+					t.Errorf("read a partially truncated file (%d bytes): %q", len(rdata), rdata)
+					return
+				}
+				_, rdata, err = WFS.ReadAt(ctx, zoneId, fileName, 40, 20)
+				if err != nil {
+					t.Errorf("error reading data: %v", err)
+					return
+				}
+				if !bytes.Equal(rdata, longData[:20]) && !bytes.Equal(rdata, shortData[:20]) {
+					t.Errorf("read mixed data across a truncate: %q", rdata)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	checkFileData(t, ctx, zoneId, fileName, string(longData))
+}
+
+func TestListFilesSorted(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	for _, name := range []string{"b", "a", "c"} {
+		err := WFS.MakeFile(ctx, zoneId, name, nil, FileOptsType{})
+		if err != nil {
+			t.Fatalf("error creating file: %v", err)
+		}
+	}
+	_, err := WFS.WriteFile(ctx, zoneId, "a", []byte("hello world"))
+	if err != nil {
+		t.Fatalf("error writing data: %v", err)
+	}
+	time.Sleep(5 * time.Millisecond)
+	_, err = WFS.WriteFile(ctx, zoneId, "c", []byte("hello"))
+	if err != nil {
+		t.Fatalf("error writing data: %v", err)
+	}
+	time.Sleep(5 * time.Millisecond)
+	// dirty (unflushed) writes count for both size and modts
+	_, err = WFS.AppendData(ctx, zoneId, "b", []byte(makeText(120)))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	checkOrder := func(by SortKey, limit int, expected ...string) {
+		t.Helper()
+		infos, err := WFS.ListFilesSorted(ctx, zoneId, by, limit)
+		if err != nil {
+			t.Fatalf("error listing files by %s: %v", by, err)
+		}
+		var names []string
+		for _, info := range infos {
+			names = append(names, info.Name)
+		}
+		if !reflect.DeepEqual(names, expected) {
+			t.Errorf("order by %s (limit %d) mismatch: expected %v, got %v", by, limit, expected, names)
+		}
+	}
+	checkOrder(SortByName, 0, "a", "b", "c")
+	checkOrder(SortBySize, 0, "b", "a", "c")
+	checkOrder(SortByModTs, 0, "b", "c", "a")
+	checkOrder(SortBySize, 2, "b", "a")
+	checkOrder(SortByModTs, 1, "b")
+	_, err = WFS.ListFilesSorted(ctx, zoneId, "bogus", 0)
+	if err == nil {
+		t.Fatalf("expected error for an invalid sort key")
+	}
+}
+
+func TestSnapshotDeterministic(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	meta := FileMeta{}
+	for i := 0; i < 20; i++ {
+		meta[fmt.Sprintf("key%d", i)] = i
+	}
+	for _, name := range []string{"f3", "f1", "f2"} {
+		err := WFS.MakeFile(ctx, zoneId, name, meta, FileOptsType{})
+		if err != nil {
+			t.Fatalf("error creating file: %v", err)
+		}
+	}
+	// parts written out of order, plus a sparse gap
+	_, err := WFS.WriteAt(ctx, zoneId, "f1", 0, []byte(makeText(150)))
+	if err != nil {
+		t.Fatalf("error writing data: %v", err)
+	}
+	_, err = WFS.WriteAt(ctx, zoneId, "f1", 20, []byte("hello"))
+	if err != nil {
+		t.Fatalf("error writing data: %v", err)
+	}
+	_, err = WFS.Preallocate(ctx, zoneId, "f2", 120)
+	if err != nil {
+		t.Fatalf("error preallocating: %v", err)
+	}
+	_, err = WFS.WriteAt(ctx, zoneId, "f2", 100, []byte("tail"))
+	if err != nil {
+		t.Fatalf("error writing data: %v", err)
+	}
+	err = WFS.MakeFile(ctx, zoneId, "c1", nil, FileOptsType{Circular: true, MaxSize: 100})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	_, err = WFS.AppendData(ctx, zoneId, "c1", []byte(makeText(230)))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	var snap1, snap2, snap3 bytes.Buffer
+	err = WFS.SnapshotAll(ctx, &snap1)
+	if err != nil {
+		t.Fatalf("error taking snapshot: %v", err)
+	}
+	err = WFS.SnapshotAll(ctx, &snap2)
+	if err != nil {
+		t.Fatalf("error taking snapshot: %v", err)
+	}
+	if !bytes.Equal(snap1.Bytes(), snap2.Bytes()) {
+		t.Fatalf("snapshots of the same state differ")
+	}
+	cleanupDb(t)
+	initDb(t)
+	err = WFS.RestoreAll(ctx, bytes.NewReader(snap1.Bytes()))
+	if err != nil {
+		t.Fatalf("error restoring snapshot: %v", err)
+	}
+	err = WFS.SnapshotAll(ctx, &snap3)
+	if err != nil {
+		t.Fatalf("error taking snapshot: %v", err)
+	}
+	if !bytes.Equal(snap1.Bytes(), snap3.Bytes()) {
+		t.Fatalf("snapshot of the restored state differs")
+	}
+}
+
+func TestBackendBreaker(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	for _, name := range []string{"clean", "dirty"} {
+		err := WFS.MakeFile(ctx, zoneId, name, nil, FileOptsType{})
+		if err != nil {
+			t.Fatalf("error creating file: %v", err)
+		}
+	}
+	_, err := WFS.WriteFile(ctx, zoneId, "clean", []byte("hello"))
+	if err != nil {
+		t.Fatalf("error writing file: %v", err)
+	}
+	_, err = WFS.AppendData(ctx, zoneId, "dirty", []byte("world"))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	WFS.LoadTimeout = 20 * time.Millisecond
+	WFS.BreakerThreshold = 2
+	WFS.BreakerCooldown = 100 * time.Millisecond
+	defer func() {
+		WFS.LoadTimeout = 0
+		WFS.BreakerThreshold = 0
+		WFS.BreakerCooldown = 0
+	}()
+	// the db only allows one connection, so holding a transaction open stalls every load
+	txStarted := make(chan struct{})
+	releaseTx := make(chan struct{})
+	txDone := make(chan struct{})
+	go func() {
+		defer close(txDone)
+		WithTx(ctx, func(tx *TxWrap) error {
+			close(txStarted)
+			<-releaseTx
+			return nil
+		})
+	}()
+	<-txStarted
+	for i := 0; i < 2; i++ {
+		_, _, err = WFS.ReadFile(ctx, zoneId, "clean")
+		if !errors.Is(err, ErrBackendTimeout) {
+			t.Fatalf("expected ErrBackendTimeout, got %v", err)
+		}
+	}
+	stats := WFS.CacheStats()
+	if stats.Breaker != BreakerOpen || stats.BackendFailures != 2 {
+		t.Fatalf("expected an open breaker after 2 failures, got %q (%d failures)", stats.Breaker, stats.BackendFailures)
+	}
+	startTs := time.Now()
+	_, _, err = WFS.ReadFile(ctx, zoneId, "clean")
+	if !errors.Is(err, ErrBackendUnavailable) {
+		t.Fatalf("expected ErrBackendUnavailable, got %v", err)
+	}
+	if time.Since(startTs) >= WFS.LoadTimeout {
+		t.Errorf("open breaker did not fail fast (took %v)", time.Since(startTs))
+	}
+	// resident files are still served from the cache, and turned-away flushes don't drop dirty data
+	_, err = WFS.AppendData(ctx, zoneId, "dirty", []byte("!"))
+	if err != nil {
+		t.Fatalf("error appending to a resident file: %v", err)
+	}
+	checkFileData(t, ctx, zoneId, "dirty", "world!")
+	for i := 0; i < 5; i++ {
+		_, err = WFS.FlushCache(ctx)
+		if !errors.Is(err, ErrBackendUnavailable) {
+			t.Fatalf("expected ErrBackendUnavailable from flush, got %v", err)
+		}
+	}
+	checkFileData(t, ctx, zoneId, "dirty", "world!")
+	close(releaseTx)
+	<-txDone
+
+	// after the cooldown a probe is let through, and its success closes the breaker
+	time.Sleep(WFS.BreakerCooldown)
+	if WFS.CacheStats().Breaker != BreakerHalfOpen {
+		t.Fatalf("expected a half-open breaker after the cooldown, got %q", WFS.CacheStats().Breaker)
+	}
+	checkFileData(t, ctx, zoneId, "clean", "hello")
+	stats = WFS.CacheStats()
+	if stats.Breaker != BreakerClosed || stats.BackendFailures != 0 {
+		t.Fatalf("expected a closed breaker after a successful probe, got %q (%d failures)", stats.Breaker, stats.BackendFailures)
+	}
+	_, err = WFS.FlushCache(ctx)
+	if err != nil {
+		t.Fatalf("error flushing cache: %v", err)
+	}
+	checkFileData(t, ctx, zoneId, "dirty", "world!")
+}
+
+func TestContentHash(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	checkHash := func(name string, expected string) {
+		t.Helper()
+		hash, err := WFS.ContentHash(ctx, zoneId, name)
+		if err != nil {
+			t.Fatalf("error hashing %s: %v", name, err)
+		}
+		expectedHash := sha256.Sum256([]byte(expected))
+		if !bytes.Equal(hash, expectedHash[:]) {
+			t.Errorf("hash mismatch for %s: expected %x, got %x", name, expectedHash, hash)
+		}
+	}
+	_, err := WFS.ContentHash(ctx, zoneId, "f1")
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("expected ErrNotExist for a missing file, got %v", err)
+	}
+	err = WFS.MakeFile(ctx, zoneId, "f1", nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	checkHash("f1", "")
+	text := makeText(120)
+	_, err = WFS.WriteFile(ctx, zoneId, "f1", []byte(text))
+	if err != nil {
+		t.Fatalf("error writing file: %v", err)
+	}
+	checkHash("f1", text)
+	// dirty data is included, and the remembered hash is not reused after a write
+	_, err = WFS.AppendData(ctx, zoneId, "f1", []byte("more"))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	checkHash("f1", text+"more")
+	checkHash("f1", text+"more")
+
+	// the same data hashes the same in another zone
+	otherZoneId := uuid.NewString()
+	err = WFS.MakeFileWithData(ctx, otherZoneId, "g1", nil, FileOptsType{}, []byte(text+"more"))
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	hash1, err := WFS.ContentHash(ctx, zoneId, "f1")
+	if err != nil {
+		t.Fatalf("error hashing file: %v", err)
+	}
+	hash2, err := WFS.ContentHash(ctx, otherZoneId, "g1")
+	if err != nil {
+		t.Fatalf("error hashing file: %v", err)
+	}
+	if !bytes.Equal(hash1, hash2) {
+		t.Errorf("identical files hash differently: %x vs %x", hash1, hash2)
+	}
+
+	// a recreated file is hashed again
+	err = WFS.DeleteFile(ctx, zoneId, "f1")
+	if err != nil {
+		t.Fatalf("error deleting file: %v", err)
+	}
+	err = WFS.MakeFile(ctx, zoneId, "f1", nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	_, err = WFS.AppendData(ctx, zoneId, "f1", []byte("other"))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	checkHash("f1", "other")
+
+	// circular files hash the retained data in logical order
+	err = WFS.MakeFile(ctx, zoneId, "c1", nil, FileOptsType{Circular: true, MaxSize: 100})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	circularText := makeText(230)
+	_, err = WFS.AppendData(ctx, zoneId, "c1", []byte(circularText))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	checkHash("c1", circularText[130:])
+
+	// sparse holes hash as zeros
+	err = WFS.MakeFile(ctx, zoneId, "s1", nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	_, err = WFS.Preallocate(ctx, zoneId, "s1", 120)
+	if err != nil {
+		t.Fatalf("error preallocating: %v", err)
+	}
+	_, err = WFS.WriteAt(ctx, zoneId, "s1", 110, []byte("tail"))
+	if err != nil {
+		t.Fatalf("error writing data: %v", err)
+	}
+	checkHash("s1", string(make([]byte, 110))+"tail"+string(make([]byte, 6)))
+}
+
+func TestFlushDependency(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	// the index sorts before its data file, so batched flushes reach it first
+	indexKey := FileKey{ZoneId: zoneId, Name: "a-index"}
+	dataKey := FileKey{ZoneId: zoneId, Name: "b-data"}
+	otherKey := FileKey{ZoneId: zoneId, Name: "c-other"}
+	err := WFS.SetFlushDependency(indexKey, indexKey)
+	if err == nil {
+		t.Fatalf("expected error for a self dependency")
+	}
+	err = WFS.SetFlushDependency(indexKey, dataKey)
+	if err != nil {
+		t.Fatalf("error setting flush dependency: %v", err)
+	}
+	err = WFS.SetFlushDependency(dataKey, otherKey)
+	if err != nil {
+		t.Fatalf("error setting flush dependency: %v", err)
+	}
+	err = WFS.SetFlushDependency(otherKey, indexKey)
+	if err == nil {
+		t.Fatalf("expected error for a dependency cycle")
+	}
+	for _, key := range []FileKey{indexKey, dataKey, otherKey} {
+		err = WFS.MakeFile(ctx, zoneId, key.Name, nil, FileOptsType{})
+		if err != nil {
+			t.Fatalf("error creating file: %v", err)
+		}
+	}
+	writeAll := func(text string) {
+		t.Helper()
+		for _, key := range []FileKey{indexKey, dataKey, otherKey} {
+			_, err := WFS.AppendData(ctx, zoneId, key.Name, []byte(text))
+			if err != nil {
+				t.Fatalf("error appending data: %v", err)
+			}
+		}
+	}
+	writeAll("hello")
+	stats, err := WFS.FlushCache(ctx)
+	if err != nil {
+		t.Fatalf("error flushing cache: %v", err)
+	}
+	if stats.NumCommitted != 3 || stats.NumBlocked != 0 {
+		t.Errorf("expected 3 committed and 0 blocked, got %+v", stats)
+	}
+	// evicting the index flushes the data file and (transitively) its prerequisite first
+	writeAll(" there")
+	err = WFS.Evict(ctx, zoneId, indexKey.Name)
+	if err != nil {
+		t.Fatalf("error evicting file: %v", err)
+	}
+	checkFileData(t, ctx, zoneId, indexKey.Name, "hello there")
+	stats, err = WFS.FlushCache(ctx)
+	if err != nil {
+		t.Fatalf("error flushing cache: %v", err)
+	}
+	if stats.NumDirtyEntries != 0 {
+		t.Errorf("expected the prerequisites to be flushed by the evict, got %+v", stats)
+	}
+	if WFS.getCacheSize() != 0 {
+		t.Errorf("expected an empty cache after the flush, got %d entries", WFS.getCacheSize())
+	}
+
+	// batched, prerequisites that sort after their dependents are still flushed first
+	WFS.FlushBatchSize = 1
+	defer func() { WFS.FlushBatchSize = 0 }()
+	writeAll(" world")
+	stats, err = WFS.FlushCache(ctx)
+	if err != nil {
+		t.Fatalf("error flushing cache: %v", err)
+	}
+	if stats.NumCommitted != 3 || stats.NumBlocked != 0 {
+		t.Errorf("expected 3 committed and 0 blocked, got %+v", stats)
+	}
+	if WFS.getCacheSize() != 0 {
+		t.Errorf("expected an empty cache after the flush, got %d entries", WFS.getCacheSize())
+	}
+	for _, key := range []FileKey{indexKey, dataKey, otherKey} {
+		checkFileData(t, ctx, zoneId, key.Name, "hello there world")
+	}
+
+	WFS.RemoveFlushDependency(indexKey, dataKey)
+	writeAll("!")
+	err = WFS.Evict(ctx, zoneId, indexKey.Name)
+	if err != nil {
+		t.Fatalf("error evicting file after removing its dependency: %v", err)
+	}
+	err = WFS.SetFlushDependency(otherKey, indexKey)
+	if err != nil {
+		t.Fatalf("error setting flush dependency once the cycle is gone: %v", err)
+	}
+}
+
+// WriteFile and ResetCircular flush right away: dirty prerequisites are flushed first, and when the
+// flush would be turned away they fail without changing the file.  a replace whose flush fails anyway
+// still drops the stale parts later.
+func TestReplaceFlushTurnedAway(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	aKey := FileKey{ZoneId: zoneId, Name: "a"}
+	bKey := FileKey{ZoneId: zoneId, Name: "b"}
+	for _, name := range []string{"a", "b"} {
+		err := WFS.MakeFile(ctx, zoneId, name, nil, FileOptsType{})
+		if err != nil {
+			t.Fatalf("error creating file: %v", err)
+		}
+	}
+	err := WFS.MakeFile(ctx, zoneId, "c", nil, FileOptsType{Circular: true, MaxSize: 100})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	_, err = WFS.WriteFile(ctx, zoneId, "b", []byte(makeRepeat('S', 200)))
+	if err != nil {
+		t.Fatalf("error writing file: %v", err)
+	}
+	_, err = WFS.AppendData(ctx, zoneId, "c", []byte("ring"))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	_, err = WFS.FlushCache(ctx)
+	if err != nil {
+		t.Fatalf("error flushing cache: %v", err)
+	}
+	checkPartIdxs := func(name string, expected ...int) {
+		t.Helper()
+		partIdxs, err := WFS.DBPartIndexes(ctx, zoneId, name)
+		if err != nil {
+			t.Fatalf("error getting part indexes: %v", err)
+		}
+		if !reflect.DeepEqual(partIdxs, expected) {
+			t.Errorf("persisted parts mismatch for %s: expected %v, got %v", name, expected, partIdxs)
+		}
+	}
+
+	err = WFS.SetFlushDependency(bKey, aKey)
+	if err != nil {
+		t.Fatalf("error setting flush dependency: %v", err)
+	}
+	_, err = WFS.AppendData(ctx, zoneId, "a", []byte("dirty"))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	_, err = WFS.WriteFile(ctx, zoneId, "b", []byte("new"))
+	if err != nil {
+		t.Fatalf("error writing file with a dirty prerequisite: %v", err)
+	}
+	checkPartIdxs("a", 0)
+	checkPartIdxs("b", 0)
+	checkFileData(t, ctx, zoneId, "b", "new")
+	WFS.RemoveFlushDependency(bKey, aKey)
+	_, err = WFS.WriteFile(ctx, zoneId, "b", []byte(makeRepeat('S', 200)))
+	if err != nil {
+		t.Fatalf("error writing file: %v", err)
+	}
+
+	WFS.BreakerThreshold = 1
+	defer func() {
+		WFS.BreakerThreshold = 0
+		WFS.lock()
+		WFS.breaker = backendBreaker{}
+		WFS.Lock.Unlock()
+	}()
+	setBreakerOpen := func(open bool) {
+		WFS.lock()
+		defer WFS.Lock.Unlock()
+		WFS.breaker = backendBreaker{}
+		if open {
+			WFS.breaker.openUntil = time.Now().Add(time.Hour)
+		}
+	}
+	// resident, so only the flush goes to the backend
+	for _, name := range []string{"b", "c"} {
+		err = WFS.Touch(ctx, zoneId, name)
+		if err != nil {
+			t.Fatalf("error touching file: %v", err)
+		}
+	}
+	setBreakerOpen(true)
+	_, err = WFS.WriteFile(ctx, zoneId, "b", []byte("new"))
+	if !errors.Is(err, ErrBackendUnavailable) {
+		t.Fatalf("expected ErrBackendUnavailable, got %v", err)
+	}
+	_, err = WFS.ResetCircular(ctx, zoneId, "c")
+	if !errors.Is(err, ErrBackendUnavailable) {
+		t.Fatalf("expected ErrBackendUnavailable, got %v", err)
+	}
+	setBreakerOpen(false)
+	checkFileData(t, ctx, zoneId, "b", makeRepeat('S', 200))
+	checkFileData(t, ctx, zoneId, "c", "ring")
+
+	// the breaker opens between the check and the flush: the write stands, and the deferred flush
+	// deletes the parts the replace dropped
+	err = withLock(WFS, zoneId, "b", func(entry *CacheEntry) error {
+		err := entry.loadFileForWrite(ctx)
+		if err != nil {
+			return err
+		}
+		entry.writeAt(0, []byte("new"), true)
+		setBreakerOpen(true)
+		return entry.flushToDB(ctx, true)
+	})
+	if !errors.Is(err, ErrBackendUnavailable) {
+		t.Fatalf("expected ErrBackendUnavailable, got %v", err)
+	}
+	setBreakerOpen(false)
+	_, err = WFS.FlushCache(ctx)
+	if err != nil {
+		t.Fatalf("error flushing cache: %v", err)
+	}
+	checkPartIdxs("b", 0)
+	_, err = WFS.Preallocate(ctx, zoneId, "b", 200)
+	if err != nil {
+		t.Fatalf("error preallocating: %v", err)
+	}
+	checkFileData(t, ctx, zoneId, "b", "new"+string(make([]byte, 197)))
+}
+
+// operations that flush a dependent right away flush its dirty prerequisites first instead of failing,
+// including the write-through flush of NoDataCache writes
+func TestDependentFlushesPrerequisites(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	prereqZoneId := uuid.NewString()
+	depKey := FileKey{ZoneId: zoneId, Name: "dep"}
+	prereqKey := FileKey{ZoneId: prereqZoneId, Name: "prereq"}
+	for _, key := range []FileKey{depKey, prereqKey} {
+		err := WFS.MakeFile(ctx, key.ZoneId, key.Name, nil, FileOptsType{Circular: true, MaxSize: 2 * partDataSize})
+		if err != nil {
+			t.Fatalf("error creating file: %v", err)
+		}
+	}
+	err := WFS.SetFlushDependency(depKey, prereqKey)
+	if err != nil {
+		t.Fatalf("error setting flush dependency: %v", err)
+	}
+	defer WFS.RemoveFlushDependency(depKey, prereqKey)
+	checkPrereqClean := func(op string) {
+		t.Helper()
+		if dirty := WFS.dirtyPrerequisites(cacheKey{ZoneId: zoneId, Name: depKey.Name}); len(dirty) != 0 {
+			t.Errorf("expected %s to flush the prerequisite, got dirty prerequisites %v", op, dirty)
+		}
+	}
+	ops := []struct {
+		name string
+		fn   func() error
+	}{
+		{"FlushRange", func() error { return WFS.FlushRange(ctx, zoneId, depKey.Name, 0, 1) }},
+		{"Seal", func() error { return WFS.Seal(ctx, zoneId, depKey.Name) }},
+		{"Unseal", func() error { return WFS.Unseal(ctx, zoneId, depKey.Name) }},
+		{"UpdateOpts", func() error {
+			_, err := WFS.UpdateOpts(ctx, zoneId, depKey.Name, FileOptsType{Circular: true, MaxSize: 2 * partDataSize})
+			return err
+		}},
+		{"ResetCircular", func() error {
+			_, err := WFS.ResetCircular(ctx, zoneId, depKey.Name)
+			return err
+		}},
+	}
+	for _, op := range ops {
+		// a touch keeps the dependent dirty even while it is sealed
+		err := WFS.Touch(ctx, zoneId, depKey.Name)
+		if err != nil {
+			t.Fatalf("error touching file: %v", err)
+		}
+		_, err = WFS.AppendData(ctx, prereqZoneId, prereqKey.Name, []byte("data"))
+		if err != nil {
+			t.Fatalf("error appending data: %v", err)
+		}
+		err = op.fn()
+		if err != nil {
+			t.Fatalf("%s with a dirty prerequisite: %v", op.name, err)
+		}
+		checkPrereqClean(op.name)
+	}
+
+	logger := &recordingLogger{}
+	WFS.Logger = logger
+	defer func() { WFS.Logger = nil }()
+	WFS.NoDataCache = true
+	defer func() { WFS.NoDataCache = false }()
+	for i := 0; i < 3; i++ {
+		// dirty without any dirty parts, so its own writes don't flush it
+		err := WFS.Touch(ctx, prereqZoneId, prereqKey.Name)
+		if err != nil {
+			t.Fatalf("error touching file: %v", err)
+		}
+		_, err = WFS.AppendData(ctx, zoneId, depKey.Name, []byte("x"))
+		if err != nil {
+			t.Fatalf("error appending data: %v", err)
+		}
+		checkPrereqClean("a NoDataCache write")
+	}
+	if len(logger.msgs) != 0 {
+		t.Errorf("expected no log messages, got %q", logger.msgs)
+	}
+	checkFileData(t, ctx, zoneId, depKey.Name, "xxx")
+}
+
+// a prerequisite that is written continuously can't keep an operation that flushes its dependent from
+// finishing, even without a deadline
+func TestDependentFlushWithBusyPrerequisite(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	depKey := FileKey{ZoneId: zoneId, Name: "dep"}
+	prereqKey := FileKey{ZoneId: zoneId, Name: "prereq"}
+	for _, key := range []FileKey{depKey, prereqKey} {
+		err := WFS.MakeFile(ctx, key.ZoneId, key.Name, nil, FileOptsType{Circular: true, MaxSize: 2 * partDataSize})
+		if err != nil {
+			t.Fatalf("error creating file: %v", err)
+		}
+	}
+	err := WFS.SetFlushDependency(depKey, prereqKey)
+	if err != nil {
+		t.Fatalf("error setting flush dependency: %v", err)
+	}
+	defer WFS.RemoveFlushDependency(depKey, prereqKey)
+	stopCh := make(chan struct{})
+	var writerWg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		writerWg.Add(1)
+		go func() {
+			defer writerWg.Done()
+			for {
+				select {
+				case <-stopCh:
+					return
+				default:
+				}
+				_, err := WFS.AppendData(ctx, zoneId, prereqKey.Name, []byte("data"))
+				if err != nil {
+					t.Errorf("error appending data: %v", err)
+					return
+				}
+			}
+		}()
+	}
+	opsDone := make(chan error, 1)
+	go func() {
+		bgCtx := context.Background()
+		for i := 0; i < 20; i++ {
+			if _, err := WFS.WriteFile(bgCtx, zoneId, depKey.Name, []byte("hello")); err != nil {
+				opsDone <- fmt.Errorf("WriteFile: %w", err)
+				return
+			}
+			if err := WFS.Seal(bgCtx, zoneId, depKey.Name); err != nil {
+				opsDone <- fmt.Errorf("Seal: %w", err)
+				return
+			}
+			if err := WFS.Unseal(bgCtx, zoneId, depKey.Name); err != nil {
+				opsDone <- fmt.Errorf("Unseal: %w", err)
+				return
+			}
+			// the dependent and its prerequisite locked together
+			if err := WFS.SwapFiles(bgCtx, zoneId, depKey.Name, prereqKey.Name); err != nil {
+				opsDone <- fmt.Errorf("SwapFiles: %w", err)
+				return
+			}
+		}
+		opsDone <- nil
+	}()
+	select {
+	case err := <-opsDone:
+		if err != nil {
+			t.Errorf("error with a busy prerequisite: %v", err)
+		}
+	case <-ctx.Done():
+		t.Errorf("operations with a busy prerequisite didn't finish")
+	}
+	close(stopCh)
+	writerWg.Wait()
+}
+
+// SnapshotAll flushes dirty files in dependency order, so a dependent visited first isn't blocked
+func TestSnapshotAllFlushDependency(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	// a chain, so cache map order almost never matches it
+	var keys []FileKey
+	for i := 0; i < 8; i++ {
+		key := FileKey{ZoneId: zoneId, Name: fmt.Sprintf("f%d", i)}
+		err := WFS.MakeFile(ctx, zoneId, key.Name, nil, FileOptsType{})
+		if err != nil {
+			t.Fatalf("error creating file: %v", err)
+		}
+		if i > 0 {
+			err = WFS.SetFlushDependency(keys[i-1], key)
+			if err != nil {
+				t.Fatalf("error setting flush dependency: %v", err)
+			}
+			defer WFS.RemoveFlushDependency(keys[i-1], key)
+		}
+		keys = append(keys, key)
+	}
+	for i := 0; i < 5; i++ {
+		for _, key := range keys {
+			_, err := WFS.AppendData(ctx, zoneId, key.Name, []byte("x"))
+			if err != nil {
+				t.Fatalf("error appending data: %v", err)
+			}
+		}
+		var buf bytes.Buffer
+		err := WFS.SnapshotAll(ctx, &buf)
+		if err != nil {
+			t.Fatalf("error taking snapshot: %v", err)
+		}
+	}
+	if WFS.getCacheSize() != 0 {
+		t.Errorf("expected an empty cache after the snapshot, got %d entries", WFS.getCacheSize())
+	}
+	for _, key := range keys {
+		checkFileData(t, ctx, zoneId, key.Name, "xxxxx")
+	}
+}
+
+func TestReadInto(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	err := WFS.MakeFile(ctx, zoneId, "f1", nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	text := makeText(120)
+	_, err = WFS.WriteFile(ctx, zoneId, "f1", []byte(text))
+	if err != nil {
+		t.Fatalf("error writing file: %v", err)
+	}
+	// the same buffer is reused across reads (spanning parts)
+	buf := make([]byte, 30)
+	for _, offset := range []int64{0, 40, 90} {
+		n, err := WFS.ReadInto(ctx, zoneId, "f1", offset, buf)
+		if err != nil {
+			t.Fatalf("error reading at %d: %v", offset, err)
+		}
+		if n != len(buf) || string(buf) != text[offset:offset+30] {
+			t.Errorf("read at %d mismatch: got %d bytes %q", offset, n, buf[:n])
+		}
+	}
+	n, err := WFS.ReadInto(ctx, zoneId, "f1", 100, buf)
+	if err != io.EOF {
+		t.Fatalf("expected io.EOF for a short read, got %v", err)
+	}
+	if n != 20 || string(buf[:n]) != text[100:] {
+		t.Errorf("short read mismatch: got %d bytes %q", n, buf[:n])
+	}
+	n, err = WFS.ReadInto(ctx, zoneId, "f1", 200, buf)
+	if err != io.EOF || n != 0 {
+		t.Errorf("expected (0, io.EOF) past the end, got (%d, %v)", n, err)
+	}
+	n, err = WFS.ReadIntoWithOpts(ctx, zoneId, "f1", 100, buf, ReadOpts{PastEOF: PastEOFError})
+	if !errors.Is(err, io.EOF) || n != 0 {
+		t.Errorf("expected (0, io.EOF) with PastEOFError, got (%d, %v)", n, err)
+	}
+	for i := range buf {
+		buf[i] = 'x'
+	}
+	n, err = WFS.ReadIntoWithOpts(ctx, zoneId, "f1", 100, buf, ReadOpts{PastEOF: PastEOFZero})
+	if err != nil {
+		t.Fatalf("error reading with PastEOFZero: %v", err)
+	}
+	if n != len(buf) || string(buf) != text[100:]+string(make([]byte, 10)) {
+		t.Errorf("zero-padded read mismatch: got %d bytes %q", n, buf[:n])
+	}
+
+	// evicted circular data is an error, never data from another offset
+	err = WFS.MakeFile(ctx, zoneId, "c1", nil, FileOptsType{Circular: true, MaxSize: 100})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	circularText := makeText(230)
+	_, err = WFS.AppendData(ctx, zoneId, "c1", []byte(circularText))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	_, err = WFS.ReadInto(ctx, zoneId, "c1", 120, buf)
+	if !errors.Is(err, ErrEvicted) {
+		t.Errorf("expected ErrEvicted, got %v", err)
+	}
+	n, err = WFS.ReadInto(ctx, zoneId, "c1", 150, buf)
+	if err != nil {
+		t.Fatalf("error reading circular file: %v", err)
+	}
+	if n != len(buf) || string(buf) != circularText[150:180] {
+		t.Errorf("circular read mismatch: got %d bytes %q", n, buf[:n])
+	}
+}
+
+func TestReplaceParts(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	err := WFS.MakeFile(ctx, zoneId, "f1", nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	_, err = WFS.WriteFile(ctx, zoneId, "f1", []byte(makeText(230)))
+	if err != nil {
+		t.Fatalf("error writing file: %v", err)
+	}
+	checkPartIdxs := func(expected ...int) {
+		t.Helper()
+		_, err := WFS.FlushCache(ctx)
+		if err != nil {
+			t.Fatalf("error flushing cache: %v", err)
+		}
+		partIdxs, err := WFS.DBPartIndexes(ctx, zoneId, "f1")
+		if err != nil {
+			t.Fatalf("error getting part indexes: %v", err)
+		}
+		if !reflect.DeepEqual(partIdxs, expected) {
+			t.Errorf("persisted parts mismatch: expected %v, got %v", expected, partIdxs)
+		}
+	}
+	// dirty parts past the new size are dropped from the cache too
+	_, err = WFS.AppendData(ctx, zoneId, "f1", []byte("more"))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	_, err = WFS.ReplaceParts(ctx, zoneId, "f1", map[int][]byte{0: []byte(makeRepeat('A', 50)), 1: []byte(makeRepeat('B', 20))}, 70)
+	if err != nil {
+		t.Fatalf("error replacing parts: %v", err)
+	}
+	checkFileData(t, ctx, zoneId, "f1", makeRepeat('A', 50)+makeRepeat('B', 20))
+	checkPartIdxs(0, 1)
+	checkFileData(t, ctx, zoneId, "f1", makeRepeat('A', 50)+makeRepeat('B', 20))
+
+	// shrinking into a part that isn't given trims it, the dropped bytes don't come back when the file grows
+	_, err = WFS.ReplaceParts(ctx, zoneId, "f1", nil, 30)
+	if err != nil {
+		t.Fatalf("error replacing parts: %v", err)
+	}
+	checkPartIdxs(0)
+	_, err = WFS.Preallocate(ctx, zoneId, "f1", 100)
+	if err != nil {
+		t.Fatalf("error preallocating: %v", err)
+	}
+	checkFileData(t, ctx, zoneId, "f1", makeRepeat('A', 30)+string(make([]byte, 70)))
+	version, err := WFS.ReplaceParts(ctx, zoneId, "f1", map[int][]byte{2: []byte("CCCCC")}, 105)
+	if err != nil {
+		t.Fatalf("error replacing parts: %v", err)
+	}
+	checkFileData(t, ctx, zoneId, "f1", makeRepeat('A', 30)+string(make([]byte, 70))+"CCCCC")
+	file, err := WFS.Stat(ctx, zoneId, "f1")
+	if err != nil {
+		t.Fatalf("error stating file: %v", err)
+	}
+	if file.Version != version {
+		t.Errorf("version mismatch: expected %d, got %d", version, file.Version)
+	}
+
+	// persisted parts past the new size stay in the DB until the next flush, regrowing before it must not
+	// bring them back (neither for reads nor for partial writes that are flushed later)
+	err = WFS.MakeFile(ctx, zoneId, "f2", nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	_, err = WFS.WriteFile(ctx, zoneId, "f2", []byte(makeRepeat('Z', 150)))
+	if err != nil {
+		t.Fatalf("error writing file: %v", err)
+	}
+	_, err = WFS.FlushCache(ctx)
+	if err != nil {
+		t.Fatalf("error flushing cache: %v", err)
+	}
+	_, err = WFS.ReplaceParts(ctx, zoneId, "f2", nil, 50)
+	if err != nil {
+		t.Fatalf("error replacing parts: %v", err)
+	}
+	_, err = WFS.Preallocate(ctx, zoneId, "f2", 150)
+	if err != nil {
+		t.Fatalf("error preallocating: %v", err)
+	}
+	checkFileData(t, ctx, zoneId, "f2", makeRepeat('Z', 50)+string(make([]byte, 100)))
+	_, err = WFS.WriteAt(ctx, zoneId, "f2", 95, []byte("xxxxx"))
+	if err != nil {
+		t.Fatalf("error writing at: %v", err)
+	}
+	checkFileData(t, ctx, zoneId, "f2", makeRepeat('Z', 50)+string(make([]byte, 45))+"xxxxx"+string(make([]byte, 50)))
+	_, err = WFS.FlushCache(ctx)
+	if err != nil {
+		t.Fatalf("error flushing cache: %v", err)
+	}
+	WFS.clearCache()
+	checkFileData(t, ctx, zoneId, "f2", makeRepeat('Z', 50)+string(make([]byte, 45))+"xxxxx"+string(make([]byte, 50)))
+	// regrowing after the flush that applied the truncate
+	_, err = WFS.ReplaceParts(ctx, zoneId, "f2", nil, 50)
+	if err != nil {
+		t.Fatalf("error replacing parts: %v", err)
+	}
+	_, err = WFS.FlushCache(ctx)
+	if err != nil {
+		t.Fatalf("error flushing cache: %v", err)
+	}
+	_, err = WFS.Preallocate(ctx, zoneId, "f2", 150)
+	if err != nil {
+		t.Fatalf("error preallocating: %v", err)
+	}
+	checkFileData(t, ctx, zoneId, "f2", makeRepeat('Z', 50)+string(make([]byte, 100)))
+
+	_, err = WFS.ReplaceParts(ctx, zoneId, "f1", map[int][]byte{0: []byte(makeRepeat('A', 51))}, 105)
+	if err == nil {
+		t.Errorf("expected error for a part larger than the part size")
+	}
+	_, err = WFS.ReplaceParts(ctx, zoneId, "f1", map[int][]byte{2: []byte("CCCCC")}, 102)
+	if err == nil {
+		t.Errorf("expected error for a part that ends past the new size")
+	}
+	checkFileData(t, ctx, zoneId, "f1", makeRepeat('A', 30)+string(make([]byte, 70))+"CCCCC")
+	err = WFS.MakeFile(ctx, zoneId, "c1", nil, FileOptsType{Circular: true, MaxSize: 100})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	_, err = WFS.ReplaceParts(ctx, zoneId, "c1", map[int][]byte{0: []byte("hello")}, 5)
+	if err == nil {
+		t.Errorf("expected error for a circular file")
+	}
+}
+
+// the truncate a shrinking ReplaceParts records is applied by the first flush that writes the file,
+// a range flush included, so a later full flush doesn't delete the parts it persisted
+func TestReplacePartsThenFlushRange(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	err := WFS.MakeFile(ctx, zoneId, "f1", nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	_, err = WFS.WriteFile(ctx, zoneId, "f1", []byte(makeRepeat('S', 200)))
+	if err != nil {
+		t.Fatalf("error writing file: %v", err)
+	}
+	_, err = WFS.FlushCache(ctx)
+	if err != nil {
+		t.Fatalf("error flushing cache: %v", err)
+	}
+	_, err = WFS.ReplaceParts(ctx, zoneId, "f1", nil, 50)
+	if err != nil {
+		t.Fatalf("error replacing parts: %v", err)
+	}
+	_, err = WFS.AppendData(ctx, zoneId, "f1", []byte(makeRepeat('Z', 120)))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	// part 3 stays dirty so this is a partial flush
+	err = WFS.FlushRange(ctx, zoneId, "f1", 1, 3)
+	if err != nil {
+		t.Fatalf("error flushing range: %v", err)
+	}
+	_, err = WFS.FlushCache(ctx)
+	if err != nil {
+		t.Fatalf("error flushing cache: %v", err)
+	}
+	partIdxs, err := WFS.DBPartIndexes(ctx, zoneId, "f1")
+	if err != nil {
+		t.Fatalf("error getting part indexes: %v", err)
+	}
+	if !reflect.DeepEqual(partIdxs, []int{0, 1, 2, 3}) {
+		t.Errorf("persisted parts mismatch: expected [0 1 2 3], got %v", partIdxs)
+	}
+	checkFileData(t, ctx, zoneId, "f1", makeRepeat('S', 50)+makeRepeat('Z', 120))
+}
+
+// every flush path runs under the entry lock, so a background and an explicit flush of the same entry
+// can't both write it: the second finds the entry clean.  run with -race.
+func TestConcurrentFlushSameEntry(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+	ctx, cancelFn := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	fileName := "cf1"
+	err := WFS.MakeFile(ctx, zoneId, fileName, nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	countFlushedParts := func() int64 {
+		var total int64
+		for idx := range WFS.throughput {
+			total += WFS.throughput[idx].parts.Load()
+		}
+		return total
+	}
+	startParts := countFlushedParts()
+	const numRounds = 100
+	var expected strings.Builder
+	for i := 0; i < numRounds; i++ {
+		// 10 bytes at a multiple of 10 dirties exactly one part
+		text := fmt.Sprintf("%09d\n", i)
+		expected.WriteString(text)
+		_, err := WFS.AppendData(ctx, zoneId, fileName, []byte(text))
+		if err != nil {
+			t.Fatalf("error appending data: %v", err)
+		}
+		var wg sync.WaitGroup
+		wg.Add(3)
+		go func() {
+			defer wg.Done()
+			// the background flusher's path
+			_, err := WFS.flushCache(ctx, true)
+			if err != nil {
+				t.Errorf("error in background flush: %v", err)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			err := WFS.FlushRange(ctx, zoneId, fileName, 0, math.MaxInt32)
+			if err != nil {
+				t.Errorf("error flushing range: %v", err)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			err := WFS.Evict(ctx, zoneId, fileName)
+			if err != nil {
+				t.Errorf("error evicting file: %v", err)
+			}
+		}()
+		wg.Wait()
+	}
+	if flushed := countFlushedParts() - startParts; flushed != numRounds {
+		t.Errorf("expected %d part flushes (one per round), got %d", numRounds, flushed)
+	}
+	checkFileData(t, ctx, zoneId, fileName, expected.String())
+	if err := WFS.checkInvariants(); err != nil {
+		t.Errorf("invariant violated: %v", err)
+	}
+}
+
+func TestModifiedSince(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId1 := uuid.NewString()
+	zoneId2 := uuid.NewString()
+	startTs := time.Now()
+	keyA := FileKey{ZoneId: zoneId1, Name: "a"}
+	keyB := FileKey{ZoneId: zoneId2, Name: "b"}
+	keyC := FileKey{ZoneId: zoneId1, Name: "c"}
+	for _, key := range []FileKey{keyA, keyB, keyC} {
+		err := WFS.MakeFile(ctx, key.ZoneId, key.Name, nil, FileOptsType{})
+		if err != nil {
+			t.Fatalf("error creating file: %v", err)
+		}
+	}
+	checkModified := func(since time.Time, expected ...FileKey) {
+		t.Helper()
+		keys, err := WFS.ModifiedSince(ctx, since)
+		if err != nil {
+			t.Fatalf("error getting modified files: %v", err)
+		}
+		if len(expected) == 0 {
+			expected = []FileKey{}
+		}
+		sort.Slice(expected, func(i, j int) bool {
+			if expected[i].ZoneId != expected[j].ZoneId {
+				return expected[i].ZoneId < expected[j].ZoneId
+			}
+			return expected[i].Name < expected[j].Name
+		})
+		if !reflect.DeepEqual(keys, expected) {
+			t.Errorf("modified files mismatch: expected %v, got %v", expected, keys)
+		}
+	}
+	checkModified(startTs, keyA, keyB, keyC)
+	time.Sleep(5 * time.Millisecond)
+	backupTs := time.Now()
+	time.Sleep(5 * time.Millisecond)
+	checkModified(backupTs)
+	_, err := WFS.WriteFile(ctx, zoneId1, "a", []byte("flushed"))
+	if err != nil {
+		t.Fatalf("error writing file: %v", err)
+	}
+	// unflushed writes count
+	_, err = WFS.AppendData(ctx, zoneId2, "b", []byte("dirty"))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	checkModified(backupTs, keyA, keyB)
+
+	// the timestamp is persisted, so it survives a restart (an empty cache)
+	_, err = WFS.FlushCache(ctx)
+	if err != nil {
+		t.Fatalf("error flushing cache: %v", err)
+	}
+	WFS.clearCache()
+	checkModified(backupTs, keyA, keyB)
+	err = WFS.DeleteFile(ctx, zoneId1, "a")
+	if err != nil {
+		t.Fatalf("error deleting file: %v", err)
+	}
+	checkModified(backupTs, keyB)
+}
+
+// run with -race: a read racing a delete sees the whole file or fs.ErrNotExist, and nothing after the first error
+func TestConcurrentDeleteReads(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+	ctx, cancelFn := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	text := makeText(230)
+	for round := 0; round < 20; round++ {
+		fileName := fmt.Sprintf("dr%d", round)
+		err := WFS.MakeFileWithData(ctx, zoneId, fileName, nil, FileOptsType{}, []byte(text))
+		if err != nil {
+			t.Fatalf("error creating file: %v", err)
+		}
+		// half the rounds have dirty data in the cache when the delete lands
+		if round%2 == 1 {
+			_, err = WFS.WriteAt(ctx, zoneId, fileName, 0, []byte(text[:100]))
+			if err != nil {
+				t.Fatalf("error writing data: %v", err)
+			}
+		}
+		var wg sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				sawDelete := false
+				for j := 0; j < 20; j++ {
+					_, rdata, err := WFS.ReadFile(ctx, zoneId, fileName)
+					if errors.Is(err, fs.ErrNotExist) {
+						sawDelete = true
+						continue
+					}
+					if err != nil {
+						t.Errorf("error reading file: %v", err)
+						return
+					}
+					if sawDelete {
+						t.Errorf("read data after the file was deleted")
+						return
+					}
+					if string(rdata) != text {
+						t.Errorf("read a partially deleted file (%d bytes)", len(rdata))
+						return
+					}
+				}
+			}()
+		}
+		err = WFS.DeleteFile(ctx, zoneId, fileName)
+		if err != nil {
+			t.Fatalf("error deleting file: %v", err)
+		}
+		wg.Wait()
+	}
+}
+
+func TestEstimateWriteFootprint(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	err := WFS.MakeFile(ctx, zoneId, "f1", nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	checkEstimate := func(estimate int64, expected int64, writeFn func() error) {
+		t.Helper()
+		if estimate != expected {
+			t.Errorf("estimate mismatch: expected %d, got %d", expected, estimate)
+		}
+		before := WFS.CacheStats().ResidentBytes
+		err := writeFn()
+		if err != nil {
+			t.Fatalf("error writing data: %v", err)
+		}
+		if added := WFS.CacheStats().ResidentBytes - before; added > estimate {
+			t.Errorf("write added %d resident bytes, more than the estimate of %d", added, estimate)
+		}
+	}
+	estimate, err := WFS.EstimateAppendFootprint(ctx, zoneId, "f1", 10)
+	if err != nil {
+		t.Fatalf("error estimating: %v", err)
+	}
+	checkEstimate(estimate, 50, func() error {
+		_, err := WFS.AppendData(ctx, zoneId, "f1", []byte(makeText(10)))
+		return err
+	})
+	// the resident part 0 only counts for what it can still grow by
+	part0Cap := WFS.CacheStats().ResidentBytes
+	estimate, err = WFS.EstimateAppendFootprint(ctx, zoneId, "f1", 100)
+	if err != nil {
+		t.Fatalf("error estimating: %v", err)
+	}
+	checkEstimate(estimate, 150-part0Cap, func() error {
+		_, err := WFS.AppendData(ctx, zoneId, "f1", []byte(makeText(100)))
+		return err
+	})
+	_, err = WFS.FlushCache(ctx)
+	if err != nil {
+		t.Fatalf("error flushing cache: %v", err)
+	}
+	estimate, err = WFS.EstimateWriteFootprint(ctx, zoneId, "f1", 40, 20)
+	if err != nil {
+		t.Fatalf("error estimating: %v", err)
+	}
+	checkEstimate(estimate, 100, func() error {
+		_, err := WFS.WriteAt(ctx, zoneId, "f1", 40, []byte(makeText(20)))
+		return err
+	})
+	estimate, err = WFS.EstimateWriteFootprint(ctx, zoneId, "f1", 0, 0)
+	if err != nil || estimate != 0 {
+		t.Errorf("expected (0, nil) for an empty write, got (%d, %v)", estimate, err)
+	}
+
+	// a long write to a circular file only touches each part of the ring once
+	err = WFS.MakeFile(ctx, zoneId, "c1", nil, FileOptsType{Circular: true, MaxSize: 100})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	estimate, err = WFS.EstimateAppendFootprint(ctx, zoneId, "c1", 1000)
+	if err != nil {
+		t.Fatalf("error estimating: %v", err)
+	}
+	checkEstimate(estimate, 100, func() error {
+		_, err := WFS.AppendData(ctx, zoneId, "c1", []byte(makeText(1000)))
+		return err
+	})
+	_, err = WFS.EstimateAppendFootprint(ctx, zoneId, "missing", 10)
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected ErrNotExist for a missing file, got %v", err)
+	}
+}
+
+func TestVerifiedWriter(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	text := makeText(180)
+	expectedHash := sha256.Sum256([]byte(text))
+	ingest := func(name string, data string, deleteOnMismatch bool) error {
+		t.Helper()
+		err := WFS.MakeFile(ctx, zoneId, name, nil, FileOptsType{})
+		if err != nil {
+			t.Fatalf("error creating file: %v", err)
+		}
+		w := WFS.NewVerifiedWriter(ctx, zoneId, name, expectedHash[:], deleteOnMismatch)
+		_, err = io.Copy(w, strings.NewReader(data[:70]))
+		if err != nil {
+			t.Fatalf("error writing: %v", err)
+		}
+		_, err = w.Write([]byte(data[70:]))
+		if err != nil {
+			t.Fatalf("error writing: %v", err)
+		}
+		return w.Close()
+	}
+	err := ingest("good", text, false)
+	if err != nil {
+		t.Fatalf("expected a matching checksum, got %v", err)
+	}
+	checkFileData(t, ctx, zoneId, "good", text)
+	truncated := text[:150]
+	err = ingest("short", truncated, false)
+	if !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatalf("expected ErrChecksumMismatch, got %v", err)
+	}
+	checkFileData(t, ctx, zoneId, "short", truncated)
+	corrupted := text[:100] + "X" + text[101:]
+	err = ingest("corrupt", corrupted, true)
+	if !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatalf("expected ErrChecksumMismatch, got %v", err)
+	}
+	_, err = WFS.Stat(ctx, zoneId, "corrupt")
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected the mismatched file to be deleted, got %v", err)
+	}
+	w := WFS.NewVerifiedWriter(ctx, zoneId, "good", expectedHash[:], false)
+	if err = w.Close(); err != nil {
+		t.Fatalf("error closing: %v", err)
+	}
+	if err = w.Close(); err != nil {
+		t.Errorf("expected a second Close to be a no-op, got %v", err)
+	}
+	_, err = w.Write([]byte("more"))
+	if !errors.Is(err, fs.ErrClosed) {
+		t.Errorf("expected fs.ErrClosed writing after Close, got %v", err)
+	}
+}
+
+func TestPauseFlusher(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	err := WFS.MakeFile(ctx, zoneId, "f1", nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	WFS.PauseFlusher()
+	WFS.PauseFlusher()
+	_, err = WFS.AppendData(ctx, zoneId, "f1", []byte(makeText(120)))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	// stopFlush is set in tests, so runFlusher makes a single pass and returns
+	WFS.runFlusher()
+	if WFS.getCacheSize() != 1 {
+		t.Fatalf("expected a paused flusher to leave the file dirty, cache size %d", WFS.getCacheSize())
+	}
+	sleepDone := make(chan struct{})
+	go func() {
+		defer close(sleepDone)
+		WFS.flusherSleep(time.Minute)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	WFS.ResumeFlusher()
+	select {
+	case <-sleepDone:
+	case <-time.After(time.Second):
+		t.Fatalf("expected ResumeFlusher to cut the flusher's sleep short")
+	}
+	WFS.ResumeFlusher()
+	WFS.runFlusher()
+	if WFS.getCacheSize() != 0 {
+		t.Fatalf("expected the resumed flusher to flush the file, cache size %d", WFS.getCacheSize())
+	}
+	checkFileData(t, ctx, zoneId, "f1", makeText(120))
+
+	// writers blocked at the high water mark still get a sweep while paused
+	WFS.HighWater = 100
+	WFS.LowWater = 0
+	defer func() {
+		WFS.HighWater = 0
+		WFS.LowWater = 0
+	}()
+	WFS.PauseFlusher()
+	defer WFS.ResumeFlusher()
+	_, err = WFS.AppendData(ctx, zoneId, "f1", []byte(makeText(100)))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	if WFS.flusherSweepDue() {
+		t.Fatalf("expected no sweep while paused with no throttled writers")
+	}
+	writeErrCh := make(chan error, 1)
+	go func() {
+		_, err := WFS.AppendData(ctx, zoneId, "f1", []byte("x"))
+		writeErrCh <- err
+	}()
+	deadline := time.Now().Add(time.Second)
+	for !WFS.flusherSweepDue() {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected a sweep to be due once a writer is throttled")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	WFS.runFlusher()
+	err = <-writeErrCh
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	checkFileSize(t, ctx, zoneId, "f1", 221)
+}
+
+func TestReadAtWithVersion(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	_, _, _, err := WFS.ReadAtWithVersion(ctx, zoneId, "f1", 0, 10)
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("expected ErrNotExist for a missing file, got %v", err)
+	}
+	err = WFS.MakeFile(ctx, zoneId, "f1", nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	writeVersion, err := WFS.WriteAt(ctx, zoneId, "f1", 0, []byte(makeText(80)))
+	if err != nil {
+		t.Fatalf("error writing data: %v", err)
+	}
+	offset, data, version, err := WFS.ReadAtWithVersion(ctx, zoneId, "f1", 40, 20)
+	if err != nil {
+		t.Fatalf("error reading data: %v", err)
+	}
+	if offset != 40 || string(data) != makeText(80)[40:60] {
+		t.Errorf("unexpected read: offset %d, data %q", offset, data)
+	}
+	if version != writeVersion {
+		t.Errorf("expected version %d, got %d", writeVersion, version)
+	}
+
+	// every read's data must be exactly what the write of its version left in the file
+	const numWrites = 50
+	var written sync.Map
+	readerDone := make(chan struct{})
+	type versionedRead struct {
+		version int64
+		data    string
+	}
+	var reads []versionedRead
+	go func() {
+		defer close(readerDone)
+		for i := 0; i < 200; i++ {
+			_, data, version, err := WFS.ReadAtWithVersion(ctx, zoneId, "f1", 0, 200)
+			if err != nil {
+				t.Errorf("error reading data: %v", err)
+				return
+			}
+			reads = append(reads, versionedRead{version: version, data: string(data)})
+		}
+	}()
+	for i := 0; i < numWrites; i++ {
+		text := makeRepeat(byte('a'+i%26), 60+i)
+		version, err := WFS.WriteFile(ctx, zoneId, "f1", []byte(text))
+		if err != nil {
+			t.Fatalf("error writing file: %v", err)
+		}
+		written.Store(version, text)
+	}
+	<-readerDone
+	written.Store(writeVersion, makeText(80))
+	for _, read := range reads {
+		text, found := written.Load(read.version)
+		if !found {
+			t.Fatalf("read returned version %d, which no write produced", read.version)
+		}
+		if read.data != text.(string) {
+			t.Fatalf("read of version %d returned %q, expected %q", read.version, read.data, text)
+		}
+	}
+}
+
+func TestBatchDeletes(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+	WFS.BatchDeletes = true
+	defer func() {
+		WFS.BatchDeletes = false
+	}()
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	names := []string{"f1", "f2", "f3", "f4"}
+	for _, name := range names {
+		err := WFS.MakeFile(ctx, zoneId, name, nil, FileOptsType{})
+		if err != nil {
+			t.Fatalf("error creating file: %v", err)
+		}
+		_, err = WFS.AppendData(ctx, zoneId, name, []byte(makeText(80)))
+		if err != nil {
+			t.Fatalf("error appending data: %v", err)
+		}
+	}
+	_, err := WFS.FlushCache(ctx)
+	if err != nil {
+		t.Fatalf("error flushing cache: %v", err)
+	}
+	// leaves dirty data in f4, the delete drops it
+	_, err = WFS.AppendData(ctx, zoneId, "f4", []byte("more"))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	// every row, marked or not
+	checkDBFiles := func(expected []string) {
+		t.Helper()
+		dbNames, err := WithTxRtn(ctx, func(tx *TxWrap) ([]string, error) {
+			var names []string
+			tx.Select(&names, "SELECT name FROM db_wave_file WHERE zoneid = ? ORDER BY name", zoneId)
+			return names, nil
+		})
+		if err != nil {
+			t.Fatalf("error getting db files: %v", err)
+		}
+		if !reflect.DeepEqual(dbNames, expected) {
+			t.Errorf("expected db files %v, got %v", expected, dbNames)
+		}
+	}
+	for _, name := range names {
+		err = WFS.DeleteFile(ctx, zoneId, name)
+		if err != nil {
+			t.Fatalf("error deleting file: %v", err)
+		}
+	}
+	checkDBFiles(names)
+	// reads fail right away, and a new file with the same name starts out empty
+	_, _, err = WFS.ReadFile(ctx, zoneId, "f1")
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected ErrNotExist reading a deleted file, got %v", err)
+	}
+	files, err := WFS.ListFiles(ctx, zoneId)
+	if err != nil {
+		t.Fatalf("error listing files: %v", err)
+	}
+	if len(files) != 0 {
+		t.Errorf("expected no files, got %d", len(files))
+	}
+	err = WFS.MakeFile(ctx, zoneId, "f2", nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error recreating file: %v", err)
+	}
+	checkFileData(t, ctx, zoneId, "f2", "")
+	err = WFS.Undelete(ctx, zoneId, "f3")
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected ErrNotExist undeleting a batch-deleted file, got %v", err)
+	}
+	stats, err := WFS.FlushCache(ctx)
+	if err != nil {
+		t.Fatalf("error flushing cache: %v", err)
+	}
+	if stats.NumDeleted != 3 {
+		t.Errorf("expected the flush to apply 3 pending deletes, got %d", stats.NumDeleted)
+	}
+	checkDBFiles([]string{"f2"})
+	checkFileData(t, ctx, zoneId, "f2", "")
+
+	// the mark is persisted by DeleteFile, so the delete survives a crash before the flush: nothing in
+	// memory is needed to keep the file deleted, and the next flush still removes it
+	err = WFS.DeleteFile(ctx, zoneId, "f2")
+	if err != nil {
+		t.Fatalf("error deleting file: %v", err)
+	}
+	WFS.clearCache()
+	_, err = WFS.Stat(ctx, zoneId, "f2")
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected f2 to stay deleted, got %v", err)
+	}
+	checkDBFiles([]string{"f2"})
+	stats, err = WFS.FlushCache(ctx)
+	if err != nil {
+		t.Fatalf("error flushing cache: %v", err)
+	}
+	if stats.NumDeleted != 1 {
+		t.Errorf("expected the flush to apply 1 pending delete, got %d", stats.NumDeleted)
+	}
+	checkDBFiles(nil)
+}
+
+func TestReadReverse(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	checkPages := func(name string, endOffset int64, size int64, expected []string, expectedStart int64) {
+		t.Helper()
+		for idx, page := range expected {
+			offset, rdata, err := WFS.ReadReverse(ctx, zoneId, name, endOffset, size)
+			if err != nil {
+				t.Fatalf("error reading page %d: %v", idx, err)
+			}
+			if string(rdata) != page {
+				t.Errorf("page %d mismatch: offset %d, data %q, expected %q", idx, offset, rdata, page)
+			}
+			endOffset = offset
+		}
+		if endOffset != expectedStart {
+			t.Errorf("expected paging to stop at %d, got %d", expectedStart, endOffset)
+		}
+	}
+	data := makeText(230)
+	for _, fileDef := range []struct {
+		name string
+		opts FileOptsType
+	}{{"r1", FileOptsType{}}, {"c1", FileOptsType{Circular: true, MaxSize: 100}}} {
+		err := WFS.MakeFile(ctx, zoneId, fileDef.name, nil, fileDef.opts)
+		if err != nil {
+			t.Fatalf("error creating file: %v", err)
+		}
+		_, err = WFS.AppendData(ctx, zoneId, fileDef.name, []byte(data))
+		if err != nil {
+			t.Fatalf("error appending data: %v", err)
+		}
+	}
+	// end offsets past the end are clamped, and the last page is short
+	checkPages("r1", 500, 100, []string{data[130:], data[30:130], data[:30], ""}, 0)
+	checkPages("r1", 95, 40, []string{data[55:95], data[15:55], data[:15]}, 0)
+	// circular files stop at the oldest retained byte
+	checkPages("c1", 230, 60, []string{data[170:], data[130:170], ""}, 130)
+	_, _, err := WFS.ReadReverse(ctx, zoneId, "c1", 120, 10)
+	if !errors.Is(err, ErrEvicted) {
+		t.Errorf("expected ErrEvicted for an end offset before the retained window, got %v", err)
+	}
+	_, _, err = WFS.ReadReverse(ctx, zoneId, "r1", -1, 10)
+	if err == nil {
+		t.Errorf("expected an error for a negative end offset")
+	}
+}
+
+func TestVerifiedWriterBuffering(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	err := WFS.MakeFile(ctx, zoneId, "f1", nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	text := makeText(115)
+	_, err = WFS.AppendData(ctx, zoneId, "f1", []byte(text[:20]))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	expectedHash := sha256.Sum256([]byte(text))
+	w := WFS.NewVerifiedWriter(ctx, zoneId, "f1", expectedHash[:], false)
+	write := func(data string, expectedSize int64) {
+		t.Helper()
+		n, err := w.Write([]byte(data))
+		if err != nil || n != len(data) {
+			t.Fatalf("error writing: n=%d, err=%v", n, err)
+		}
+		checkFileSize(t, ctx, zoneId, "f1", expectedSize)
+	}
+	// nothing reaches the store until a part boundary (50) is reached
+	write(text[20:40], 20)
+	write(text[40:55], 50)
+	// then whole parts go out as they fill
+	write(text[55:105], 100)
+	err = w.Flush()
+	if err != nil {
+		t.Fatalf("error flushing writer: %v", err)
+	}
+	checkFileSize(t, ctx, zoneId, "f1", 105)
+	if WFS.getCacheSize() != 0 {
+		t.Errorf("expected Flush to leave the file clean, cache size %d", WFS.getCacheSize())
+	}
+	write(text[105:], 105)
+	err = w.Close()
+	if err != nil {
+		t.Fatalf("error closing writer: %v", err)
+	}
+	checkFileData(t, ctx, zoneId, "f1", text)
+	err = w.Flush()
+	if !errors.Is(err, fs.ErrClosed) {
+		t.Errorf("expected fs.ErrClosed flushing after Close, got %v", err)
+	}
+
+	// a failed append sticks
+	w = WFS.NewVerifiedWriter(ctx, zoneId, "f1", expectedHash[:], false)
+	write("x", 115)
+	err = WFS.DeleteFile(ctx, zoneId, "f1")
+	if err != nil {
+		t.Fatalf("error deleting file: %v", err)
+	}
+	_, err = w.Write([]byte(makeText(60)))
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("expected ErrNotExist writing to a deleted file, got %v", err)
+	}
+	_, err = w.Write([]byte("y"))
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected the write error to stick, got %v", err)
+	}
+	err = w.Close()
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected Close to return the write error, got %v", err)
+	}
+}
+
+func TestDirtyByZone(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneA, zoneB := uuid.NewString(), uuid.NewString()
+	for _, zoneId := range []string{zoneA, zoneB} {
+		for _, name := range []string{"f1", "f2"} {
+			err := WFS.MakeFile(ctx, zoneId, name, nil, FileOptsType{})
+			if err != nil {
+				t.Fatalf("error creating file: %v", err)
+			}
+		}
+	}
+	if dirty := WFS.DirtyByZone(); len(dirty) != 0 {
+		t.Fatalf("expected no dirty zones, got %v", dirty)
+	}
+	writes := []struct {
+		zoneId string
+		name   string
+		size   int
+	}{{zoneA, "f1", 120}, {zoneA, "f2", 30}, {zoneB, "f1", 10}}
+	for _, write := range writes {
+		_, err := WFS.AppendData(ctx, write.zoneId, write.name, []byte(makeText(write.size)))
+		if err != nil {
+			t.Fatalf("error appending data: %v", err)
+		}
+	}
+	_, err := WFS.WriteMeta(ctx, zoneB, "f2", FileMeta{"a": 1}, false)
+	if err != nil {
+		t.Fatalf("error writing meta: %v", err)
+	}
+	// zoneA has 4 resident parts (3 in f1, 1 in f2), zoneB 1 (plus a meta-only change)
+	expected := map[string]int64{zoneA: 4 * partDataSize, zoneB: partDataSize}
+	dirty := WFS.DirtyByZone()
+	if !reflect.DeepEqual(dirty, expected) {
+		t.Errorf("expected %v, got %v", expected, dirty)
+	}
+	if residentBytes := WFS.CacheStats().ResidentBytes; dirty[zoneA]+dirty[zoneB] != residentBytes {
+		t.Errorf("expected the zones to add up to ResidentBytes %d, got %v", residentBytes, dirty)
+	}
+	err = WFS.Evict(ctx, zoneA, "f1")
+	if err != nil {
+		t.Fatalf("error evicting file: %v", err)
+	}
+	expected[zoneA] = partDataSize
+	if dirty := WFS.DirtyByZone(); !reflect.DeepEqual(dirty, expected) {
+		t.Errorf("expected %v, got %v", expected, dirty)
+	}
+	err = WFS.Evict(ctx, zoneB, "f1")
+	if err != nil {
+		t.Fatalf("error evicting file: %v", err)
+	}
+	expected[zoneB] = 0
+	if dirty := WFS.DirtyByZone(); !reflect.DeepEqual(dirty, expected) {
+		t.Errorf("expected zoneB to stay listed for its meta change, got %v", dirty)
+	}
+	_, err = WFS.FlushCache(ctx)
+	if err != nil {
+		t.Fatalf("error flushing cache: %v", err)
+	}
+	if dirty := WFS.DirtyByZone(); len(dirty) != 0 {
+		t.Errorf("expected no dirty zones after a flush, got %v", dirty)
+	}
+}
+
+func TestBudgetDegradation(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+	WFS.HighWater = 100
+	WFS.LowWater = 50
+	WFS.CacheBudget = 100
+	WFS.BreakerThreshold = 1
+	defer func() {
+		WFS.HighWater = 0
+		WFS.LowWater = 0
+		WFS.CacheBudget = 0
+		WFS.BreakerThreshold = 0
+	}()
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	keys := []FileKey{{ZoneId: zoneId, Name: "f1"}, {ZoneId: zoneId, Name: "f2"}}
+	for _, key := range keys {
+		err := WFS.MakeFile(ctx, zoneId, key.Name, nil, FileOptsType{})
+		if err != nil {
+			t.Fatalf("error creating file: %v", err)
+		}
+	}
+	unpinAll := WFS.PinAll(keys)
+	defer unpinAll()
+	_, err := WFS.AppendData(ctx, zoneId, "f2", []byte("a"))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	_, err = WFS.AppendData(ctx, zoneId, "f1", []byte(makeText(120)))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	// the backend is down, nothing resident can be flushed (files that aren't resident can't even be loaded)
+	WFS.lock()
+	WFS.breaker.openUntil = time.Now().Add(time.Hour)
+	WFS.Lock.Unlock()
+	writeErrCh := make(chan error, 2)
+	go func() {
+		_, err := WFS.AppendData(ctx, zoneId, "f2", []byte("hello"))
+		writeErrCh <- err
+	}()
+	go func() {
+		writeErrCh <- WFS.WaitForBudget(ctx)
+	}()
+	deadline := time.Now().Add(time.Second)
+	for !WFS.MemoryPressure().Throttled {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected writes to be throttled")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	// stopFlush is set in tests, so runFlusher makes a single pass and returns
+	WFS.runFlusher()
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-writeErrCh:
+			if err != nil {
+				t.Fatalf("expected blocked callers to be released, got %v", err)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("blocked callers still waiting after a failed sweep")
+		}
+	}
+	pressure := WFS.MemoryPressure()
+	if !pressure.OverBudget || pressure.Throttled {
+		t.Errorf("expected the store to be over budget and not throttled, got %+v", pressure)
+	}
+	// further writes go through while over budget (up to a part boundary, so no part needs loading)
+	_, err = WFS.AppendData(ctx, zoneId, "f2", []byte(makeText(94)))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	WFS.runFlusher()
+	if overruns := WFS.CacheStats().BudgetOverruns; overruns != 1 {
+		t.Errorf("expected 1 budget overrun, got %d", overruns)
+	}
+	// once the backend is back a sweep drains the cache and the limits apply again
+	WFS.lock()
+	WFS.breaker = backendBreaker{}
+	WFS.Lock.Unlock()
+	WFS.runFlusher()
+	pressure = WFS.MemoryPressure()
+	if pressure.OverBudget || pressure.ResidentBytes != 0 {
+		t.Errorf("expected the store back under budget, got %+v", pressure)
+	}
+	checkFileData(t, ctx, zoneId, "f2", "ahello"+makeText(94))
+}
+
+func TestFileCount(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+	WFS.DeleteRetention = time.Hour
+	WFS.BatchDeletes = true
+	defer func() {
+		WFS.DeleteRetention = 0
+		WFS.BatchDeletes = false
+	}()
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneA, zoneB := uuid.NewString(), uuid.NewString()
+	checkCounts := func(expectedA int, expectedB int) {
+		t.Helper()
+		for zoneId, expected := range map[string]int{zoneA: expectedA, zoneB: expectedB} {
+			count, err := WFS.FileCount(ctx, zoneId)
+			if err != nil {
+				t.Fatalf("error counting files: %v", err)
+			}
+			if count != expected {
+				t.Errorf("expected %d files, got %d", expected, count)
+			}
+		}
+		counts, err := WFS.FileCounts(ctx)
+		if err != nil {
+			t.Fatalf("error counting files: %v", err)
+		}
+		if counts[zoneA] != expectedA || counts[zoneB] != expectedB {
+			t.Errorf("expected counts %d/%d, got %v", expectedA, expectedB, counts)
+		}
+		if _, found := counts[uuid.NewString()]; found {
+			t.Errorf("unexpected zone in counts")
+		}
+	}
+	checkCounts(0, 0)
+	for _, name := range []string{"f1", "f2", "f3"} {
+		err := WFS.MakeFile(ctx, zoneA, name, nil, FileOptsType{})
+		if err != nil {
+			t.Fatalf("error creating file: %v", err)
+		}
+	}
+	err := WFS.MakeFile(ctx, zoneB, "f1", nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	// dirty (resident) files count once
+	_, err = WFS.AppendData(ctx, zoneA, "f1", []byte("hello"))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	checkCounts(3, 1)
+	// a deleted file with dirty data, its soft delete still queued
+	err = WFS.DeleteFile(ctx, zoneA, "f1")
+	if err != nil {
+		t.Fatalf("error deleting file: %v", err)
+	}
+	checkCounts(2, 1)
+	err = WFS.Undelete(ctx, zoneA, "f1")
+	if err != nil {
+		t.Fatalf("error undeleting file: %v", err)
+	}
+	checkCounts(3, 1)
+}
+
+func TestUnsafeSharedFiles(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+	defer func() {
+		WFS.UnsafeSharedFiles = false
+	}()
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	err := WFS.MakeFile(ctx, zoneId, "f1", FileMeta{"a": 1}, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	_, err = WFS.AppendData(ctx, zoneId, "f1", []byte("hello"))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	statTwice := func() (*WaveFile, *WaveFile) {
+		t.Helper()
+		file1, err := WFS.Stat(ctx, zoneId, "f1")
+		if err != nil {
+			t.Fatalf("error stating file: %v", err)
+		}
+		files, err := WFS.ListFiles(ctx, zoneId)
+		if err != nil || len(files) != 1 {
+			t.Fatalf("error listing files: %v (%d files)", err, len(files))
+		}
+		return file1, files[0]
+	}
+	file1, file2 := statTwice()
+	if file1 == file2 {
+		t.Errorf("expected copies by default")
+	}
+	WFS.UnsafeSharedFiles = true
+	file1, file2 = statTwice()
+	if file1 != file2 {
+		t.Errorf("expected the live file with UnsafeSharedFiles")
+	}
+	// which is why it is unsafe: later writes show through
+	_, err = WFS.AppendData(ctx, zoneId, "f1", []byte(" world"))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	if file1.Size != 11 {
+		t.Errorf("expected the shared file to reflect the append, size %d", file1.Size)
+	}
+	// clean files come from the DB, so they are never shared
+	_, err = WFS.FlushCache(ctx)
+	if err != nil {
+		t.Fatalf("error flushing cache: %v", err)
+	}
+	file1, file2 = statTwice()
+	if file1 == file2 || file1.Size != 11 {
+		t.Errorf("expected separate files loaded from the DB")
+	}
+}
+
+// partial writes to parts that were flushed and dropped from the cache must load the part first
+// (read-modify-write), or the flush would persist the unwritten bytes of the part as zeros
+func TestPartialWriteEvictedPart(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	for _, fileDef := range []struct {
+		name string
+		opts FileOptsType
+	}{{"r1", FileOptsType{}}, {"c1", FileOptsType{Circular: true, MaxSize: 200}}} {
+		err := WFS.MakeFile(ctx, zoneId, fileDef.name, nil, fileDef.opts)
+		if err != nil {
+			t.Fatalf("error creating file: %v", err)
+		}
+		expected := []byte(makeText(130))
+		_, err = WFS.AppendData(ctx, zoneId, fileDef.name, expected)
+		if err != nil {
+			t.Fatalf("error appending data: %v", err)
+		}
+		writes := []struct {
+			offset int64
+			data   string
+		}{
+			{60, "XXXXX"},     // inside a part
+			{45, "YYYYYYYYY"}, // across a part boundary, partial on both sides
+			{128, "ZZZZ"},     // over the end of the partial last part
+		}
+		for _, write := range writes {
+			err = WFS.Evict(ctx, zoneId, fileDef.name)
+			if err != nil {
+				t.Fatalf("error evicting file: %v", err)
+			}
+			if parts, _ := WFS.PartStatus(zoneId, fileDef.name); len(parts) != 0 {
+				t.Fatalf("expected no resident parts after evict, got %v", parts)
+			}
+			_, err = WFS.WriteAt(ctx, zoneId, fileDef.name, write.offset, []byte(write.data))
+			if err != nil {
+				t.Fatalf("error writing data: %v", err)
+			}
+			end := write.offset + int64(len(write.data))
+			if end > int64(len(expected)) {
+				expected = append(expected, make([]byte, end-int64(len(expected)))...)
+			}
+			copy(expected[write.offset:], write.data)
+		}
+		// read back from the DB only
+		_, err = WFS.FlushCache(ctx)
+		if err != nil {
+			t.Fatalf("error flushing cache: %v", err)
+		}
+		WFS.clearCache()
+		checkFileData(t, ctx, zoneId, fileDef.name, string(expected))
+	}
+}
+
+// measures the cache-side cost of a large part-aligned sequential write (no DB)
+func BenchmarkAlignedSequentialWrite(b *testing.B) {
+	const numParts = 256
+	chunk := bytes.Repeat([]byte{'x'}, int(partDataSize))
+	b.SetBytes(numParts * partDataSize)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		entry := makeCacheEntry(WFS, "zone", "bench")
+		entry.File = &WaveFile{ZoneId: "zone", Name: "bench"}
+		for partIdx := 0; partIdx < numParts; partIdx++ {
+			entry.writeAt(int64(partIdx)*partDataSize, chunk, false)
+		}
+	}
+}
+
+// measures the memory held by a dirty tiny file (no DB), part buffers grow with the data rather than
+// being allocated at the full part size
+func BenchmarkTinyFileWrite(b *testing.B) {
+	savedPartSize := partDataSize
+	partDataSize = DefaultPartDataSize
+	defer func() { partDataSize = savedPartSize }()
+	b.ReportAllocs()
+	var residentBytes int64
+	for i := 0; i < b.N; i++ {
+		entry := makeCacheEntry(WFS, "zone", "tiny")
+		entry.File = &WaveFile{ZoneId: "zone", Name: "tiny"}
+		entry.writeAt(0, []byte("hello"), false)
+		residentBytes += entry.residentBytes()
+	}
+	b.ReportMetric(float64(residentBytes)/float64(b.N), "resident-bytes/file")
+}
+
+// fills reads with a fixed byte (stands in for a network stream)
+type patternReader struct{}
+
+func (patternReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 'x'
+	}
+	return len(p), nil
+}
+
+// a large streamed ingest at the default part size (whole parts are adopted by the cache, not copied)
+func BenchmarkAppendFrom(b *testing.B) {
+	initDb(b)
+	defer cleanupDb(b)
+	partDataSize = DefaultPartDataSize
+	const ingestSize = 256 * 1024 * 1024
+	ctx := context.Background()
+	b.SetBytes(ingestSize)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		zoneId := uuid.NewString()
+		err := WFS.MakeFile(ctx, zoneId, "ingest", nil, FileOptsType{})
+		if err != nil {
+			b.Fatalf("error creating file: %v", err)
+		}
+		written, err := WFS.AppendFrom(ctx, zoneId, "ingest", io.LimitReader(patternReader{}, ingestSize))
+		if err != nil || written != ingestSize {
+			b.Fatalf("error ingesting data (%d bytes written): %v", written, err)
+		}
+		b.StopTimer()
+		err = WFS.DeleteFile(ctx, zoneId, "ingest")
+		if err != nil {
+			b.Fatalf("error deleting file: %v", err)
+		}
+		b.StartTimer()
+	}
+}
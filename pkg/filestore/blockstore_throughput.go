@@ -0,0 +1,86 @@
+// Copyright 2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package filestore
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// one bucket per second, so this also bounds ThroughputWindow
+const throughputBuckets = 600
+
+const DefaultThroughputWindow = time.Minute
+
+// per-second counters, reused round-robin (a bucket is reset when a new second first lands on it).
+// writers only do atomic adds, the windowing is done by Throughput.
+type throughputBucket struct {
+	sec   atomic.Int64 // unix second the bucket is counting
+	bytes atomic.Int64
+	parts atomic.Int64
+}
+
+type ThroughputStats struct {
+	Window      time.Duration `json:"window"`
+	BytesPerSec float64       `json:"bytespersec"` // bytes written (to the cache)
+	PartsPerSec float64       `json:"partspersec"` // parts flushed to the DB
+}
+
+func (s *FileStore) throughputBucket(sec int64) *throughputBucket {
+	bucket := &s.throughput[sec%throughputBuckets]
+	for {
+		bucketSec := bucket.sec.Load()
+		if bucketSec == sec {
+			return bucket
+		}
+		if bucket.sec.CompareAndSwap(bucketSec, sec) {
+			// an add racing with the reset can be lost, fine for rates
+			bucket.bytes.Store(0)
+			bucket.parts.Store(0)
+			return bucket
+		}
+	}
+}
+
+func (s *FileStore) recordBytesWritten(numBytes int64) {
+	if numBytes <= 0 {
+		return
+	}
+	s.bytesWritten.Add(numBytes)
+	s.throughputBucket(time.Now().Unix()).bytes.Add(numBytes)
+}
+
+func (s *FileStore) recordPartsFlushed(numParts int) {
+	if numParts <= 0 {
+		return
+	}
+	s.throughputBucket(time.Now().Unix()).parts.Add(int64(numParts))
+}
+
+// returns the average write and flush rates over the last ThroughputWindow (whole seconds, including the
+// current one).  the rates are approximate: a count that races with its bucket being recycled can be lost.
+func (s *FileStore) Throughput() ThroughputStats {
+	window := s.ThroughputWindow
+	if window <= 0 {
+		window = DefaultThroughputWindow
+	}
+	window = min(max(window, time.Second), throughputBuckets*time.Second).Truncate(time.Second)
+	windowSecs := int64(window / time.Second)
+	nowSec := time.Now().Unix()
+	var numBytes, numParts int64
+	for i := range s.throughput {
+		bucket := &s.throughput[i]
+		bucketSec := bucket.sec.Load()
+		if bucketSec <= nowSec-windowSecs || bucketSec > nowSec {
+			continue
+		}
+		numBytes += bucket.bytes.Load()
+		numParts += bucket.parts.Load()
+	}
+	return ThroughputStats{
+		Window:      window,
+		BytesPerSec: float64(numBytes) / float64(windowSecs),
+		PartsPerSec: float64(numParts) / float64(windowSecs),
+	}
+}
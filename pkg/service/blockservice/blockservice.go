@@ -55,7 +55,7 @@ func (bs *BlockService) SaveTerminalState(ctx context.Context, blockId string, s
 	}
 	// ignore MakeFile error (already exists is ok)
 	filestore.WFS.MakeFile(ctx, blockId, "cache:term:"+stateType, nil, filestore.FileOptsType{})
-	err = filestore.WFS.WriteFile(ctx, blockId, "cache:term:"+stateType, []byte(state))
+	_, err = filestore.WFS.WriteFile(ctx, blockId, "cache:term:"+stateType, []byte(state))
 	if err != nil {
 		return fmt.Errorf("cannot save terminal state: %w", err)
 	}
@@ -63,7 +63,7 @@ func (bs *BlockService) SaveTerminalState(ctx context.Context, blockId string, s
 		"ptyoffset": ptyOffset,
 		"termsize":  termSize,
 	}
-	err = filestore.WFS.WriteMeta(ctx, blockId, "cache:term:"+stateType, fileMeta, true)
+	_, err = filestore.WFS.WriteMeta(ctx, blockId, "cache:term:"+stateType, fileMeta, true)
 	if err != nil {
 		return fmt.Errorf("cannot save terminal state meta: %w", err)
 	}
@@ -85,7 +85,7 @@ func (bs *BlockService) SaveWaveAiData(ctx context.Context, blockId string, hist
 	}
 	// ignore MakeFile error (already exists is ok)
 	filestore.WFS.MakeFile(ctx, blockId, "aidata", nil, filestore.FileOptsType{})
-	err = filestore.WFS.WriteFile(ctx, blockId, "aidata", historyBytes)
+	_, err = filestore.WFS.WriteFile(ctx, blockId, "aidata", historyBytes)
 	if err != nil {
 		return fmt.Errorf("cannot save terminal state: %w", err)
 	}
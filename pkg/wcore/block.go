@@ -87,7 +87,7 @@ func CreateBlock(ctx context.Context, tabId string, blockDef *waveobj.BlockDef,
 			if err != nil {
 				return nil, fmt.Errorf("error making blockfile %q: %w", fileName, err)
 			}
-			err = filestore.WFS.WriteFile(ctx, newBlockOID, fileName, []byte(fileDef.Content))
+			_, err = filestore.WFS.WriteFile(ctx, newBlockOID, fileName, []byte(fileDef.Content))
 			if err != nil {
 				return nil, fmt.Errorf("error writing blockfile %q: %w", fileName, err)
 			}
@@ -103,7 +103,8 @@ func SavePlotData(ctx context.Context, blockId string, history string) error {
 		return fmt.Errorf("unable to serialize plot data: %v", err)
 	}
 	// ignore MakeFile error (already exists is ok)
-	return filestore.WFS.WriteFile(ctx, blockId, "cpuplotdata", historyBytes)
+	_, err = filestore.WFS.WriteFile(ctx, blockId, "cpuplotdata", historyBytes)
+	return err
 }
 
 func (ws *WshServer) GetMetaCommand(ctx context.Context, data wshrpc.CommandGetMetaData) (waveobj.MetaMapType, error) {
@@ -384,7 +385,7 @@ func (ws *WshServer) FileWriteCommand(ctx context.Context, data wshrpc.CommandFi
 		return fmt.Errorf("error decoding data64: %w", err)
 	}
 	if data.At != nil {
-		err = filestore.WFS.WriteAt(ctx, data.ZoneId, data.FileName, data.At.Offset, dataBuf)
+		_, err = filestore.WFS.WriteAt(ctx, data.ZoneId, data.FileName, data.At.Offset, dataBuf)
 		if err == fs.ErrNotExist {
 			return fmt.Errorf("NOTFOUND: %w", err)
 		}
@@ -392,7 +393,7 @@ func (ws *WshServer) FileWriteCommand(ctx context.Context, data wshrpc.CommandFi
 			return fmt.Errorf("error writing to blockfile: %w", err)
 		}
 	} else {
-		err = filestore.WFS.WriteFile(ctx, data.ZoneId, data.FileName, dataBuf)
+		_, err = filestore.WFS.WriteFile(ctx, data.ZoneId, data.FileName, dataBuf)
 		if err == fs.ErrNotExist {
 			return fmt.Errorf("NOTFOUND: %w", err)
 		}
@@ -439,7 +440,7 @@ func (ws *WshServer) FileAppendCommand(ctx context.Context, data wshrpc.CommandF
 	if err != nil {
 		return fmt.Errorf("error decoding data64: %w", err)
 	}
-	err = filestore.WFS.AppendData(ctx, data.ZoneId, data.FileName, dataBuf)
+	_, err = filestore.WFS.AppendData(ctx, data.ZoneId, data.FileName, dataBuf)
 	if err == fs.ErrNotExist {
 		return fmt.Errorf("NOTFOUND: %w", err)
 	}
@@ -467,7 +468,7 @@ func (ws *WshServer) FileAppendIJsonCommand(ctx context.Context, data wshrpc.Com
 			return fmt.Errorf("error creating blockfile[vdom]: %w", err)
 		}
 	}
-	err := filestore.WFS.AppendIJson(ctx, data.ZoneId, data.FileName, data.Data)
+	_, err := filestore.WFS.AppendIJson(ctx, data.ZoneId, data.FileName, data.Data)
 	if err != nil {
 		return fmt.Errorf("error appending to blockfile(ijson): %w", err)
 	}
@@ -827,5 +828,6 @@ func (ws *WshServer) SetVarCommand(ctx context.Context, data wshrpc.CommandVarDa
 		envMap[data.Key] = data.Val
 	}
 	envStr := envutil.MapToEnv(envMap)
-	return filestore.WFS.WriteFile(ctx, data.ZoneId, data.FileName, []byte(envStr))
+	_, err = filestore.WFS.WriteFile(ctx, data.ZoneId, data.FileName, []byte(envStr))
+	return err
 }